@@ -0,0 +1,253 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+const DefaultMaxActivityLogEntries = 10000
+
+// An ActivityLogEntry records a request frame received by a CqlServerConnection, and the response frame sent for it.
+type ActivityLogEntry struct {
+	// The time the request was received.
+	Timestamp time.Time
+	// The connection the request was received on.
+	Connection *CqlServerConnection
+	// The request frame.
+	Request *frame.Frame
+	// The response frame sent by the connection's request handlers, or nil if no handler responded (yet).
+	Response *frame.Frame
+}
+
+// Returns the query string of the request, for QUERY and PREPARE requests, or an empty string otherwise.
+func (e *ActivityLogEntry) Query() string {
+	return requestQuery(e.Request.Body.Message)
+}
+
+// Returns the consistency level of the request, for QUERY, EXECUTE and BATCH requests. The boolean is false for other
+// requests.
+func (e *ActivityLogEntry) Consistency() (primitive.ConsistencyLevel, bool) {
+	return requestConsistency(e.Request.Body.Message)
+}
+
+func (e *ActivityLogEntry) String() string {
+	return fmt.Sprintf("%v: %v -> %v", e.Connection, e.Request.Body.Message, e.Response)
+}
+
+// An ActivityFilter selects ActivityLogEntry instances. All the non-zero criteria must match for an entry to be
+// selected; a nil filter selects all entries.
+type ActivityFilter struct {
+	// The request opcodes to match.
+	OpCodes []primitive.OpCode
+	// The exact query string to match; see ActivityLogEntry.Query.
+	Query string
+	// A regular expression the query string must match.
+	QueryPattern *regexp.Regexp
+	// The consistency level to match.
+	Consistency *primitive.ConsistencyLevel
+}
+
+func (f *ActivityFilter) matches(entry *ActivityLogEntry) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.OpCodes) > 0 && !containsOpCode(f.OpCodes, entry.Request.Header.OpCode) {
+		return false
+	}
+	query := entry.Query()
+	if f.Query != "" && f.Query != query {
+		return false
+	}
+	if f.QueryPattern != nil && !f.QueryPattern.MatchString(query) {
+		return false
+	}
+	if f.Consistency != nil {
+		if consistency, ok := entry.Consistency(); !ok || consistency != *f.Consistency {
+			return false
+		}
+	}
+	return true
+}
+
+type activityRecord struct {
+	entry ActivityLogEntry
+	lock  *sync.Mutex
+}
+
+func (r *activityRecord) snapshot() *ActivityLogEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entry := r.entry
+	return &entry
+}
+
+// ActivityLog records the requests received by a CqlServer, or by one of its connections, along with the responses
+// sent; see CqlServer.ActivityLog and CqlServerConnection.ActivityLog. Entries are recorded in the order requests were
+// received, including requests that no handler could handle. The log is safe for concurrent use.
+type ActivityLog struct {
+	// The maximum number of entries to keep; older entries are discarded first. Zero or negative means unlimited.
+	MaxEntries int
+
+	records []*activityRecord
+	changed chan struct{}
+	lock    *sync.Mutex
+}
+
+func NewActivityLog() *ActivityLog {
+	return &ActivityLog{
+		MaxEntries: DefaultMaxActivityLogEntries,
+		changed:    make(chan struct{}),
+		lock:       &sync.Mutex{},
+	}
+}
+
+func (l *ActivityLog) add(record *activityRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = append(l.records, record)
+	if excess := len(l.records) - l.MaxEntries; l.MaxEntries > 0 && excess > 0 {
+		l.records = l.records[excess:]
+	}
+	l.notifyLocked()
+}
+
+func (l *ActivityLog) notify() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.notifyLocked()
+}
+
+func (l *ActivityLog) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Returns the entries selected by the given filter, in the order requests were received.
+func (l *ActivityLog) Entries(filter *ActivityFilter) []*ActivityLogEntry {
+	entries, _ := l.entries(filter)
+	return entries
+}
+
+func (l *ActivityLog) entries(filter *ActivityFilter) ([]*ActivityLogEntry, <-chan struct{}) {
+	l.lock.Lock()
+	records := make([]*activityRecord, len(l.records))
+	copy(records, l.records)
+	changed := l.changed
+	l.lock.Unlock()
+	var entries []*ActivityLogEntry
+	for _, record := range records {
+		if entry := record.snapshot(); filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, changed
+}
+
+// Removes all entries.
+func (l *ActivityLog) Clear() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = nil
+}
+
+// Removes the entries for which the given predicate returns true.
+func (l *ActivityLog) remove(predicate func(entry *ActivityLogEntry) bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	records := l.records[:0]
+	for _, record := range l.records {
+		if !predicate(record.snapshot()) {
+			records = append(records, record)
+		}
+	}
+	l.records = records
+}
+
+// Waits until at least count entries are selected by the given filter, or the given context is done, whichever
+// happens first. Returns the selected entries, and the context error if the context is done first.
+func (l *ActivityLog) Await(ctx context.Context, filter *ActivityFilter, count int) ([]*ActivityLogEntry, error) {
+	for {
+		entries, changed := l.entries(filter)
+		if len(entries) >= count {
+			return entries, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return entries, ctx.Err()
+		}
+	}
+}
+
+// Waits until at least count entries are selected by the given filter, failing the test if the timeout elapses
+// first. Returns the selected entries.
+func (l *ActivityLog) RequireRequests(t testing.TB, filter *ActivityFilter, count int, timeout time.Duration) []*ActivityLogEntry {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	entries, err := l.Await(ctx, filter, count)
+	if err != nil {
+		t.Fatalf("expected at least %v matching requests within %v, got %v: %v", count, timeout, len(entries), entries)
+	}
+	return entries
+}
+
+// Asserts that exactly count entries are currently selected by the given filter, marking the test as failed
+// otherwise. Returns true if the assertion succeeded.
+func (l *ActivityLog) AssertRequestCount(t testing.TB, filter *ActivityFilter, count int) bool {
+	t.Helper()
+	if entries := l.Entries(filter); len(entries) != count {
+		t.Errorf("expected %v matching requests, got %v: %v", count, len(entries), entries)
+		return false
+	}
+	return true
+}
+
+func requestQuery(msg message.Message) string {
+	switch msg := msg.(type) {
+	case *message.Query:
+		return msg.Query
+	case *message.Prepare:
+		return msg.Query
+	}
+	return ""
+}
+
+func requestConsistency(msg message.Message) (primitive.ConsistencyLevel, bool) {
+	switch msg := msg.(type) {
+	case *message.Query:
+		if msg.Options != nil {
+			return msg.Options.Consistency, true
+		}
+		return primitive.ConsistencyLevelAny, true
+	case *message.Execute:
+		if msg.Options != nil {
+			return msg.Options.Consistency, true
+		}
+		return primitive.ConsistencyLevelAny, true
+	case *message.Batch:
+		return msg.Consistency, true
+	}
+	return 0, false
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestActivityLog(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, client.HeartbeatHandler, unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	localQuorum := primitive.ConsistencyLevelLocalQuorum
+	sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1", Options: &message.QueryOptions{Consistency: localQuorum}})
+	sendQuery(t, clientConn, &message.Query{Query: "INSERT INTO ks1.table1 (pk) VALUES (1)"})
+	_, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+	require.Nil(t, err)
+	// no handler responds to PREPARE requests
+	_, err = clientConn.Send(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: "SELECT 1"}))
+	require.Nil(t, err)
+
+	entries := server.ActivityLog.RequireRequests(t, nil, 4, time.Second*10)
+	require.Len(t, entries, 4)
+	assert.Equal(t, primitive.OpCodeQuery, entries[0].Request.Header.OpCode)
+	assert.Equal(t, "SELECT * FROM ks1.table1", entries[0].Query())
+	assert.Equal(t, clientConn.LocalAddr(), entries[0].Connection.RemoteAddr())
+	require.NotNil(t, entries[0].Response)
+	assert.IsType(t, &message.Invalid{}, entries[0].Response.Body.Message)
+	assert.IsType(t, &message.Supported{}, entries[2].Response.Body.Message)
+	assert.Equal(t, "SELECT 1", entries[3].Query())
+	assert.Nil(t, entries[3].Response)
+
+	// filters
+	queries := server.ActivityLog.Entries(&client.ActivityFilter{OpCodes: []primitive.OpCode{primitive.OpCodeQuery}})
+	assert.Len(t, queries, 2)
+	server.ActivityLog.AssertRequestCount(t, &client.ActivityFilter{Query: "SELECT * FROM ks1.table1", Consistency: &localQuorum}, 1)
+	server.ActivityLog.AssertRequestCount(t, &client.ActivityFilter{Query: "INSERT INTO ks1.table1 (pk) VALUES (1)", Consistency: &localQuorum}, 0)
+	server.ActivityLog.AssertRequestCount(t, &client.ActivityFilter{QueryPattern: regexp.MustCompile(`^SELECT`)}, 2)
+
+	// per connection
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	require.Len(t, serverConns, 1)
+	serverConns[0].ActivityLog().AssertRequestCount(t, nil, 4)
+
+	server.ActivityLog.Clear()
+	assert.Empty(t, server.ActivityLog.Entries(nil))
+	serverConns[0].ActivityLog().AssertRequestCount(t, nil, 4)
+}
+
+func TestActivityLog_Await(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	filter := &client.ActivityFilter{Query: "SELECT * FROM ks1.table1"}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			_, _ = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM ks1.table1"}))
+		}
+	}()
+	entries := server.ActivityLog.RequireRequests(t, filter, 3, time.Second*10)
+	assert.Len(t, entries, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	entries, err := server.ActivityLog.Await(ctx, filter, 4)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, entries, 3)
+
+	// failed assertions
+	mockT := &failureRecordingT{TB: t}
+	server.ActivityLog.AssertRequestCount(mockT, filter, 2)
+	assert.True(t, mockT.failed)
+}
+
+func TestActivityLog_MaxEntries(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	server.ActivityLog.MaxEntries = 2
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 3"} {
+		sendQuery(t, clientConn, &message.Query{Query: query})
+	}
+	entries := server.ActivityLog.Entries(nil)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "SELECT 2", entries[0].Query())
+	assert.Equal(t, "SELECT 3", entries[1].Query())
+}
+
+// A testing.TB recording failures instead of failing the test.
+type failureRecordingT struct {
+	testing.TB
+	failed bool
+}
+
+func (t *failureRecordingT) Helper() {}
+
+func (t *failureRecordingT) Errorf(string, ...interface{}) {
+	t.failed = true
+}
+
+func (t *failureRecordingT) Fatalf(string, ...interface{}) {
+	t.failed = true
+}
@@ -0,0 +1,894 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdminPrime is the JSON representation of a PrimeRule in the AdminServer API.
+type AdminPrime struct {
+	// The prime id, assigned by the admin server.
+	Id int `json:"id"`
+	// The remote (client) address of the connection to prime the rule for. If empty, the rule is primed for all
+	// connections.
+	Connection string `json:"connection,omitempty"`
+	// The matching criteria.
+	When AdminPrimeWhen `json:"when"`
+	// The response.
+	Then AdminPrimeThen `json:"then"`
+}
+
+// AdminPrimeWhen is the JSON representation of the matching criteria of a PrimeRule.
+type AdminPrimeWhen struct {
+	// The request opcodes to match, e.g. "QUERY" or "BATCH".
+	OpCodes []string `json:"opcodes,omitempty"`
+	Query   string   `json:"query,omitempty"`
+	// A regular expression the query string must match.
+	QueryPattern string `json:"query_pattern,omitempty"`
+	Keyspace     string `json:"keyspace,omitempty"`
+	// The consistency level name, e.g. "LOCAL_QUORUM".
+	Consistency string `json:"consistency,omitempty"`
+	// The positional bound values to match.
+	Params []*AdminValue `json:"params,omitempty"`
+	// The named bound values to match.
+	NamedParams map[string]*AdminValue `json:"named_params,omitempty"`
+}
+
+// AdminPrimeThen is the JSON representation of the response of a PrimeRule.
+type AdminPrimeThen struct {
+	// The action: "respond" (default), "no_response" or "close_connection".
+	Action      string      `json:"action,omitempty"`
+	DelayMillis int64       `json:"delay_ms,omitempty"`
+	Error       *AdminError `json:"error,omitempty"`
+	// The result set columns; if present, a Rows RESULT response is returned, otherwise a Void one.
+	Columns []*AdminColumn `json:"columns,omitempty"`
+	// The rows, one value per column. Values are converted according to the column types: numbers for numeric types,
+	// strings for textual types, uuids and addresses, hex strings starting with "0x" for blobs, arrays for lists and
+	// sets and objects for maps.
+	Rows [][]interface{} `json:"rows,omitempty"`
+}
+
+// AdminValue is the JSON representation of a bound value.
+type AdminValue struct {
+	// The CQL type name, e.g. "int" or "list<varchar>".
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// AdminColumn is the JSON representation of a result set column.
+type AdminColumn struct {
+	Keyspace string `json:"keyspace,omitempty"`
+	Table    string `json:"table,omitempty"`
+	Name     string `json:"name"`
+	// The CQL type name, e.g. "int" or "list<varchar>".
+	Type string `json:"type"`
+}
+
+// AdminError is the JSON representation of an ERROR response. Only the fields relevant to the error code are used.
+type AdminError struct {
+	// The error code name, e.g. "overloaded", "unavailable" or "read_timeout".
+	Code        string `json:"code"`
+	Message     string `json:"message,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+	Required    int32  `json:"required,omitempty"`
+	Alive       int32  `json:"alive,omitempty"`
+	Received    int32  `json:"received,omitempty"`
+	BlockFor    int32  `json:"block_for,omitempty"`
+	DataPresent bool   `json:"data_present,omitempty"`
+	WriteType   string `json:"write_type,omitempty"`
+	Keyspace    string `json:"keyspace,omitempty"`
+	Table       string `json:"table,omitempty"`
+}
+
+// AdminEvent is the JSON representation of an EVENT to push to client connections. Events are only pushed to the
+// connections that registered for the event type, with the protocol version of their REGISTER request.
+type AdminEvent struct {
+	// The event type: "STATUS_CHANGE", "TOPOLOGY_CHANGE" or "SCHEMA_CHANGE".
+	Type string `json:"type"`
+	// The change type, e.g. "UP", "NEW_NODE" or "CREATED".
+	Change string `json:"change"`
+	// The node address, for status and topology changes.
+	Address string `json:"address,omitempty"`
+	Port    int32  `json:"port,omitempty"`
+	// The schema change target, e.g. "TABLE", and the affected schema objects.
+	Target    string   `json:"target,omitempty"`
+	Keyspace  string   `json:"keyspace,omitempty"`
+	Object    string   `json:"object,omitempty"`
+	Arguments []string `json:"arguments,omitempty"`
+}
+
+// AdminConnection is the JSON representation of a CqlServerConnection.
+type AdminConnection struct {
+	// The address of the server the connection belongs to.
+	Server string `json:"server"`
+	// The remote (client) address, used to identify the connection.
+	Address string `json:"address"`
+	Paused  bool   `json:"paused"`
+	// The event types the client registered for.
+	Events []string `json:"events,omitempty"`
+}
+
+// AdminServerInfo is the JSON representation of a CqlServer.
+type AdminServerInfo struct {
+	Address     string             `json:"address"`
+	Connections []*AdminConnection `json:"connections"`
+}
+
+// AdminRequest is the JSON representation of a request received by a CqlServer.
+type AdminRequest struct {
+	Timestamp time.Time `json:"timestamp"`
+	// The address of the server that received the request.
+	Server string `json:"server"`
+	// The remote (client) address of the connection the request was received on.
+	Connection      string `json:"connection"`
+	ProtocolVersion int    `json:"protocol_version"`
+	StreamId        int16  `json:"stream_id"`
+	OpCode          string `json:"opcode"`
+	// The query string, for QUERY and PREPARE requests.
+	Query string `json:"query,omitempty"`
+	// The consistency level, for QUERY, EXECUTE and BATCH requests.
+	Consistency string `json:"consistency,omitempty"`
+	// A human-readable description of the request message.
+	Message string `json:"message"`
+	// The response opcode, e.g. "RESULT", or empty if no response was sent.
+	ResponseOpCode string `json:"response_opcode,omitempty"`
+	// A human-readable description of the response message, if any.
+	Response string `json:"response,omitempty"`
+}
+
+type adminPrime struct {
+	json *AdminPrime
+	rule *PrimeRule
+	conn *CqlServerConnection
+}
+
+// AdminServer exposes an HTTP/JSON API to prime and inspect running CqlServer instances, so that they can be used as
+// standalone fakes from tests written in any language; see also the cqlfake command. It is preferable to create
+// AdminServer instances using the constructor function NewAdminServer. The API is the following:
+// - GET /servers: lists the servers and their connections, see AdminServerInfo.
+// - GET /connections: lists the open connections, see AdminConnection. DELETE /connections closes connections; POST
+// /connections/pause and POST /connections/resume pause and resume connections, see CqlServerConnection.Pause.
+// - GET /primes: lists the primed rules; POST /primes primes a rule, see AdminPrime, and returns it with its id;
+// DELETE /primes removes all rules; DELETE /primes/{id} removes a single rule.
+// - POST /events: pushes an event to the connections that registered for it, see AdminEvent, and returns these
+// connections.
+// - GET /requests: lists the received requests from the servers' ActivityLog, see AdminRequest; DELETE /requests clears
+// them.
+// All the /connections, /events and /requests endpoints accept an optional "address" query parameter to target a
+// single connection, by its remote (client) address; by default, they target all connections.
+type AdminServer struct {
+	// The address to listen to.
+	ListenAddress string
+	// The servers to administer.
+	Servers []*CqlServer
+	// The PrimingEngine used to prime rules. Its Handler must be installed in the servers' handlers.
+	Engine *PrimingEngine
+
+	primes     map[int]*adminPrime
+	nextId     int
+	lock       *sync.Mutex
+	listener   net.Listener
+	httpServer *http.Server
+	ctx        context.Context
+	cancel     context.CancelFunc
+	waitGroup  *sync.WaitGroup
+	state      int32
+}
+
+// Creates a new AdminServer with default options.
+func NewAdminServer(listenAddress string, engine *PrimingEngine, servers ...*CqlServer) *AdminServer {
+	return &AdminServer{
+		ListenAddress: listenAddress,
+		Servers:       servers,
+		Engine:        engine,
+		primes:        make(map[int]*adminPrime),
+		nextId:        1,
+		lock:          &sync.Mutex{},
+	}
+}
+
+func (a *AdminServer) String() string {
+	return fmt.Sprintf("CQL admin server [%v]", a.ListenAddress)
+}
+
+func (a *AdminServer) IsRunning() bool {
+	return atomic.LoadInt32(&a.state) == ServerStateRunning
+}
+
+func (a *AdminServer) IsClosed() bool {
+	return atomic.LoadInt32(&a.state) == ServerStateClosed
+}
+
+// Returns the address the server is listening to, or nil if the server is not running. Useful when ListenAddress
+// has a zero port.
+func (a *AdminServer) Addr() net.Addr {
+	if !a.IsRunning() {
+		return nil
+	}
+	return a.listener.Addr()
+}
+
+// Starts the server and binds to its listen address. The server is closed when the given context is canceled.
+func (a *AdminServer) Start(ctx context.Context) (err error) {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+	if atomic.CompareAndSwapInt32(&a.state, ServerStateNotStarted, ServerStateRunning) {
+		log.Debug().Msgf("%v: server is starting", a)
+		if a.listener, err = net.Listen("tcp", a.ListenAddress); err != nil {
+			atomic.StoreInt32(&a.state, ServerStateClosed)
+			return fmt.Errorf("%v: start failed: %w", a, err)
+		}
+		a.httpServer = &http.Server{Handler: a}
+		a.ctx, a.cancel = context.WithCancel(ctx)
+		a.waitGroup = &sync.WaitGroup{}
+		a.waitGroup.Add(1)
+		go func() {
+			defer a.waitGroup.Done()
+			if err := a.httpServer.Serve(a.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msgf("%v: error serving requests", a)
+			}
+		}()
+		go func() {
+			<-a.ctx.Done()
+			log.Debug().Err(a.ctx.Err()).Msgf("%v: context was closed", a)
+			if err := a.Close(); err != nil {
+				log.Error().Err(err).Msgf("%v: error closing", a)
+			}
+		}()
+		log.Info().Msgf("%v: successfully started", a)
+	} else {
+		log.Debug().Msgf("%v: already started or closed", a)
+	}
+	return err
+}
+
+func (a *AdminServer) Close() (err error) {
+	if atomic.CompareAndSwapInt32(&a.state, ServerStateRunning, ServerStateClosed) {
+		log.Debug().Msgf("%v: closing", a)
+		a.cancel()
+		err = a.httpServer.Close()
+		a.waitGroup.Wait()
+		if err != nil {
+			err = fmt.Errorf("%v: could not close server: %w", a, err)
+		} else {
+			log.Info().Msgf("%v: successfully closed", a)
+		}
+	} else {
+		log.Debug().Msgf("%v: not started or already closed", a)
+	}
+	return err
+}
+
+// Primes the given rule with the server's PrimingEngine, and assigns it an id.
+func (a *AdminServer) Prime(prime *AdminPrime) (*AdminPrime, error) {
+	if a.Engine == nil {
+		return nil, fmt.Errorf("%v: no priming engine", a)
+	}
+	rule, err := prime.toRule()
+	if err != nil {
+		return nil, err
+	}
+	var conn *CqlServerConnection
+	if prime.Connection != "" {
+		if conns := a.connections(prime.Connection); len(conns) == 0 {
+			return nil, fmt.Errorf("%v: connection not found: %v", a, prime.Connection)
+		} else {
+			conn = conns[0]
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	prime.Id = a.nextId
+	a.nextId++
+	a.primes[prime.Id] = &adminPrime{json: prime, rule: rule, conn: conn}
+	if conn != nil {
+		a.Engine.PrimeConnection(conn, rule)
+	} else {
+		a.Engine.Prime(rule)
+	}
+	return prime, nil
+}
+
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msgf("%v: received %v %v", a, r.Method, r.URL)
+	address := r.URL.Query().Get("address")
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/servers" && r.Method == http.MethodGet:
+		a.writeJson(w, http.StatusOK, a.serverInfos())
+	case path == "/connections" && r.Method == http.MethodGet:
+		a.writeJson(w, http.StatusOK, adminConnections(a.connections(address)))
+	case path == "/connections" && r.Method == http.MethodDelete:
+		conns := a.connections(address)
+		for _, conn := range conns {
+			conn.abort()
+		}
+		a.writeJson(w, http.StatusOK, adminConnections(conns))
+	case path == "/connections/pause" && r.Method == http.MethodPost:
+		conns := a.connections(address)
+		for _, conn := range conns {
+			conn.Pause()
+		}
+		a.writeJson(w, http.StatusOK, adminConnections(conns))
+	case path == "/connections/resume" && r.Method == http.MethodPost:
+		conns := a.connections(address)
+		for _, conn := range conns {
+			conn.Resume()
+		}
+		a.writeJson(w, http.StatusOK, adminConnections(conns))
+	case path == "/primes" && r.Method == http.MethodGet:
+		a.writeJson(w, http.StatusOK, a.primedRules())
+	case path == "/primes" && r.Method == http.MethodPost:
+		prime := &AdminPrime{}
+		if err := json.NewDecoder(r.Body).Decode(prime); err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid prime: %w", err))
+		} else if prime, err = a.Prime(prime); err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+		} else {
+			a.writeJson(w, http.StatusCreated, prime)
+		}
+	case path == "/primes" && r.Method == http.MethodDelete:
+		a.removePrimes(func(int) bool { return true })
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(path, "/primes/") && r.Method == http.MethodDelete:
+		if id, err := strconv.Atoi(strings.TrimPrefix(path, "/primes/")); err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid prime id: %w", err))
+		} else if a.removePrimes(func(candidate int) bool { return candidate == id }) == 0 {
+			a.writeError(w, http.StatusNotFound, fmt.Errorf("prime not found: %v", id))
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case path == "/events" && r.Method == http.MethodPost:
+		event := &AdminEvent{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid event: %w", err))
+		} else if msg, err := event.toMessage(); err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+		} else {
+			var sent []*CqlServerConnection
+			for _, conn := range a.connections(address) {
+				if !conn.IsRegistered(msg.GetEventType()) {
+					continue
+				} else if err := conn.SendEvent(msg); err != nil {
+					log.Error().Err(err).Msgf("%v: could not push event", a)
+				} else {
+					sent = append(sent, conn)
+				}
+			}
+			a.writeJson(w, http.StatusOK, adminConnections(sent))
+		}
+	case path == "/requests" && r.Method == http.MethodGet:
+		a.writeJson(w, http.StatusOK, a.recordedRequests(address))
+	case path == "/requests" && r.Method == http.MethodDelete:
+		a.clearRecordedRequests(address)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		a.writeError(w, http.StatusNotFound, fmt.Errorf("unknown endpoint: %v %v", r.Method, r.URL.Path))
+	}
+}
+
+func (a *AdminServer) writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msgf("%v: could not write response", a)
+	}
+}
+
+func (a *AdminServer) writeError(w http.ResponseWriter, status int, err error) {
+	log.Debug().Err(err).Msgf("%v: request failed", a)
+	a.writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+// Returns the open connections of all servers, or the connection with the given remote address.
+func (a *AdminServer) connections(address string) []*CqlServerConnection {
+	var result []*CqlServerConnection
+	for _, server := range a.Servers {
+		if conns, err := server.AllAcceptedClients(); err == nil {
+			for _, conn := range conns {
+				if address == "" || conn.RemoteAddr().String() == address {
+					result = append(result, conn)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (a *AdminServer) serverInfos() []*AdminServerInfo {
+	result := make([]*AdminServerInfo, 0, len(a.Servers))
+	for _, server := range a.Servers {
+		info := &AdminServerInfo{Address: server.ListenAddress, Connections: []*AdminConnection{}}
+		if conns, err := server.AllAcceptedClients(); err == nil {
+			info.Connections = adminConnections(conns)
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+func (a *AdminServer) primedRules() []*AdminPrime {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	result := make([]*AdminPrime, 0, len(a.primes))
+	for _, prime := range a.primes {
+		result = append(result, prime.json)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+func (a *AdminServer) removePrimes(filter func(id int) bool) (removed int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for id, prime := range a.primes {
+		if filter(id) {
+			a.Engine.Remove(prime.rule)
+			delete(a.primes, id)
+			removed++
+		}
+	}
+	return
+}
+
+func (a *AdminServer) recordedRequests(address string) []*AdminRequest {
+	var entries []*ActivityLogEntry
+	for _, server := range a.Servers {
+		if server.ActivityLog != nil {
+			entries = append(entries, server.ActivityLog.Entries(nil)...)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	result := make([]*AdminRequest, 0, len(entries))
+	for _, entry := range entries {
+		if address == "" || entry.Connection.RemoteAddr().String() == address {
+			result = append(result, newAdminRequest(entry))
+		}
+	}
+	return result
+}
+
+// Clears the requests recorded by all servers, or only the requests received from the given remote address, including
+// by connections that are now closed.
+func (a *AdminServer) clearRecordedRequests(address string) {
+	for _, server := range a.Servers {
+		if server.ActivityLog == nil {
+			continue
+		} else if address == "" {
+			server.ActivityLog.Clear()
+		} else {
+			server.ActivityLog.remove(func(entry *ActivityLogEntry) bool {
+				return entry.Connection.RemoteAddr().String() == address
+			})
+		}
+	}
+	for _, conn := range a.connections(address) {
+		conn.ActivityLog().Clear()
+	}
+}
+
+func newAdminRequest(entry *ActivityLogEntry) *AdminRequest {
+	request := &AdminRequest{
+		Timestamp:       entry.Timestamp,
+		Server:          entry.Connection.LocalAddr().String(),
+		Connection:      entry.Connection.RemoteAddr().String(),
+		ProtocolVersion: int(entry.Request.Header.Version),
+		StreamId:        entry.Request.Header.StreamId,
+		OpCode:          opCodeName(entry.Request.Header.OpCode),
+		Query:           entry.Query(),
+		Message:         fmt.Sprint(entry.Request.Body.Message),
+	}
+	if consistency, ok := entry.Consistency(); ok {
+		request.Consistency = consistencyName(consistency)
+	}
+	if entry.Response != nil {
+		request.ResponseOpCode = opCodeName(entry.Response.Header.OpCode)
+		request.Response = fmt.Sprint(entry.Response.Body.Message)
+	}
+	return request
+}
+
+func eventTypeNames(eventTypes []primitive.EventType) []string {
+	var names []string
+	for _, eventType := range eventTypes {
+		names = append(names, string(eventType))
+	}
+	return names
+}
+
+func adminConnections(conns []*CqlServerConnection) []*AdminConnection {
+	result := make([]*AdminConnection, 0, len(conns))
+	for _, conn := range conns {
+		result = append(result, &AdminConnection{
+			Server:  conn.LocalAddr().String(),
+			Address: conn.RemoteAddr().String(),
+			Paused:  conn.IsPaused(),
+			Events:  eventTypeNames(conn.RegisteredEventTypes()),
+		})
+	}
+	return result
+}
+
+func (p *AdminPrime) toRule() (*PrimeRule, error) {
+	rule := &PrimeRule{
+		Query:    p.When.Query,
+		Keyspace: p.When.Keyspace,
+		Delay:    time.Duration(p.Then.DelayMillis) * time.Millisecond,
+	}
+	for _, name := range p.When.OpCodes {
+		if opCode, found := opCodesByName[strings.ToUpper(name)]; !found {
+			return nil, fmt.Errorf("unknown opcode: %v", name)
+		} else {
+			rule.OpCodes = append(rule.OpCodes, opCode)
+		}
+	}
+	if p.When.QueryPattern != "" {
+		if pattern, err := regexp.Compile(p.When.QueryPattern); err != nil {
+			return nil, fmt.Errorf("invalid query pattern: %w", err)
+		} else {
+			rule.QueryPattern = pattern
+		}
+	}
+	if p.When.Consistency != "" {
+		if consistency, err := parseConsistency(p.When.Consistency); err != nil {
+			return nil, err
+		} else {
+			rule.Consistency = &consistency
+		}
+	}
+	if p.When.Params != nil {
+		rule.PositionalValues = []*primitive.Value{}
+		for i, param := range p.When.Params {
+			if value, err := param.toValue(); err != nil {
+				return nil, fmt.Errorf("invalid param %v: %w", i, err)
+			} else {
+				rule.PositionalValues = append(rule.PositionalValues, value)
+			}
+		}
+	}
+	if p.When.NamedParams != nil {
+		rule.NamedValues = make(map[string]*primitive.Value)
+		for name, param := range p.When.NamedParams {
+			if value, err := param.toValue(); err != nil {
+				return nil, fmt.Errorf("invalid param %v: %w", name, err)
+			} else {
+				rule.NamedValues[name] = value
+			}
+		}
+	}
+	switch strings.ToLower(p.Then.Action) {
+	case "", "respond":
+		rule.Action = PrimeActionRespond
+	case "no_response":
+		rule.Action = PrimeActionNoResponse
+	case "close_connection":
+		rule.Action = PrimeActionCloseConnection
+	default:
+		return nil, fmt.Errorf("unknown action: %v", p.Then.Action)
+	}
+	if p.Then.Error != nil {
+		if msg, err := p.Then.Error.toMessage(); err != nil {
+			return nil, err
+		} else {
+			rule.Error = msg
+		}
+	}
+	if p.Then.Columns != nil {
+		columns, codecs, err := adminColumns(p.Then.Columns)
+		if err != nil {
+			return nil, err
+		}
+		rule.Columns = &message.RowsMetadata{ColumnCount: int32(len(columns)), Columns: columns}
+		rule.Rows = message.RowSet{}
+		for i, row := range p.Then.Rows {
+			if len(row) != len(columns) {
+				return nil, fmt.Errorf("row %v: expected %v values, got %v", i, len(columns), len(row))
+			}
+			encodedRow := make(message.Row, len(row))
+			for j, value := range row {
+				if encodedRow[j], err = encodeJsonValue(columns[j].Type, codecs[j], value); err != nil {
+					return nil, fmt.Errorf("row %v, column %v: %w", i, columns[j].Name, err)
+				}
+			}
+			rule.Rows = append(rule.Rows, encodedRow)
+		}
+	} else if p.Then.Rows != nil {
+		return nil, fmt.Errorf("rows require columns")
+	}
+	return rule, nil
+}
+
+func adminColumns(columns []*AdminColumn) ([]*message.ColumnMetadata, []datatype.Codec, error) {
+	var result []*message.ColumnMetadata
+	var codecs []datatype.Codec
+	for _, column := range columns {
+		if dataType, err := datatype.ParseDataType(column.Type); err != nil {
+			return nil, nil, fmt.Errorf("column %v: %w", column.Name, err)
+		} else if codec, err := datatype.CodecFor(dataType); err != nil {
+			return nil, nil, fmt.Errorf("column %v: %w", column.Name, err)
+		} else {
+			result = append(result, &message.ColumnMetadata{
+				Keyspace: column.Keyspace,
+				Table:    column.Table,
+				Name:     column.Name,
+				Type:     dataType,
+			})
+			codecs = append(codecs, codec)
+		}
+	}
+	return result, codecs, nil
+}
+
+func (v *AdminValue) toValue() (*primitive.Value, error) {
+	if dataType, err := datatype.ParseDataType(v.Type); err != nil {
+		return nil, err
+	} else if codec, err := datatype.CodecFor(dataType); err != nil {
+		return nil, err
+	} else if encoded, err := encodeJsonValue(dataType, codec, v.Value); err != nil {
+		return nil, err
+	} else {
+		return primitive.NewValue(encoded), nil
+	}
+}
+
+// Encodes the given JSON value with the given codec. Encoding uses protocol version 4, which has the same collection
+// encoding as versions 3 and 5.
+func encodeJsonValue(dataType datatype.DataType, codec datatype.Codec, value interface{}) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	} else if converted, err := fromJsonValue(dataType, value); err != nil {
+		return nil, err
+	} else {
+		return codec.Encode(converted, primitive.ProtocolVersion4)
+	}
+}
+
+// Converts the given decoded JSON value to a value accepted by the codec of the given type.
+func fromJsonValue(dataType datatype.DataType, value interface{}) (interface{}, error) {
+	switch dataType.GetDataTypeCode() {
+	case primitive.DataTypeCodeInt,
+		primitive.DataTypeCodeBigint,
+		primitive.DataTypeCodeCounter,
+		primitive.DataTypeCodeSmallint,
+		primitive.DataTypeCodeTinyint,
+		primitive.DataTypeCodeVarint:
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("expected integer, got %v", v)
+			}
+			return int64(v), nil
+		case string:
+			return strconv.ParseInt(v, 10, 64)
+		}
+	case primitive.DataTypeCodeDouble:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case primitive.DataTypeCodeFloat:
+		switch v := value.(type) {
+		case float64:
+			return float32(v), nil
+		case string:
+			f, err := strconv.ParseFloat(v, 32)
+			return float32(f), err
+		}
+	case primitive.DataTypeCodeBoolean:
+		switch value.(type) {
+		case bool, string:
+			return value, nil
+		}
+	case primitive.DataTypeCodeInet:
+		if v, ok := value.(string); ok {
+			if ip := net.ParseIP(v); ip != nil {
+				return ip, nil
+			}
+			return nil, fmt.Errorf("invalid address: %v", v)
+		}
+	case primitive.DataTypeCodeBlob:
+		if v, ok := value.(string); ok {
+			if strings.HasPrefix(v, "0x") {
+				return hex.DecodeString(v[2:])
+			}
+			return v, nil
+		}
+	case primitive.DataTypeCodeList, primitive.DataTypeCodeSet:
+		var elementType datatype.DataType
+		if listType, ok := dataType.(datatype.ListType); ok {
+			elementType = listType.GetElementType()
+		} else {
+			elementType = dataType.(datatype.SetType).GetElementType()
+		}
+		if v, ok := value.([]interface{}); ok {
+			result := make([]interface{}, len(v))
+			for i, element := range v {
+				var err error
+				if result[i], err = fromJsonValue(elementType, element); err != nil {
+					return nil, err
+				}
+			}
+			return result, nil
+		}
+	case primitive.DataTypeCodeMap:
+		mapType := dataType.(datatype.MapType)
+		if v, ok := value.(map[string]interface{}); ok {
+			result := make(map[interface{}]interface{}, len(v))
+			for key, element := range v {
+				// JSON object keys are always strings; non-textual keys are parsed from them
+				if convertedKey, err := fromJsonValue(mapType.GetKeyType(), key); err != nil {
+					return nil, err
+				} else if convertedElement, err := fromJsonValue(mapType.GetValueType(), element); err != nil {
+					return nil, err
+				} else {
+					result[convertedKey] = convertedElement
+				}
+			}
+			return result, nil
+		}
+	default:
+		return value, nil
+	}
+	return nil, fmt.Errorf("cannot convert %v to %v", value, dataType)
+}
+
+func (e *AdminError) toMessage() (message.Error, error) {
+	var consistency primitive.ConsistencyLevel
+	if e.Consistency != "" {
+		var err error
+		if consistency, err = parseConsistency(e.Consistency); err != nil {
+			return nil, err
+		}
+	}
+	writeType := primitive.WriteTypeSimple
+	if e.WriteType != "" {
+		writeType = primitive.WriteType(strings.ToUpper(e.WriteType))
+	}
+	switch strings.ToLower(e.Code) {
+	case "server_error":
+		return &message.ServerError{ErrorMessage: e.Message}, nil
+	case "protocol_error":
+		return &message.ProtocolError{ErrorMessage: e.Message}, nil
+	case "bad_credentials":
+		return &message.AuthenticationError{ErrorMessage: e.Message}, nil
+	case "unavailable":
+		return &message.Unavailable{ErrorMessage: e.Message, Consistency: consistency, Required: e.Required, Alive: e.Alive}, nil
+	case "overloaded":
+		return &message.Overloaded{ErrorMessage: e.Message}, nil
+	case "is_bootstrapping":
+		return &message.IsBootstrapping{ErrorMessage: e.Message}, nil
+	case "truncate_error":
+		return &message.TruncateError{ErrorMessage: e.Message}, nil
+	case "write_timeout":
+		return &message.WriteTimeout{
+			ErrorMessage: e.Message,
+			Consistency:  consistency,
+			Received:     e.Received,
+			BlockFor:     e.BlockFor,
+			WriteType:    writeType,
+		}, nil
+	case "read_timeout":
+		return &message.ReadTimeout{
+			ErrorMessage: e.Message,
+			Consistency:  consistency,
+			Received:     e.Received,
+			BlockFor:     e.BlockFor,
+			DataPresent:  e.DataPresent,
+		}, nil
+	case "syntax_error":
+		return &message.SyntaxError{ErrorMessage: e.Message}, nil
+	case "unauthorized":
+		return &message.Unauthorized{ErrorMessage: e.Message}, nil
+	case "invalid":
+		return &message.Invalid{ErrorMessage: e.Message}, nil
+	case "config_error":
+		return &message.ConfigError{ErrorMessage: e.Message}, nil
+	case "already_exists":
+		return &message.AlreadyExists{ErrorMessage: e.Message, Keyspace: e.Keyspace, Table: e.Table}, nil
+	}
+	return nil, fmt.Errorf("unknown error code: %v", e.Code)
+}
+
+func (e *AdminEvent) toMessage() (message.Event, error) {
+	address := &primitive.Inet{Port: e.Port}
+	if e.Address != "" {
+		if address.Addr = net.ParseIP(e.Address); address.Addr == nil {
+			return nil, fmt.Errorf("invalid address: %v", e.Address)
+		}
+	}
+	change := strings.ToUpper(e.Change)
+	switch primitive.EventType(strings.ToUpper(e.Type)) {
+	case primitive.EventTypeStatusChange:
+		return &message.StatusChangeEvent{ChangeType: primitive.StatusChangeType(change), Address: address}, nil
+	case primitive.EventTypeTopologyChange:
+		return &message.TopologyChangeEvent{ChangeType: primitive.TopologyChangeType(change), Address: address}, nil
+	case primitive.EventTypeSchemaChange:
+		return &message.SchemaChangeEvent{
+			ChangeType: primitive.SchemaChangeType(change),
+			Target:     primitive.SchemaChangeTarget(strings.ToUpper(e.Target)),
+			Keyspace:   e.Keyspace,
+			Object:     e.Object,
+			Arguments:  e.Arguments,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown event type: %v", e.Type)
+}
+
+var opCodesByName = map[string]primitive.OpCode{
+	"QUERY":   primitive.OpCodeQuery,
+	"PREPARE": primitive.OpCodePrepare,
+	"EXECUTE": primitive.OpCodeExecute,
+	"BATCH":   primitive.OpCodeBatch,
+}
+
+var consistencyLevelsByName = map[string]primitive.ConsistencyLevel{
+	"ANY":          primitive.ConsistencyLevelAny,
+	"ONE":          primitive.ConsistencyLevelOne,
+	"TWO":          primitive.ConsistencyLevelTwo,
+	"THREE":        primitive.ConsistencyLevelThree,
+	"QUORUM":       primitive.ConsistencyLevelQuorum,
+	"ALL":          primitive.ConsistencyLevelAll,
+	"LOCAL_QUORUM": primitive.ConsistencyLevelLocalQuorum,
+	"EACH_QUORUM":  primitive.ConsistencyLevelEachQuorum,
+	"SERIAL":       primitive.ConsistencyLevelSerial,
+	"LOCAL_SERIAL": primitive.ConsistencyLevelLocalSerial,
+	"LOCAL_ONE":    primitive.ConsistencyLevelLocalOne,
+}
+
+func parseConsistency(name string) (primitive.ConsistencyLevel, error) {
+	if consistency, found := consistencyLevelsByName[strings.ToUpper(name)]; found {
+		return consistency, nil
+	}
+	return 0, fmt.Errorf("unknown consistency level: %v", name)
+}
+
+func consistencyName(consistency primitive.ConsistencyLevel) string {
+	for name, candidate := range consistencyLevelsByName {
+		if candidate == consistency {
+			return name
+		}
+	}
+	return strconv.Itoa(int(consistency))
+}
+
+func opCodeName(opCode primitive.OpCode) string {
+	// OpCode.String returns e.g. "OpCode QUERY [0x07]"
+	if fields := strings.Fields(opCode.String()); len(fields) == 3 {
+		return fields[1]
+	}
+	return opCode.String()
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createAdminServer(t *testing.T) (*client.AdminServer, *client.CqlServer, *client.CqlClientConnection, context.CancelFunc) {
+	engine := client.NewPrimingEngine()
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	admin := client.NewAdminServer("127.0.0.1:0", engine, server)
+	server.RequestHandlers = []client.RequestHandler{client.RegisterHandler, engine.Handler(), unprimedHandler}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+	require.Nil(t, admin.Start(ctx))
+	clientConn, err := client.NewCqlClient("127.0.0.1:9043", nil).Connect(ctx)
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		conns, err := server.AllAcceptedClients()
+		return err == nil && len(conns) == 1
+	}, time.Second*10, time.Millisecond*10)
+	return admin, server, clientConn, cancelFn
+}
+
+func callAdmin(t *testing.T, admin *client.AdminServer, method string, path string, body string, result interface{}) int {
+	request, err := http.NewRequest(method, fmt.Sprintf("http://%v%v", admin.Addr(), path), strings.NewReader(body))
+	require.Nil(t, err)
+	response, err := http.DefaultClient.Do(request)
+	require.Nil(t, err)
+	defer response.Body.Close()
+	if result != nil {
+		require.Nil(t, json.NewDecoder(response.Body).Decode(result))
+	}
+	return response.StatusCode
+}
+
+func TestAdminServer_Primes(t *testing.T) {
+	admin, server, clientConn, cancelFn := createAdminServer(t)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	prime := &client.AdminPrime{}
+	status := callAdmin(t, admin, http.MethodPost, "/primes", `{
+		"when": {"query": "SELECT * FROM ks1.table1 WHERE pk = ?", "params": [{"type": "int", "value": 1}]},
+		"then": {
+			"columns": [
+				{"keyspace": "ks1", "table": "table1", "name": "pk", "type": "int"},
+				{"keyspace": "ks1", "table": "table1", "name": "v", "type": "map<varchar,list<bigint>>"},
+				{"keyspace": "ks1", "table": "table1", "name": "b", "type": "boolean"}
+			],
+			"rows": [[1, {"a": [1, 2]}, true], [1, null, false]]
+		}
+	}`, prime)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 1, prime.Id)
+	status = callAdmin(t, admin, http.MethodPost, "/primes", `{
+		"when": {"query_pattern": "^INSERT", "consistency": "LOCAL_QUORUM"},
+		"then": {"error": {"code": "write_timeout", "message": "timeout", "consistency": "LOCAL_QUORUM", "block_for": 2}}
+	}`, prime)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 2, prime.Id)
+	var primes []*client.AdminPrime
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/primes", "", &primes))
+	assert.Len(t, primes, 2)
+
+	// rows
+	pk, _ := (&datatype.IntCodec{}).Encode(1, primitive.ProtocolVersion4)
+	response := sendQuery(t, clientConn, &message.Query{
+		Query:   "SELECT * FROM ks1.table1 WHERE pk = ?",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(pk)}},
+	})
+	require.IsType(t, &message.RowsResult{}, response)
+	rows := response.(*message.RowsResult)
+	assert.Equal(t, datatype.NewMapType(datatype.Varchar, datatype.NewListType(datatype.Bigint)), rows.Metadata.Columns[1].Type)
+	require.Len(t, rows.Data, 2)
+	assert.Equal(t, pk, rows.Data[0][0])
+	decoded, err := datatype.NewMapCodec(&datatype.VarcharCodec{}, datatype.NewListCodec(&datatype.BigintCodec{})).Decode(rows.Data[0][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"a": []interface{}{int64(1), int64(2)}}, decoded)
+	assert.Nil(t, rows.Data[1][1])
+	assert.Equal(t, []byte{1}, rows.Data[0][2])
+	assert.Equal(t, []byte{0}, rows.Data[1][2])
+
+	// errors
+	response = sendQuery(t, clientConn, &message.Query{
+		Query:   "INSERT INTO ks1.table1 (pk) VALUES (1)",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelLocalQuorum},
+	})
+	require.IsType(t, &message.WriteTimeout{}, response)
+	assert.EqualValues(t, 2, response.(*message.WriteTimeout).BlockFor)
+
+	// removal
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, admin, http.MethodDelete, "/primes/2", "", nil))
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, admin, http.MethodDelete, "/primes/2", "", nil))
+	assert.True(t, isUnprimed(sendQuery(t, clientConn, &message.Query{
+		Query:   "INSERT INTO ks1.table1 (pk) VALUES (1)",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelLocalQuorum},
+	})))
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, admin, http.MethodDelete, "/primes", "", nil))
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/primes", "", &primes))
+	assert.Empty(t, primes)
+
+	// invalid primes
+	assert.Equal(t, http.StatusBadRequest, callAdmin(t, admin, http.MethodPost, "/primes", `{"then": {"error": {"code": "unknown"}}}`, nil))
+	assert.Equal(t, http.StatusBadRequest, callAdmin(t, admin, http.MethodPost, "/primes", `{"then": {"columns": [{"name": "c", "type": "integer"}]}}`, nil))
+	assert.Equal(t, http.StatusBadRequest, callAdmin(t, admin, http.MethodPost, "/primes", `{"then": {"columns": [{"name": "c", "type": "int"}], "rows": [["a"]]}}`, nil))
+}
+
+func TestAdminServer_Connections(t *testing.T) {
+	admin, server, clientConn, cancelFn := createAdminServer(t)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	var servers []*client.AdminServerInfo
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/servers", "", &servers))
+	require.Len(t, servers, 1)
+	assert.Equal(t, "127.0.0.1:9043", servers[0].Address)
+	require.Len(t, servers[0].Connections, 1)
+	address := clientConn.LocalAddr().String()
+	assert.Equal(t, address, servers[0].Connections[0].Address)
+
+	// pause and resume
+	var conns []*client.AdminConnection
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodPost, "/connections/pause?address="+address, "", &conns))
+	require.Len(t, conns, 1)
+	assert.True(t, conns[0].Paused)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	inFlight, err := clientConn.SendContext(ctx, frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT paused"}))
+	require.Nil(t, err)
+	select {
+	case <-inFlight.Incoming():
+		assert.Fail(t, "expected no response while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodPost, "/connections/resume", "", &conns))
+	assert.False(t, conns[0].Paused)
+	response, err := clientConn.Receive(inFlight)
+	require.Nil(t, err)
+	assert.True(t, isUnprimed(response.Body.Message))
+
+	// events
+	statusChange := `{"type": "STATUS_CHANGE", "change": "DOWN", "address": "127.0.0.2", "port": 9042}`
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodPost, "/events", statusChange, &conns))
+	assert.Empty(t, conns)
+	register := &message.Register{EventTypes: []primitive.EventType{primitive.EventTypeStatusChange}}
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, register))
+	require.Nil(t, err)
+	require.IsType(t, &message.Ready{}, response.Body.Message)
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodPost, "/events", statusChange, &conns))
+	require.Len(t, conns, 1)
+	assert.Equal(t, []string{"STATUS_CHANGE"}, conns[0].Events)
+	event, err := clientConn.ReceiveEvent()
+	require.Nil(t, err)
+	require.IsType(t, &message.StatusChangeEvent{}, event.Body.Message)
+	assert.Equal(t, primitive.StatusChangeTypeDown, event.Body.Message.(*message.StatusChangeEvent).ChangeType)
+	assert.Equal(t, "127.0.0.2:9042", event.Body.Message.(*message.StatusChangeEvent).Address.String())
+	assert.Equal(t, http.StatusBadRequest, callAdmin(t, admin, http.MethodPost, "/events", `{"type": "UNKNOWN"}`, nil))
+
+	// close
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodDelete, "/connections?address=unknown", "", &conns))
+	assert.Empty(t, conns)
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodDelete, "/connections?address="+address, "", &conns))
+	assert.Len(t, conns, 1)
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestAdminServer_Requests(t *testing.T) {
+	admin, server, clientConn, cancelFn := createAdminServer(t)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	sendQuery(t, clientConn, &message.Query{Query: "SELECT 1", Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelLocalOne}})
+	batch := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Batch{
+		Children:    []*message.BatchChild{{QueryOrId: "INSERT INTO ks1.table1 (pk) VALUES (1)"}},
+		Consistency: primitive.ConsistencyLevelQuorum,
+	})
+	_, err := clientConn.SendAndReceive(batch)
+	require.Nil(t, err)
+
+	var requests []*client.AdminRequest
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/requests", "", &requests))
+	require.Len(t, requests, 2)
+	assert.Equal(t, "QUERY", requests[0].OpCode)
+	assert.Equal(t, "SELECT 1", requests[0].Query)
+	assert.Equal(t, "LOCAL_ONE", requests[0].Consistency)
+	assert.Equal(t, clientConn.LocalAddr().String(), requests[0].Connection)
+	assert.Equal(t, "ERROR", requests[0].ResponseOpCode)
+	assert.Equal(t, "BATCH", requests[1].OpCode)
+	assert.Equal(t, "QUORUM", requests[1].Consistency)
+
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/requests?address=unknown", "", &requests))
+	assert.Empty(t, requests)
+
+	// clear the requests of a single connection
+	otherConn, err := client.NewCqlClient("127.0.0.1:9043", nil).Connect(context.Background())
+	require.Nil(t, err)
+	defer otherConn.Close()
+	sendQuery(t, otherConn, &message.Query{Query: "SELECT 2"})
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, admin, http.MethodDelete, "/requests?address="+clientConn.LocalAddr().String(), "", nil))
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/requests", "", &requests))
+	require.Len(t, requests, 1)
+	assert.Equal(t, "SELECT 2", requests[0].Query)
+	assert.Equal(t, otherConn.LocalAddr().String(), requests[0].Connection)
+	conns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	for _, conn := range conns {
+		if conn.RemoteAddr().String() == clientConn.LocalAddr().String() {
+			assert.Empty(t, conn.ActivityLog().Entries(nil))
+		} else {
+			assert.Len(t, conn.ActivityLog().Entries(nil), 1)
+		}
+	}
+
+	assert.Equal(t, http.StatusNoContent, callAdmin(t, admin, http.MethodDelete, "/requests", "", nil))
+	assert.Equal(t, http.StatusOK, callAdmin(t, admin, http.MethodGet, "/requests", "", &requests))
+	assert.Empty(t, requests)
+	assert.Equal(t, http.StatusNotFound, callAdmin(t, admin, http.MethodGet, "/unknown", "", nil))
+
+	cancelFn()
+	assert.Eventually(t, admin.IsClosed, time.Second*10, time.Millisecond*10)
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// A Statement is a request to execute on a cluster, see ClusterClient.Execute.
+type Statement struct {
+	// The request frame to send.
+	Frame *frame.Frame
+	// The routing key of the statement, that is, the serialized value of its partition key, if known. If nil, the
+	// routing key of EXECUTE requests is computed by ClusterClient from the partition key indices of the prepared
+	// statement, if known.
+	RoutingKey []byte
+	// Whether the statement is idempotent, that is, whether it can be applied more than once without changing the
+	// result beyond the initial application. Non-idempotent statements are never retried after a connection error or
+	// a write timeout; see RetryPolicy.
+	Idempotent bool
+}
+
+// LoadBalancingPolicy decides which hosts to contact when executing statements, and in which order.
+type LoadBalancingPolicy interface {
+	// Returns the hosts to contact to execute the given statement, in order of preference. The given hosts are all the
+	// hosts known by the cluster, including hosts that are down. The returned query plan should not contain hosts
+	// that are down.
+	NewQueryPlan(statement *Statement, hosts []*Host) []*Host
+}
+
+// A LoadBalancingPolicy that rotates over all the hosts that are up.
+type RoundRobinPolicy struct {
+	index uint32
+}
+
+func NewRoundRobinPolicy() *RoundRobinPolicy {
+	return &RoundRobinPolicy{}
+}
+
+func (p *RoundRobinPolicy) NewQueryPlan(_ *Statement, hosts []*Host) []*Host {
+	return rotate(upHosts(hosts), &p.index)
+}
+
+// A LoadBalancingPolicy that rotates over the hosts of the local datacenter first. Hosts from remote datacenters are
+// included at the end of query plans only if AllowRemoteHosts is true.
+type DCAwarePolicy struct {
+	// The local datacenter, as found in the data_center column of system tables.
+	LocalDatacenter string
+	// Whether to include hosts from remote datacenters at the end of query plans.
+	AllowRemoteHosts bool
+
+	index uint32
+}
+
+func NewDCAwarePolicy(localDatacenter string) *DCAwarePolicy {
+	return &DCAwarePolicy{LocalDatacenter: localDatacenter}
+}
+
+func (p *DCAwarePolicy) NewQueryPlan(_ *Statement, hosts []*Host) []*Host {
+	var local, remote []*Host
+	for _, host := range upHosts(hosts) {
+		if host.Datacenter == p.LocalDatacenter {
+			local = append(local, host)
+		} else {
+			remote = append(remote, host)
+		}
+	}
+	index := atomic.AddUint32(&p.index, 1)
+	plan := rotateFrom(local, index)
+	if p.AllowRemoteHosts {
+		plan = append(plan, rotateFrom(remote, index)...)
+	}
+	return plan
+}
+
+// A LoadBalancingPolicy that contacts the host owning the token of the statement's routing key first, then falls back
+// to the query plan of its child policy. Ownership is determined by the tokens of each host, as found in the tokens
+// column of system tables: since keyspace replication settings are not known, only the primary replica is
+// considered. Statements without routing keys are routed by the child policy.
+type TokenAwarePolicy struct {
+	Child LoadBalancingPolicy
+}
+
+func NewTokenAwarePolicy(child LoadBalancingPolicy) *TokenAwarePolicy {
+	return &TokenAwarePolicy{Child: child}
+}
+
+func (p *TokenAwarePolicy) NewQueryPlan(statement *Statement, hosts []*Host) []*Host {
+	plan := p.Child.NewQueryPlan(statement, hosts)
+	if statement == nil || statement.RoutingKey == nil {
+		return plan
+	}
+	replica := primaryReplica(Murmur3Token(statement.RoutingKey), hosts)
+	if replica == nil || !replica.IsUp() {
+		return plan
+	}
+	result := []*Host{replica}
+	for _, host := range plan {
+		if host != replica {
+			result = append(result, host)
+		}
+	}
+	return result
+}
+
+type ringEntry struct {
+	token int64
+	host  *Host
+}
+
+// Returns the host owning the given token, that is, the host with the smallest token greater than or equal to the
+// given token, wrapping around the ring.
+func primaryReplica(token int64, hosts []*Host) *Host {
+	var ring []ringEntry
+	for _, host := range hosts {
+		for _, t := range host.Tokens {
+			if parsed, err := strconv.ParseInt(t, 10, 64); err == nil {
+				ring = append(ring, ringEntry{parsed, host})
+			}
+		}
+	}
+	if len(ring) == 0 {
+		return nil
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].token < ring[j].token })
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].token >= token })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].host
+}
+
+// Computes a routing key from the serialized values of the partition key components. Single-component keys are used
+// as is; composite keys are encoded as a sequence of [short bytes] each followed by a zero byte.
+func NewRoutingKey(components ...[]byte) []byte {
+	if len(components) == 1 {
+		return components[0]
+	}
+	buf := &bytes.Buffer{}
+	for _, component := range components {
+		buf.WriteByte(byte(len(component) >> 8))
+		buf.WriteByte(byte(len(component)))
+		buf.Write(component)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func upHosts(hosts []*Host) []*Host {
+	var up []*Host
+	for _, host := range hosts {
+		if host.IsUp() {
+			up = append(up, host)
+		}
+	}
+	return up
+}
+
+func rotate(hosts []*Host, index *uint32) []*Host {
+	return rotateFrom(hosts, atomic.AddUint32(index, 1))
+}
+
+func rotateFrom(hosts []*Host, index uint32) []*Host {
+	if len(hosts) == 0 {
+		return nil
+	}
+	start := int(index % uint32(len(hosts)))
+	plan := make([]*Host, 0, len(hosts))
+	plan = append(plan, hosts[start:]...)
+	return append(plan, hosts[:start]...)
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	host1 = &client.Host{Address: "127.0.0.1:9042", Datacenter: "dc1", Tokens: []string{"-9223372036854775808"}}
+	host2 = &client.Host{Address: "127.0.0.2:9042", Datacenter: "dc1", Tokens: []string{"-3074457345618258603"}}
+	host3 = &client.Host{Address: "127.0.0.3:9042", Datacenter: "dc2", Tokens: []string{"3074457345618258602"}}
+	hosts = []*client.Host{host1, host2, host3}
+)
+
+func TestRoundRobinPolicy(t *testing.T) {
+	policy := client.NewRoundRobinPolicy()
+	assert.Equal(t, []*client.Host{host2, host3, host1}, policy.NewQueryPlan(nil, hosts))
+	assert.Equal(t, []*client.Host{host3, host1, host2}, policy.NewQueryPlan(nil, hosts))
+	assert.Equal(t, []*client.Host{host1, host2, host3}, policy.NewQueryPlan(nil, hosts))
+	assert.Nil(t, policy.NewQueryPlan(nil, nil))
+}
+
+func TestDCAwarePolicy(t *testing.T) {
+	policy := client.NewDCAwarePolicy("dc1")
+	assert.Equal(t, []*client.Host{host2, host1}, policy.NewQueryPlan(nil, hosts))
+	assert.Equal(t, []*client.Host{host1, host2}, policy.NewQueryPlan(nil, hosts))
+	policy.AllowRemoteHosts = true
+	assert.Equal(t, []*client.Host{host2, host1, host3}, policy.NewQueryPlan(nil, hosts))
+}
+
+func TestTokenAwarePolicy(t *testing.T) {
+	policy := client.NewTokenAwarePolicy(client.NewDCAwarePolicy("dc1"))
+	// token(1) = -4069959284402364209, owned by host2
+	plan := policy.NewQueryPlan(&client.Statement{RoutingKey: []byte{0, 0, 0, 1}}, hosts)
+	assert.Equal(t, host2, plan[0])
+	assert.Len(t, plan, 2)
+	// token(3) = 9010454139840013625, wraps around the ring and is owned by host1
+	plan = policy.NewQueryPlan(&client.Statement{RoutingKey: []byte{0, 0, 0, 3}}, hosts)
+	assert.Equal(t, host1, plan[0])
+	assert.Len(t, plan, 2)
+	// no routing key
+	plan = policy.NewQueryPlan(&client.Statement{}, hosts)
+	assert.Len(t, plan, 2)
+}
+
+func TestNewRoutingKey(t *testing.T) {
+	assert.Equal(t, []byte{0, 0, 0, 1}, client.NewRoutingKey([]byte{0, 0, 0, 1}))
+	assert.Equal(t,
+		[]byte{0, 4, 0, 0, 0, 1, 0, 0, 1, 'a', 0},
+		client.NewRoutingKey([]byte{0, 0, 0, 1}, []byte("a")),
+	)
+}
+
+func TestClusterClient_Execute_TokenAware(t *testing.T) {
+
+	var lock sync.Mutex
+	var coordinators []string
+	prepareHandler := client.NewPreparedStatementHandler(
+		"SELECT * FROM ks1.table1 WHERE pk = ?",
+		&message.VariablesMetadata{
+			PkIndices: []uint16{0},
+			Columns:   []*message.ColumnMetadata{{Keyspace: "ks1", Table: "table1", Name: "pk", Type: datatype.Int}},
+		},
+		&message.RowsMetadata{ColumnCount: 0},
+		func(options *message.QueryOptions) message.RowSet { return message.RowSet{} },
+	)
+	executeHandler := func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		if _, ok := request.Body.Message.(*message.Execute); ok {
+			lock.Lock()
+			coordinators = append(coordinators, conn.LocalAddr().String())
+			lock.Unlock()
+		}
+		return prepareHandler(request, conn, ctx)
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	servers := startTestCluster(t, ctx, newTestTopology(), executeHandler)
+
+	cluster := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+	cluster.PoolSize = 1
+	err := cluster.Start(ctx)
+	require.Nil(t, err)
+
+	prepare := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: "SELECT * FROM ks1.table1 WHERE pk = ?"})
+	response, err := cluster.Execute(ctx, &client.Statement{Frame: prepare})
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+	preparedId := response.Body.Message.(*message.PreparedResult).PreparedQueryId
+
+	// the statement is reused with new bound values: its routing key must be computed anew each time
+	statement := &client.Statement{}
+	for _, pk := range []int32{1, 2, 3} {
+		value, _ := (&datatype.IntCodec{}).Encode(pk, primitive.ProtocolVersion4)
+		statement.Frame = frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{
+			QueryId: preparedId,
+			Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(value)}},
+		})
+		response, err := cluster.Execute(ctx, statement)
+		require.Nil(t, err)
+		require.IsType(t, &message.RowsResult{}, response.Body.Message)
+		assert.Nil(t, statement.RoutingKey)
+	}
+	lock.Lock()
+	require.Equal(t, []string{"127.0.0.2:9043", "127.0.0.2:9043", "127.0.0.1:9043"}, coordinators)
+	lock.Unlock()
+
+	cancelFn()
+
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+	for _, server := range servers {
+		assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// BatchHandler is a RequestHandler factory that handles BATCH requests child by child. Each child, whether a query
+// string or the id of a statement prepared with the Store or with the Engine Registry, is first matched against the
+// rules of the Engine, as if it were a QUERY or EXECUTE request with the options of the batch; children not matching
+// any rule are executed with the Store, or simply acknowledged if there is no Store.
+//
+// Like Cassandra, the handler only accepts INSERT, UPDATE and DELETE children, and validates the batch type: COUNTER
+// batches may only contain counter updates, LOGGED batches may not contain any, and UNLOGGED batches may not mix them;
+// counter updates are recognized with the Store Schema, or, for tables the Store does not know, by their c = c + <value>
+// assignments; children whose kind cannot be told are not validated. The handler then waits for the delays, and applies the
+// actions, of the matching rules, in the order of the children, and responds with the first primed error, if any;
+// otherwise, it executes the children left to the Store atomically, and responds with the Store error, if any, or with
+// the ROWS of conditional batches, which include the [applied] column. Otherwise, it responds with the first primed
+// ROWS, if any, or with a VOID result. It is preferable to create BatchHandler instances using the constructor function
+// NewBatchHandler.
+type BatchHandler struct {
+	// The engine whose rules are matched against the batch children; optional.
+	Engine *PrimingEngine
+	// The store executing the batch children not matching any rule; optional.
+	Store *TableStore
+}
+
+func NewBatchHandler(engine *PrimingEngine, store *TableStore) *BatchHandler {
+	return &BatchHandler{Engine: engine, Store: store}
+}
+
+// Returns a RequestHandler handling BATCH requests.
+func (h *BatchHandler) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) *frame.Frame {
+		batch, ok := request.Body.Message.(*message.Batch)
+		if !ok {
+			return nil
+		}
+		log.Debug().Msgf("%v: [batch handler]: intercepted BATCH with %v children", conn, len(batch.Children))
+		msg := h.handleBatch(batch, request.Header.Version, conn)
+		if msg == nil {
+			return nil
+		}
+		log.Debug().Msgf("%v: [batch handler]: returning %v", conn, msg)
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	}
+}
+
+func (h *BatchHandler) handleBatch(batch *message.Batch, version primitive.ProtocolVersion, conn *CqlServerConnection) message.Message {
+	keyspace := batch.Keyspace
+	if keyspace == "" && h.Store != nil {
+		keyspace = h.Store.currentKeyspace(conn)
+	}
+	var rules []*PrimeRule
+	var children []*storeBatchChild
+	// the counter status of the children whose status is known
+	var counters []bool
+	for _, child := range batch.Children {
+		query, childKeyspace, found := h.resolve(child.QueryOrId)
+		if !found {
+			return newUnprepared(child.QueryOrId.([]byte))
+		} else if batch.Keyspace != "" || childKeyspace == "" {
+			childKeyspace = keyspace
+		}
+		if words := strings.Fields(query); len(words) == 0 || !isModificationVerb(words[0]) {
+			return &message.Invalid{ErrorMessage: "Invalid statement in batch: only UPDATE, INSERT and DELETE statements are allowed"}
+		}
+		parsed, err := parseCql(query)
+		if h.Engine != nil {
+			if rule := h.Engine.Match(newBatchChildFrame(batch, child, version), conn); rule != nil {
+				log.Debug().Msgf("%v: [batch handler]: batch child matched primed rule: %v", conn, query)
+				rules = append(rules, rule)
+				if err == nil {
+					counters = h.appendCounterStatus(counters, parsed, childKeyspace)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			if err != errCqlNotSupported && h.Store != nil {
+				return &message.SyntaxError{ErrorMessage: err.Error()}
+			}
+			continue
+		}
+		counters = h.appendCounterStatus(counters, parsed, childKeyspace)
+		if h.Store == nil || isSystemKeyspace(statementKeyspace(parsed, childKeyspace)) {
+			continue
+		}
+		values := &cqlValues{positional: child.Values, version: version}
+		children = append(children, &storeBatchChild{parsed, childKeyspace, values})
+	}
+	if errMsg := validateBatchType(batch.Type, counters); errMsg != nil {
+		return errMsg
+	}
+	for _, rule := range rules {
+		if !h.Engine.await(rule, conn) {
+			return nil
+		}
+	}
+	for _, rule := range rules {
+		if rule.Error != nil {
+			return rule.Error
+		}
+	}
+	if len(children) > 0 {
+		switch result := h.Store.executeBatch(batch.Type, children, version).(type) {
+		case message.Error, *message.RowsResult:
+			return result
+		}
+	}
+	for _, rule := range rules {
+		if response, ok := rule.response().(*message.RowsResult); ok {
+			return response
+		}
+	}
+	return &message.VoidResult{}
+}
+
+// Returns the query string of the given batch child, along with the keyspace it was prepared in, if any; found is
+// false if the child is the id of a statement prepared neither with the store nor with the engine registry.
+func (h *BatchHandler) resolve(queryOrId interface{}) (query string, keyspace string, found bool) {
+	id, ok := queryOrId.([]byte)
+	if !ok {
+		query, _ = queryOrId.(string)
+		return query, "", true
+	}
+	if h.Store != nil {
+		h.Store.lock.Lock()
+		statement := h.Store.prepared[string(id)]
+		h.Store.lock.Unlock()
+		if statement != nil {
+			return statement.query, statement.keyspace, true
+		}
+	}
+	if h.Engine != nil && h.Engine.Registry != nil {
+		keyspace, query, found = h.Engine.Registry.Lookup(id)
+	}
+	return query, keyspace, found
+}
+
+// Returns whether the given statement is a counter update, and whether this can be told: with the table definition, if
+// the statement targets a table of the store schema, or with the statement itself otherwise.
+func (h *BatchHandler) counterStatus(parsed *cqlStatement, keyspace string) (counter bool, known bool) {
+	if h.Store != nil {
+		if table := statementTable(h.Store.Schema, parsed, keyspace); table != nil {
+			return isCounterTable(table), true
+		}
+	}
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		// counters cannot be inserted
+		return false, true
+	case *updateStatement:
+		for _, assignment := range statement.assignments {
+			if assignment.operator == "" {
+				// counters cannot be set
+				return false, true
+			}
+			// c = c + <literal> can only be a counter update, c = c + <collection> only a collection update, but
+			// c = c + ? could be either
+			switch assignment.value.(type) {
+			case *cqlLiteral:
+				return true, true
+			case *cqlCollection:
+				return false, true
+			}
+		}
+	}
+	return false, false
+}
+
+// Appends the counter status of the given statement to the given statuses, if it is known.
+func (h *BatchHandler) appendCounterStatus(counters []bool, parsed *cqlStatement, keyspace string) []bool {
+	if counter, known := h.counterStatus(parsed, keyspace); known {
+		return append(counters, counter)
+	}
+	return counters
+}
+
+func isModificationVerb(word string) bool {
+	switch strings.ToLower(word) {
+	case "insert", "update", "delete":
+		return true
+	}
+	return false
+}
+
+// Returns a QUERY or EXECUTE frame equivalent to the given batch child, for matching against priming rules.
+func newBatchChildFrame(batch *message.Batch, child *message.BatchChild, version primitive.ProtocolVersion) *frame.Frame {
+	options := &message.QueryOptions{
+		Consistency:       batch.Consistency,
+		PositionalValues:  child.Values,
+		SerialConsistency: batch.SerialConsistency,
+		DefaultTimestamp:  batch.DefaultTimestamp,
+		Keyspace:          batch.Keyspace,
+	}
+	if id, ok := child.QueryOrId.([]byte); ok {
+		return frame.NewFrame(version, 0, &message.Execute{QueryId: id, Options: options})
+	}
+	query, _ := child.QueryOrId.(string)
+	return frame.NewFrame(version, 0, &message.Query{Query: query, Options: options})
+}
+
+// Returns the definition of the table targeted by the given INSERT, UPDATE or DELETE statement in the given schema,
+// or nil if the statement targets another kind of object, or if the table does not exist.
+func statementTable(schema *Schema, parsed *cqlStatement, defaultKeyspace string) *SchemaTable {
+	var name string
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		name = statement.table
+	case *updateStatement:
+		name = statement.table
+	case *deleteStatement:
+		name = statement.table
+	default:
+		return nil
+	}
+	keyspace := schema.Keyspace(statementKeyspace(parsed, defaultKeyspace))
+	if keyspace == nil {
+		return nil
+	}
+	return keyspace.Table(name)
+}
+
+// Validates the types of the statements of a BATCH request of the given type, like Cassandra does: counters tells,
+// for each statement, whether it is a counter update.
+func validateBatchType(batchType primitive.BatchType, counters []bool) message.Error {
+	hasCounters, hasNonCounters := false, false
+	for _, counter := range counters {
+		if batchType == primitive.BatchTypeCounter && !counter {
+			return invalidf("Cannot include non-counter statement in a counter batch")
+		} else if batchType == primitive.BatchTypeLogged && counter {
+			return invalidf("Cannot include a counter statement in a logged batch")
+		}
+		hasCounters = hasCounters || counter
+		hasNonCounters = hasNonCounters || !counter
+	}
+	if hasCounters && hasNonCounters {
+		return invalidf("Counter and non-counter mutations cannot exist in the same batch")
+	}
+	return nil
+}
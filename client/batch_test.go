@@ -0,0 +1,203 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBatchHandler_BatchTypes(t *testing.T) {
+	store := newTestTableStore(t,
+		"CREATE TABLE ks1.t1 (pk int PRIMARY KEY, v text)",
+		"CREATE TABLE ks1.c1 (pk int PRIMARY KEY, c counter)",
+	)
+	handler := client.NewBatchHandler(nil, store).Handler()
+	update := &message.BatchChild{QueryOrId: "UPDATE ks1.t1 SET v = 'a' WHERE pk = 1"}
+	increment := &message.BatchChild{QueryOrId: "UPDATE ks1.c1 SET c = c + 1 WHERE pk = 1"}
+	for _, test := range []struct {
+		name      string
+		batchType primitive.BatchType
+		children  []*message.BatchChild
+		expected  message.Message
+	}{
+		{"logged", primitive.BatchTypeLogged, []*message.BatchChild{update}, &message.VoidResult{}},
+		{"logged with counters", primitive.BatchTypeLogged, []*message.BatchChild{increment},
+			&message.Invalid{ErrorMessage: "Cannot include a counter statement in a logged batch"}},
+		{"unlogged", primitive.BatchTypeUnlogged, []*message.BatchChild{update}, &message.VoidResult{}},
+		{"unlogged with counters", primitive.BatchTypeUnlogged, []*message.BatchChild{increment}, &message.VoidResult{}},
+		{"unlogged mixed", primitive.BatchTypeUnlogged, []*message.BatchChild{update, increment},
+			&message.Invalid{ErrorMessage: "Counter and non-counter mutations cannot exist in the same batch"}},
+		{"counter", primitive.BatchTypeCounter, []*message.BatchChild{increment}, &message.VoidResult{}},
+		{"counter with non-counters", primitive.BatchTypeCounter, []*message.BatchChild{increment, update},
+			&message.Invalid{ErrorMessage: "Cannot include non-counter statement in a counter batch"}},
+		{"select", primitive.BatchTypeLogged, []*message.BatchChild{{QueryOrId: "SELECT * FROM ks1.t1"}},
+			&message.Invalid{ErrorMessage: "Invalid statement in batch: only UPDATE, INSERT and DELETE statements are allowed"}},
+		{"unprepared", primitive.BatchTypeLogged, []*message.BatchChild{{QueryOrId: []byte{1, 2, 3}}},
+			&message.Unprepared{ErrorMessage: "Prepared query with ID 010203 not found", Id: []byte{1, 2, 3}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{Type: test.batchType, Children: test.children})
+			response := handler(request, nil, nil)
+			require.NotNil(t, response)
+			assert.Equal(t, test.expected, response.Body.Message)
+		})
+	}
+	assert.Equal(t, [][]interface{}{{int32(1), int64(2)}}, selectRows(t, store, "SELECT * FROM c1"))
+	assert.Nil(t, handler(frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Query{Query: "SELECT * FROM ks1.t1"}), nil, nil))
+}
+
+func TestBatchHandler_BatchTypesWithoutSchema(t *testing.T) {
+	registry := client.NewPreparedStatementRegistry()
+	engine := client.NewPrimingEngine()
+	engine.Registry = registry
+	engine.Prime(&client.PrimeRule{Query: "UPDATE ks1.c1 SET c = c + 2 WHERE pk = 2"})
+	prepared := registry.Prepare("ks1", "UPDATE ks1.c1 SET c = c + ? WHERE pk = ?", primitive.ProtocolVersion4)
+	handler := client.NewBatchHandler(engine, nil).Handler()
+	increment := &message.BatchChild{QueryOrId: "UPDATE ks1.c1 SET c = c + 1 WHERE pk = 1"}
+	primed := &message.BatchChild{QueryOrId: "UPDATE ks1.c1 SET c = c + 2 WHERE pk = 2"}
+	bound := &message.BatchChild{QueryOrId: prepared.PreparedQueryId, Values: encodeValues(t, int32(1), int32(1))}
+	update := &message.BatchChild{QueryOrId: "UPDATE ks1.t1 SET v = 'a' WHERE pk = 1"}
+	for _, test := range []struct {
+		name      string
+		batchType primitive.BatchType
+		children  []*message.BatchChild
+		expected  message.Message
+	}{
+		{"counter", primitive.BatchTypeCounter, []*message.BatchChild{increment, primed, bound}, &message.VoidResult{}},
+		{"counter with non-counters", primitive.BatchTypeCounter, []*message.BatchChild{increment, update},
+			&message.Invalid{ErrorMessage: "Cannot include non-counter statement in a counter batch"}},
+		{"logged with counters", primitive.BatchTypeLogged, []*message.BatchChild{update, primed},
+			&message.Invalid{ErrorMessage: "Cannot include a counter statement in a logged batch"}},
+		{"logged with unknown children", primitive.BatchTypeLogged, []*message.BatchChild{update, bound}, &message.VoidResult{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{Type: test.batchType, Children: test.children})
+			response := handler(request, nil, nil)
+			require.NotNil(t, response)
+			assert.Equal(t, test.expected, response.Body.Message)
+		})
+	}
+}
+
+func TestBatchHandler_Conditional(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int, cc int, v text, w int, PRIMARY KEY (pk, cc))")
+	require.IsType(t, &message.VoidResult{}, store.Execute("ks1", "INSERT INTO t1 (pk, cc, v, w) VALUES (1, 1, 'a', 10)"))
+	handler := client.NewBatchHandler(nil, store).Handler()
+	batch := func(children ...string) message.Message {
+		msg := &message.Batch{Keyspace: "ks1"}
+		for _, child := range children {
+			msg.Children = append(msg.Children, &message.BatchChild{QueryOrId: child})
+		}
+		response := handler(frame.NewFrame(primitive.ProtocolVersion5, 1, msg), nil, nil)
+		require.NotNil(t, response)
+		return response.Body.Message
+	}
+
+	// conditions not applying: no mutation is applied
+	response := batch(
+		"UPDATE t1 SET v = 'b' WHERE pk = 1 AND cc = 1 IF v = 'x'",
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 2, 'c')",
+	)
+	require.IsType(t, &message.RowsResult{}, response)
+	rows := response.(*message.RowsResult)
+	assert.Equal(t, []string{"[applied]", "pk", "cc", "v"}, metadataNames(rows.Metadata.Columns))
+	assert.Equal(t, datatype.Boolean, rows.Metadata.Columns[0].Type)
+	assert.Equal(t, [][]interface{}{{false, int32(1), int32(1), "a"}}, decodeRows(t, rows))
+	assert.Len(t, selectRows(t, store, "SELECT * FROM t1"), 1)
+
+	// conditions applying: all mutations are applied
+	response = batch(
+		"UPDATE t1 SET v = 'b' WHERE pk = 1 AND cc = 1 IF v = 'a'",
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 2, 'c') IF NOT EXISTS",
+	)
+	require.IsType(t, &message.RowsResult{}, response)
+	assert.Equal(t, [][]interface{}{{true}}, decodeRows(t, response.(*message.RowsResult)))
+	assert.Equal(t, [][]interface{}{{"b"}, {"c"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 1"))
+
+	// IF NOT EXISTS conditions report all the columns of the existing rows
+	response = batch(
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 1, 'd') IF NOT EXISTS",
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 2, 'd') IF NOT EXISTS",
+	)
+	require.IsType(t, &message.RowsResult{}, response)
+	rows = response.(*message.RowsResult)
+	assert.Equal(t, []string{"[applied]", "pk", "cc", "v", "w"}, metadataNames(rows.Metadata.Columns))
+	assert.Equal(t, [][]interface{}{{false, int32(1), int32(1), "b", int32(10)}, {false, int32(1), int32(2), "c", nil}}, decodeRows(t, rows))
+
+	assert.Equal(t, &message.Invalid{ErrorMessage: "Batch with conditions cannot span multiple partitions"}, batch(
+		"UPDATE t1 SET v = 'e' WHERE pk = 1 AND cc = 1 IF EXISTS",
+		"INSERT INTO t1 (pk, cc, v) VALUES (2, 1, 'e')",
+	))
+}
+
+func TestBatchHandler_PrimedChildren(t *testing.T) {
+	registry := client.NewPreparedStatementRegistry()
+	engine := client.NewPrimingEngine()
+	engine.Registry = registry
+	engine.Prime(&client.PrimeRule{
+		Query: "INSERT INTO ks1.t1 (pk) VALUES (2)",
+		Error: &message.WriteTimeout{ErrorMessage: "timeout", Consistency: primitive.ConsistencyLevelQuorum, WriteType: primitive.WriteTypeBatch},
+	})
+	consistency := primitive.ConsistencyLevelSerial
+	engine.Prime(&client.PrimeRule{
+		Query:       "UPDATE ks1.t1 SET v = 'a' WHERE pk = 3 IF v = 'b'",
+		Consistency: &consistency,
+		Columns: &message.RowsMetadata{ColumnCount: 1, Columns: []*message.ColumnMetadata{
+			{Keyspace: "ks1", Table: "t1", Name: "[applied]", Type: datatype.Boolean},
+		}},
+		Rows: message.RowSet{{{0}}},
+	})
+	prepared := registry.Prepare("ks1", "INSERT INTO ks1.t1 (pk) VALUES (2)", primitive.ProtocolVersion4)
+	server, clientConn, cancelFn := createServerAndClient(t, client.NewBatchHandler(engine, nil).Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	// unprimed children are acknowledged
+	response := sendAndReceive(t, clientConn, frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{
+		Children: []*message.BatchChild{{QueryOrId: "INSERT INTO ks1.t1 (pk) VALUES (1)"}},
+	}))
+	assert.Equal(t, &message.VoidResult{}, response)
+
+	// primed errors are returned, whether the child is a query string or a prepared id
+	for _, child := range []*message.BatchChild{
+		{QueryOrId: "INSERT INTO ks1.t1 (pk) VALUES (2)"},
+		{QueryOrId: prepared.PreparedQueryId},
+	} {
+		response = sendAndReceive(t, clientConn, frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{
+			Children: []*message.BatchChild{{QueryOrId: "INSERT INTO ks1.t1 (pk) VALUES (1)"}, child},
+		}))
+		assert.Equal(t, &message.WriteTimeout{ErrorMessage: "timeout", Consistency: primitive.ConsistencyLevelQuorum, WriteType: primitive.WriteTypeBatch}, response)
+	}
+
+	// primed rows are returned when the child options match
+	response = sendAndReceive(t, clientConn, frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{
+		Children:    []*message.BatchChild{{QueryOrId: "UPDATE ks1.t1 SET v = 'a' WHERE pk = 3 IF v = 'b'"}},
+		Consistency: primitive.ConsistencyLevelSerial,
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	assert.Equal(t, [][]interface{}{{false}}, decodeRows(t, response.(*message.RowsResult)))
+	response = sendAndReceive(t, clientConn, frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Batch{
+		Children:    []*message.BatchChild{{QueryOrId: "UPDATE ks1.t1 SET v = 'a' WHERE pk = 3 IF v = 'b'"}},
+		Consistency: primitive.ConsistencyLevelOne,
+	}))
+	assert.Equal(t, &message.VoidResult{}, response)
+}
@@ -31,8 +31,9 @@ import (
 )
 
 const (
-	DefaultConnectTimeout = time.Second * 5
-	DefaultReadTimeout    = time.Second * 12
+	DefaultConnectTimeout   = time.Second * 5
+	DefaultReadTimeout      = time.Second * 12
+	DefaultHeartbeatTimeout = time.Second * 5
 )
 
 const (
@@ -46,6 +47,10 @@ const ManagedStreamId int16 = 0
 // event.
 type EventHandler func(event *frame.Frame, conn *CqlClientConnection)
 
+// A heartbeat failure handler is a callback function that gets invoked whenever a CqlClientConnection fails to
+// receive a response to a heartbeat in a timely manner. The connection is closed right after the handler returns.
+type HeartbeatFailureHandler func(err error, conn *CqlClientConnection)
+
 // CqlClient is a client for Cassandra-compatible backends. It is preferable to create CqlClient instances using the
 // constructor function NewCqlClient. Once the client is created and properly configured, use Connect or ConnectAndInit
 // to establish new connections to the server.
@@ -68,17 +73,26 @@ type CqlClient struct {
 	ReadTimeout time.Duration
 	// An optional list of handlers to handle incoming events.
 	EventHandlers []EventHandler
+	// The interval after which a heartbeat is sent on connections that neither sent nor received any frame. Heartbeats
+	// are OPTIONS requests sent with a managed stream id. Zero or negative disables heartbeats.
+	HeartbeatInterval time.Duration
+	// The timeout to apply when waiting for heartbeat responses. If no response is received in time, the connection is
+	// closed.
+	HeartbeatTimeout time.Duration
+	// An optional list of handlers to notify when a heartbeat fails.
+	HeartbeatFailureHandlers []HeartbeatFailureHandler
 }
 
 // Creates a new CqlClient with default options. Leave credentials nil to opt out from authentication.
 func NewCqlClient(remoteAddress string, credentials *AuthCredentials) *CqlClient {
 	return &CqlClient{
-		RemoteAddress:  remoteAddress,
-		Credentials:    credentials,
-		MaxInFlight:    DefaultMaxInFlight,
-		MaxPending:     DefaultMaxPending,
-		ConnectTimeout: DefaultConnectTimeout,
-		ReadTimeout:    DefaultReadTimeout,
+		RemoteAddress:    remoteAddress,
+		Credentials:      credentials,
+		MaxInFlight:      DefaultMaxInFlight,
+		MaxPending:       DefaultMaxPending,
+		ConnectTimeout:   DefaultConnectTimeout,
+		ReadTimeout:      DefaultReadTimeout,
+		HeartbeatTimeout: DefaultHeartbeatTimeout,
 	}
 }
 
@@ -93,7 +107,8 @@ func (client *CqlClient) String() string {
 func (client *CqlClient) Connect(ctx context.Context) (*CqlClientConnection, error) {
 	log.Debug().Msgf("%v: connecting", client)
 	dialer := net.Dialer{}
-	connectCtx, _ := context.WithTimeout(ctx, client.ConnectTimeout)
+	connectCtx, cancel := context.WithTimeout(ctx, client.ConnectTimeout)
+	defer cancel()
 	if conn, err := dialer.DialContext(connectCtx, "tcp", client.RemoteAddress); err != nil {
 		return nil, fmt.Errorf("%v: cannot establish TCP connection: %w", client, err)
 	} else {
@@ -106,6 +121,9 @@ func (client *CqlClient) Connect(ctx context.Context) (*CqlClientConnection, err
 			client.MaxPending,
 			client.ReadTimeout,
 			client.EventHandlers,
+			client.HeartbeatInterval,
+			client.HeartbeatTimeout,
+			client.HeartbeatFailureHandlers,
 		)
 		log.Info().Msgf("%v: new TCP connection established: %v", client, connection)
 		return connection, err
@@ -131,18 +149,23 @@ func (client *CqlClient) ConnectAndInit(
 // CqlClientConnection encapsulates a TCP client connection to a remote Cassandra-compatible backend.
 // CqlClientConnection instances should be created by calling CqlClient.Connect or CqlClient.ConnectAndInit.
 type CqlClientConnection struct {
-	conn            net.Conn
-	codec           frame.Codec
-	readTimeout     time.Duration
-	credentials     *AuthCredentials
-	handlers        []EventHandler
-	inFlightHandler *inFlightRequestsHandler
-	outgoing        chan *frame.Frame
-	events          chan *frame.Frame
-	waitGroup       *sync.WaitGroup
-	closed          int32
-	ctx             context.Context
-	cancel          context.CancelFunc
+	conn              net.Conn
+	codec             frame.Codec
+	readTimeout       time.Duration
+	credentials       *AuthCredentials
+	handlers          []EventHandler
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	heartbeatHandlers []HeartbeatFailureHandler
+	inFlightHandler   *inFlightRequestsHandler
+	outgoing          chan *frame.Frame
+	events            chan *frame.Frame
+	waitGroup         *sync.WaitGroup
+	closed            int32
+	lastActivity      int64  // unix nanos of the last frame sent or received; accessed atomically
+	version           uint32 // protocol version of the last frame sent; accessed atomically
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
 func newCqlClientConnection(
@@ -154,6 +177,9 @@ func newCqlClientConnection(
 	maxPending int,
 	readTimeout time.Duration,
 	handlers []EventHandler,
+	heartbeatInterval time.Duration,
+	heartbeatTimeout time.Duration,
+	heartbeatHandlers []HeartbeatFailureHandler,
 ) (*CqlClientConnection, error) {
 	if conn == nil {
 		return nil, fmt.Errorf("TCP connection cannot be nil")
@@ -173,19 +199,24 @@ func newCqlClientConnection(
 		codec = frame.NewCodec()
 	}
 	connection := &CqlClientConnection{
-		conn:        conn,
-		codec:       codec,
-		readTimeout: readTimeout,
-		credentials: credentials,
-		handlers:    handlers,
-		outgoing:    make(chan *frame.Frame, maxInFlight),
-		events:      make(chan *frame.Frame, maxInFlight),
-		waitGroup:   &sync.WaitGroup{},
+		conn:              conn,
+		codec:             codec,
+		readTimeout:       readTimeout,
+		credentials:       credentials,
+		handlers:          handlers,
+		heartbeatInterval: heartbeatInterval,
+		heartbeatTimeout:  heartbeatTimeout,
+		heartbeatHandlers: heartbeatHandlers,
+		outgoing:          make(chan *frame.Frame, maxInFlight),
+		events:            make(chan *frame.Frame, maxInFlight),
+		waitGroup:         &sync.WaitGroup{},
+		lastActivity:      time.Now().UnixNano(),
 	}
 	connection.ctx, connection.cancel = context.WithCancel(ctx)
 	connection.inFlightHandler = newInFlightRequestsHandler(connection.String(), connection.ctx, maxInFlight, maxPending, readTimeout)
 	connection.incomingLoop()
 	connection.outgoingLoop()
+	connection.heartbeatLoop()
 	connection.awaitDone()
 	return connection, nil
 }
@@ -230,6 +261,7 @@ func (c *CqlClientConnection) incomingLoop() {
 				break
 			} else {
 				log.Debug().Msgf("%v: received incoming frame: %v", c, incoming)
+				c.recordActivity()
 				if incoming.Header.OpCode == primitive.OpCodeEvent {
 					for _, handler := range c.handlers {
 						handler(incoming, c)
@@ -290,6 +322,7 @@ func (c *CqlClientConnection) outgoingLoop() {
 					break
 				} else {
 					log.Debug().Msgf("%v: outgoing frame successfully written: %v", c, outgoing)
+					c.recordActivity()
 				}
 			}
 		}
@@ -354,6 +387,21 @@ type InFlightRequest interface {
 // manually assigned ones, but it is not recommended to mix managed stream ids with non-managed ones on the same
 // connection.
 func (c *CqlClientConnection) Send(f *frame.Frame) (InFlightRequest, error) {
+	return c.SendContext(context.Background(), f)
+}
+
+// SendContext is like Send, but additionally binds the in-flight request to the given context: if the context deadline
+// is exceeded before the response is received, the in-flight request is closed with a RequestTimeoutError; if the
+// context is canceled, it is closed with an error wrapping context.Canceled. Requests closed this way are orphaned: if
+// they use managed stream ids, their stream ids will only be released when their late responses arrive. See
+// OrphanedCount. Note that the configured read timeout still applies.
+func (c *CqlClientConnection) SendContext(ctx context.Context, f *frame.Frame) (InFlightRequest, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("%v: context cannot be nil", c)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%v: request context done: %w", c, err)
+	}
 	if f == nil {
 		return nil, fmt.Errorf("%v: frame cannot be nil", c)
 	}
@@ -361,7 +409,8 @@ func (c *CqlClientConnection) Send(f *frame.Frame) (InFlightRequest, error) {
 		return nil, fmt.Errorf("%v: connection closed", c)
 	}
 	log.Debug().Msgf("%v: enqueuing outgoing frame: %v", c, f)
-	if inFlight, err := c.inFlightHandler.onOutgoingFrameEnqueued(f); err != nil {
+	atomic.StoreUint32(&c.version, uint32(f.Header.Version))
+	if inFlight, err := c.inFlightHandler.onOutgoingFrameEnqueued(ctx, f); err != nil {
 		return nil, fmt.Errorf("%v: failed to register in-flight handler for frame: %v: %w", c, f, err)
 	} else {
 		select {
@@ -398,13 +447,31 @@ func (c *CqlClientConnection) Receive(ch InFlightRequest) (*frame.Frame, error)
 
 // Convenience method chaining a call to Send to a call to Receive.
 func (c *CqlClientConnection) SendAndReceive(f *frame.Frame) (*frame.Frame, error) {
-	if ch, err := c.Send(f); err != nil {
+	return c.SendAndReceiveContext(context.Background(), f)
+}
+
+// Convenience method chaining a call to SendContext to a call to Receive. Use errors.As with a RequestTimeoutError to
+// determine whether the returned error is a timeout.
+func (c *CqlClientConnection) SendAndReceiveContext(ctx context.Context, f *frame.Frame) (*frame.Frame, error) {
+	if ch, err := c.SendContext(ctx, f); err != nil {
 		return nil, err
 	} else {
 		return c.Receive(ch)
 	}
 }
 
+// Returns the number of requests currently in-flight on this connection, including orphaned ones.
+func (c *CqlClientConnection) InFlightCount() int {
+	return c.inFlightHandler.inFlightCount()
+}
+
+// Returns the number of orphaned requests on this connection, that is, requests that were closed because of a timeout
+// or a cancellation while their responses haven't arrived yet. The stream ids of orphaned requests remain in use until
+// their late responses arrive.
+func (c *CqlClientConnection) OrphanedCount() int {
+	return c.inFlightHandler.orphanedCount()
+}
+
 // A receive-only channel for incoming events. A receive channel can be obtained through
 // CqlClientConnection.EventChannel.
 type EventChannel <-chan *frame.Frame
@@ -0,0 +1,110 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// A RequestHandler that replies to OPTIONS requests after the given delay.
+func newDelayedHeartbeatHandler(delay time.Duration) client.RequestHandler {
+	return func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		time.Sleep(delay)
+		return client.HeartbeatHandler(request, conn, ctx)
+	}
+}
+
+func TestCqlClientConnection_SendAndReceiveContext_Deadline(t *testing.T) {
+
+	server, clientConn, cancelFn := createServerAndClient(t, newDelayedHeartbeatHandler(500*time.Millisecond))
+
+	ctx, cancelRequest := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelRequest()
+	request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{})
+	response, err := clientConn.SendAndReceiveContext(ctx, request)
+	require.Nil(t, response)
+	require.NotNil(t, err)
+
+	var timeoutErr *client.RequestTimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	require.True(t, timeoutErr.DeadlineExceeded)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// stream id remains in use until the late response arrives
+	require.Equal(t, 1, clientConn.OrphanedCount())
+	assert.Eventually(t, func() bool { return clientConn.InFlightCount() == 0 }, time.Second*5, time.Millisecond*10)
+	require.Equal(t, 0, clientConn.OrphanedCount())
+	require.False(t, clientConn.IsClosed())
+
+	cancelFn()
+	checkClosed(t, clientConn, server)
+}
+
+func TestCqlClientConnection_SendAndReceiveContext_Canceled(t *testing.T) {
+
+	server, clientConn, cancelFn := createServerAndClient(t, newDelayedHeartbeatHandler(500*time.Millisecond))
+
+	ctx, cancelRequest := context.WithCancel(context.Background())
+	request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{})
+	inFlight, err := clientConn.SendContext(ctx, request)
+	require.Nil(t, err)
+	cancelRequest()
+	response, err := clientConn.Receive(inFlight)
+	require.Nil(t, response)
+	require.NotNil(t, err)
+
+	var timeoutErr *client.RequestTimeoutError
+	require.False(t, errors.As(err, &timeoutErr))
+	require.True(t, errors.Is(err, context.Canceled))
+
+	_, err = clientConn.SendContext(ctx, request)
+	require.True(t, errors.Is(err, context.Canceled))
+
+	cancelFn()
+	checkClosed(t, clientConn, server)
+}
+
+func TestCqlClientConnection_SendAndReceive_ReadTimeout(t *testing.T) {
+
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{newDelayedHeartbeatHandler(500 * time.Millisecond)}
+	clt := client.NewCqlClient("127.0.0.1:9043", nil)
+	clt.ReadTimeout = 50 * time.Millisecond
+	ctx, cancelFn := context.WithCancel(context.Background())
+	err := server.Start(ctx)
+	require.Nil(t, err)
+	clientConn, err := clt.Connect(ctx)
+	require.Nil(t, err)
+
+	request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{})
+	response, err := clientConn.SendAndReceive(request)
+	require.Nil(t, response)
+
+	var timeoutErr *client.RequestTimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	require.False(t, timeoutErr.DeadlineExceeded)
+
+	cancelFn()
+	checkClosed(t, clientConn, server)
+}
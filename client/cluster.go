@@ -0,0 +1,850 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ClusterStateNotStarted = int32(iota)
+	ClusterStateRunning    = int32(iota)
+	ClusterStateClosed     = int32(iota)
+)
+
+// Host holds the metadata of a node in the cluster, as discovered from the system.local and system.peers tables.
+// Host instances are immutable, except for their up / down state; when the metadata of a node changes, a new Host
+// instance is created.
+type Host struct {
+	// The native transport address of the host, in host:port format.
+	Address string
+	// The host id, or nil if unknown.
+	HostId *primitive.UUID
+	// The datacenter the host belongs to.
+	Datacenter string
+	// The rack the host belongs to.
+	Rack string
+	// The tokens owned by the host.
+	Tokens []string
+	// The Cassandra version of the host.
+	ReleaseVersion string
+
+	down int32
+}
+
+func (h *Host) String() string {
+	return fmt.Sprintf("host [%v]", h.Address)
+}
+
+// Returns true if the host is considered up, that is, if no DOWN event was received for it, or if it was marked
+// back up by an UP event.
+func (h *Host) IsUp() bool {
+	return atomic.LoadInt32(&h.down) == 0
+}
+
+func (h *Host) setUp(up bool) {
+	if up {
+		atomic.StoreInt32(&h.down, 0)
+	} else {
+		atomic.StoreInt32(&h.down, 1)
+	}
+}
+
+// ClusterClient is a cluster-aware client for Cassandra-compatible backends. It is preferable to create ClusterClient
+// instances using the constructor function NewClusterClient. Once the client is created and properly configured, use
+// Start to connect to the cluster.
+// The client opens a control connection to one of the contact points and discovers the cluster topology from the
+// system.local and system.peers tables (or system.peers_v2, if available). The control connection then registers for
+// TOPOLOGY_CHANGE and STATUS_CHANGE events to keep the topology up-to-date. The client maintains a ConnectionPool for
+// each host that is up.
+type ClusterClient struct {
+	// The contact points to use to open the control connection, in host:port format.
+	ContactPoints []string
+	// The AuthCredentials for authenticated servers. If nil, no authentication will be used.
+	Credentials *AuthCredentials
+	// The protocol version to use.
+	Version primitive.ProtocolVersion
+	// The number of connections to maintain to each host.
+	PoolSize int
+	// The timeout to apply when establishing new connections.
+	ConnectTimeout time.Duration
+	// The timeout to apply when waiting for incoming responses.
+	ReadTimeout time.Duration
+	// The heartbeat interval to apply to connections; see CqlClient.HeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// The delay to wait before the first reconnection attempt; see ConnectionPool.ReconnectBaseDelay. This delay also
+	// applies to reconnection attempts of the control connection. Must be strictly positive.
+	ReconnectBaseDelay time.Duration
+	// The maximum delay to wait between two reconnection attempts. Must be greater than or equal to ReconnectBaseDelay.
+	ReconnectMaxDelay time.Duration
+	// The LoadBalancingPolicy to use to route statements.
+	LoadBalancingPolicy LoadBalancingPolicy
+	// The RetryPolicy to consult when statement executions fail.
+	RetryPolicy RetryPolicy
+	// The SpeculativeExecutionPolicy to consult when executing idempotent statements.
+	SpeculativeExecutionPolicy SpeculativeExecutionPolicy
+	// The cache of prepared statements, shared by all connection pools. See ConnectionPool.PreparedCache.
+	PreparedCache *PreparedStatementCache
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	controlConn *CqlClientConnection
+	usePeersV2  bool
+	hosts       map[string]*Host
+	pools       map[string]*ConnectionPool
+	prepared    map[string]*message.VariablesMetadata
+	lock        *sync.RWMutex
+	waitGroup   *sync.WaitGroup
+	state       int32
+}
+
+// Creates a new ClusterClient with default options. Leave credentials nil to opt out from authentication.
+func NewClusterClient(contactPoints []string, credentials *AuthCredentials, version primitive.ProtocolVersion) *ClusterClient {
+	return &ClusterClient{
+		ContactPoints:              contactPoints,
+		Credentials:                credentials,
+		Version:                    version,
+		PoolSize:                   DefaultPoolSize,
+		ConnectTimeout:             DefaultConnectTimeout,
+		ReadTimeout:                DefaultReadTimeout,
+		ReconnectBaseDelay:         DefaultReconnectBaseDelay,
+		ReconnectMaxDelay:          DefaultReconnectMaxDelay,
+		LoadBalancingPolicy:        NewTokenAwarePolicy(NewRoundRobinPolicy()),
+		RetryPolicy:                NewDefaultRetryPolicy(),
+		SpeculativeExecutionPolicy: NewNoSpeculativeExecutionPolicy(),
+		PreparedCache:              NewPreparedStatementCache(),
+	}
+}
+
+func (c *ClusterClient) String() string {
+	return fmt.Sprintf("CQL cluster client %v", c.ContactPoints)
+}
+
+func (c *ClusterClient) IsNotStarted() bool {
+	return atomic.LoadInt32(&c.state) == ClusterStateNotStarted
+}
+
+func (c *ClusterClient) IsRunning() bool {
+	return atomic.LoadInt32(&c.state) == ClusterStateRunning
+}
+
+func (c *ClusterClient) IsClosed() bool {
+	return atomic.LoadInt32(&c.state) == ClusterStateClosed
+}
+
+// Starts the client: opens the control connection, discovers the cluster topology and opens a connection pool to
+// each host that is up. Set ctx to context.Background if no parent context exists.
+func (c *ClusterClient) Start(ctx context.Context) error {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+	if len(c.ContactPoints) == 0 {
+		return fmt.Errorf("%v: no contact points provided", c)
+	}
+	if c.ReconnectBaseDelay <= 0 {
+		return fmt.Errorf("%v: reconnect base delay: expecting positive, got: %v", c, c.ReconnectBaseDelay)
+	}
+	if c.ReconnectMaxDelay < c.ReconnectBaseDelay {
+		return fmt.Errorf("%v: reconnect max delay: expecting at least %v, got: %v", c, c.ReconnectBaseDelay, c.ReconnectMaxDelay)
+	}
+	if !atomic.CompareAndSwapInt32(&c.state, ClusterStateNotStarted, ClusterStateRunning) {
+		log.Debug().Msgf("%v: already started or closed", c)
+		return nil
+	}
+	log.Debug().Msgf("%v: cluster client is starting", c)
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.lock = &sync.RWMutex{}
+	c.waitGroup = &sync.WaitGroup{}
+	c.hosts = make(map[string]*Host)
+	c.pools = make(map[string]*ConnectionPool)
+	c.prepared = make(map[string]*message.VariablesMetadata)
+	c.usePeersV2 = true
+	c.awaitDone()
+	if err := c.connectControl(c.ContactPoints); err != nil {
+		_ = c.Close()
+		return fmt.Errorf("%v: start failed: %w", c, err)
+	}
+	c.controlLoop()
+	log.Info().Msgf("%v: successfully started with %d hosts", c, len(c.Hosts()))
+	return nil
+}
+
+// Closes the client, its control connection and all its connection pools.
+func (c *ClusterClient) Close() (err error) {
+	if atomic.CompareAndSwapInt32(&c.state, ClusterStateRunning, ClusterStateClosed) {
+		log.Debug().Msgf("%v: closing", c)
+		c.cancel()
+		c.lock.Lock()
+		controlConn := c.controlConn
+		pools := c.pools
+		c.controlConn = nil
+		c.pools = make(map[string]*ConnectionPool)
+		c.lock.Unlock()
+		if controlConn != nil {
+			if closeErr := controlConn.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+		for _, pool := range pools {
+			if closeErr := pool.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+		c.waitGroup.Wait()
+		log.Info().Msgf("%v: successfully closed", c)
+	} else {
+		log.Debug().Msgf("%v: not started or already closed", c)
+	}
+	return err
+}
+
+// Returns all the known hosts, sorted by address.
+func (c *ClusterClient) Hosts() []*Host {
+	if c.IsNotStarted() {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	hosts := make([]*Host, 0, len(c.hosts))
+	for _, host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Address < hosts[j].Address })
+	return hosts
+}
+
+// Returns the host with the given address, or nil if no such host is known.
+func (c *ClusterClient) Host(address string) *Host {
+	if c.IsNotStarted() {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.hosts[address]
+}
+
+// Returns the connection pool for the given host, or nil if the host is unknown or down.
+func (c *ClusterClient) Pool(host *Host) *ConnectionPool {
+	if c.IsNotStarted() {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.pools[host.Address]
+}
+
+// Returns the current control connection, or nil if the control connection is being re-established.
+func (c *ClusterClient) ControlConnection() *CqlClientConnection {
+	if c.IsNotStarted() {
+		return nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.controlConn
+}
+
+// ExecutionInfo holds information about a statement execution, see ClusterClient.ExecuteWithInfo.
+type ExecutionInfo struct {
+	// The host that produced the response, or nil if no host could be contacted.
+	Coordinator *Host
+	// The index of the execution that produced the response: zero for the initial execution, 1 for the first
+	// speculative execution, and so on.
+	ExecutionIndex int
+	// The number of speculative executions that were started.
+	SpeculativeExecutions int
+	// The number of retries performed by the execution that produced the response.
+	RetryCount int
+}
+
+// Executes the given statement and waits for its response. See ExecuteWithInfo.
+func (c *ClusterClient) Execute(ctx context.Context, statement *Statement) (*frame.Frame, error) {
+	response, _, err := c.ExecuteWithInfo(ctx, statement)
+	return response, err
+}
+
+// Sends the given request frame as a non-idempotent statement and waits for its response. See Execute.
+func (c *ClusterClient) SendAndReceiveContext(ctx context.Context, f *frame.Frame) (*frame.Frame, error) {
+	return c.Execute(ctx, &Statement{Frame: f})
+}
+
+// Executes the given statement and waits for its response, then returns the response along with information about
+// the execution.
+// The hosts to contact are chosen by the LoadBalancingPolicy. When the request fails, or when the coordinator replies
+// with an error that can be retried, the RetryPolicy decides whether the statement should be retried, and where. Error
+// responses that are not retried are returned as regular response frames.
+// If the statement is idempotent, the SpeculativeExecutionPolicy may start speculative executions on the next hosts
+// of the query plan; the first execution to produce a response wins and the other executions are canceled. The
+// stream ids of canceled requests are released when their late responses arrive.
+// The variables metadata of PREPARED results are recorded in order to compute the routing key of subsequent EXECUTE
+// requests.
+func (c *ClusterClient) ExecuteWithInfo(ctx context.Context, statement *Statement) (*frame.Frame, *ExecutionInfo, error) {
+	if !c.IsRunning() {
+		return nil, nil, fmt.Errorf("%v: not running", c)
+	}
+	if statement.RoutingKey == nil {
+		if routingKey := c.routingKey(statement.Frame); routingKey != nil {
+			// the caller's statement is left untouched, since it may be reused or executed concurrently
+			routed := *statement
+			routed.RoutingKey = routingKey
+			statement = &routed
+		}
+	}
+	plan := &queryPlan{hosts: c.LoadBalancingPolicy.NewQueryPlan(statement, c.Hosts())}
+	executionsCtx, cancel := context.WithCancel(ctx)
+	// cancels losing executions
+	defer cancel()
+	results := make(chan *executionResult, len(plan.hosts)+1)
+	started := 0
+	startExecution := func() {
+		index := started
+		started++
+		go func() {
+			results <- c.execute(executionsCtx, statement, plan, index)
+		}()
+	}
+	var nextExecution <-chan time.Time
+	scheduleNextExecution := func() {
+		nextExecution = nil
+		if statement.Idempotent {
+			if delay := c.SpeculativeExecutionPolicy.NextExecution(statement, started); delay >= 0 {
+				nextExecution = time.After(delay)
+			}
+		}
+	}
+	startExecution()
+	scheduleNextExecution()
+	var last *executionResult
+	for running := 1; running > 0; {
+		select {
+		case result := <-results:
+			running--
+			last = result
+			if result.err == nil {
+				return result.response, c.newExecutionInfo(result, started), nil
+			}
+		case <-nextExecution:
+			if plan.exhausted() {
+				nextExecution = nil
+			} else {
+				log.Debug().Msgf("%v: starting speculative execution %d", c, started)
+				startExecution()
+				running++
+				scheduleNextExecution()
+			}
+		}
+	}
+	return nil, c.newExecutionInfo(last, started), last.err
+}
+
+func (c *ClusterClient) newExecutionInfo(result *executionResult, started int) *ExecutionInfo {
+	return &ExecutionInfo{
+		Coordinator:           result.host,
+		ExecutionIndex:        result.index,
+		SpeculativeExecutions: started - 1,
+		RetryCount:            result.retryCount,
+	}
+}
+
+// A query plan shared by all the executions of a statement.
+type queryPlan struct {
+	hosts []*Host
+	index int32
+}
+
+// Returns the next host in the plan, or nil if the plan is exhausted.
+func (p *queryPlan) next() *Host {
+	if i := int(atomic.AddInt32(&p.index, 1)) - 1; i < len(p.hosts) {
+		return p.hosts[i]
+	}
+	return nil
+}
+
+func (p *queryPlan) exhausted() bool {
+	return int(atomic.LoadInt32(&p.index)) >= len(p.hosts)
+}
+
+type executionResult struct {
+	response   *frame.Frame
+	err        error
+	host       *Host
+	index      int
+	retryCount int
+}
+
+// Performs one execution of the given statement, retrying it according to the RetryPolicy. Executions return either a
+// response frame, possibly an error response, or an error.
+func (c *ClusterClient) execute(ctx context.Context, statement *Statement, plan *queryPlan, index int) *executionResult {
+	result := &executionResult{index: index}
+	var lastErr error
+	host := plan.next()
+	for host != nil {
+		pool := c.Pool(host)
+		if pool == nil {
+			host = plan.next()
+			continue
+		}
+		result.host = host
+		var decision RetryDecision
+		start := time.Now()
+		response, err := pool.SendAndReceiveContext(ctx, copyRequest(statement.Frame))
+		if err != nil {
+			if ctx.Err() != nil {
+				result.err = err
+				return result
+			}
+			decision = c.RetryPolicy.OnConnectionError(statement, err, result.retryCount)
+			lastErr = err
+			result.response = nil
+		} else {
+			if tracker, ok := c.SpeculativeExecutionPolicy.(LatencyTracker); ok {
+				tracker.Update(host, time.Since(start))
+			}
+			e, isError := response.Body.Message.(message.Error)
+			if !isError {
+				if prepared, ok := response.Body.Message.(*message.PreparedResult); ok {
+					c.lock.Lock()
+					c.prepared[string(prepared.PreparedQueryId)] = prepared.VariablesMetadata
+					c.lock.Unlock()
+				}
+				result.response = response
+				return result
+			}
+			decision = retryDecisionForError(c.RetryPolicy, statement, e, result.retryCount)
+			lastErr = nil
+			result.response = response
+		}
+		log.Debug().Err(err).Msgf("%v: execution %d failed on %v, retry decision: %v", c, index, host, decision)
+		switch decision {
+		case RetryDecisionRetrySame:
+			result.retryCount++
+		case RetryDecisionRetryNext:
+			result.retryCount++
+			host = plan.next()
+		case RetryDecisionIgnore:
+			result.response = frame.NewFrame(statement.Frame.Header.Version, statement.Frame.Header.StreamId, &message.VoidResult{})
+			return result
+		default:
+			result.err = lastErr
+			return result
+		}
+	}
+	if result.response == nil {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no host available")
+		}
+		result.err = fmt.Errorf("%v: could not execute statement: %w", c, lastErr)
+	}
+	return result
+}
+
+// Returns a shallow copy of the given request frame with its own header, since the stream id is assigned when the
+// request is sent, and the same request may be sent more than once.
+func copyRequest(f *frame.Frame) *frame.Frame {
+	header := *f.Header
+	return &frame.Frame{Header: &header, Body: f.Body}
+}
+
+// Computes the routing key of EXECUTE requests, from the partition key indices of the prepared statement.
+func (c *ClusterClient) routingKey(f *frame.Frame) []byte {
+	execute, ok := f.Body.Message.(*message.Execute)
+	if !ok || execute.Options == nil {
+		return nil
+	}
+	c.lock.RLock()
+	variables := c.prepared[string(execute.QueryId)]
+	c.lock.RUnlock()
+	if variables == nil || len(variables.PkIndices) == 0 {
+		return nil
+	}
+	var components [][]byte
+	for _, index := range variables.PkIndices {
+		if int(index) >= len(execute.Options.PositionalValues) {
+			return nil
+		}
+		value := execute.Options.PositionalValues[index]
+		if value == nil || value.Type != primitive.ValueTypeRegular {
+			return nil
+		}
+		components = append(components, value.Contents)
+	}
+	return NewRoutingKey(components...)
+}
+
+func (c *ClusterClient) newCqlClient(address string) *CqlClient {
+	client := NewCqlClient(address, c.Credentials)
+	client.ConnectTimeout = c.ConnectTimeout
+	client.ReadTimeout = c.ReadTimeout
+	client.HeartbeatInterval = c.HeartbeatInterval
+	return client
+}
+
+// Opens the control connection to the first reachable address among the given ones, then registers for events and
+// refreshes the topology.
+func (c *ClusterClient) connectControl(addresses []string) (err error) {
+	for _, address := range addresses {
+		var conn *CqlClientConnection
+		if conn, err = c.newCqlClient(address).ConnectAndInit(c.ctx, c.Version, ManagedStreamId); err != nil {
+			log.Debug().Err(err).Msgf("%v: could not open control connection to %v", c, address)
+			continue
+		}
+		if err = c.initControl(conn); err != nil {
+			log.Debug().Err(err).Msgf("%v: could not initialize control connection to %v", c, address)
+			_ = conn.Close()
+			continue
+		}
+		log.Info().Msgf("%v: control connection established: %v", c, conn)
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no address to connect to")
+	}
+	return fmt.Errorf("%v: could not open control connection: %w", c, err)
+}
+
+func (c *ClusterClient) initControl(conn *CqlClientConnection) error {
+	register := frame.NewFrame(c.Version, ManagedStreamId, &message.Register{
+		EventTypes: []primitive.EventType{primitive.EventTypeTopologyChange, primitive.EventTypeStatusChange},
+	})
+	if response, err := conn.SendAndReceiveContext(c.ctx, register); err != nil {
+		return err
+	} else if _, ok := response.Body.Message.(*message.Ready); !ok {
+		return fmt.Errorf("expected READY in response to REGISTER, got: %v", response.Body.Message)
+	}
+	c.lock.Lock()
+	if !c.IsRunning() {
+		c.lock.Unlock()
+		return fmt.Errorf("%v: not running", c)
+	}
+	c.controlConn = conn
+	c.lock.Unlock()
+	return c.refreshTopology()
+}
+
+// Listens for events on the control connection, and re-establishes the control connection when it gets closed.
+func (c *ClusterClient) controlLoop() {
+	c.waitGroup.Add(1)
+	go func() {
+		defer c.waitGroup.Done()
+		for c.IsRunning() {
+			conn := c.ControlConnection()
+			if conn == nil {
+				return
+			}
+			events := conn.EventChannel()
+		listen:
+			for {
+				select {
+				case event, ok := <-events:
+					if !ok {
+						break listen
+					}
+					c.onEvent(event)
+				case <-conn.ctx.Done():
+					break listen
+				case <-c.ctx.Done():
+					return
+				}
+			}
+			if c.IsRunning() {
+				log.Warn().Msgf("%v: control connection %v was closed, reconnecting", c, conn)
+				c.reconnectControl()
+			}
+		}
+	}()
+}
+
+func (c *ClusterClient) reconnectControl() {
+	delay := c.ReconnectBaseDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return
+		}
+		var addresses []string
+		for _, host := range c.Hosts() {
+			if host.IsUp() {
+				addresses = append(addresses, host.Address)
+			}
+		}
+		addresses = append(addresses, c.ContactPoints...)
+		if err := c.connectControl(addresses); err != nil {
+			log.Debug().Err(err).Msgf("%v: reconnection attempt %d for control connection failed", c, attempt)
+			if delay *= 2; delay > c.ReconnectMaxDelay {
+				delay = c.ReconnectMaxDelay
+			}
+		} else {
+			return
+		}
+	}
+}
+
+func (c *ClusterClient) onEvent(event *frame.Frame) {
+	log.Debug().Msgf("%v: received event: %v", c, event.Body.Message)
+	switch e := event.Body.Message.(type) {
+	case *message.TopologyChangeEvent:
+		if err := c.refreshTopology(); err != nil {
+			log.Error().Err(err).Msgf("%v: could not refresh topology after event: %v", c, e)
+		}
+	case *message.StatusChangeEvent:
+		address := net.JoinHostPort(e.Address.Addr.String(), strconv.Itoa(int(e.Address.Port)))
+		if host := c.Host(address); host == nil {
+			if err := c.refreshTopology(); err != nil {
+				log.Error().Err(err).Msgf("%v: could not refresh topology after event: %v", c, e)
+			}
+		} else if e.ChangeType == primitive.StatusChangeTypeUp {
+			log.Info().Msgf("%v: %v is up", c, host)
+			host.setUp(true)
+			c.openPool(host)
+		} else if e.ChangeType == primitive.StatusChangeTypeDown {
+			log.Info().Msgf("%v: %v is down", c, host)
+			host.setUp(false)
+			c.closePool(host.Address)
+		}
+	}
+}
+
+// Queries the system tables on the control connection, then updates the known hosts and their pools.
+func (c *ClusterClient) refreshTopology() error {
+	conn := c.ControlConnection()
+	if conn == nil {
+		return fmt.Errorf("%v: no control connection", c)
+	}
+	local, err := c.querySystemTable(conn, "SELECT * FROM system.local WHERE key = 'local'")
+	if err != nil {
+		return fmt.Errorf("%v: could not query system.local: %w", c, err)
+	} else if len(local) != 1 {
+		return fmt.Errorf("%v: expected 1 row from system.local, got: %d", c, len(local))
+	}
+	var peers []systemRow
+	if c.usePeersV2 {
+		if peers, err = c.querySystemTable(conn, "SELECT * FROM system.peers_v2"); err != nil {
+			log.Debug().Err(err).Msgf("%v: system.peers_v2 not available, falling back to system.peers", c)
+			c.usePeersV2 = false
+		}
+	}
+	if !c.usePeersV2 {
+		if peers, err = c.querySystemTable(conn, "SELECT * FROM system.peers"); err != nil {
+			return fmt.Errorf("%v: could not query system.peers: %w", c, err)
+		}
+	}
+	_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	hosts := map[string]*Host{}
+	localHost := local[0].toHost(conn.RemoteAddr().String())
+	hosts[localHost.Address] = localHost
+	for _, peer := range peers {
+		if address := peer.peerAddress(port); address == "" {
+			log.Warn().Msgf("%v: ignoring peer with no address", c)
+		} else {
+			hosts[address] = peer.toHost(address)
+		}
+	}
+	c.updateHosts(hosts)
+	return nil
+}
+
+func (c *ClusterClient) updateHosts(hosts map[string]*Host) {
+	var added []*Host
+	var removed []string
+	c.lock.Lock()
+	for address, host := range hosts {
+		if old, found := c.hosts[address]; found {
+			host.setUp(old.IsUp())
+		} else {
+			added = append(added, host)
+		}
+	}
+	for address := range c.hosts {
+		if _, found := hosts[address]; !found {
+			removed = append(removed, address)
+		}
+	}
+	c.hosts = hosts
+	c.lock.Unlock()
+	for _, address := range removed {
+		log.Info().Msgf("%v: host removed: %v", c, address)
+		c.closePool(address)
+	}
+	for _, host := range added {
+		log.Info().Msgf("%v: host added: %v", c, host)
+		c.openPool(host)
+	}
+}
+
+func (c *ClusterClient) openPool(host *Host) {
+	if c.Pool(host) != nil {
+		return
+	}
+	pool := NewConnectionPool(c.newCqlClient(host.Address), c.Version)
+	pool.Size = c.PoolSize
+	pool.ReconnectBaseDelay = c.ReconnectBaseDelay
+	pool.ReconnectMaxDelay = c.ReconnectMaxDelay
+	pool.PreparedCache = c.PreparedCache
+	if err := pool.Start(c.ctx); err != nil {
+		log.Warn().Err(err).Msgf("%v: could not open pool to %v, marking it down", c, host)
+		host.setUp(false)
+		return
+	}
+	c.lock.Lock()
+	if !c.IsRunning() {
+		c.lock.Unlock()
+		_ = pool.Close()
+		return
+	}
+	c.pools[host.Address] = pool
+	c.lock.Unlock()
+}
+
+func (c *ClusterClient) closePool(address string) {
+	c.lock.Lock()
+	pool := c.pools[address]
+	delete(c.pools, address)
+	c.lock.Unlock()
+	if pool != nil {
+		if err := pool.Close(); err != nil {
+			log.Error().Err(err).Msgf("%v: error closing pool to %v", c, address)
+		}
+	}
+}
+
+func (c *ClusterClient) awaitDone() {
+	c.waitGroup.Add(1)
+	go func() {
+		<-c.ctx.Done()
+		log.Debug().Err(c.ctx.Err()).Msgf("%v: context was closed", c)
+		c.waitGroup.Done()
+		if err := c.Close(); err != nil {
+			log.Error().Err(err).Msgf("%v: error closing", c)
+		}
+	}()
+}
+
+func (c *ClusterClient) querySystemTable(conn *CqlClientConnection, query string) ([]systemRow, error) {
+	request := frame.NewFrame(c.Version, ManagedStreamId, &message.Query{Query: query})
+	response, err := conn.SendAndReceiveContext(c.ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := response.Body.Message.(*message.RowsResult)
+	if !ok {
+		return nil, fmt.Errorf("expected ROWS result, got: %v", response.Body.Message)
+	}
+	columns := map[string]int{}
+	if rows.Metadata != nil {
+		for i, column := range rows.Metadata.Columns {
+			columns[column.Name] = i
+		}
+	}
+	result := make([]systemRow, len(rows.Data))
+	for i, row := range rows.Data {
+		result[i] = systemRow{columns: columns, row: row, version: c.Version}
+	}
+	return result, nil
+}
+
+// A row from a system table, with helper methods to decode its columns by name.
+type systemRow struct {
+	columns map[string]int
+	row     message.Row
+	version primitive.ProtocolVersion
+}
+
+func (r systemRow) decode(name string, codec datatype.Codec) interface{} {
+	if i, found := r.columns[name]; !found || i >= len(r.row) {
+		return nil
+	} else if value, err := codec.Decode(r.row[i], r.version); err != nil {
+		log.Warn().Err(err).Msgf("could not decode system table column %v", name)
+		return nil
+	} else {
+		return value
+	}
+}
+
+func (r systemRow) getString(name string) string {
+	value, _ := r.decode(name, &datatype.VarcharCodec{}).(string)
+	return value
+}
+
+func (r systemRow) getInet(name string) net.IP {
+	value, _ := r.decode(name, &datatype.InetCodec{}).(net.IP)
+	return value
+}
+
+func (r systemRow) getUuid(name string) *primitive.UUID {
+	if value, ok := r.decode(name, &datatype.UuidCodec{}).(primitive.UUID); ok {
+		return &value
+	}
+	return nil
+}
+
+func (r systemRow) getInt(name string) (int32, bool) {
+	value, ok := r.decode(name, &datatype.IntCodec{}).(int32)
+	return value, ok
+}
+
+func (r systemRow) getStringSet(name string) []string {
+	elements, _ := r.decode(name, datatype.NewSetCodec(&datatype.VarcharCodec{})).([]interface{})
+	var values []string
+	for _, element := range elements {
+		if value, ok := element.(string); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Returns the native transport address of a peer, in host:port format. The address is read from the native_address
+// and native_port columns in system.peers_v2; in system.peers, the address is read from rpc_address (or peer, if
+// rpc_address is a wildcard address), and the port defaults to the given one.
+func (r systemRow) peerAddress(defaultPort string) string {
+	addr := r.getInet("native_address")
+	port := defaultPort
+	if nativePort, ok := r.getInt("native_port"); ok {
+		port = strconv.Itoa(int(nativePort))
+	}
+	if addr == nil {
+		addr = r.getInet("rpc_address")
+	}
+	if addr == nil || addr.IsUnspecified() {
+		addr = r.getInet("peer")
+	}
+	if addr == nil {
+		return ""
+	}
+	return net.JoinHostPort(addr.String(), port)
+}
+
+func (r systemRow) toHost(address string) *Host {
+	return &Host{
+		Address:        address,
+		HostId:         r.getUuid("host_id"),
+		Datacenter:     r.getString("data_center"),
+		Rack:           r.getString("rack"),
+		Tokens:         r.getStringSet("tokens"),
+		ReleaseVersion: r.getString("release_version"),
+	}
+}
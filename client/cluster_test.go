@@ -0,0 +1,228 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	ip     string
+	rack   string
+	token  string
+	hostId string
+}
+
+// A fake cluster topology, served by a RequestHandler answering queries to system.local and system.peers.
+type testTopology struct {
+	nodes []testNode
+	lock  sync.Mutex
+}
+
+func (topology *testTopology) remove(ip string) {
+	topology.lock.Lock()
+	defer topology.lock.Unlock()
+	for i, node := range topology.nodes {
+		if node.ip == ip {
+			topology.nodes = append(topology.nodes[:i], topology.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (topology *testTopology) handler(request *frame.Frame, conn *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+	query, ok := request.Body.Message.(*message.Query)
+	if !ok {
+		return nil
+	}
+	q := strings.ToLower(query.Query)
+	if strings.Contains(q, "system.peers_v2") {
+		// emulate a Cassandra 3.x node
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Invalid{ErrorMessage: "unconfigured table peers_v2"})
+	}
+	local := strings.Contains(q, "system.local")
+	if !local && !strings.Contains(q, "system.peers") {
+		return nil
+	}
+	localIp := conn.LocalAddr().(*net.TCPAddr).IP.String()
+	addressColumn := "peer"
+	if local {
+		addressColumn = "broadcast_address"
+	}
+	columns := []*message.ColumnMetadata{
+		{Keyspace: "system", Table: "local", Name: addressColumn, Type: datatype.Inet},
+		{Keyspace: "system", Table: "local", Name: "rpc_address", Type: datatype.Inet},
+		{Keyspace: "system", Table: "local", Name: "data_center", Type: datatype.Varchar},
+		{Keyspace: "system", Table: "local", Name: "rack", Type: datatype.Varchar},
+		{Keyspace: "system", Table: "local", Name: "host_id", Type: datatype.Uuid},
+		{Keyspace: "system", Table: "local", Name: "release_version", Type: datatype.Varchar},
+		{Keyspace: "system", Table: "local", Name: "tokens", Type: datatype.NewSetType(datatype.Varchar)},
+	}
+	rows := message.RowSet{}
+	topology.lock.Lock()
+	for _, node := range topology.nodes {
+		if (node.ip == localIp) == local {
+			ip, _ := (&datatype.InetCodec{}).Encode(net.ParseIP(node.ip), request.Header.Version)
+			hostId, _ := (&datatype.UuidCodec{}).Encode(node.hostId, request.Header.Version)
+			tokens, _ := datatype.NewSetCodec(&datatype.VarcharCodec{}).Encode([]string{node.token}, request.Header.Version)
+			rows = append(rows, message.Row{ip, ip, []byte("dc1"), []byte(node.rack), hostId, []byte("3.11.9"), tokens})
+		}
+	}
+	topology.lock.Unlock()
+	return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.RowsResult{
+		Metadata: &message.RowsMetadata{ColumnCount: int32(len(columns)), Columns: columns},
+		Data:     rows,
+	})
+}
+
+// Returns a topology of 3 nodes in the same datacenter, listening on 127.0.0.1, 127.0.0.2 and 127.0.0.3.
+func newTestTopology() *testTopology {
+	return &testTopology{nodes: []testNode{
+		{"127.0.0.1", "rack1", "-9223372036854775808", "c0d1d21e-bb01-4196-86db-bc317bc1796a"},
+		{"127.0.0.2", "rack2", "-3074457345618258603", "c0d1d21e-bb01-4196-86db-bc317bc1796b"},
+		{"127.0.0.3", "rack3", "3074457345618258602", "c0d1d21e-bb01-4196-86db-bc317bc1796c"},
+	}}
+}
+
+// Starts one CqlServer per node in the given topology. Servers handle handshakes, heartbeats and queries to system
+// tables; the given handlers are invoked before the system tables handler.
+func startTestCluster(t *testing.T, ctx context.Context, topology *testTopology, handlers ...client.RequestHandler) []*client.CqlServer {
+	var servers []*client.CqlServer
+	for _, node := range topology.nodes {
+		server := client.NewCqlServer(node.ip+":9043", nil)
+		server.RequestHandlers = append([]client.RequestHandler{client.HandshakeHandler, client.HeartbeatHandler}, handlers...)
+		server.RequestHandlers = append(server.RequestHandlers, client.RegisterHandler, topology.handler)
+		err := server.Start(ctx)
+		require.Nil(t, err)
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func TestClusterClient(t *testing.T) {
+
+	topology := newTestTopology()
+
+	// server connections that received a REGISTER request, i.e. control connections
+	registered := make(chan *client.CqlServerConnection, 10)
+	registerHandler := func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		response := client.RegisterHandler(request, conn, ctx)
+		if response != nil {
+			registered <- conn
+		}
+		return response
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	servers := startTestCluster(t, ctx, topology, registerHandler)
+
+	cluster := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+	cluster.PoolSize = 1
+	cluster.ReconnectBaseDelay = 10 * time.Millisecond
+	err := cluster.Start(ctx)
+	require.Nil(t, err)
+
+	// topology discovery
+	hosts := cluster.Hosts()
+	require.Len(t, hosts, 3)
+	for i, host := range hosts {
+		node := topology.nodes[i]
+		require.Equal(t, node.ip+":9043", host.Address)
+		require.Equal(t, "dc1", host.Datacenter)
+		require.Equal(t, node.rack, host.Rack)
+		require.Equal(t, []string{node.token}, host.Tokens)
+		require.Equal(t, node.hostId, host.HostId.String())
+		require.Equal(t, "3.11.9", host.ReleaseVersion)
+		require.True(t, host.IsUp())
+		require.NotNil(t, cluster.Pool(host))
+		require.Len(t, cluster.Pool(host).Connections(), 1)
+	}
+
+	controlConn := <-registered
+	host3 := cluster.Host("127.0.0.3:9043")
+	address3 := &primitive.Inet{Addr: net.ParseIP("127.0.0.3"), Port: 9043}
+
+	// status changes
+	err = controlConn.Send(frame.NewFrame(primitive.ProtocolVersion4, -1,
+		&message.StatusChangeEvent{ChangeType: primitive.StatusChangeTypeDown, Address: address3}))
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return !host3.IsUp() && cluster.Pool(host3) == nil }, time.Second*10, time.Millisecond*10)
+
+	err = controlConn.Send(frame.NewFrame(primitive.ProtocolVersion4, -1,
+		&message.StatusChangeEvent{ChangeType: primitive.StatusChangeTypeUp, Address: address3}))
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return host3.IsUp() && cluster.Pool(host3) != nil }, time.Second*10, time.Millisecond*10)
+
+	// topology changes
+	topology.remove("127.0.0.3")
+	err = controlConn.Send(frame.NewFrame(primitive.ProtocolVersion4, -1,
+		&message.TopologyChangeEvent{ChangeType: primitive.TopologyChangeTypeRemovedNode, Address: address3}))
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(cluster.Hosts()) == 2 && cluster.Pool(host3) == nil }, time.Second*10, time.Millisecond*10)
+
+	// control connection is re-established when closed
+	clientControlConn := cluster.ControlConnection()
+	require.Nil(t, controlConn.Close())
+	select {
+	case <-registered:
+	case <-time.After(time.Second * 10):
+		require.Fail(t, "control connection not re-established")
+	}
+	assert.Eventually(t, func() bool {
+		newControlConn := cluster.ControlConnection()
+		return newControlConn != nil && newControlConn != clientControlConn
+	}, time.Second*10, time.Millisecond*10)
+
+	cancelFn()
+
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+	for _, server := range servers {
+		assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+	}
+}
+
+func TestClusterClient_Start_Invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseDelay time.Duration
+		maxDelay  time.Duration
+	}{
+		{"zero base delay", 0, client.DefaultReconnectMaxDelay},
+		{"negative base delay", -time.Second, client.DefaultReconnectMaxDelay},
+		{"max delay less than base delay", time.Second, time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+			cluster.ReconnectBaseDelay = tt.baseDelay
+			cluster.ReconnectMaxDelay = tt.maxDelay
+			assert.Error(t, cluster.Start(context.Background()))
+			assert.False(t, cluster.IsRunning())
+		})
+	}
+}
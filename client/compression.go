@@ -0,0 +1,133 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"io"
+	"strings"
+	"sync"
+)
+
+const compressionOption = "COMPRESSION"
+
+// Enables compression on this connection with the given algorithm, as requested by the client in its STARTUP
+// request; the algorithm is matched case-insensitively against the compressors supported by the connection (see
+// SupportedCompressors). An empty algorithm disables compression. Once compression is enabled, all outgoing frames
+// are compressed, except those that the protocol specs require to remain uncompressed, such as READY. Returns an
+// error if the algorithm is not supported.
+// HandshakeHandler and AcceptHandshake call this method automatically.
+func (c *CqlServerConnection) EnableCompression(algorithm string) error {
+	if algorithm == "" {
+		c.compression.set(nil)
+		return nil
+	}
+	for _, compressor := range c.SupportedCompressors() {
+		if strings.EqualFold(compressor.Algorithm(), algorithm) {
+			c.compression.set(compressor)
+			log.Debug().Msgf("%v: compression enabled: %v", c, compressor.Algorithm())
+			return nil
+		}
+	}
+	return fmt.Errorf("%v: unknown compression algorithm: %v", c, algorithm)
+}
+
+// Returns the compression algorithm enabled on this connection, or an empty string if compression is not enabled.
+func (c *CqlServerConnection) Compression() string {
+	if compressor := c.compression.get(); compressor != nil {
+		return compressor.Algorithm()
+	}
+	return ""
+}
+
+// Returns the compressors supported by this connection. When the server uses its default codec, these are the
+// compressors configured with CqlServer.Compressors. When the server was configured with a custom codec, the only
+// supported compressor is the codec body compressor, if any.
+func (c *CqlServerConnection) SupportedCompressors() []frame.BodyCompressor {
+	if c.compressors != nil {
+		return c.compressors
+	} else if compressor := c.codec.GetBodyCompressor(); compressor != nil && compressor != &c.compression {
+		return []frame.BodyCompressor{compressor}
+	}
+	return nil
+}
+
+// Returns the options to advertise in SUPPORTED responses: the supported compression algorithms, in lower case, as
+// Cassandra does. Returns nil if no compression algorithm is supported.
+func (c *CqlServerConnection) SupportedOptions() map[string][]string {
+	compressors := c.SupportedCompressors()
+	if len(compressors) == 0 {
+		return nil
+	}
+	algorithms := make([]string, len(compressors))
+	for i, compressor := range compressors {
+		algorithms[i] = strings.ToLower(compressor.Algorithm())
+	}
+	return map[string][]string{compressionOption: algorithms}
+}
+
+// Returns a copy of the given outgoing frame with the compression flag set, if compression is enabled and the frame
+// is compressible; otherwise, returns the frame unchanged.
+func (c *CqlServerConnection) maybeCompress(f *frame.Frame) *frame.Frame {
+	if c.compression.get() == nil || f.Header.Flags.Contains(primitive.HeaderFlagCompressed) {
+		return f
+	}
+	compressed := &frame.Frame{Header: f.Header.Clone(), Body: f.Body}
+	compressed.SetCompress(true)
+	return compressed
+}
+
+// negotiatedCompressor is the frame.BodyCompressor of connections using the default codec; it delegates to the
+// compressor enabled with CqlServerConnection.EnableCompression. The zero value is ready to use.
+type negotiatedCompressor struct {
+	compressor frame.BodyCompressor
+	lock       sync.RWMutex
+}
+
+func (n *negotiatedCompressor) get() frame.BodyCompressor {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return n.compressor
+}
+
+func (n *negotiatedCompressor) set(compressor frame.BodyCompressor) {
+	n.lock.Lock()
+	n.compressor = compressor
+	n.lock.Unlock()
+}
+
+func (n *negotiatedCompressor) Algorithm() string {
+	if compressor := n.get(); compressor != nil {
+		return compressor.Algorithm()
+	}
+	return ""
+}
+
+func (n *negotiatedCompressor) Compress(source io.Reader, dest io.Writer) error {
+	if compressor := n.get(); compressor != nil {
+		return compressor.Compress(source, dest)
+	}
+	return fmt.Errorf("compression was not negotiated")
+}
+
+func (n *negotiatedCompressor) Decompress(source io.Reader, dest io.Writer) error {
+	if compressor := n.get(); compressor != nil {
+		return compressor.Decompress(source, dest)
+	}
+	return fmt.Errorf("compression was not negotiated")
+}
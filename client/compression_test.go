@@ -0,0 +1,112 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/compression/lz4"
+	"github.com/datastax/go-cassandra-native-protocol/compression/snappy"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	for _, compressor := range []frame.BodyCompressor{nil, lz4.BodyCompressor{}, snappy.BodyCompressor{}} {
+		name := "NONE"
+		if compressor != nil {
+			name = compressor.Algorithm()
+		}
+		t.Run(fmt.Sprintf("compression %v", name), func(t *testing.T) {
+			server, clientConn, cancelFn := createCompressionServerAndClient(t, compressor)
+			defer checkClosed(t, clientConn, server)
+			defer cancelFn()
+
+			response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+			require.Nil(t, err)
+			require.IsType(t, &message.Supported{}, response.Body.Message)
+			assert.Equal(t, map[string][]string{"COMPRESSION": {"lz4", "snappy"}}, response.Body.Message.(*message.Supported).Options)
+
+			require.Nil(t, clientConn.InitiateHandshake(primitive.ProtocolVersion4, client.ManagedStreamId))
+			serverConns, err := server.AllAcceptedClients()
+			require.Nil(t, err)
+			require.Len(t, serverConns, 1)
+			if compressor == nil {
+				assert.Equal(t, "", serverConns[0].Compression())
+			} else {
+				assert.Equal(t, compressor.Algorithm(), serverConns[0].Compression())
+			}
+
+			query := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM system.local"})
+			query.SetCompress(compressor != nil)
+			response, err = clientConn.SendAndReceive(query)
+			require.Nil(t, err)
+			assert.IsType(t, &message.VoidResult{}, response.Body.Message)
+			assert.Equal(t, compressor != nil, response.Header.Flags.Contains(primitive.HeaderFlagCompressed))
+		})
+	}
+}
+
+func TestCompressionNegotiation_UnknownAlgorithm(t *testing.T) {
+	server, clientConn, cancelFn := createCompressionServerAndClient(t, nil)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	// need to send a request to make sure the server connection was accepted
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+	require.Nil(t, err)
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	require.Len(t, serverConns, 1)
+	assert.Nil(t, serverConns[0].EnableCompression("Snappy"))
+	assert.Equal(t, "SNAPPY", serverConns[0].Compression())
+	assert.Nil(t, serverConns[0].EnableCompression(""))
+	assert.Equal(t, "", serverConns[0].Compression())
+	assert.NotNil(t, serverConns[0].EnableCompression("zstd"))
+
+	startup := message.NewStartup()
+	startup.SetCompression("zstd")
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, startup))
+	require.Nil(t, err)
+	assert.Equal(t, &message.ProtocolError{ErrorMessage: "Unknown compression algorithm: zstd"}, response.Body.Message)
+	assert.Equal(t, "", serverConns[0].Compression())
+}
+
+func createCompressionServerAndClient(t *testing.T, compressor frame.BodyCompressor) (*client.CqlServer, *client.CqlClientConnection, context.CancelFunc) {
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.Compressors = []frame.BodyCompressor{lz4.BodyCompressor{}, snappy.BodyCompressor{}}
+	server.RequestHandlers = []client.RequestHandler{
+		client.HeartbeatHandler,
+		client.HandshakeHandler,
+		func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.VoidResult{})
+		},
+	}
+	clt := client.NewCqlClient("127.0.0.1:9043", nil)
+	if compressor != nil {
+		clt.Codec = frame.NewCodec()
+		clt.Codec.SetBodyCompressor(compressor)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+	clientConn, err := clt.Connect(ctx)
+	require.Nil(t, err)
+	return server, clientConn, cancelFn
+}
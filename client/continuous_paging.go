@@ -0,0 +1,420 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// ContinuousPagingSession drives a DSE continuous paging query: the server streams pages on the stream id of the
+// original request until the last page is sent. Create sessions with CqlClientConnection.StartContinuousPaging.
+// With DSE protocol v2, if ContinuousPagingOptions.NextPages is positive, the server sends at most NextPages pages
+// before waiting for the client to ask for more. The session takes care of this backpressure mechanism: every time
+// half of the requested pages have been consumed, a REVISE request asking for more pages is sent. Note that the
+// connection's MaxPending should be greater than or equal to NextPages, otherwise the connection would not be able to
+// buffer all the pages that the server is allowed to send.
+// Sessions are not safe for concurrent use.
+type ContinuousPagingSession struct {
+	conn      *CqlClientConnection
+	ctx       context.Context
+	version   primitive.ProtocolVersion
+	inFlight  InFlightRequest
+	nextPages int32
+	requested int32
+	consumed  int32
+	done      bool
+	err       error
+}
+
+// Sends the given QUERY or EXECUTE request and starts a continuous paging session. The request must use a DSE
+// protocol version and have its ContinuousPagingOptions set. Canceling ctx cancels the session.
+func (c *CqlClientConnection) StartContinuousPaging(ctx context.Context, request *frame.Frame) (*ContinuousPagingSession, error) {
+	var options *message.QueryOptions
+	switch msg := request.Body.Message.(type) {
+	case *message.Query:
+		options = msg.Options
+	case *message.Execute:
+		options = msg.Options
+	default:
+		return nil, fmt.Errorf("%v: expected QUERY or EXECUTE request, got: %v", c, msg)
+	}
+	if !request.Header.Version.IsDse() {
+		return nil, fmt.Errorf("%v: continuous paging requires a DSE protocol version, got: %v", c, request.Header.Version)
+	} else if options == nil || options.ContinuousPagingOptions == nil {
+		return nil, fmt.Errorf("%v: continuous paging options not set", c)
+	}
+	inFlight, err := c.SendContext(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	session := &ContinuousPagingSession{
+		conn:     c,
+		ctx:      ctx,
+		version:  request.Header.Version,
+		inFlight: inFlight,
+	}
+	if request.Header.Version >= primitive.ProtocolVersionDse2 {
+		session.nextPages = options.ContinuousPagingOptions.NextPages
+		session.requested = session.nextPages
+	}
+	log.Debug().Msgf("%v: continuous paging session started", session)
+	return session, nil
+}
+
+func (s *ContinuousPagingSession) String() string {
+	return fmt.Sprintf("%v: continuous paging [stream id %d]", s.conn, s.inFlight.StreamId())
+}
+
+// Waits for the next page and returns it. Returns nil without error when the last page was already returned, or when
+// the session was canceled. Pages are checked to arrive in order; if the server replies with an error, or if a page
+// arrives out of order, the session is canceled and an error is returned.
+func (s *ContinuousPagingSession) NextPage() (*message.RowsResult, error) {
+	if s.err != nil {
+		return nil, s.err
+	} else if s.done {
+		return nil, nil
+	}
+	var response *frame.Frame
+	select {
+	case f, ok := <-s.inFlight.Incoming():
+		if !ok {
+			err := s.inFlight.Err()
+			if err == nil {
+				err = fmt.Errorf("request closed before last page")
+			}
+			return nil, s.fail(err)
+		}
+		response = f
+	case <-s.ctx.Done():
+		return nil, s.fail(s.ctx.Err())
+	}
+	rows, ok := response.Body.Message.(*message.RowsResult)
+	if !ok {
+		return nil, s.fail(fmt.Errorf("expected ROWS result, got: %v", response.Body.Message))
+	}
+	if rows.Metadata.ContinuousPageNumber != s.consumed+1 {
+		return nil, s.fail(fmt.Errorf("expected page %d, got page %d", s.consumed+1, rows.Metadata.ContinuousPageNumber))
+	}
+	s.consumed++
+	if rows.Metadata.LastContinuousPage {
+		log.Debug().Msgf("%v: last page received: %d", s, s.consumed)
+		s.done = true
+	} else if err := s.maybeRequestMorePages(); err != nil {
+		return nil, s.fail(err)
+	}
+	return rows, nil
+}
+
+// Returns true if the last page was received, or if the session was canceled or failed.
+func (s *ContinuousPagingSession) IsDone() bool {
+	return s.done || s.err != nil
+}
+
+// Cancels the session: sends a REVISE request asking the server to stop sending pages. Pages still in transit are
+// discarded. Canceling a session that is already done has no effect.
+func (s *ContinuousPagingSession) Cancel() error {
+	if s.IsDone() {
+		return nil
+	}
+	s.done = true
+	return s.cancel()
+}
+
+func (s *ContinuousPagingSession) cancel() error {
+	log.Debug().Msgf("%v: canceling", s)
+	// discard pages in transit until the request is done, to free its stream id as soon as possible
+	go func() {
+		for range s.inFlight.Incoming() {
+		}
+	}()
+	if err := s.revise(&message.Revise{
+		RevisionType:   primitive.DseRevisionTypeCancelContinuousPaging,
+		TargetStreamId: int32(s.inFlight.StreamId()),
+	}); err != nil {
+		return fmt.Errorf("%v: %w", s, err)
+	}
+	return nil
+}
+
+func (s *ContinuousPagingSession) fail(err error) error {
+	s.err = fmt.Errorf("%v: %w", s, err)
+	if !s.done {
+		s.done = true
+		if cancelErr := s.cancel(); cancelErr != nil {
+			log.Debug().Err(cancelErr).Msgf("%v: could not cancel", s)
+		}
+	}
+	return s.err
+}
+
+// With DSE v2 backpressure, asks for more pages when half of the requested pages have been consumed.
+func (s *ContinuousPagingSession) maybeRequestMorePages() error {
+	if s.nextPages <= 0 {
+		return nil
+	}
+	if outstanding := s.requested - s.consumed; outstanding <= s.nextPages/2 {
+		more := s.nextPages - outstanding
+		log.Debug().Msgf("%v: requesting %d more pages", s, more)
+		if err := s.revise(&message.Revise{
+			RevisionType:   primitive.DseRevisionTypeMoreContinuousPages,
+			TargetStreamId: int32(s.inFlight.StreamId()),
+			NextPages:      more,
+		}); err != nil {
+			return err
+		}
+		s.requested += more
+	}
+	return nil
+}
+
+func (s *ContinuousPagingSession) revise(revise *message.Revise) error {
+	request := frame.NewFrame(s.version, ManagedStreamId, revise)
+	// use a background context, since the session context may be the reason for the cancellation
+	if response, err := s.conn.SendAndReceiveContext(context.Background(), request); err != nil {
+		return fmt.Errorf("revise request failed: %w", err)
+	} else if e, isError := response.Body.Message.(message.Error); isError {
+		return fmt.Errorf("revise request failed: %v", e)
+	}
+	return nil
+}
+
+// The default page size used by the continuous paging handler, when the request does not specify one.
+const DefaultContinuousPagingPageSize = 5000
+
+// A RequestHandler to handle DSE continuous paging QUERY requests for the given query string, effectively emulating the
+// behavior of a DSE node streaming pages on the stream id of the original request.
+// When a QUERY request targets the query string and has ContinuousPagingOptions set, the data produced by the rows
+// factory function is split in pages of QueryOptions.PageSize rows, then sent one by one; the last page sent is flagged
+// as such. The handler honors the following options:
+// - MaxPages: if positive, at most MaxPages pages are sent;
+// - PagesPerSecond: if positive, pages are sent at the given rate at most;
+// - NextPages (DSE v2 only): if positive, at most NextPages pages are sent until the client asks for more pages.
+// REVISE requests are intercepted: DseRevisionTypeMoreContinuousPages increases the number of pages the targeted
+// session is allowed to send, and DseRevisionTypeCancelContinuousPaging stops it; no further pages are sent on the
+// stream id of a canceled session. REVISE requests targeting a session started by the handler are acknowledged with a
+// VOID result, even if the session already completed; REVISE requests targeting other sessions, e.g. sessions started
+// by another continuous paging handler, are not handled.
+// When a QUERY request targets the query string without ContinuousPagingOptions, all the rows are returned in a single
+// Rows RESULT response.
+func NewContinuousPagingHandler(
+	query string,
+	columns *message.RowsMetadata,
+	rows func(options *message.QueryOptions) message.RowSet,
+) RequestHandler {
+	sessions := newContinuousPagingSessions()
+	return func(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) (response *frame.Frame) {
+		version := request.Header.Version
+		id := request.Header.StreamId
+		// a new request on the stream id of a completed session means that the client is done with that session
+		sessions.forget(conn, id)
+		switch msg := request.Body.Message.(type) {
+		case *message.Query:
+			if msg.Query != query {
+				return
+			}
+			if msg.Options == nil || msg.Options.ContinuousPagingOptions == nil {
+				log.Debug().Msgf("%v: [continuous paging handler]: intercepted QUERY without continuous paging", conn)
+				return frame.NewFrame(version, id, &message.RowsResult{Metadata: columns, Data: rows(msg.Options)})
+			}
+			log.Debug().Msgf("%v: [continuous paging handler]: intercepted continuous paging QUERY", conn)
+			state := newContinuousPagingState(version, msg.Options)
+			sessions.start(conn, id, state)
+			defer sessions.complete(conn, id)
+			response = state.stream(request, conn, columns, rows(msg.Options))
+		case *message.Revise:
+			if state, found := sessions.lookup(conn, int16(msg.TargetStreamId)); found {
+				log.Debug().Msgf("%v: [continuous paging handler]: intercepted REVISE: %v", conn, msg)
+				if state != nil {
+					state.revise(msg)
+				}
+				response = frame.NewFrame(version, id, &message.VoidResult{})
+			}
+		}
+		return
+	}
+}
+
+// The continuous paging sessions started by a continuous paging handler, keyed by connection and stream id. Completed
+// sessions are remembered until their stream id is reused, or until their connection is closed, so that late REVISE
+// requests targeting them can still be acknowledged.
+type continuousPagingSessions struct {
+	lock *sync.Mutex
+	// the sessions of each connection; the state of completed sessions is nil
+	sessions map[*CqlServerConnection]map[int16]*continuousPagingState
+}
+
+func newContinuousPagingSessions() *continuousPagingSessions {
+	return &continuousPagingSessions{
+		lock:     &sync.Mutex{},
+		sessions: make(map[*CqlServerConnection]map[int16]*continuousPagingState),
+	}
+}
+
+func (s *continuousPagingSessions) start(conn *CqlServerConnection, streamId int16, state *continuousPagingState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sessions, found := s.sessions[conn]
+	if !found {
+		sessions = make(map[int16]*continuousPagingState)
+		s.sessions[conn] = sessions
+		go func() {
+			<-conn.ctx.Done()
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			delete(s.sessions, conn)
+		}()
+	}
+	sessions[streamId] = state
+}
+
+func (s *continuousPagingSessions) complete(conn *CqlServerConnection, streamId int16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sessions, found := s.sessions[conn]; found {
+		sessions[streamId] = nil
+	}
+}
+
+func (s *continuousPagingSessions) forget(conn *CqlServerConnection, streamId int16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sessions, found := s.sessions[conn]; found {
+		if state, found := sessions[streamId]; found && state == nil {
+			delete(sessions, streamId)
+		}
+	}
+}
+
+// Returns the state of the given session, or nil if the session completed; found is false if the session was not
+// started by the handler.
+func (s *continuousPagingSessions) lookup(conn *CqlServerConnection, streamId int16) (state *continuousPagingState, found bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, found = s.sessions[conn][streamId]
+	return
+}
+
+// The state of a continuous paging session emulated by a continuous paging handler.
+type continuousPagingState struct {
+	pageSize  int
+	maxPages  int32
+	interval  time.Duration
+	nextPages int32
+	more      chan int32
+	canceled  chan struct{}
+	cancel    sync.Once
+}
+
+func newContinuousPagingState(version primitive.ProtocolVersion, options *message.QueryOptions) *continuousPagingState {
+	state := &continuousPagingState{
+		pageSize: int(options.PageSize),
+		maxPages: options.ContinuousPagingOptions.MaxPages,
+		more:     make(chan int32, 16),
+		canceled: make(chan struct{}),
+	}
+	if state.pageSize <= 0 {
+		state.pageSize = DefaultContinuousPagingPageSize
+	}
+	if pagesPerSecond := options.ContinuousPagingOptions.PagesPerSecond; pagesPerSecond > 0 {
+		state.interval = time.Second / time.Duration(pagesPerSecond)
+	}
+	if version >= primitive.ProtocolVersionDse2 {
+		state.nextPages = options.ContinuousPagingOptions.NextPages
+	}
+	return state
+}
+
+func (s *continuousPagingState) revise(revise *message.Revise) {
+	switch revise.RevisionType {
+	case primitive.DseRevisionTypeCancelContinuousPaging:
+		s.cancel.Do(func() { close(s.canceled) })
+	case primitive.DseRevisionTypeMoreContinuousPages:
+		select {
+		case s.more <- revise.NextPages:
+		case <-s.canceled:
+		}
+	}
+}
+
+// Sends all the pages but the last one, and returns the last one; returns nil if the session was canceled, or if the
+// connection was closed.
+func (s *continuousPagingState) stream(
+	request *frame.Frame,
+	conn *CqlServerConnection,
+	columns *message.RowsMetadata,
+	rows message.RowSet,
+) *frame.Frame {
+	allowed := s.nextPages
+	var lastSent time.Time
+	for page := int32(1); ; page++ {
+		for allowed > 0 && page > allowed {
+			select {
+			case more := <-s.more:
+				allowed += more
+			case <-s.canceled:
+				log.Debug().Msgf("%v: [continuous paging handler]: session canceled", conn)
+				return nil
+			case <-conn.ctx.Done():
+				return nil
+			}
+		}
+		if s.interval > 0 && !lastSent.IsZero() {
+			select {
+			case <-time.After(time.Until(lastSent.Add(s.interval))):
+			case <-s.canceled:
+				log.Debug().Msgf("%v: [continuous paging handler]: session canceled", conn)
+				return nil
+			case <-conn.ctx.Done():
+				return nil
+			}
+		}
+		select {
+		case <-s.canceled:
+			log.Debug().Msgf("%v: [continuous paging handler]: session canceled", conn)
+			return nil
+		case <-conn.ctx.Done():
+			return nil
+		default:
+		}
+		data := rows
+		if len(data) > s.pageSize {
+			data = data[:s.pageSize]
+		}
+		rows = rows[len(data):]
+		last := len(rows) == 0 || (s.maxPages > 0 && page >= s.maxPages)
+		metadata := &message.RowsMetadata{}
+		if columns != nil {
+			*metadata = *columns
+		}
+		metadata.ContinuousPageNumber = page
+		metadata.LastContinuousPage = last
+		f := frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.RowsResult{Metadata: metadata, Data: data})
+		if last {
+			return f
+		}
+		if err := conn.Send(f); err != nil {
+			log.Error().Err(err).Msgf("%v: [continuous paging handler]: could not send page %d", conn, page)
+			return nil
+		}
+		lastSent = time.Now()
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A fake DSE server streaming totalPages pages for each continuous paging query, honoring backpressure and
+// cancellation REVISE requests.
+type continuousPagingServer struct {
+	totalPages int32
+	more       chan int32
+	canceled   chan struct{}
+	revisions  int32
+}
+
+func newContinuousPagingServer(totalPages int32) *continuousPagingServer {
+	return &continuousPagingServer{
+		totalPages: totalPages,
+		more:       make(chan int32, 100),
+		canceled:   make(chan struct{}),
+	}
+}
+
+func (s *continuousPagingServer) handler(request *frame.Frame, conn *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+	switch msg := request.Body.Message.(type) {
+	case *message.Revise:
+		atomic.AddInt32(&s.revisions, 1)
+		if msg.RevisionType == primitive.DseRevisionTypeCancelContinuousPaging {
+			close(s.canceled)
+		} else {
+			s.more <- msg.NextPages
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.VoidResult{})
+	case *message.Query:
+		if msg.Options == nil || msg.Options.ContinuousPagingOptions == nil {
+			return nil
+		}
+		allowed := msg.Options.ContinuousPagingOptions.NextPages
+		for page := int32(1); page <= s.totalPages; page++ {
+			for allowed > 0 && page > allowed {
+				select {
+				case more := <-s.more:
+					allowed += more
+				case <-s.canceled:
+					return nil
+				}
+			}
+			select {
+			case <-s.canceled:
+				return nil
+			default:
+			}
+			rows := &message.RowsResult{
+				Metadata: &message.RowsMetadata{
+					ColumnCount: 1,
+					Columns: []*message.ColumnMetadata{
+						{Keyspace: "ks1", Table: "table1", Name: "col1", Type: datatype.Int},
+					},
+					ContinuousPageNumber: page,
+					LastContinuousPage:   page == s.totalPages,
+				},
+				Data: message.RowSet{{{0, 0, 0, byte(page)}}},
+			}
+			response := frame.NewFrame(request.Header.Version, request.Header.StreamId, rows)
+			if page == s.totalPages {
+				return response
+			}
+			if err := conn.Send(response); err != nil {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func continuousPagingQuery(nextPages int32) *frame.Frame {
+	return frame.NewFrame(
+		primitive.ProtocolVersionDse2,
+		client.ManagedStreamId,
+		&message.Query{
+			Query: "SELECT * FROM ks1.table1",
+			Options: &message.QueryOptions{
+				ContinuousPagingOptions: &message.ContinuousPagingOptions{NextPages: nextPages},
+			},
+		},
+	)
+}
+
+func TestCqlClientConnection_StartContinuousPaging(t *testing.T) {
+	for _, nextPages := range []int32{0, 4} {
+		t.Run(fmt.Sprintf("next pages %d", nextPages), func(t *testing.T) {
+			paging := newContinuousPagingServer(10)
+			server, clientConn, cancelFn := createServerAndClient(t, paging.handler)
+			defer checkClosed(t, clientConn, server)
+			defer cancelFn()
+
+			session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingQuery(nextPages))
+			require.NoError(t, err)
+			for page := 1; page <= 10; page++ {
+				rows, err := session.NextPage()
+				require.NoError(t, err)
+				require.NotNil(t, rows)
+				assert.EqualValues(t, page, rows.Metadata.ContinuousPageNumber)
+				assert.Equal(t, message.RowSet{{{0, 0, 0, byte(page)}}}, rows.Data)
+			}
+			assert.True(t, session.IsDone())
+			rows, err := session.NextPage()
+			assert.NoError(t, err)
+			assert.Nil(t, rows)
+			if nextPages > 0 {
+				assert.Greater(t, atomic.LoadInt32(&paging.revisions), int32(0))
+			} else {
+				assert.Zero(t, atomic.LoadInt32(&paging.revisions))
+			}
+		})
+	}
+}
+
+func TestContinuousPagingSession_Cancel(t *testing.T) {
+	paging := newContinuousPagingServer(10)
+	server, clientConn, cancelFn := createServerAndClient(t, paging.handler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingQuery(2))
+	require.NoError(t, err)
+	rows, err := session.NextPage()
+	require.NoError(t, err)
+	require.NotNil(t, rows)
+	require.NoError(t, session.Cancel())
+	select {
+	case <-paging.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("server did not receive cancellation")
+	}
+	assert.True(t, session.IsDone())
+	rows, err = session.NextPage()
+	assert.NoError(t, err)
+	assert.Nil(t, rows)
+}
+
+func TestContinuousPagingSession_ReviseError(t *testing.T) {
+	paging := newContinuousPagingServer(10)
+	rejectRevise := func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+		if _, ok := request.Body.Message.(*message.Revise); ok {
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.ServerError{ErrorMessage: "boom"})
+		}
+		return nil
+	}
+	server, clientConn, cancelFn := createServerAndClient(t, rejectRevise, paging.handler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingQuery(2))
+	require.NoError(t, err)
+	_, err = session.NextPage()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "revise request failed")
+	assert.Equal(t, 1, strings.Count(err.Error(), session.String()))
+	assert.True(t, session.IsDone())
+}
+
+func TestCqlClientConnection_StartContinuousPaging_Invalid(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	request := continuousPagingQuery(0)
+	request.Header.Version = primitive.ProtocolVersion4
+	_, err := clientConn.StartContinuousPaging(context.Background(), request)
+	assert.Error(t, err)
+
+	request = frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	_, err = clientConn.StartContinuousPaging(context.Background(), request)
+	assert.Error(t, err)
+
+	request = frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Options{})
+	_, err = clientConn.StartContinuousPaging(context.Background(), request)
+	assert.Error(t, err)
+}
+
+func newContinuousPagingTestHandler() client.RequestHandler {
+	columns := &message.RowsMetadata{
+		ColumnCount: 1,
+		Columns: []*message.ColumnMetadata{
+			{Keyspace: "ks1", Table: "table1", Name: "col1", Type: datatype.Int},
+		},
+	}
+	return client.NewContinuousPagingHandler("SELECT * FROM ks1.table1", columns, func(*message.QueryOptions) message.RowSet {
+		var rows message.RowSet
+		for i := 0; i < 10; i++ {
+			rows = append(rows, message.Row{{0, 0, 0, byte(i)}})
+		}
+		return rows
+	})
+}
+
+func continuousPagingHandlerQuery(options *message.ContinuousPagingOptions) *frame.Frame {
+	return frame.NewFrame(
+		primitive.ProtocolVersionDse2,
+		client.ManagedStreamId,
+		&message.Query{
+			Query:   "SELECT * FROM ks1.table1",
+			Options: &message.QueryOptions{PageSize: 3, ContinuousPagingOptions: options},
+		},
+	)
+}
+
+func TestNewContinuousPagingHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       *message.ContinuousPagingOptions
+		expectedPages int
+		expectedRows  int
+		minDuration   time.Duration
+	}{
+		{"no limit", &message.ContinuousPagingOptions{}, 4, 10, 0},
+		{"next pages", &message.ContinuousPagingOptions{NextPages: 2}, 4, 10, 0},
+		{"max pages", &message.ContinuousPagingOptions{MaxPages: 2}, 2, 6, 0},
+		{"pages per second", &message.ContinuousPagingOptions{PagesPerSecond: 20}, 4, 10, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, clientConn, cancelFn := createServerAndClient(t, newContinuousPagingTestHandler())
+			defer checkClosed(t, clientConn, server)
+			defer cancelFn()
+
+			start := time.Now()
+			session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingHandlerQuery(tt.options))
+			require.NoError(t, err)
+			var pages, rows int
+			for {
+				page, err := session.NextPage()
+				require.NoError(t, err)
+				if page == nil {
+					break
+				}
+				for _, row := range page.Data {
+					assert.Equal(t, message.Row{{0, 0, 0, byte(rows)}}, row)
+					rows++
+				}
+				pages++
+			}
+			assert.Equal(t, tt.expectedPages, pages)
+			assert.Equal(t, tt.expectedRows, rows)
+			assert.GreaterOrEqual(t, int64(time.Since(start)), int64(tt.minDuration))
+		})
+	}
+}
+
+func TestNewContinuousPagingHandler_Cancel(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, newContinuousPagingTestHandler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	options := &message.ContinuousPagingOptions{NextPages: 1}
+	session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingHandlerQuery(options))
+	require.NoError(t, err)
+	page, err := session.NextPage()
+	require.NoError(t, err)
+	require.NotNil(t, page)
+	require.NoError(t, session.Cancel())
+	page, err = session.NextPage()
+	assert.NoError(t, err)
+	assert.Nil(t, page)
+}
+
+func TestNewContinuousPagingHandler_NoContinuousPaging(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, newContinuousPagingTestHandler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	response, err := clientConn.SendAndReceive(continuousPagingHandlerQuery(nil))
+	require.NoError(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.Len(t, response.Body.Message.(*message.RowsResult).Data, 10)
+}
+
+func TestNewContinuousPagingHandler_MultipleHandlers(t *testing.T) {
+	columns := &message.RowsMetadata{
+		ColumnCount: 1,
+		Columns: []*message.ColumnMetadata{
+			{Keyspace: "ks1", Table: "table2", Name: "col1", Type: datatype.Int},
+		},
+	}
+	otherHandler := client.NewContinuousPagingHandler("SELECT * FROM ks1.table2", columns, func(*message.QueryOptions) message.RowSet {
+		return message.RowSet{{{0, 0, 0, 1}}, {{0, 0, 0, 2}}, {{0, 0, 0, 3}}, {{0, 0, 0, 4}}}
+	})
+	server, clientConn, cancelFn := createServerAndClient(t, newContinuousPagingTestHandler(), otherHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	// the REVISE requests asking for more pages of the other handler's session are not intercepted by the first handler
+	options := &message.ContinuousPagingOptions{NextPages: 1}
+	request := continuousPagingHandlerQuery(options)
+	request.Body.Message.(*message.Query).Query = "SELECT * FROM ks1.table2"
+	session, err := clientConn.StartContinuousPaging(context.Background(), request)
+	require.NoError(t, err)
+	var pages int
+	for {
+		page, err := session.NextPage()
+		require.NoError(t, err)
+		if page == nil {
+			break
+		}
+		pages++
+	}
+	assert.Equal(t, 2, pages)
+	// the first handler still handles the REVISE requests of its own sessions
+	session, err = clientConn.StartContinuousPaging(context.Background(), continuousPagingHandlerQuery(options))
+	require.NoError(t, err)
+	page, err := session.NextPage()
+	require.NoError(t, err)
+	require.NotNil(t, page)
+	require.NoError(t, session.Cancel())
+	page, err = session.NextPage()
+	assert.NoError(t, err)
+	assert.Nil(t, page)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"sync"
+)
+
+// eventRegistration holds the event types a connection registered for. The zero value is ready to use.
+type eventRegistration struct {
+	version    primitive.ProtocolVersion
+	eventTypes []primitive.EventType
+	lock       sync.Mutex
+}
+
+// Records that the client registered for the given event types, with a REGISTER request of the given protocol
+// version. Registrations are cumulative: event types registered previously remain registered. This method is invoked
+// by RegisterHandler; custom handlers replying to REGISTER requests should invoke it as well.
+func (c *CqlServerConnection) Register(version primitive.ProtocolVersion, eventTypes ...primitive.EventType) {
+	log.Debug().Msgf("%v: registering for events: %v", c, eventTypes)
+	c.registration.lock.Lock()
+	defer c.registration.lock.Unlock()
+	c.registration.version = version
+	for _, eventType := range eventTypes {
+		if !containsEventType(c.registration.eventTypes, eventType) {
+			c.registration.eventTypes = append(c.registration.eventTypes, eventType)
+		}
+	}
+}
+
+// Returns the event types the client registered for, if any.
+func (c *CqlServerConnection) RegisteredEventTypes() []primitive.EventType {
+	c.registration.lock.Lock()
+	defer c.registration.lock.Unlock()
+	eventTypes := make([]primitive.EventType, len(c.registration.eventTypes))
+	copy(eventTypes, c.registration.eventTypes)
+	return eventTypes
+}
+
+// Returns true if the client registered for the given event type.
+func (c *CqlServerConnection) IsRegistered(eventType primitive.EventType) bool {
+	_, registered := c.registeredVersion(eventType)
+	return registered
+}
+
+func (c *CqlServerConnection) registeredVersion(eventType primitive.EventType) (primitive.ProtocolVersion, bool) {
+	c.registration.lock.Lock()
+	defer c.registration.lock.Unlock()
+	return c.registration.version, containsEventType(c.registration.eventTypes, eventType)
+}
+
+// Sends the given event to the client, in a frame with stream id -1 and the protocol version of the client's REGISTER
+// request. Returns an error if the client did not register for the event type, or if the event cannot be encoded
+// with that protocol version, e.g. a TOPOLOGY_CHANGE MOVED_NODE event with protocol version 2.
+func (c *CqlServerConnection) SendEvent(event message.Event) error {
+	version, registered := c.registeredVersion(event.GetEventType())
+	if !registered {
+		return fmt.Errorf("%v: client not registered for %v events", c, event.GetEventType())
+	}
+	f := frame.NewFrame(version, -1, event)
+	// encode the frame beforehand, since encoding errors in the outgoing loop would close the connection
+	if err := c.codec.EncodeFrame(f, ioutil.Discard); err != nil {
+		return fmt.Errorf("%v: cannot encode event with protocol version %v: %w", c, version, err)
+	}
+	return c.Send(f)
+}
+
+// Sends the given event to all the server connections whose client registered for the event type; see
+// CqlServerConnection.SendEvent. Returns the connections the event was sent to, and the first error encountered, if
+// any; an error sending to one connection does not prevent sending to the others.
+func (server *CqlServer) BroadcastEvent(event message.Event) (sent []*CqlServerConnection, err error) {
+	conns, err := server.AllAcceptedClients()
+	if err != nil {
+		return nil, err
+	}
+	for _, conn := range conns {
+		if !conn.IsRegistered(event.GetEventType()) {
+			continue
+		} else if sendErr := conn.SendEvent(event); sendErr != nil {
+			log.Error().Err(sendErr).Msgf("%v: could not send event", server)
+			if err == nil {
+				err = sendErr
+			}
+		} else {
+			sent = append(sent, conn)
+		}
+	}
+	log.Debug().Msgf("%v: event sent to %v connections: %v", server, len(sent), event)
+	return sent, err
+}
+
+func containsEventType(eventTypes []primitive.EventType, eventType primitive.EventType) bool {
+	for _, candidate := range eventTypes {
+		if candidate == eventType {
+			return true
+		}
+	}
+	return false
+}
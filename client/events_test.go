@@ -0,0 +1,104 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestCqlServer_BroadcastEvent(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, client.RegisterHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	require.Len(t, serverConns, 1)
+	serverConn := serverConns[0]
+	schemaChange := &message.SchemaChangeEvent{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetTable,
+		Keyspace:   "ks1",
+		Object:     "table1",
+	}
+
+	// not registered
+	assert.Empty(t, serverConn.RegisteredEventTypes())
+	assert.NotNil(t, serverConn.SendEvent(schemaChange))
+	sent, err := server.BroadcastEvent(schemaChange)
+	require.Nil(t, err)
+	assert.Empty(t, sent)
+
+	register := frame.NewFrame(primitive.ProtocolVersion3, client.ManagedStreamId, &message.Register{
+		EventTypes: []primitive.EventType{primitive.EventTypeSchemaChange},
+	})
+	response, err := clientConn.SendAndReceive(register)
+	require.Nil(t, err)
+	require.IsType(t, &message.Ready{}, response.Body.Message)
+	assert.Equal(t, []primitive.EventType{primitive.EventTypeSchemaChange}, serverConn.RegisteredEventTypes())
+	assert.True(t, serverConn.IsRegistered(primitive.EventTypeSchemaChange))
+	assert.False(t, serverConn.IsRegistered(primitive.EventTypeStatusChange))
+
+	sent, err = server.BroadcastEvent(schemaChange)
+	require.Nil(t, err)
+	assert.Equal(t, []*client.CqlServerConnection{serverConn}, sent)
+	event, err := clientConn.ReceiveEvent()
+	require.Nil(t, err)
+	assert.Equal(t, primitive.ProtocolVersion3, event.Header.Version)
+	assert.EqualValues(t, -1, event.Header.StreamId)
+	assert.Equal(t, schemaChange, event.Body.Message)
+
+	// only subscribed connections receive events
+	statusChange := &message.StatusChangeEvent{
+		ChangeType: primitive.StatusChangeTypeUp,
+		Address:    &primitive.Inet{Addr: net.ParseIP("127.0.0.2"), Port: 9042},
+	}
+	sent, err = server.BroadcastEvent(statusChange)
+	require.Nil(t, err)
+	assert.Empty(t, sent)
+
+	// events are encoded with the registered protocol version: functions require protocol version 4
+	functionChange := &message.SchemaChangeEvent{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetFunction,
+		Keyspace:   "ks1",
+		Object:     "func1",
+		Arguments:  []string{"int"},
+	}
+	sent, err = server.BroadcastEvent(functionChange)
+	assert.NotNil(t, err)
+	assert.Empty(t, sent)
+	assert.False(t, serverConn.IsClosed())
+
+	// registrations are cumulative
+	register = frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Register{
+		EventTypes: []primitive.EventType{primitive.EventTypeStatusChange},
+	})
+	_, err = clientConn.SendAndReceive(register)
+	require.Nil(t, err)
+	assert.Equal(t, []primitive.EventType{primitive.EventTypeSchemaChange, primitive.EventTypeStatusChange}, serverConn.RegisteredEventTypes())
+	require.Nil(t, serverConn.SendEvent(functionChange))
+	event, err = clientConn.ReceiveEvent()
+	require.Nil(t, err)
+	assert.Equal(t, primitive.ProtocolVersion4, event.Header.Version)
+	assert.Equal(t, functionChange, event.Body.Message)
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The delay after which responses held back by Faults.ReorderWindow are sent, if no other response is sent meanwhile.
+const ReorderFlushDelay = 100 * time.Millisecond
+
+// Faults describes network misbehaviors to inject in CqlServerConnection instances, to test driver resilience.
+// Faults can be set server-wide with CqlServer.SetFaults, or per connection with CqlServerConnection.SetFaults; faults
+// set on a connection replace the server-wide ones. Faults can be changed at any time, but a Faults instance must not
+// be modified once set: set a new instance instead.
+type Faults struct {
+	// A fixed delay to apply to each response.
+	Delay time.Duration
+	// A random extra delay, uniformly distributed between zero and DelayJitter, to apply to each response. Delayed
+	// responses do not block other responses, so random delays may cause responses to be sent out of order.
+	DelayJitter time.Duration
+	// The probability, between 0 and 1, to drop each response.
+	DropProbability float64
+	// If greater than 1, responses are held back until ReorderWindow responses are held, then sent in reverse order.
+	// Held responses are also sent, in reverse order, if no other response is sent for ReorderFlushDelay.
+	ReorderWindow int
+	// The probability, between 0 and 1, to corrupt each response, by flipping the bits of a random byte of its body.
+	// Responses with an empty body are never corrupted.
+	CorruptProbability float64
+	// The probability, between 0 and 1, to truncate each response in the middle of its body. The connection is closed
+	// right after a truncated response is written, as if the network failed.
+	TruncateProbability float64
+	// Stops reading incoming requests, as if the server's TCP receive window was full. A request being read when
+	// StallReads is set is still processed.
+	StallReads bool
+	// Closes the write side of the connection: clients receive an EOF, while the server keeps reading requests. All
+	// further responses are discarded, even if the faults are removed.
+	HalfClose bool
+}
+
+var errFrameTruncated = errors.New("frame truncated")
+
+// faultState holds the faults set on a server or a connection. The zero value is ready to use.
+type faultState struct {
+	faults  *Faults
+	changed chan struct{}
+	lock    sync.Mutex
+}
+
+func (s *faultState) get() (*Faults, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.faults, s.changed
+}
+
+func (s *faultState) set(faults *Faults) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = faults
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// Sets the faults to inject in all the connections that do not have their own faults set; nil removes all faults.
+func (server *CqlServer) SetFaults(faults *Faults) {
+	log.Debug().Msgf("%v: setting faults: %+v", server, faults)
+	server.faults.set(faults)
+	if !server.IsRunning() {
+		return
+	}
+	for _, conn := range server.connectionsHandler.allAcceptedClients() {
+		conn.applyFaults()
+	}
+}
+
+// Returns the faults set server-wide, if any.
+func (server *CqlServer) Faults() *Faults {
+	faults, _ := server.faults.get()
+	return faults
+}
+
+// Sets the faults to inject in this connection, replacing the server-wide faults; nil reverts to the server-wide
+// faults, if any.
+func (c *CqlServerConnection) SetFaults(faults *Faults) {
+	log.Debug().Msgf("%v: setting faults: %+v", c, faults)
+	c.faults.set(faults)
+	c.applyFaults()
+}
+
+// Returns the faults currently injected in this connection, either its own or the server-wide ones, if any.
+func (c *CqlServerConnection) Faults() *Faults {
+	faults, _, _ := c.currentFaults()
+	return faults
+}
+
+func (c *CqlServerConnection) currentFaults() (*Faults, <-chan struct{}, <-chan struct{}) {
+	faults, changed := c.faults.get()
+	var serverChanged <-chan struct{}
+	if c.serverFaults != nil {
+		var serverFaults *Faults
+		serverFaults, serverChanged = c.serverFaults.get()
+		if faults == nil {
+			faults = serverFaults
+		}
+	}
+	return faults, changed, serverChanged
+}
+
+// Applies the faults that take effect immediately.
+func (c *CqlServerConnection) applyFaults() {
+	if faults := c.Faults(); faults != nil && faults.HalfClose {
+		c.halfClose()
+	}
+}
+
+func (c *CqlServerConnection) halfClose() {
+	if atomic.CompareAndSwapInt32(&c.halfClosed, 0, 1) {
+		log.Debug().Msgf("%v: closing write side", c)
+		if conn, ok := c.conn.(interface{ CloseWrite() error }); !ok {
+			log.Error().Msgf("%v: cannot close write side of %T", c, c.conn)
+		} else if err := conn.CloseWrite(); err != nil {
+			log.Error().Err(err).Msgf("%v: error closing write side", c)
+		}
+	}
+}
+
+func (c *CqlServerConnection) isHalfClosed() bool {
+	return atomic.LoadInt32(&c.halfClosed) == 1
+}
+
+// Blocks while reads are stalled, or until the connection is closed.
+func (c *CqlServerConnection) awaitReadsResumed() {
+	for {
+		faults, changed, serverChanged := c.currentFaults()
+		if faults == nil || !faults.StallReads {
+			return
+		}
+		log.Debug().Msgf("%v: reads stalled", c)
+		select {
+		case <-changed:
+		case <-serverChanged:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Writes the given frames, in order, applying the given faults.
+func (c *CqlServerConnection) writeFrames(frames []*frame.Frame, faults *Faults) (err error) {
+	for _, f := range frames {
+		if err = c.writeFrameWithFaults(f, faults); err != nil {
+			break
+		}
+	}
+	return
+}
+
+func (c *CqlServerConnection) writeFrameWithFaults(f *frame.Frame, faults *Faults) error {
+	if faults == nil {
+		return c.writeFrame(f, nil)
+	} else if faults.DropProbability > 0 && rand.Float64() < faults.DropProbability {
+		log.Debug().Msgf("%v: dropping outgoing frame: %v", c, f)
+		return nil
+	}
+	delay := faults.Delay
+	if faults.DelayJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(faults.DelayJitter)))
+	}
+	if delay <= 0 {
+		return c.writeFrame(f, faults)
+	}
+	log.Debug().Msgf("%v: delaying outgoing frame by %v: %v", c, delay, f)
+	c.waitGroup.Add(1)
+	go func() {
+		abort := false
+		select {
+		case <-time.After(delay):
+			if err := c.writeFrame(f, faults); err != nil && !c.IsClosed() {
+				if errors.Is(err, errFrameTruncated) {
+					log.Info().Msgf("%v: delayed frame truncated, closing connection", c)
+				} else {
+					log.Error().Err(err).Msgf("%v: error writing delayed frame, closing connection", c)
+				}
+				abort = true
+			}
+		case <-c.ctx.Done():
+		}
+		c.waitGroup.Done()
+		if abort {
+			c.abort()
+		}
+	}()
+	return nil
+}
+
+// Encodes and writes the given frame, possibly corrupting or truncating it according to the given faults. Returns
+// errFrameTruncated if the frame was truncated.
+func (c *CqlServerConnection) writeFrame(f *frame.Frame, faults *Faults) (err error) {
+	if c.isHalfClosed() {
+		log.Debug().Msgf("%v: write side closed, discarding outgoing frame: %v", c, f)
+		return nil
+	}
+	f = c.maybeCompress(f)
+	encoded := &bytes.Buffer{}
+	if err = c.codec.EncodeFrame(f, encoded); err != nil {
+		return fmt.Errorf("%v: cannot encode frame: %w", c, err)
+	}
+	contents := encoded.Bytes()
+	headerLength := len(contents) - int(f.Header.BodyLength)
+	bodyLength := len(contents) - headerLength
+	truncated := false
+	if faults != nil && bodyLength > 0 {
+		if faults.CorruptProbability > 0 && rand.Float64() < faults.CorruptProbability {
+			log.Debug().Msgf("%v: corrupting outgoing frame: %v", c, f)
+			contents[headerLength+rand.Intn(bodyLength)] ^= 0xFF
+		}
+		if faults.TruncateProbability > 0 && rand.Float64() < faults.TruncateProbability {
+			log.Debug().Msgf("%v: truncating outgoing frame: %v", c, f)
+			contents = contents[:headerLength+bodyLength/2]
+			truncated = true
+		}
+	}
+	c.writeLock.Lock()
+	_, err = c.conn.Write(contents)
+	c.writeLock.Unlock()
+	if err == nil && truncated {
+		err = errFrameTruncated
+	}
+	return err
+}
+
+func reverseFrames(frames []*frame.Frame) []*frame.Frame {
+	reversed := make([]*frame.Frame, len(frames))
+	for i, f := range frames {
+		reversed[len(frames)-1-i] = f
+	}
+	return reversed
+}
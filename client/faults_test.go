@@ -0,0 +1,213 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// Creates a server and a raw TCP connection to it, to observe the frames exactly as they are sent by the server.
+func createServerAndRawConn(t *testing.T) (*client.CqlServer, *client.CqlServerConnection, net.Conn, context.CancelFunc) {
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{unprimedHandler}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+	conn, err := net.Dial("tcp", "127.0.0.1:9043")
+	require.Nil(t, err)
+	var serverConns []*client.CqlServerConnection
+	require.Eventually(t, func() bool {
+		serverConns, err = server.AllAcceptedClients()
+		return err == nil && len(serverConns) == 1
+	}, time.Second*10, time.Millisecond*10)
+	return server, serverConns[0], conn, func() {
+		_ = conn.Close()
+		cancelFn()
+	}
+}
+
+func writeRawQuery(t *testing.T, conn net.Conn, streamId int16) {
+	request := frame.NewFrame(primitive.ProtocolVersion4, streamId, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	require.Nil(t, frame.NewCodec().EncodeFrame(request, conn))
+}
+
+func readRawFrame(t *testing.T, conn net.Conn) *frame.RawFrame {
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second*10)))
+	response, err := frame.NewRawCodec().DecodeRawFrame(conn)
+	require.Nil(t, err)
+	return response
+}
+
+func TestFaults_Delay(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	server.SetFaults(&client.Faults{Delay: 200 * time.Millisecond, DelayJitter: 50 * time.Millisecond})
+	start := time.Now()
+	sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+
+	server.SetFaults(nil)
+	start = time.Now()
+	sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+func TestFaults_Drop(t *testing.T) {
+	server, clientConn, cancelFn := createServerAndClient(t, unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	server.SetFaults(&client.Faults{DropProbability: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	query := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	_, err := clientConn.SendAndReceiveContext(ctx, query)
+	var timeoutErr *client.RequestTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+
+	// faults set on a connection replace server-wide faults
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	serverConns[0].SetFaults(&client.Faults{})
+	assert.Equal(t, &client.Faults{}, serverConns[0].Faults())
+	assert.True(t, isUnprimed(sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1"})))
+}
+
+func TestFaults_Reorder(t *testing.T) {
+	server, serverConn, conn, cancelFn := createServerAndRawConn(t)
+	defer cancelFn()
+
+	serverConn.SetFaults(&client.Faults{ReorderWindow: 3})
+	writeRawQueryAndAwaitResponse(t, serverConn, conn, 1)
+	writeRawQueryAndAwaitResponse(t, serverConn, conn, 2)
+	// responses are held back until the window is full
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(client.ReorderFlushDelay/2)))
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr) && netErr.Timeout())
+	writeRawQueryAndAwaitResponse(t, serverConn, conn, 3)
+	assert.EqualValues(t, 3, readRawFrame(t, conn).Header.StreamId)
+	assert.EqualValues(t, 2, readRawFrame(t, conn).Header.StreamId)
+	assert.EqualValues(t, 1, readRawFrame(t, conn).Header.StreamId)
+
+	// held responses are eventually flushed
+	writeRawQueryAndAwaitResponse(t, serverConn, conn, 4)
+	writeRawQueryAndAwaitResponse(t, serverConn, conn, 5)
+	assert.EqualValues(t, 5, readRawFrame(t, conn).Header.StreamId)
+	assert.EqualValues(t, 4, readRawFrame(t, conn).Header.StreamId)
+
+	cancelFn()
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+// Request handlers are invoked concurrently: waits until the response is handed over to the connection, to ensure
+// that responses are sent in the order of requests.
+func writeRawQueryAndAwaitResponse(t *testing.T, serverConn *client.CqlServerConnection, conn net.Conn, streamId int16) {
+	writeRawQuery(t, conn, streamId)
+	require.Eventually(t, func() bool {
+		for _, entry := range serverConn.ActivityLog().Entries(nil) {
+			if entry.Request.Header.StreamId == streamId && entry.Response != nil {
+				return true
+			}
+		}
+		return false
+	}, time.Second*10, time.Millisecond)
+}
+
+func TestFaults_Corrupt(t *testing.T) {
+	server, serverConn, conn, cancelFn := createServerAndRawConn(t)
+	defer cancelFn()
+
+	writeRawQuery(t, conn, 1)
+	expected := readRawFrame(t, conn)
+	serverConn.SetFaults(&client.Faults{CorruptProbability: 1})
+	writeRawQuery(t, conn, 1)
+	corrupted := readRawFrame(t, conn)
+	assert.Equal(t, expected.Header, corrupted.Header)
+	assert.Len(t, corrupted.Body, len(expected.Body))
+	assert.NotEqual(t, expected.Body, corrupted.Body)
+
+	cancelFn()
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestFaults_Truncate(t *testing.T) {
+	server, serverConn, conn, cancelFn := createServerAndRawConn(t)
+	defer cancelFn()
+
+	writeRawQuery(t, conn, 1)
+	expected := readRawFrame(t, conn)
+	serverConn.SetFaults(&client.Faults{TruncateProbability: 1})
+	writeRawQuery(t, conn, 1)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second*10)))
+	truncated, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	assert.Equal(t, 9+len(expected.Body)/2, len(truncated))
+	assert.Eventually(t, serverConn.IsClosed, time.Second*10, time.Millisecond*10)
+
+	cancelFn()
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestFaults_StallReads(t *testing.T) {
+	server, serverConn, conn, cancelFn := createServerAndRawConn(t)
+	defer cancelFn()
+
+	server.SetFaults(&client.Faults{StallReads: true})
+	// the request being read when reads are stalled is still processed
+	writeRawQuery(t, conn, 1)
+	assert.EqualValues(t, 1, readRawFrame(t, conn).Header.StreamId)
+	writeRawQuery(t, conn, 2)
+	time.Sleep(100 * time.Millisecond)
+	serverConn.ActivityLog().AssertRequestCount(t, nil, 1)
+
+	server.SetFaults(nil)
+	assert.EqualValues(t, 2, readRawFrame(t, conn).Header.StreamId)
+	serverConn.ActivityLog().AssertRequestCount(t, nil, 2)
+
+	cancelFn()
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestFaults_HalfClose(t *testing.T) {
+	server, serverConn, conn, cancelFn := createServerAndRawConn(t)
+	defer cancelFn()
+
+	serverConn.SetFaults(&client.Faults{HalfClose: true})
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second*10)))
+	remaining, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	assert.Empty(t, remaining)
+
+	// the server keeps reading requests
+	writeRawQuery(t, conn, 1)
+	serverConn.ActivityLog().RequireRequests(t, nil, 1, time.Second*10)
+	assert.False(t, serverConn.IsClosed())
+
+	cancelFn()
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
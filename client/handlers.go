@@ -22,11 +22,11 @@ import (
 )
 
 // A RequestHandler to handle server-side heartbeats. This handler assumes that every OPTIONS request is a heartbeat
-// probe and replies with a SUPPORTED response.
+// probe and replies with a SUPPORTED response advertising the connection supported options.
 var HeartbeatHandler RequestHandler = func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) (response *frame.Frame) {
 	if _, ok := request.Body.Message.(*message.Options); ok {
 		log.Debug().Msgf("%v: [heartbeat handler]: received heartbeat probe", conn)
-		response = frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Supported{})
+		response = frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Supported{Options: conn.SupportedOptions()})
 	}
 	return
 }
@@ -49,10 +49,12 @@ func NewSetKeyspaceHandler(onKeyspaceSet func(string)) RequestHandler {
 	}
 }
 
-// A RequestHandler to handle USE requests. This handler intercepts REGISTER requests and replies with READY.
+// A RequestHandler to handle REGISTER requests. This handler intercepts REGISTER requests, records the registered
+// event types on the connection (see CqlServerConnection.Register), and replies with READY.
 var RegisterHandler RequestHandler = func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) (response *frame.Frame) {
 	if register, ok := request.Body.Message.(*message.Register); ok {
 		log.Debug().Msgf("%v: [register handler]: received REGISTER: %v", conn, register.EventTypes)
+		conn.Register(request.Header.Version, register.EventTypes...)
 		response = frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Ready{})
 	}
 	return
@@ -108,7 +108,8 @@ func (c *CqlClientConnection) InitiateHandshake(version primitive.ProtocolVersio
 
 // Listens for a client STARTUP request and proceeds with the server-side handshake procedure. Authentication will be
 // required if the connection was created with auth credentials; otherwise the handshake will proceed without
-// authentication.
+// authentication. Compression is enabled if the STARTUP request asks for it; if the requested algorithm is not supported,
+// a PROTOCOL ERROR is sent back and an error is returned. See EnableCompression.
 // This method is intended for use when server-side handshake should be triggered manually. For automatic server-side
 // handshake, consider using HandshakeHandler instead.
 func (c *CqlServerConnection) AcceptHandshake() (err error) {
@@ -118,13 +119,18 @@ func (c *CqlServerConnection) AcceptHandshake() (err error) {
 	done := false
 	for !done && err == nil {
 		if request, err = c.Receive(); err == nil {
-			switch request.Body.Message.(type) {
+			switch msg := request.Body.Message.(type) {
 			case *message.Options:
-				supported := frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Supported{})
+				supported := frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Supported{Options: c.SupportedOptions()})
 				err = c.Send(supported)
 				continue
 			case *message.Startup:
-				if c.credentials == nil {
+				if err = c.EnableCompression(msg.GetCompression()); err != nil {
+					protocolError := frame.NewFrame(request.Header.Version, request.Header.StreamId, unknownCompressionError(msg))
+					if sendErr := c.Send(protocolError); sendErr != nil {
+						err = sendErr
+					}
+				} else if c.credentials == nil {
 					authSuccess = true
 					ready := frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Ready{})
 					err = c.Send(ready)
@@ -176,7 +182,8 @@ const (
 )
 
 // A RequestHandler to handle server-side handshakes. This is an alternative to CqlServerConnection.AcceptHandshake
-// to make the server connection automatically handle all incoming handshake attempts.
+// to make the server connection automatically handle all incoming handshake attempts. Compression is enabled if the
+// STARTUP request asks for it; STARTUP requests asking for an unsupported algorithm are rejected with a PROTOCOL ERROR.
 var HandshakeHandler RequestHandler = func(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) (response *frame.Frame) {
 	if ctx.GetAttribute(handshakeStateKey) == handshakeStateDone {
 		return
@@ -186,9 +193,12 @@ var HandshakeHandler RequestHandler = func(request *frame.Frame, conn *CqlServer
 	switch msg := request.Body.Message.(type) {
 	case *message.Options:
 		log.Debug().Msgf("%v: [handshake handler]: intercepted OPTIONS before STARTUP", conn)
-		response = frame.NewFrame(version, id, &message.Supported{})
+		response = frame.NewFrame(version, id, &message.Supported{Options: conn.SupportedOptions()})
 	case *message.Startup:
-		if conn.Credentials() == nil {
+		if err := conn.EnableCompression(msg.GetCompression()); err != nil {
+			log.Error().Err(err).Msgf("%v: [handshake handler]: compression negotiation failed", conn)
+			response = frame.NewFrame(version, id, unknownCompressionError(msg))
+		} else if conn.Credentials() == nil {
 			ctx.PutAttribute(handshakeStateKey, handshakeStateDone)
 			log.Info().Msgf("%v: [handshake handler]: handshake successful", conn)
 			response = frame.NewFrame(version, id, &message.Ready{})
@@ -223,3 +233,7 @@ var HandshakeHandler RequestHandler = func(request *frame.Frame, conn *CqlServer
 	}
 	return
 }
+
+func unknownCompressionError(startup *message.Startup) *message.ProtocolError {
+	return &message.ProtocolError{ErrorMessage: fmt.Sprintf("Unknown compression algorithm: %v", startup.GetCompression())}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"sync/atomic"
+	"time"
+)
+
+func (c *CqlClientConnection) recordActivity() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// Returns how long this connection has been idle, that is, the time elapsed since the last frame was sent or received.
+func (c *CqlClientConnection) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+func (c *CqlClientConnection) heartbeatLoop() {
+	if c.heartbeatInterval <= 0 {
+		return
+	}
+	log.Debug().Msgf("%v: sending heartbeats every %v of inactivity", c, c.heartbeatInterval)
+	c.waitGroup.Add(1)
+	go func() {
+		var failure error
+		timer := time.NewTimer(c.heartbeatInterval)
+		for !c.IsClosed() && failure == nil {
+			select {
+			case <-timer.C:
+				if idle := c.idleTime(); idle < c.heartbeatInterval {
+					timer.Reset(c.heartbeatInterval - idle)
+				} else {
+					if err := c.sendHeartbeat(); err != nil && !c.IsClosed() {
+						failure = err
+					}
+					timer.Reset(c.heartbeatInterval)
+				}
+			case <-c.ctx.Done():
+			}
+		}
+		timer.Stop()
+		c.waitGroup.Done()
+		if failure != nil {
+			log.Error().Err(failure).Msgf("%v: heartbeat failed, closing connection", c)
+			for _, handler := range c.heartbeatHandlers {
+				handler(failure, c)
+			}
+			c.abort()
+		}
+	}()
+}
+
+func (c *CqlClientConnection) sendHeartbeat() error {
+	version := primitive.ProtocolVersion(atomic.LoadUint32(&c.version))
+	if version == 0 {
+		log.Trace().Msgf("%v: protocol version not known yet, skipping heartbeat", c)
+		return nil
+	}
+	log.Debug().Msgf("%v: connection idle, sending heartbeat", c)
+	heartbeat := frame.NewFrame(version, ManagedStreamId, &message.Options{})
+	ctx, cancel := context.WithTimeout(c.ctx, c.heartbeatTimeout)
+	defer cancel()
+	if response, err := c.SendAndReceiveContext(ctx, heartbeat); err != nil {
+		return fmt.Errorf("%v: heartbeat failed: %w", c, err)
+	} else if _, supported := response.Body.Message.(*message.Supported); !supported {
+		return fmt.Errorf("%v: expected SUPPORTED in response to heartbeat, got: %v", c, response.Body.Message)
+	}
+	log.Debug().Msgf("%v: heartbeat successful", c)
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCqlClientConnection_Heartbeat(t *testing.T) {
+
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, client.HeartbeatHandler}
+
+	var failures int32
+	clt := client.NewCqlClient("127.0.0.1:9043", nil)
+	clt.HeartbeatInterval = 100 * time.Millisecond
+	clt.HeartbeatFailureHandlers = []client.HeartbeatFailureHandler{
+		func(err error, conn *client.CqlClientConnection) { atomic.AddInt32(&failures, 1) },
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	err := server.Start(ctx)
+	require.Nil(t, err)
+
+	clientConn, err := clt.ConnectAndInit(ctx, primitive.ProtocolVersion4, client.ManagedStreamId)
+	require.Nil(t, err)
+
+	serverConn, err := server.AcceptAny()
+	require.Nil(t, err)
+
+	startup, err := serverConn.Receive()
+	require.Nil(t, err)
+	require.IsType(t, &message.Startup{}, startup.Body.Message)
+
+	for i := 0; i < 3; i++ {
+		heartbeat, err := serverConn.Receive()
+		require.Nil(t, err)
+		require.IsType(t, &message.Options{}, heartbeat.Body.Message)
+	}
+
+	require.False(t, clientConn.IsClosed())
+	require.EqualValues(t, 0, atomic.LoadInt32(&failures))
+
+	cancelFn()
+
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestCqlClientConnection_HeartbeatFailure(t *testing.T) {
+
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	// no heartbeat handler: heartbeats will never be answered
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler}
+
+	failures := make(chan error, 1)
+	clt := client.NewCqlClient("127.0.0.1:9043", nil)
+	clt.HeartbeatInterval = 100 * time.Millisecond
+	clt.HeartbeatTimeout = 100 * time.Millisecond
+	clt.HeartbeatFailureHandlers = []client.HeartbeatFailureHandler{
+		func(err error, conn *client.CqlClientConnection) { failures <- err },
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	err := server.Start(ctx)
+	require.Nil(t, err)
+
+	clientConn, err := clt.ConnectAndInit(ctx, primitive.ProtocolVersion4, client.ManagedStreamId)
+	require.Nil(t, err)
+
+	select {
+	case err := <-failures:
+		require.NotNil(t, err)
+	case <-time.After(time.Second * 5):
+		require.Fail(t, "heartbeat failure handler not invoked")
+	}
+
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+
+	cancelFn()
+
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
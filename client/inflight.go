@@ -65,7 +65,34 @@ func newInFlightRequestsHandler(
 	return handler
 }
 
-func (h *inFlightRequestsHandler) onOutgoingFrameEnqueued(f *frame.Frame) (InFlightRequest, error) {
+// RequestTimeoutError is the error reported by an in-flight request when its response was not received in time, either
+// because the configured read timeout elapsed, or because the deadline of the request context was exceeded. Use
+// errors.As to distinguish timeouts from other failures, such as connection failures.
+type RequestTimeoutError struct {
+	// The stream id of the request that timed out.
+	StreamId int16
+	// Whether the timeout was caused by the request context deadline, rather than by the configured read timeout.
+	DeadlineExceeded bool
+}
+
+func (e *RequestTimeoutError) Error() string {
+	if e.DeadlineExceeded {
+		return fmt.Sprintf("request deadline exceeded waiting for incoming frames on stream id %d", e.StreamId)
+	}
+	return fmt.Sprintf("timed out waiting for incoming frames on stream id %d", e.StreamId)
+}
+
+// Timeout always returns true; it is provided for compatibility with net.Error.
+func (e *RequestTimeoutError) Timeout() bool {
+	return true
+}
+
+// Unwrap returns context.DeadlineExceeded, so that errors.Is(err, context.DeadlineExceeded) holds for all timeouts.
+func (e *RequestTimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+func (h *inFlightRequestsHandler) onOutgoingFrameEnqueued(ctx context.Context, f *frame.Frame) (InFlightRequest, error) {
 	if h.isClosed() {
 		return nil, fmt.Errorf("%v: handler closed", h)
 	}
@@ -91,6 +118,7 @@ func (h *inFlightRequestsHandler) onOutgoingFrameEnqueued(f *frame.Frame) (InFli
 		inFlight, err = h.addInFlight(streamId, managedStreamId)
 		if err == nil {
 			inFlight.startTimeout()
+			inFlight.watchContext(ctx)
 			return inFlight, nil
 		}
 	}
@@ -143,6 +171,28 @@ func (h *inFlightRequestsHandler) removeInFlight(streamId int16) {
 	}
 }
 
+// Returns the number of requests currently in-flight, including orphaned ones.
+func (h *inFlightRequestsHandler) inFlightCount() int {
+	h.inFlightLock.RLock()
+	defer h.inFlightLock.RUnlock()
+	return len(h.inFlight)
+}
+
+// Returns the number of orphaned requests, that is, requests that were closed because of a timeout or a cancellation,
+// but whose response hasn't arrived yet. The stream ids of orphaned requests remain in use until their (late)
+// responses arrive, since reusing them earlier could cause late responses to be delivered to the wrong requests.
+func (h *inFlightRequestsHandler) orphanedCount() int {
+	h.inFlightLock.RLock()
+	defer h.inFlightLock.RUnlock()
+	count := 0
+	for _, inFlight := range h.inFlight {
+		if inFlight.IsDone() {
+			count++
+		}
+	}
+	return count
+}
+
 func (h *inFlightRequestsHandler) borrowStreamId() (int16, error) {
 	if h.isClosed() {
 		return -1, fmt.Errorf("%v: handler closed", h)
@@ -293,7 +343,7 @@ func (r *inFlightRequest) startTimeout() {
 		case <-r.timeoutCtx.Done():
 			switch r.timeoutCtx.Err() {
 			case context.DeadlineExceeded:
-				err := fmt.Errorf("%v: timed out waiting for incoming frames", r)
+				err := fmt.Errorf("%v: %w", r, &RequestTimeoutError{StreamId: r.streamId})
 				r.close(err)
 			case context.Canceled:
 				log.Trace().Msgf("%v: timeout canceled", r)
@@ -302,13 +352,35 @@ func (r *inFlightRequest) startTimeout() {
 	}()
 }
 
+// Closes this request when the given request context is done, either because its deadline was exceeded or because it
+// was canceled. The request remains registered as orphaned until its response arrives.
+func (r *inFlightRequest) watchContext(ctx context.Context) {
+	if ctx == nil || ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			var err error
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("%v: %w", r, &RequestTimeoutError{StreamId: r.streamId, DeadlineExceeded: true})
+			} else {
+				err = fmt.Errorf("%v: request canceled: %w", r, ctx.Err())
+			}
+			log.Trace().Err(err).Msgf("%v: request context done, orphaning request", r)
+			r.close(err)
+		case <-r.ctx.Done():
+		}
+	}()
+}
+
 func (r *inFlightRequest) stopTimeout() {
 	if r.timeoutCancel != nil {
 		r.timeoutCancel()
 	}
 }
 
-func (r inFlightRequest) resetTimeout() {
+func (r *inFlightRequest) resetTimeout() {
 	r.stopTimeout()
 	r.startTimeout()
 }
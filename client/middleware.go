@@ -0,0 +1,120 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// A Middleware wraps a RequestHandler into another RequestHandler. The returned handler can inspect the request,
+// invoke the next handler (or not), and inspect or replace the response it produced; a nil response means, as usual,
+// that the request was not handled. Use NewMiddlewareChain to wrap handlers with middlewares.
+// Handlers replying with multiple frames send all frames but the last one with CqlServerConnection.Send before
+// returning the last one; use InterceptResponses to also process these frames, or NewResponseMiddleware, which does
+// it for all frames.
+type Middleware func(next RequestHandler) RequestHandler
+
+// Creates a new RequestHandler wrapping the given handler with the given middlewares. The first middleware is the
+// outermost layer: it sees the request first, and the response last.
+func NewMiddlewareChain(handler RequestHandler, middlewares ...Middleware) RequestHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Creates a new Middleware invoking the next handler and applying the given function to each response frame it
+// produces for the request: the frame it returns, and the frames it sends beforehand with CqlServerConnection.Send, as
+// handlers replying with multiple frames do. The function is never invoked for unhandled requests; it may modify the
+// response, or return another frame. If it returns nil for a frame sent beforehand, the frame is dropped; if it
+// returns nil for the returned frame, the request is considered unhandled.
+func NewResponseMiddleware(transform func(request *frame.Frame, response *frame.Frame, conn *CqlServerConnection) *frame.Frame) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) *frame.Frame {
+			var response *frame.Frame
+			conn.InterceptResponses(request, func(sent *frame.Frame) *frame.Frame {
+				return transform(request, sent, conn)
+			}, func() {
+				response = next(request, conn, ctx)
+			})
+			if response == nil {
+				return nil
+			}
+			return transform(request, response, conn)
+		}
+	}
+}
+
+// A Middleware that logs the time the next handler took to produce a response, at debug level.
+var LatencyLoggingMiddleware Middleware = func(next RequestHandler) RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) *frame.Frame {
+		start := time.Now()
+		response := next(request, conn, ctx)
+		if response != nil {
+			log.Debug().Msgf("%v: [latency middleware]: request %v handled in %v", conn, request, time.Since(start))
+		}
+		return response
+	}
+}
+
+// Invokes the given function, applying the given interceptor to each frame sent with Send for the given request (that
+// is, with the request stream id) until the function returns. The interceptor may modify the frame, or return another
+// frame; if it returns nil, the frame is dropped. Interceptors can be nested: inner interceptors are applied first.
+// This allows middlewares to process the frames sent by handlers replying with multiple frames; see Middleware.
+func (c *CqlServerConnection) InterceptResponses(request *frame.Frame, interceptor func(*frame.Frame) *frame.Frame, f func()) {
+	streamId := request.Header.StreamId
+	c.interceptors.push(streamId, interceptor)
+	defer c.interceptors.pop(streamId)
+	f()
+}
+
+// responseInterceptors holds the interceptors of a connection, by stream id. The zero value is ready to use.
+type responseInterceptors struct {
+	interceptors map[int16][]func(*frame.Frame) *frame.Frame
+	lock         sync.Mutex
+}
+
+func (i *responseInterceptors) push(streamId int16, interceptor func(*frame.Frame) *frame.Frame) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.interceptors == nil {
+		i.interceptors = make(map[int16][]func(*frame.Frame) *frame.Frame)
+	}
+	i.interceptors[streamId] = append(i.interceptors[streamId], interceptor)
+}
+
+func (i *responseInterceptors) pop(streamId int16) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if interceptors := i.interceptors[streamId]; len(interceptors) > 1 {
+		i.interceptors[streamId] = interceptors[:len(interceptors)-1]
+	} else {
+		delete(i.interceptors, streamId)
+	}
+}
+
+// Applies the interceptors registered for the frame stream id, innermost first. Returns nil if the frame was dropped.
+func (i *responseInterceptors) apply(f *frame.Frame) *frame.Frame {
+	i.lock.Lock()
+	interceptors := i.interceptors[f.Header.StreamId]
+	i.lock.Unlock()
+	for j := len(interceptors) - 1; j >= 0 && f != nil; j-- {
+		f = interceptors[j](f)
+	}
+	return f
+}
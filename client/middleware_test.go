@@ -0,0 +1,145 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestNewMiddlewareChain(t *testing.T) {
+	var calls []string
+	tracing := func(name string) client.Middleware {
+		return func(next client.RequestHandler) client.RequestHandler {
+			return func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+				calls = append(calls, name+" before")
+				response := next(request, conn, ctx)
+				calls = append(calls, name+" after")
+				return response
+			}
+		}
+	}
+	warnings := client.NewResponseMiddleware(func(request *frame.Frame, response *frame.Frame, _ *client.CqlServerConnection) *frame.Frame {
+		response.SetWarnings(append(response.Body.Warnings, "warning"))
+		return response
+	})
+	payload := client.NewResponseMiddleware(func(request *frame.Frame, response *frame.Frame, _ *client.CqlServerConnection) *frame.Frame {
+		response.SetCustomPayload(map[string][]byte{"key": {1}})
+		return response
+	})
+	handler := client.NewMiddlewareChain(
+		client.HeartbeatHandler,
+		tracing("outer"),
+		client.LatencyLoggingMiddleware,
+		warnings,
+		payload,
+		tracing("inner"),
+	)
+	server, clientConn, cancelFn := createServerAndClient(t, handler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.Supported{}, response.Body.Message)
+	assert.Equal(t, []string{"warning"}, response.Body.Warnings)
+	assert.Equal(t, map[string][]byte{"key": {1}}, response.Body.CustomPayload)
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+
+	// unhandled requests are not transformed
+	calls = nil
+	unhandled := frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Query{Query: "SELECT * FROM system.local"})
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	assert.Nil(t, handler(unhandled, serverConns[0], nil))
+	assert.Equal(t, []string{"outer before", "inner before", "inner after", "outer after"}, calls)
+}
+
+func TestNewResponseMiddleware_MultipleFrames(t *testing.T) {
+	var frames []*frame.Frame
+	lock := &sync.Mutex{}
+	middleware := client.NewResponseMiddleware(func(request *frame.Frame, response *frame.Frame, _ *client.CqlServerConnection) *frame.Frame {
+		lock.Lock()
+		frames = append(frames, response)
+		lock.Unlock()
+		rows, ok := response.Body.Message.(*message.RowsResult)
+		if !ok {
+			return response
+		}
+		var data message.RowSet
+		for _, row := range rows.Data {
+			data = append(data, message.Row{{0, 0, 1, row[0][3]}})
+		}
+		rows.Data = data
+		return response
+	})
+	handler := client.NewMiddlewareChain(newContinuousPagingTestHandler(), middleware)
+	server, clientConn, cancelFn := createServerAndClient(t, handler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	session, err := clientConn.StartContinuousPaging(context.Background(), continuousPagingHandlerQuery(&message.ContinuousPagingOptions{}))
+	require.Nil(t, err)
+	var pages, rows int
+	for {
+		page, err := session.NextPage()
+		require.Nil(t, err)
+		if page == nil {
+			break
+		}
+		for _, row := range page.Data {
+			assert.Equal(t, message.Row{{0, 0, 1, byte(rows)}}, row)
+			rows++
+		}
+		pages++
+	}
+	assert.Equal(t, 4, pages)
+	assert.Equal(t, 10, rows)
+	lock.Lock()
+	assert.Len(t, frames, 4)
+	lock.Unlock()
+}
+
+func TestNewResponseMiddleware_Drop(t *testing.T) {
+	// a handler replying with two frames
+	handler := func(request *frame.Frame, conn *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+		intermediate := &message.Supported{Options: map[string][]string{"intermediate": {"true"}}}
+		if err := conn.Send(frame.NewFrame(request.Header.Version, request.Header.StreamId, intermediate)); err != nil {
+			return nil
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Supported{})
+	}
+	middleware := client.NewResponseMiddleware(func(request *frame.Frame, response *frame.Frame, _ *client.CqlServerConnection) *frame.Frame {
+		if _, intermediate := response.Body.Message.(*message.Supported).Options["intermediate"]; intermediate {
+			return nil
+		}
+		return response
+	})
+	server, clientConn, cancelFn := createServerAndClient(t, client.NewMiddlewareChain(handler, middleware))
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+	require.Nil(t, err)
+	require.IsType(t, &message.Supported{}, response.Body.Message)
+	assert.Empty(t, response.Body.Message.(*message.Supported).Options)
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	murmur3C1 uint64 = 0x87c37b91114253d5
+	murmur3C2 uint64 = 0x4cf5ad432745937f
+)
+
+// Computes the token of the given routing key, as computed by Cassandra's Murmur3Partitioner.
+// Note that Cassandra's implementation of the 128-bit x64 variant of MurmurHash3 differs from the reference
+// implementation: the bytes of the tail are sign-extended before being mixed in. Also, the minimum token value is
+// reserved, and is replaced by the maximum one.
+func Murmur3Token(key []byte) int64 {
+	h1 := murmur3Hash(key)
+	if h1 == math.MinInt64 {
+		return math.MaxInt64
+	}
+	return h1
+}
+
+// Returns the first 64 bits of Cassandra's variant of MurmurHash3_x64_128, with a zero seed.
+func murmur3Hash(key []byte) int64 {
+	length := len(key)
+	var h1, h2 uint64
+	nBlocks := length / 16
+	for i := 0; i < nBlocks; i++ {
+		k1 := binary.LittleEndian.Uint64(key[i*16:])
+		k2 := binary.LittleEndian.Uint64(key[i*16+8:])
+		h1 ^= murmur3MixK1(k1)
+		h1 = bits.RotateLeft64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+		h2 ^= murmur3MixK2(k2)
+		h2 = bits.RotateLeft64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+	tail := key[nBlocks*16:]
+	var k1, k2 uint64
+	for i := 8; i < len(tail); i++ {
+		k2 ^= uint64(int64(int8(tail[i]))) << (uint(i-8) * 8)
+	}
+	if len(tail) > 8 {
+		h2 ^= murmur3MixK2(k2)
+	}
+	for i := 0; i < len(tail) && i < 8; i++ {
+		k1 ^= uint64(int64(int8(tail[i]))) << (uint(i) * 8)
+	}
+	if len(tail) > 0 {
+		h1 ^= murmur3MixK1(k1)
+	}
+	h1 ^= uint64(length)
+	h2 ^= uint64(length)
+	h1 += h2
+	h2 += h1
+	h1 = murmur3Fmix(h1)
+	h2 = murmur3Fmix(h2)
+	h1 += h2
+	return int64(h1)
+}
+
+func murmur3MixK1(k1 uint64) uint64 {
+	k1 *= murmur3C1
+	k1 = bits.RotateLeft64(k1, 31)
+	k1 *= murmur3C2
+	return k1
+}
+
+func murmur3MixK2(k2 uint64) uint64 {
+	k2 *= murmur3C2
+	k2 = bits.RotateLeft64(k2, 33)
+	k2 *= murmur3C1
+	return k2
+}
+
+func murmur3Fmix(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
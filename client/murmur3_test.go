@@ -0,0 +1,39 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMurmur3Token(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      []byte
+		expected int64
+	}{
+		// values obtained with SELECT token(pk) on a table with an int partition key
+		{"int 1", []byte{0, 0, 0, 1}, -4069959284402364209},
+		{"int 2", []byte{0, 0, 0, 2}, -3248873570005575792},
+		{"int 3", []byte{0, 0, 0, 3}, 9010454139840013625},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, client.Murmur3Token(tt.key))
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/rs/zerolog/log"
+)
+
+// RequestSender is the interface of components capable of sending requests and waiting for their responses. It is
+// implemented by CqlClientConnection, ConnectionPool and ClusterClient.
+type RequestSender interface {
+	SendAndReceiveContext(ctx context.Context, f *frame.Frame) (*frame.Frame, error)
+}
+
+// RowIterator iterates over the rows returned by a QUERY or EXECUTE request, transparently fetching subsequent pages
+// using the paging state returned with each page. Rows are decoded with the codecs of their column types; columns for
+// which no codec is available are returned as raw bytes. Create RowIterator instances with NewRowIterator.
+// Typical usage:
+//
+//	iterator := NewRowIterator(ctx, conn, request, true)
+//	defer iterator.Close()
+//	for iterator.Next() {
+//		row := iterator.Row()
+//	}
+//	if err := iterator.Err(); err != nil {
+//		...
+//	}
+type RowIterator struct {
+	sender   RequestSender
+	request  *frame.Frame
+	prefetch bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	columns     []*message.ColumnMetadata
+	codecs      []datatype.Codec
+	page        message.RowSet
+	index       int
+	pagingState []byte
+	pending     <-chan *pageResult
+	row         []interface{}
+	err         error
+	closed      bool
+}
+
+type pageResult struct {
+	rows *message.RowsResult
+	err  error
+}
+
+// Creates a new RowIterator and starts fetching the first page of results. The request must be a QUERY or EXECUTE
+// request; its page size should be set in its query options. If prefetch is true, the next page is fetched in the
+// background as soon as the current page is received. The iterator stops when ctx is canceled; always call Close
+// when done with the iterator.
+func NewRowIterator(ctx context.Context, sender RequestSender, request *frame.Frame, prefetch bool) *RowIterator {
+	it := &RowIterator{
+		sender:   sender,
+		request:  request,
+		prefetch: prefetch,
+	}
+	it.ctx, it.cancel = context.WithCancel(ctx)
+	it.pending = it.fetch(nil)
+	return it
+}
+
+// Advances the iterator to the next row, fetching the next page if required. Returns false when there are no more
+// rows, or when an error occurred; use Err to tell the difference.
+func (it *RowIterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	for it.index >= len(it.page) {
+		if it.pending == nil {
+			if it.pagingState == nil {
+				return false
+			}
+			it.pending = it.fetch(it.pagingState)
+		}
+		var result *pageResult
+		select {
+		case result = <-it.pending:
+		case <-it.ctx.Done():
+			result = &pageResult{err: it.ctx.Err()}
+		}
+		it.pending = nil
+		if result.err != nil {
+			it.err = result.err
+			return false
+		}
+		it.setPage(result.rows)
+	}
+	raw := it.page[it.index]
+	it.index++
+	it.row = make([]interface{}, len(raw))
+	for i, column := range raw {
+		if i >= len(it.codecs) || it.codecs[i] == nil {
+			it.row[i] = []byte(column)
+		} else if value, err := it.codecs[i].Decode(column, it.request.Header.Version); err != nil {
+			it.err = fmt.Errorf("cannot decode column %v: %w", it.columns[i].Name, err)
+			return false
+		} else {
+			it.row[i] = value
+		}
+	}
+	return true
+}
+
+// Returns the decoded values of the current row.
+func (it *RowIterator) Row() []interface{} {
+	return it.row
+}
+
+// Returns the raw, undecoded values of the current row.
+func (it *RowIterator) RawRow() message.Row {
+	if it.index == 0 || it.index > len(it.page) {
+		return nil
+	}
+	return it.page[it.index-1]
+}
+
+// Returns the metadata of the result set columns, or nil if no page was received yet, or if the server did not send
+// result set metadata.
+func (it *RowIterator) Columns() []*message.ColumnMetadata {
+	return it.columns
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+// Closes the iterator and cancels any request in progress.
+func (it *RowIterator) Close() {
+	if !it.closed {
+		it.closed = true
+		it.cancel()
+	}
+}
+
+func (it *RowIterator) setPage(rows *message.RowsResult) {
+	it.page = rows.Data
+	it.index = 0
+	it.pagingState = nil
+	if rows.Metadata != nil {
+		if rows.Metadata.Columns != nil {
+			it.columns = rows.Metadata.Columns
+			it.codecs = make([]datatype.Codec, len(it.columns))
+			for i, column := range it.columns {
+				if codec, err := datatype.CodecFor(column.Type); err != nil {
+					log.Debug().Err(err).Msgf("row iterator: column %v will not be decoded", column.Name)
+				} else {
+					it.codecs[i] = codec
+				}
+			}
+		}
+		it.pagingState = rows.Metadata.PagingState
+	}
+	if it.pagingState != nil && it.prefetch {
+		it.pending = it.fetch(it.pagingState)
+	}
+}
+
+func (it *RowIterator) fetch(pagingState []byte) <-chan *pageResult {
+	ch := make(chan *pageResult, 1)
+	go func() {
+		ch <- it.fetchPage(pagingState)
+	}()
+	return ch
+}
+
+// Fetches the page with the given paging state, or the first page if pagingState is nil.
+func (it *RowIterator) fetchPage(pagingState []byte) *pageResult {
+	request := copyRequest(it.request)
+	if pagingState != nil {
+		var err error
+		if request, err = withPagingState(it.request, pagingState); err != nil {
+			return &pageResult{err: err}
+		}
+	}
+	response, err := it.sender.SendAndReceiveContext(it.ctx, request)
+	if err != nil {
+		return &pageResult{err: err}
+	}
+	switch msg := response.Body.Message.(type) {
+	case *message.RowsResult:
+		return &pageResult{rows: msg}
+	case message.Error:
+		return &pageResult{err: fmt.Errorf("server replied with error: %v", msg)}
+	default:
+		// not a SELECT statement
+		return &pageResult{rows: &message.RowsResult{}}
+	}
+}
+
+// Returns a copy of the given QUERY or EXECUTE request, with the given paging state.
+func withPagingState(request *frame.Frame, pagingState []byte) (*frame.Frame, error) {
+	var msg message.Message
+	switch m := request.Body.Message.(type) {
+	case *message.Query:
+		query := m.Clone().(*message.Query)
+		if query.Options == nil {
+			query.Options = &message.QueryOptions{}
+		}
+		query.Options.PagingState = pagingState
+		msg = query
+	case *message.Execute:
+		execute := &message.Execute{QueryId: m.QueryId, ResultMetadataId: m.ResultMetadataId, Options: &message.QueryOptions{}}
+		if m.Options != nil {
+			execute.Options = m.Options.Clone()
+		}
+		execute.Options.PagingState = pagingState
+		msg = execute
+	default:
+		return nil, fmt.Errorf("expected QUERY or EXECUTE request, got: %v", request.Body.Message)
+	}
+	f := copyRequest(request)
+	body := *request.Body
+	body.Message = msg
+	f.Body = &body
+	return f, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var pagingColumns = []*message.ColumnMetadata{
+	{Keyspace: "ks1", Table: "table1", Name: "id", Type: datatype.Int},
+	{Keyspace: "ks1", Table: "table1", Name: "name", Type: datatype.Varchar},
+}
+
+// Creates a RequestHandler that returns 10 rows for the given query, one page at a time. The paging state is the
+// index of the first row of the page. The onPage function is invoked with the index of each requested page, and may
+// return a non-nil message to reply with instead of the page.
+func newPagingHandler(query string, onPage func(page int) message.Message) client.RequestHandler {
+	return func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		q, ok := request.Body.Message.(*message.Query)
+		if !ok || q.Query != query {
+			return nil
+		}
+		start := 0
+		if q.Options.PagingState != nil {
+			start = int(binary.BigEndian.Uint32(q.Options.PagingState))
+		}
+		pageSize := int(q.Options.PageSize)
+		if msg := onPage(start / pageSize); msg != nil {
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+		}
+		metadata := &message.RowsMetadata{ColumnCount: 2, Columns: pagingColumns}
+		rows := message.RowSet{}
+		for i := start; i < start+pageSize && i < 10; i++ {
+			id, _ := (&datatype.IntCodec{}).Encode(int32(i), request.Header.Version)
+			rows = append(rows, message.Row{id, []byte(fmt.Sprintf("row%d", i))})
+		}
+		if end := start + pageSize; end < 10 {
+			metadata.PagingState = make([]byte, 4)
+			binary.BigEndian.PutUint32(metadata.PagingState, uint32(end))
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.RowsResult{Metadata: metadata, Data: rows})
+	}
+}
+
+func newPagedQuery(query string) *frame.Frame {
+	return frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query:   query,
+		Options: &message.QueryOptions{PageSize: 3},
+	})
+}
+
+func TestRowIterator(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefetch %v", prefetch), func(t *testing.T) {
+			var pages int32
+			handler := newPagingHandler("SELECT * FROM ks1.table1", func(page int) message.Message {
+				atomic.AddInt32(&pages, 1)
+				return nil
+			})
+			server, clientConn, cancelFn := createServerAndClient(t, handler)
+
+			iterator := client.NewRowIterator(context.Background(), clientConn, newPagedQuery("SELECT * FROM ks1.table1"), prefetch)
+			require.True(t, iterator.Next())
+			require.Equal(t, pagingColumns, iterator.Columns())
+			if prefetch {
+				// the second page is fetched while the first one is being consumed
+				assert.Eventually(t, func() bool { return atomic.LoadInt32(&pages) == 2 }, time.Second*5, time.Millisecond*10)
+			} else {
+				require.EqualValues(t, 1, atomic.LoadInt32(&pages))
+			}
+			count := 0
+			for ok := true; ok; ok = iterator.Next() {
+				require.Equal(t, []interface{}{int32(count), fmt.Sprintf("row%d", count)}, iterator.Row())
+				require.Equal(t, []byte(fmt.Sprintf("row%d", count)), []byte(iterator.RawRow()[1]))
+				count++
+			}
+			require.Nil(t, iterator.Err())
+			require.Equal(t, 10, count)
+			require.EqualValues(t, 4, atomic.LoadInt32(&pages))
+			iterator.Close()
+
+			cancelFn()
+			checkClosed(t, clientConn, server)
+		})
+	}
+}
+
+func TestRowIterator_Error(t *testing.T) {
+
+	handler := newPagingHandler("SELECT * FROM ks1.table1", func(page int) message.Message {
+		if page == 1 {
+			return &message.ReadTimeout{ErrorMessage: "read timeout", Received: 1, BlockFor: 2}
+		}
+		return nil
+	})
+	server, clientConn, cancelFn := createServerAndClient(t, handler)
+
+	iterator := client.NewRowIterator(context.Background(), clientConn, newPagedQuery("SELECT * FROM ks1.table1"), false)
+	count := 0
+	for iterator.Next() {
+		count++
+	}
+	require.Equal(t, 3, count)
+	require.NotNil(t, iterator.Err())
+	require.Contains(t, iterator.Err().Error(), "read timeout")
+	require.False(t, iterator.Next())
+	iterator.Close()
+
+	cancelFn()
+	checkClosed(t, clientConn, server)
+}
+
+func TestRowIterator_Canceled(t *testing.T) {
+
+	handler := newPagingHandler("SELECT * FROM ks1.table1", func(page int) message.Message {
+		if page == 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		return nil
+	})
+	server, clientConn, cancelFn := createServerAndClient(t, handler)
+
+	ctx, cancelIteration := context.WithCancel(context.Background())
+	defer cancelIteration()
+	iterator := client.NewRowIterator(ctx, clientConn, newPagedQuery("SELECT * FROM ks1.table1"), true)
+	count := 0
+	for iterator.Next() {
+		if count++; count == 3 {
+			cancelIteration()
+		}
+	}
+	require.Equal(t, 3, count)
+	require.True(t, errors.Is(iterator.Err(), context.Canceled))
+	iterator.Close()
+
+	cancelFn()
+	checkClosed(t, clientConn, server)
+}
@@ -0,0 +1,458 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultPoolSize = 2
+
+const (
+	DefaultReconnectBaseDelay = time.Second
+	DefaultReconnectMaxDelay  = time.Minute
+)
+
+const (
+	PoolStateNotStarted = int32(iota)
+	PoolStateRunning    = int32(iota)
+	PoolStateClosed     = int32(iota)
+)
+
+// ConnectionPool maintains a fixed number of fully-initialized connections to the remote address of a CqlClient. It is
+// preferable to create ConnectionPool instances using the constructor function NewConnectionPool. Once the pool is
+// properly created and configured, use Start to open its connections.
+// Requests sent through the pool are routed to the connection with the fewest in-flight requests. Connections that
+// get closed are replaced in the background, with an exponential backoff between reconnection attempts. The pool also
+// keeps track of the current keyspace: whenever a USE query succeeds on one connection, the same keyspace is set on
+// all other connections, including connections opened later on.
+// Statements prepared through the pool are stored in its PreparedStatementCache: when an EXECUTE request fails with an
+// UNPREPARED error, the statement is transparently prepared again and the request re-executed; and all known
+// statements are prepared on new connections, including connections reopened after a failure. Statements prepared in
+// a keyspace other than the pool's current keyspace can only be prepared again with protocol version 5 or DSE protocol
+// version 2, which allow PREPARE requests to set their keyspace.
+type ConnectionPool struct {
+	// The CqlClient to use to open new connections.
+	Client *CqlClient
+	// The protocol version to use when initializing new connections.
+	Version primitive.ProtocolVersion
+	// The number of connections to maintain. Must be strictly positive.
+	Size int
+	// The delay to wait before the first reconnection attempt; the delay doubles after each failed attempt. Must be
+	// strictly positive.
+	ReconnectBaseDelay time.Duration
+	// The maximum delay to wait between two reconnection attempts. Must be greater than or equal to ReconnectBaseDelay.
+	ReconnectMaxDelay time.Duration
+	// The cache of prepared statements. If nil, UNPREPARED errors are returned to the caller as is.
+	PreparedCache *PreparedStatementCache
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	connections []*CqlClientConnection
+	keyspace    string
+	lock        *sync.RWMutex
+	waitGroup   *sync.WaitGroup
+	state       int32
+}
+
+// Creates a new ConnectionPool with default options.
+func NewConnectionPool(client *CqlClient, version primitive.ProtocolVersion) *ConnectionPool {
+	return &ConnectionPool{
+		Client:             client,
+		Version:            version,
+		Size:               DefaultPoolSize,
+		ReconnectBaseDelay: DefaultReconnectBaseDelay,
+		ReconnectMaxDelay:  DefaultReconnectMaxDelay,
+		PreparedCache:      NewPreparedStatementCache(),
+	}
+}
+
+func (p *ConnectionPool) String() string {
+	return fmt.Sprintf("CQL pool [%v]", p.Client.RemoteAddress)
+}
+
+func (p *ConnectionPool) IsNotStarted() bool {
+	return atomic.LoadInt32(&p.state) == PoolStateNotStarted
+}
+
+func (p *ConnectionPool) IsRunning() bool {
+	return atomic.LoadInt32(&p.state) == PoolStateRunning
+}
+
+func (p *ConnectionPool) IsClosed() bool {
+	return atomic.LoadInt32(&p.state) == PoolStateClosed
+}
+
+// Starts the pool and opens its connections. Connections that could not be opened are retried in the background; this
+// method returns an error only if no connection at all could be opened.
+// Set ctx to context.Background if no parent context exists.
+func (p *ConnectionPool) Start(ctx context.Context) error {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+	if p.Size < 1 {
+		return fmt.Errorf("%v: size: expecting positive, got: %v", p, p.Size)
+	}
+	if p.ReconnectBaseDelay <= 0 {
+		return fmt.Errorf("%v: reconnect base delay: expecting positive, got: %v", p, p.ReconnectBaseDelay)
+	}
+	if p.ReconnectMaxDelay < p.ReconnectBaseDelay {
+		return fmt.Errorf("%v: reconnect max delay: expecting at least %v, got: %v", p, p.ReconnectBaseDelay, p.ReconnectMaxDelay)
+	}
+	if !atomic.CompareAndSwapInt32(&p.state, PoolStateNotStarted, PoolStateRunning) {
+		log.Debug().Msgf("%v: already started or closed", p)
+		return nil
+	}
+	log.Debug().Msgf("%v: pool is starting", p)
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.lock = &sync.RWMutex{}
+	p.waitGroup = &sync.WaitGroup{}
+	p.connections = make([]*CqlClientConnection, p.Size)
+	p.awaitDone()
+	var lastErr error
+	opened := 0
+	for slot := 0; slot < p.Size; slot++ {
+		if conn, err := p.connect(); err != nil {
+			log.Warn().Err(err).Msgf("%v: could not open connection %d, will retry", p, slot)
+			lastErr = err
+			p.reconnect(slot)
+		} else {
+			p.setConnection(slot, conn)
+			opened++
+		}
+	}
+	if opened == 0 {
+		_ = p.Close()
+		return fmt.Errorf("%v: start failed: %w", p, lastErr)
+	}
+	log.Info().Msgf("%v: successfully started with %d/%d connections", p, opened, p.Size)
+	return nil
+}
+
+// Closes the pool and all its connections.
+func (p *ConnectionPool) Close() (err error) {
+	if atomic.CompareAndSwapInt32(&p.state, PoolStateRunning, PoolStateClosed) {
+		log.Debug().Msgf("%v: closing", p)
+		p.cancel()
+		p.lock.Lock()
+		connections := p.connections
+		p.connections = make([]*CqlClientConnection, p.Size)
+		p.lock.Unlock()
+		for _, conn := range connections {
+			if conn != nil {
+				if closeErr := conn.Close(); closeErr != nil {
+					err = closeErr
+				}
+			}
+		}
+		p.waitGroup.Wait()
+		log.Info().Msgf("%v: successfully closed", p)
+	} else {
+		log.Debug().Msgf("%v: not started or already closed", p)
+	}
+	return err
+}
+
+// Returns all the currently open connections in this pool.
+func (p *ConnectionPool) Connections() []*CqlClientConnection {
+	if p.IsNotStarted() {
+		return nil
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var connections []*CqlClientConnection
+	for _, conn := range p.connections {
+		if conn != nil && !conn.IsClosed() {
+			connections = append(connections, conn)
+		}
+	}
+	return connections
+}
+
+// Returns the current keyspace of this pool's connections, or empty if no keyspace was set.
+func (p *ConnectionPool) Keyspace() string {
+	if p.IsNotStarted() {
+		return ""
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.keyspace
+}
+
+// Returns the open connection with the fewest in-flight requests.
+func (p *ConnectionPool) Borrow() (*CqlClientConnection, error) {
+	if !p.IsRunning() {
+		return nil, fmt.Errorf("%v: pool not running", p)
+	}
+	var best *CqlClientConnection
+	bestCount := 0
+	for _, conn := range p.Connections() {
+		if count := conn.InFlightCount(); best == nil || count < bestCount {
+			best = conn
+			bestCount = count
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("%v: no connection available", p)
+	}
+	return best, nil
+}
+
+// Sends the given request frame on the least busy connection. See CqlClientConnection.Send.
+func (p *ConnectionPool) Send(f *frame.Frame) (InFlightRequest, error) {
+	return p.SendContext(context.Background(), f)
+}
+
+// Sends the given request frame on the least busy connection. See CqlClientConnection.SendContext.
+func (p *ConnectionPool) SendContext(ctx context.Context, f *frame.Frame) (InFlightRequest, error) {
+	if conn, err := p.Borrow(); err != nil {
+		return nil, err
+	} else {
+		return conn.SendContext(ctx, f)
+	}
+}
+
+// Sends the given request frame on the least busy connection and waits for its response.
+// See CqlClientConnection.SendAndReceive.
+func (p *ConnectionPool) SendAndReceive(f *frame.Frame) (*frame.Frame, error) {
+	return p.SendAndReceiveContext(context.Background(), f)
+}
+
+// Sends the given request frame on the least busy connection and waits for its response. If the response is a
+// message.SetKeyspaceResult, the new keyspace is set on all other connections as well. PREPARE requests are recorded in
+// the PreparedCache, and EXECUTE requests failing with an UNPREPARED error are prepared again and re-executed once.
+// See CqlClientConnection.SendAndReceiveContext.
+func (p *ConnectionPool) SendAndReceiveContext(ctx context.Context, f *frame.Frame) (*frame.Frame, error) {
+	if conn, err := p.Borrow(); err != nil {
+		return nil, err
+	} else if response, err := conn.SendAndReceiveContext(ctx, f); err != nil {
+		return nil, err
+	} else {
+		switch result := response.Body.Message.(type) {
+		case *message.SetKeyspaceResult:
+			if err := p.onKeyspaceSet(ctx, result.Keyspace, conn); err != nil {
+				return nil, err
+			}
+		case *message.PreparedResult:
+			p.onPrepared(f, result)
+		case *message.RowsResult:
+			p.onRows(f, result)
+		case *message.Unprepared:
+			return p.onUnprepared(ctx, conn, f, result, response)
+		}
+		return response, nil
+	}
+}
+
+func (p *ConnectionPool) onPrepared(request *frame.Frame, result *message.PreparedResult) {
+	if prepare, ok := request.Body.Message.(*message.Prepare); ok && p.PreparedCache != nil {
+		keyspace := prepare.Keyspace
+		if keyspace == "" {
+			keyspace = p.Keyspace()
+		}
+		p.PreparedCache.Put(newPreparedStatement(keyspace, prepare.Query, result))
+	}
+}
+
+func (p *ConnectionPool) onRows(request *frame.Frame, result *message.RowsResult) {
+	if result.Metadata == nil || result.Metadata.NewResultMetadataId == nil || p.PreparedCache == nil {
+		return
+	}
+	if execute, ok := request.Body.Message.(*message.Execute); ok {
+		log.Debug().Msgf("%v: result set metadata of prepared statement %x changed", p, execute.QueryId)
+		p.PreparedCache.updateResultMetadata(execute.QueryId, result.Metadata)
+	}
+}
+
+// Prepares again the statement targeted by the given EXECUTE request on the given connection, then re-executes the
+// request. The UNPREPARED response is returned as is if the statement is unknown.
+func (p *ConnectionPool) onUnprepared(
+	ctx context.Context,
+	conn *CqlClientConnection,
+	request *frame.Frame,
+	unprepared *message.Unprepared,
+	response *frame.Frame,
+) (*frame.Frame, error) {
+	execute, ok := request.Body.Message.(*message.Execute)
+	if !ok || p.PreparedCache == nil {
+		return response, nil
+	}
+	statement := p.PreparedCache.GetById(unprepared.Id)
+	if statement == nil {
+		log.Debug().Msgf("%v: unknown prepared statement %x, cannot prepare it again", p, unprepared.Id)
+		return response, nil
+	}
+	log.Debug().Msgf("%v: statement %x unprepared on %v, preparing it again", p, unprepared.Id, conn)
+	prepared, err := prepareStatement(ctx, conn, request.Header.Version, p.Keyspace(), statement)
+	if err != nil {
+		return nil, fmt.Errorf("%v: could not prepare %v again: %w", p, statement.Query, err)
+	}
+	p.PreparedCache.Put(prepared)
+	reExecute := &message.Execute{QueryId: prepared.Id, Options: execute.Options}
+	if execute.ResultMetadataId != nil {
+		reExecute.ResultMetadataId = prepared.ResultMetadataId
+	}
+	f := copyRequest(request)
+	body := *request.Body
+	body.Message = reExecute
+	f.Body = &body
+	if response, err = conn.SendAndReceiveContext(ctx, f); err != nil {
+		return nil, err
+	} else if rows, ok := response.Body.Message.(*message.RowsResult); ok {
+		p.onRows(f, rows)
+	}
+	return response, nil
+}
+
+// Prepares all the statements of the PreparedCache on the given connection. Failures are logged and ignored, since
+// statements are prepared again on demand anyway.
+func (p *ConnectionPool) prepareAll(conn *CqlClientConnection) {
+	if p.PreparedCache == nil {
+		return
+	}
+	keyspace := p.Keyspace()
+	for _, statement := range p.PreparedCache.Statements() {
+		if _, err := prepareStatement(p.ctx, conn, p.Version, keyspace, statement); err != nil {
+			log.Warn().Err(err).Msgf("%v: could not prepare %v on %v", p, statement.Query, conn)
+		}
+	}
+}
+
+// Sets the given keyspace on all the connections of this pool, including connections opened later on.
+func (p *ConnectionPool) UseKeyspace(ctx context.Context, keyspace string) error {
+	return p.onKeyspaceSet(ctx, keyspace, nil)
+}
+
+func (p *ConnectionPool) onKeyspaceSet(ctx context.Context, keyspace string, origin *CqlClientConnection) error {
+	if !p.IsRunning() {
+		return fmt.Errorf("%v: pool not running", p)
+	}
+	p.lock.Lock()
+	p.keyspace = keyspace
+	p.lock.Unlock()
+	log.Debug().Msgf("%v: keyspace set to %v, propagating to all connections", p, keyspace)
+	for _, conn := range p.Connections() {
+		if conn != origin {
+			if err := useKeyspace(ctx, conn, p.Version, keyspace); err != nil {
+				return fmt.Errorf("%v: could not set keyspace on %v: %w", p, conn, err)
+			}
+		}
+	}
+	return nil
+}
+
+var unquotedIdentifier = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func useKeyspace(ctx context.Context, conn *CqlClientConnection, version primitive.ProtocolVersion, keyspace string) error {
+	if !unquotedIdentifier.MatchString(keyspace) {
+		keyspace = `"` + strings.ReplaceAll(keyspace, `"`, `""`) + `"`
+	}
+	use := frame.NewFrame(version, ManagedStreamId, &message.Query{Query: "USE " + keyspace})
+	if response, err := conn.SendAndReceiveContext(ctx, use); err != nil {
+		return err
+	} else if _, ok := response.Body.Message.(*message.SetKeyspaceResult); !ok {
+		return fmt.Errorf("expected SET KEYSPACE result, got: %v", response.Body.Message)
+	}
+	return nil
+}
+
+func (p *ConnectionPool) connect() (*CqlClientConnection, error) {
+	conn, err := p.Client.ConnectAndInit(p.ctx, p.Version, ManagedStreamId)
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return nil, err
+	}
+	if keyspace := p.Keyspace(); keyspace != "" {
+		if err := useKeyspace(p.ctx, conn, p.Version, keyspace); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%v: could not set keyspace on %v: %w", p, conn, err)
+		}
+	}
+	p.prepareAll(conn)
+	return conn, nil
+}
+
+// Stores the given connection in the given slot, then watches it and triggers a reconnection when it gets closed.
+func (p *ConnectionPool) setConnection(slot int, conn *CqlClientConnection) {
+	p.lock.Lock()
+	if !p.IsRunning() {
+		p.lock.Unlock()
+		_ = conn.Close()
+		return
+	}
+	p.connections[slot] = conn
+	p.waitGroup.Add(1)
+	p.lock.Unlock()
+	go func() {
+		select {
+		case <-conn.ctx.Done():
+		case <-p.ctx.Done():
+		}
+		if p.IsRunning() {
+			log.Warn().Msgf("%v: connection %v was closed, reconnecting", p, conn)
+			p.reconnect(slot)
+		}
+		p.waitGroup.Done()
+	}()
+}
+
+func (p *ConnectionPool) awaitDone() {
+	p.waitGroup.Add(1)
+	go func() {
+		<-p.ctx.Done()
+		log.Debug().Err(p.ctx.Err()).Msgf("%v: context was closed", p)
+		p.waitGroup.Done()
+		if err := p.Close(); err != nil {
+			log.Error().Err(err).Msgf("%v: error closing", p)
+		}
+	}()
+}
+
+func (p *ConnectionPool) reconnect(slot int) {
+	p.waitGroup.Add(1)
+	go func() {
+		defer p.waitGroup.Done()
+		delay := p.ReconnectBaseDelay
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-time.After(delay):
+			case <-p.ctx.Done():
+				return
+			}
+			if conn, err := p.connect(); err != nil {
+				log.Debug().Err(err).Msgf("%v: reconnection attempt %d for connection %d failed", p, attempt, slot)
+				if delay *= 2; delay > p.ReconnectMaxDelay {
+					delay = p.ReconnectMaxDelay
+				}
+			} else {
+				log.Info().Msgf("%v: connection %d successfully reopened: %v", p, slot, conn)
+				p.setConnection(slot, conn)
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionPool(t *testing.T) {
+
+	var keyspaceSet int32
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{
+		client.HandshakeHandler,
+		client.NewSetKeyspaceHandler(func(keyspace string) {
+			require.Equal(t, "ks1", keyspace)
+			atomic.AddInt32(&keyspaceSet, 1)
+		}),
+		newDelayedHeartbeatHandler(200 * time.Millisecond),
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	err := server.Start(ctx)
+	require.Nil(t, err)
+
+	pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersion4)
+	pool.Size = 3
+	pool.ReconnectBaseDelay = 10 * time.Millisecond
+	err = pool.Start(ctx)
+	require.Nil(t, err)
+	require.Len(t, pool.Connections(), 3)
+
+	// requests are spread by in-flight count
+	var inFlights []client.InFlightRequest
+	for i := 0; i < 3; i++ {
+		inFlight, err := pool.Send(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Options{}))
+		require.Nil(t, err)
+		inFlights = append(inFlights, inFlight)
+	}
+	for _, conn := range pool.Connections() {
+		require.Equal(t, 1, conn.InFlightCount())
+	}
+	for _, inFlight := range inFlights {
+		response, err := pool.Connections()[0].Receive(inFlight)
+		require.Nil(t, err)
+		require.IsType(t, &message.Supported{}, response.Body.Message)
+	}
+
+	// keyspace is propagated to all connections
+	response, err := pool.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "USE ks1"}))
+	require.Nil(t, err)
+	require.IsType(t, &message.SetKeyspaceResult{}, response.Body.Message)
+	require.Equal(t, "ks1", pool.Keyspace())
+	require.EqualValues(t, 3, atomic.LoadInt32(&keyspaceSet))
+
+	// closed connections are replaced, and the keyspace is set on the new connection
+	closed := pool.Connections()[0]
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	for _, serverConn := range serverConns {
+		if serverConn.RemoteAddr().String() == closed.LocalAddr().String() {
+			require.Nil(t, serverConn.Close())
+		}
+	}
+	assert.Eventually(t, closed.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, func() bool {
+		connections := pool.Connections()
+		return len(connections) == 3 && connections[0] != closed
+	}, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&keyspaceSet) == 4 }, time.Second*10, time.Millisecond*10)
+
+	cancelFn()
+	assert.Eventually(t, pool.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestConnectionPool_Start_Invalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		baseDelay time.Duration
+		maxDelay  time.Duration
+	}{
+		{"zero size", 0, client.DefaultReconnectBaseDelay, client.DefaultReconnectMaxDelay},
+		{"zero base delay", 1, 0, client.DefaultReconnectMaxDelay},
+		{"negative base delay", 1, -time.Second, client.DefaultReconnectMaxDelay},
+		{"max delay less than base delay", 1, time.Second, time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersion4)
+			pool.Size = tt.size
+			pool.ReconnectBaseDelay = tt.baseDelay
+			pool.ReconnectMaxDelay = tt.maxDelay
+			assert.Error(t, pool.Start(context.Background()))
+			assert.True(t, pool.IsNotStarted())
+		})
+	}
+}
@@ -29,6 +29,7 @@ import (
 // invoking the provided rows factory function, which allows the result to be customized according to the bound
 // variables provided with the EXECUTE message.
 // - If the request was not prepared, returns an Unprepared ERROR response.
+// To emulate prepared statements for arbitrary queries, see PreparedStatementRegistry.
 func NewPreparedStatementHandler(
 	query string,
 	variables *message.VariablesMetadata,
@@ -0,0 +1,183 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"sort"
+	"sync"
+)
+
+// PreparedStatement is a statement prepared with a PREPARE request, as stored in a PreparedStatementCache.
+// PreparedStatement instances are immutable once stored in the cache: changes are stored as new instances.
+type PreparedStatement struct {
+	// The keyspace the statement was prepared in: either the keyspace of the PREPARE request, or the keyspace of the
+	// connection the statement was prepared on. Empty if no keyspace was set.
+	Keyspace string
+	// The query string of the statement.
+	Query string
+	// The prepared statement id.
+	Id []byte
+	// The result set metadata id; valid for protocol version 5 and DSE protocol version 2 only.
+	ResultMetadataId []byte
+	// The metadata of the statement's bound variables.
+	VariablesMetadata *message.VariablesMetadata
+	// The metadata of the statement's result set columns.
+	ResultMetadata *message.RowsMetadata
+}
+
+type preparedStatementKey struct {
+	keyspace string
+	query    string
+}
+
+// PreparedStatementCache stores the statements prepared through a ConnectionPool or a ClusterClient, keyed by keyspace
+// and query string. The cache is used to transparently re-prepare statements when a server replies to an EXECUTE
+// request with an UNPREPARED error, and to prepare all known statements on new connections. It is safe for concurrent
+// use and can be shared by many pools.
+type PreparedStatementCache struct {
+	byQuery map[preparedStatementKey]*PreparedStatement
+	byId    map[string]*PreparedStatement
+	lock    *sync.RWMutex
+}
+
+func NewPreparedStatementCache() *PreparedStatementCache {
+	return &PreparedStatementCache{
+		byQuery: make(map[preparedStatementKey]*PreparedStatement),
+		byId:    make(map[string]*PreparedStatement),
+		lock:    &sync.RWMutex{},
+	}
+}
+
+// Returns the statement prepared with the given query string in the given keyspace, or nil if none was found.
+func (c *PreparedStatementCache) Get(keyspace string, query string) *PreparedStatement {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.byQuery[preparedStatementKey{keyspace, query}]
+}
+
+// Returns the statement with the given prepared id, or nil if none was found.
+func (c *PreparedStatementCache) GetById(id []byte) *PreparedStatement {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.byId[string(id)]
+}
+
+// Stores the given statement, replacing any statement previously prepared with the same keyspace and query string.
+func (c *PreparedStatementCache) Put(statement *PreparedStatement) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := preparedStatementKey{statement.Keyspace, statement.Query}
+	if previous, found := c.byQuery[key]; found {
+		delete(c.byId, string(previous.Id))
+	}
+	c.byQuery[key] = statement
+	c.byId[string(statement.Id)] = statement
+}
+
+// Returns all the statements in the cache, sorted by keyspace and query string.
+func (c *PreparedStatementCache) Statements() []*PreparedStatement {
+	c.lock.RLock()
+	statements := make([]*PreparedStatement, 0, len(c.byQuery))
+	for _, statement := range c.byQuery {
+		statements = append(statements, statement)
+	}
+	c.lock.RUnlock()
+	sort.Slice(statements, func(i, j int) bool {
+		if statements[i].Keyspace != statements[j].Keyspace {
+			return statements[i].Keyspace < statements[j].Keyspace
+		}
+		return statements[i].Query < statements[j].Query
+	})
+	return statements
+}
+
+// Removes all the statements from the cache.
+func (c *PreparedStatementCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.byQuery = make(map[preparedStatementKey]*PreparedStatement)
+	c.byId = make(map[string]*PreparedStatement)
+}
+
+// Records the new result set metadata of the statement with the given id, as returned by the server in a ROWS result
+// when the statement's result set changed (protocol version 5 and DSE protocol version 2 only).
+func (c *PreparedStatementCache) updateResultMetadata(id []byte, metadata *message.RowsMetadata) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if previous, found := c.byId[string(id)]; found {
+		statement := *previous
+		statement.ResultMetadataId = metadata.NewResultMetadataId
+		if metadata.Columns != nil {
+			statement.ResultMetadata = metadata
+		}
+		c.byQuery[preparedStatementKey{statement.Keyspace, statement.Query}] = &statement
+		c.byId[string(id)] = &statement
+	}
+}
+
+func newPreparedStatement(keyspace string, query string, result *message.PreparedResult) *PreparedStatement {
+	return &PreparedStatement{
+		Keyspace:          keyspace,
+		Query:             query,
+		Id:                result.PreparedQueryId,
+		ResultMetadataId:  result.ResultMetadataId,
+		VariablesMetadata: result.VariablesMetadata,
+		ResultMetadata:    result.ResultMetadata,
+	}
+}
+
+// Prepares the given statement on the given connection. The statement's keyspace, if any, is included in the PREPARE
+// request only if it differs from the given current keyspace of the connection, which requires protocol version 5 or
+// DSE protocol version 2: with other versions, an error is returned, since the statement would be prepared in the
+// wrong keyspace.
+func prepareStatement(
+	ctx context.Context,
+	conn *CqlClientConnection,
+	version primitive.ProtocolVersion,
+	currentKeyspace string,
+	statement *PreparedStatement,
+) (*PreparedStatement, error) {
+	prepare := &message.Prepare{Query: statement.Query}
+	// statements prepared without keyspace are fully qualified, and can be prepared in any keyspace
+	if statement.Keyspace != "" && statement.Keyspace != currentKeyspace {
+		if !hasPrepareKeyspace(version) {
+			return nil, fmt.Errorf(
+				"cannot prepare statement in keyspace %v on a connection using keyspace %v with protocol version %v",
+				statement.Keyspace,
+				currentKeyspace,
+				version,
+			)
+		}
+		prepare.Keyspace = statement.Keyspace
+	}
+	response, err := conn.SendAndReceiveContext(ctx, frame.NewFrame(version, ManagedStreamId, prepare))
+	if err != nil {
+		return nil, err
+	} else if result, ok := response.Body.Message.(*message.PreparedResult); !ok {
+		return nil, fmt.Errorf("expected PREPARED result, got: %v", response.Body.Message)
+	} else {
+		return newPreparedStatement(statement.Keyspace, statement.Query, result), nil
+	}
+}
+
+// Returns whether PREPARE requests can set their keyspace with the given protocol version.
+func hasPrepareKeyspace(version primitive.ProtocolVersion) bool {
+	return version >= primitive.ProtocolVersion5 && version != primitive.ProtocolVersionDse1
+}
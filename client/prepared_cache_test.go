@@ -0,0 +1,253 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreparedStatementCache(t *testing.T) {
+	cache := client.NewPreparedStatementCache()
+	assert.Nil(t, cache.Get("ks1", "SELECT 1"))
+	assert.Nil(t, cache.GetById([]byte{1}))
+
+	statement1 := &client.PreparedStatement{Keyspace: "ks1", Query: "SELECT 1", Id: []byte{1}}
+	statement2 := &client.PreparedStatement{Keyspace: "", Query: "SELECT 2", Id: []byte{2}}
+	cache.Put(statement1)
+	cache.Put(statement2)
+	assert.Same(t, statement1, cache.Get("ks1", "SELECT 1"))
+	assert.Nil(t, cache.Get("ks2", "SELECT 1"))
+	assert.Same(t, statement1, cache.GetById([]byte{1}))
+	assert.Same(t, statement2, cache.Get("", "SELECT 2"))
+	assert.Equal(t, []*client.PreparedStatement{statement2, statement1}, cache.Statements())
+
+	// same keyspace and query: the previous statement is replaced
+	statement3 := &client.PreparedStatement{Keyspace: "ks1", Query: "SELECT 1", Id: []byte{3}}
+	cache.Put(statement3)
+	assert.Same(t, statement3, cache.Get("ks1", "SELECT 1"))
+	assert.Nil(t, cache.GetById([]byte{1}))
+	assert.Same(t, statement3, cache.GetById([]byte{3}))
+	assert.Len(t, cache.Statements(), 2)
+
+	cache.Clear()
+	assert.Empty(t, cache.Statements())
+	assert.Nil(t, cache.Get("", "SELECT 2"))
+}
+
+// A RequestHandler handling PREPARE and EXECUTE requests for any query, that forgets prepared statements on each new
+// connection and when forget is incremented. For EXECUTE requests, the rows returned contain the query string. The
+// result metadata id is changed when the query is prepared again.
+type unpreparingHandler struct {
+	prepares int32
+	executes int32
+	forget   int32
+}
+
+func (h *unpreparingHandler) handler(request *frame.Frame, _ *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+	version := request.Header.Version
+	id := request.Header.StreamId
+	switch msg := request.Body.Message.(type) {
+	case *message.Prepare:
+		prepares := atomic.AddInt32(&h.prepares, 1)
+		ctx.PutAttribute(msg.Query, atomic.LoadInt32(&h.forget))
+		return frame.NewFrame(version, id, &message.PreparedResult{
+			PreparedQueryId:   []byte(msg.Query),
+			ResultMetadataId:  []byte{byte(prepares)},
+			VariablesMetadata: &message.VariablesMetadata{},
+			ResultMetadata:    &message.RowsMetadata{ColumnCount: 1},
+		})
+	case *message.Execute:
+		atomic.AddInt32(&h.executes, 1)
+		if generation, ok := ctx.GetAttribute(string(msg.QueryId)).(int32); !ok || generation != atomic.LoadInt32(&h.forget) {
+			return frame.NewFrame(version, id, &message.Unprepared{ErrorMessage: "unprepared", Id: msg.QueryId})
+		}
+		return frame.NewFrame(version, id, &message.RowsResult{
+			Metadata: &message.RowsMetadata{ColumnCount: 1},
+			Data:     message.RowSet{{msg.QueryId}},
+		})
+	}
+	return nil
+}
+
+func TestConnectionPool_Unprepared(t *testing.T) {
+	unpreparing := &unpreparingHandler{}
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, unpreparing.handler}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+
+	pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersion4)
+	pool.Size = 1
+	pool.ReconnectBaseDelay = 10 * time.Millisecond
+	require.Nil(t, pool.Start(ctx))
+
+	query := "SELECT * FROM ks1.table1"
+	response, err := pool.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+	statement := pool.PreparedCache.Get("", query)
+	require.NotNil(t, statement)
+	assert.Equal(t, []byte(query), statement.Id)
+
+	execute := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{
+		QueryId: statement.Id,
+		Options: &message.QueryOptions{},
+	})
+	response, err = pool.SendAndReceive(execute)
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+
+	// the server forgets the statement: it is prepared again, then the request is re-executed
+	atomic.AddInt32(&unpreparing.forget, 1)
+	response, err = pool.SendAndReceive(execute)
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.Equal(t, message.RowSet{{[]byte(query)}}, response.Body.Message.(*message.RowsResult).Data)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&unpreparing.prepares))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&unpreparing.executes))
+
+	// unknown statements are not prepared again
+	unknown := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{QueryId: []byte("unknown")})
+	response, err = pool.SendAndReceive(unknown)
+	require.Nil(t, err)
+	require.IsType(t, &message.Unprepared{}, response.Body.Message)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&unpreparing.prepares))
+
+	// known statements are prepared on new connections
+	closed := pool.Connections()[0]
+	serverConns, err := server.AllAcceptedClients()
+	require.Nil(t, err)
+	for _, serverConn := range serverConns {
+		require.Nil(t, serverConn.Close())
+	}
+	assert.Eventually(t, closed.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&unpreparing.prepares) == 3 }, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, func() bool {
+		connections := pool.Connections()
+		return len(connections) == 1 && connections[0] != closed
+	}, time.Second*10, time.Millisecond*10)
+	response, err = pool.SendAndReceive(execute)
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&unpreparing.prepares))
+
+	cancelFn()
+	assert.Eventually(t, pool.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestConnectionPool_Unprepared_KeyspaceMismatch(t *testing.T) {
+	unpreparing := &unpreparingHandler{}
+	useHandler := func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+		if query, ok := request.Body.Message.(*message.Query); ok && strings.HasPrefix(query.Query, "USE ") {
+			keyspace := strings.TrimPrefix(query.Query, "USE ")
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.SetKeyspaceResult{Keyspace: keyspace})
+		}
+		return nil
+	}
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, useHandler, unpreparing.handler}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+
+	pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersion4)
+	pool.Size = 1
+	require.Nil(t, pool.Start(ctx))
+
+	require.Nil(t, pool.UseKeyspace(ctx, "ks1"))
+	query := "SELECT * FROM table1"
+	response, err := pool.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+	statement := pool.PreparedCache.Get("ks1", query)
+	require.NotNil(t, statement)
+
+	// protocol version 4 cannot prepare the statement in ks1 on a connection using ks2
+	require.Nil(t, pool.UseKeyspace(ctx, "ks2"))
+	atomic.AddInt32(&unpreparing.forget, 1)
+	execute := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{
+		QueryId: statement.Id,
+		Options: &message.QueryOptions{},
+	})
+	_, err = pool.SendAndReceive(execute)
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&unpreparing.prepares))
+	assert.Equal(t, statement, pool.PreparedCache.Get("ks1", query))
+
+	cancelFn()
+	assert.Eventually(t, pool.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestConnectionPool_NewResultMetadataId(t *testing.T) {
+	unpreparing := &unpreparingHandler{}
+	newResultMetadata := &message.RowsMetadata{
+		ColumnCount:         1,
+		NewResultMetadataId: []byte{42},
+		Columns:             []*message.ColumnMetadata{{Keyspace: "ks1", Table: "table1", Name: "col1", Type: datatype.Varchar}},
+	}
+	resultMetadataChanged := func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		response := unpreparing.handler(request, conn, ctx)
+		if execute, ok := request.Body.Message.(*message.Execute); ok && !bytes.Equal(execute.ResultMetadataId, []byte{42}) {
+			if rows, ok := response.Body.Message.(*message.RowsResult); ok {
+				rows.Metadata = newResultMetadata
+			}
+		}
+		return response
+	}
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, resultMetadataChanged}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+
+	pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersionDse2)
+	pool.Size = 1
+	require.Nil(t, pool.Start(ctx))
+
+	query := "SELECT * FROM ks1.table1"
+	_, err := pool.SendAndReceive(frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	statement := pool.PreparedCache.Get("", query)
+	require.NotNil(t, statement)
+	assert.Equal(t, []byte{1}, statement.ResultMetadataId)
+
+	execute := frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Execute{
+		QueryId:          statement.Id,
+		ResultMetadataId: statement.ResultMetadataId,
+		Options:          &message.QueryOptions{},
+	})
+	response, err := pool.SendAndReceive(execute)
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	statement = pool.PreparedCache.Get("", query)
+	assert.Equal(t, []byte{42}, statement.ResultMetadataId)
+	assert.Equal(t, newResultMetadata, statement.ResultMetadata)
+
+	cancelFn()
+	assert.Eventually(t, pool.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
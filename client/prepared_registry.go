@@ -0,0 +1,228 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"sync"
+)
+
+// A PreparedStatementRule tells a PreparedStatementRegistry how to prepare and execute a given query string.
+type PreparedStatementRule struct {
+	// The query string this rule applies to.
+	Query string
+	// The metadata of the statement's bound variables. If nil, the statement has no bound variables.
+	Variables *message.VariablesMetadata
+	// The metadata of the statement's result set columns. If nil, the statement is not a SELECT statement.
+	Columns *message.RowsMetadata
+	// The rows factory function, invoked for each execution of the statement with the options of the EXECUTE request.
+	// If nil, executions return no rows.
+	Rows func(options *message.QueryOptions) message.RowSet
+}
+
+type registeredStatement struct {
+	keyspace string
+	query    string
+}
+
+// PreparedStatementRegistry emulates the prepared statement cache of a server node. Use its Handler to have a
+// CqlServer handle PREPARE, EXECUTE and BATCH requests for any query:
+// - PREPARE requests are always successful; prepared ids are computed like Cassandra does, see PreparedStatementId,
+// in the keyspace of the request, if any, or in the keyspace of the connection otherwise, see
+// CqlServerConnection.Keyspace.
+// The bound variables and result set metadata are those of the PreparedStatementRule registered for the query string,
+// if any, or empty otherwise.
+// - EXECUTE requests for a prepared statement return a Rows RESULT response if the statement has result set metadata,
+// with the rows produced by the rule's rows factory function; or a Void RESULT response otherwise.
+// - BATCH requests with prepared children return a Void RESULT response.
+// - EXECUTE and BATCH requests targeting statements that were never prepared, or that were forgotten, return an
+// Unprepared ERROR response. Forget and ForgetAll can be used to simulate a node restart.
+// The registry is safe for concurrent use and can be shared by many servers, e.g. to emulate a cluster where a
+// statement prepared on one node is known to all nodes.
+type PreparedStatementRegistry struct {
+	rules    map[string]*PreparedStatementRule
+	prepared map[string]*registeredStatement
+	lock     *sync.RWMutex
+}
+
+func NewPreparedStatementRegistry() *PreparedStatementRegistry {
+	return &PreparedStatementRegistry{
+		rules:    make(map[string]*PreparedStatementRule),
+		prepared: make(map[string]*registeredStatement),
+		lock:     &sync.RWMutex{},
+	}
+}
+
+// Computes the prepared id of the given query string in the given keyspace, like Cassandra does: the MD5 digest of
+// the keyspace name, if any, followed by the query string.
+func PreparedStatementId(keyspace string, query string) []byte {
+	digest := md5.Sum([]byte(keyspace + query))
+	return digest[:]
+}
+
+// Registers the given rule, replacing any rule previously registered for the same query string. The rule applies to
+// statements already prepared as well.
+func (r *PreparedStatementRegistry) AddRule(rule *PreparedStatementRule) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules[rule.Query] = rule
+}
+
+// Prepares the given query string in the given keyspace, and returns the corresponding PREPARED result.
+func (r *PreparedStatementRegistry) Prepare(keyspace string, query string, version primitive.ProtocolVersion) *message.PreparedResult {
+	id := PreparedStatementId(keyspace, query)
+	r.lock.Lock()
+	r.prepared[string(id)] = &registeredStatement{keyspace, query}
+	rule := r.rules[query]
+	r.lock.Unlock()
+	result := &message.PreparedResult{
+		PreparedQueryId:   id,
+		VariablesMetadata: &message.VariablesMetadata{},
+		ResultMetadata:    &message.RowsMetadata{},
+	}
+	if rule != nil && rule.Variables != nil {
+		result.VariablesMetadata = rule.Variables
+	}
+	if rule != nil && rule.Columns != nil {
+		result.ResultMetadata = rule.Columns
+	}
+	if hasResultMetadataId(version) {
+		result.ResultMetadataId = resultMetadataId(result.ResultMetadata)
+	}
+	return result
+}
+
+// Returns true if the statement with the given id is currently prepared.
+func (r *PreparedStatementRegistry) IsPrepared(id []byte) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	_, found := r.prepared[string(id)]
+	return found
+}
+
+// Returns the keyspace and query string of the statement with the given id, if it is currently prepared.
+func (r *PreparedStatementRegistry) Lookup(id []byte) (keyspace string, query string, found bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if statement, ok := r.prepared[string(id)]; ok {
+		return statement.keyspace, statement.query, true
+	}
+	return "", "", false
+}
+
+// Forgets the statement prepared with the given query string in the given keyspace: further executions of the
+// statement will return an Unprepared ERROR response, until it is prepared again.
+func (r *PreparedStatementRegistry) Forget(keyspace string, query string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.prepared, string(PreparedStatementId(keyspace, query)))
+}
+
+// Forgets all prepared statements, as if the node was restarted. Rules are kept.
+func (r *PreparedStatementRegistry) ForgetAll() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prepared = make(map[string]*registeredStatement)
+}
+
+// Returns a RequestHandler handling PREPARE, EXECUTE and BATCH requests with this registry. BATCH requests without
+// prepared children are not handled.
+func (r *PreparedStatementRegistry) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) (response *frame.Frame) {
+		version := request.Header.Version
+		id := request.Header.StreamId
+		switch msg := request.Body.Message.(type) {
+		case *message.Prepare:
+			log.Debug().Msgf("%v: [prepared statement registry]: intercepted PREPARE: %v", conn, msg.Query)
+			keyspace := msg.Keyspace
+			if keyspace == "" && conn != nil {
+				keyspace = conn.Keyspace()
+			}
+			response = frame.NewFrame(version, id, r.Prepare(keyspace, msg.Query, version))
+		case *message.Execute:
+			log.Debug().Msgf("%v: [prepared statement registry]: intercepted EXECUTE: %x", conn, msg.QueryId)
+			response = frame.NewFrame(version, id, r.execute(msg, version))
+		case *message.Batch:
+			var unprepared []byte
+			hasPrepared := false
+			for _, child := range msg.Children {
+				if childId, ok := child.QueryOrId.([]byte); ok {
+					hasPrepared = true
+					if unprepared == nil && !r.IsPrepared(childId) {
+						unprepared = childId
+					}
+				}
+			}
+			if hasPrepared {
+				log.Debug().Msgf("%v: [prepared statement registry]: intercepted BATCH", conn)
+				if unprepared != nil {
+					response = frame.NewFrame(version, id, newUnprepared(unprepared))
+				} else {
+					response = frame.NewFrame(version, id, &message.VoidResult{})
+				}
+			}
+		}
+		return
+	}
+}
+
+func (r *PreparedStatementRegistry) execute(execute *message.Execute, version primitive.ProtocolVersion) message.Message {
+	r.lock.RLock()
+	statement := r.prepared[string(execute.QueryId)]
+	var rule *PreparedStatementRule
+	if statement != nil {
+		rule = r.rules[statement.query]
+	}
+	r.lock.RUnlock()
+	if statement == nil {
+		return newUnprepared(execute.QueryId)
+	} else if rule == nil || rule.Columns == nil {
+		return &message.VoidResult{}
+	}
+	metadata := *rule.Columns
+	if hasResultMetadataId(version) {
+		if id := resultMetadataId(rule.Columns); !bytes.Equal(id, execute.ResultMetadataId) {
+			metadata.NewResultMetadataId = id
+		}
+	}
+	result := &message.RowsResult{Metadata: &metadata}
+	if rule.Rows != nil {
+		result.Data = rule.Rows(execute.Options)
+	}
+	return result
+}
+
+func newUnprepared(id []byte) *message.Unprepared {
+	return &message.Unprepared{ErrorMessage: fmt.Sprintf("Prepared query with ID %x not found", id), Id: id}
+}
+
+func hasResultMetadataId(version primitive.ProtocolVersion) bool {
+	return version == primitive.ProtocolVersion5 || version == primitive.ProtocolVersionDse2
+}
+
+// Computes a result metadata id as the MD5 digest of the result set column names and types.
+func resultMetadataId(metadata *message.RowsMetadata) []byte {
+	hash := md5.New()
+	for _, column := range metadata.Columns {
+		_, _ = fmt.Fprintf(hash, "%v.%v.%v:%v;", column.Keyspace, column.Table, column.Name, column.Type)
+	}
+	return hash.Sum(nil)
+}
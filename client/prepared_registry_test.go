@@ -0,0 +1,220 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"crypto/md5"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPreparedStatementId(t *testing.T) {
+	expected := md5.Sum([]byte("ks1SELECT * FROM table1"))
+	assert.Equal(t, expected[:], client.PreparedStatementId("ks1", "SELECT * FROM table1"))
+	expected = md5.Sum([]byte("SELECT * FROM ks1.table1"))
+	assert.Equal(t, expected[:], client.PreparedStatementId("", "SELECT * FROM ks1.table1"))
+}
+
+func newTestPreparedStatementRegistry() *client.PreparedStatementRegistry {
+	registry := client.NewPreparedStatementRegistry()
+	registry.AddRule(&client.PreparedStatementRule{
+		Query: "SELECT v FROM ks1.table1 WHERE pk = ?",
+		Variables: &message.VariablesMetadata{
+			PkIndices: []uint16{0},
+			Columns:   []*message.ColumnMetadata{{Keyspace: "ks1", Table: "table1", Name: "pk", Type: datatype.Varchar}},
+		},
+		Columns: &message.RowsMetadata{
+			ColumnCount: 1,
+			Columns:     []*message.ColumnMetadata{{Keyspace: "ks1", Table: "table1", Name: "v", Type: datatype.Varchar}},
+		},
+		Rows: func(options *message.QueryOptions) message.RowSet {
+			return message.RowSet{{options.PositionalValues[0].Contents}}
+		},
+	})
+	return registry
+}
+
+func TestPreparedStatementRegistry(t *testing.T) {
+	registry := newTestPreparedStatementRegistry()
+	server, clientConn, cancelFn := createServerAndClient(t, registry.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	selectQuery := "SELECT v FROM ks1.table1 WHERE pk = ?"
+	insertQuery := "INSERT INTO ks1.table1 (pk, v) VALUES (?, ?)"
+
+	// statements with rules
+	prepared := prepareQuery(t, clientConn, selectQuery)
+	assert.Equal(t, client.PreparedStatementId("", selectQuery), prepared.PreparedQueryId)
+	assert.Equal(t, []uint16{0}, prepared.VariablesMetadata.PkIndices)
+	assert.Len(t, prepared.ResultMetadata.Columns, 1)
+	response := executePrepared(t, clientConn, prepared.PreparedQueryId, []byte("pk1"))
+	require.IsType(t, &message.RowsResult{}, response)
+	assert.Equal(t, message.RowSet{{[]byte("pk1")}}, response.(*message.RowsResult).Data)
+
+	// statements without rules
+	prepared = prepareQuery(t, clientConn, insertQuery)
+	assert.Equal(t, client.PreparedStatementId("", insertQuery), prepared.PreparedQueryId)
+	assert.Empty(t, prepared.VariablesMetadata.Columns)
+	assert.Empty(t, prepared.ResultMetadata.Columns)
+	response = executePrepared(t, clientConn, prepared.PreparedQueryId, []byte("pk1"))
+	assert.IsType(t, &message.VoidResult{}, response)
+
+	// batches
+	batch := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Batch{
+		Children: []*message.BatchChild{{QueryOrId: prepared.PreparedQueryId}, {QueryOrId: "INSERT INTO ks1.table2 (pk) VALUES (1)"}},
+	})
+	result, err := clientConn.SendAndReceive(batch)
+	require.Nil(t, err)
+	assert.IsType(t, &message.VoidResult{}, result.Body.Message)
+
+	// forgotten statements
+	registry.Forget("", insertQuery)
+	assert.False(t, registry.IsPrepared(prepared.PreparedQueryId))
+	response = executePrepared(t, clientConn, prepared.PreparedQueryId, []byte("pk1"))
+	require.IsType(t, &message.Unprepared{}, response)
+	assert.Equal(t, prepared.PreparedQueryId, response.(*message.Unprepared).Id)
+	result, err = clientConn.SendAndReceive(batch)
+	require.Nil(t, err)
+	require.IsType(t, &message.Unprepared{}, result.Body.Message)
+	assert.Equal(t, prepared.PreparedQueryId, result.Body.Message.(*message.Unprepared).Id)
+	assert.True(t, registry.IsPrepared(client.PreparedStatementId("", selectQuery)))
+	registry.ForgetAll()
+	assert.False(t, registry.IsPrepared(client.PreparedStatementId("", selectQuery)))
+}
+
+func TestPreparedStatementRegistry_ConnectionKeyspace(t *testing.T) {
+	registry := client.NewPreparedStatementRegistry()
+	server, clientConn, cancelFn := createServerAndClient(t, client.NewSetKeyspaceHandler(func(string) {}), registry.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	query := "SELECT * FROM table1"
+	prepare := func(keyspace string) []byte {
+		response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion5, client.ManagedStreamId, &message.Prepare{
+			Query:    query,
+			Keyspace: keyspace,
+		}))
+		require.Nil(t, err)
+		require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+		return response.Body.Message.(*message.PreparedResult).PreparedQueryId
+	}
+	use := func(keyspace string) {
+		response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion5, client.ManagedStreamId, &message.Query{Query: "USE " + keyspace}))
+		require.Nil(t, err)
+		require.IsType(t, &message.SetKeyspaceResult{}, response.Body.Message)
+	}
+
+	assert.Equal(t, client.PreparedStatementId("", query), prepare(""))
+	use("ks1")
+	id1 := prepare("")
+	assert.Equal(t, client.PreparedStatementId("ks1", query), id1)
+	use("ks2")
+	id2 := prepare("")
+	assert.Equal(t, client.PreparedStatementId("ks2", query), id2)
+	// the keyspace of the request takes precedence
+	assert.Equal(t, id1, prepare("ks1"))
+
+	keyspace, _, found := registry.Lookup(id1)
+	assert.True(t, found)
+	assert.Equal(t, "ks1", keyspace)
+	keyspace, _, found = registry.Lookup(id2)
+	assert.True(t, found)
+	assert.Equal(t, "ks2", keyspace)
+}
+
+func TestPreparedStatementRegistry_ResultMetadataId(t *testing.T) {
+	registry := newTestPreparedStatementRegistry()
+	server, clientConn, cancelFn := createServerAndClient(t, registry.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	query := "SELECT v FROM ks1.table1 WHERE pk = ?"
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+	prepared := response.Body.Message.(*message.PreparedResult)
+	require.NotEmpty(t, prepared.ResultMetadataId)
+
+	executeWith := func(resultMetadataId []byte) *message.RowsResult {
+		execute := frame.NewFrame(primitive.ProtocolVersionDse2, client.ManagedStreamId, &message.Execute{
+			QueryId:          prepared.PreparedQueryId,
+			ResultMetadataId: resultMetadataId,
+			Options:          &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue([]byte("pk1"))}},
+		})
+		response, err := clientConn.SendAndReceive(execute)
+		require.Nil(t, err)
+		require.IsType(t, &message.RowsResult{}, response.Body.Message)
+		return response.Body.Message.(*message.RowsResult)
+	}
+	assert.Nil(t, executeWith(prepared.ResultMetadataId).Metadata.NewResultMetadataId)
+	assert.Equal(t, prepared.ResultMetadataId, executeWith([]byte{1, 2, 3}).Metadata.NewResultMetadataId)
+}
+
+func TestPreparedStatementRegistry_ConnectionPool(t *testing.T) {
+	registry := newTestPreparedStatementRegistry()
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, registry.Handler()}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, server.Start(ctx))
+
+	pool := client.NewConnectionPool(client.NewCqlClient("127.0.0.1:9043", nil), primitive.ProtocolVersion4)
+	pool.Size = 1
+	require.Nil(t, pool.Start(ctx))
+
+	query := "SELECT v FROM ks1.table1 WHERE pk = ?"
+	response, err := pool.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+
+	// simulate a node restart: the pool prepares the statement again transparently
+	registry.ForgetAll()
+	execute := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{
+		QueryId: client.PreparedStatementId("", query),
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue([]byte("pk1"))}},
+	})
+	response, err = pool.SendAndReceive(execute)
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.True(t, registry.IsPrepared(client.PreparedStatementId("", query)))
+
+	cancelFn()
+	assert.Eventually(t, pool.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func prepareQuery(t *testing.T, clientConn *client.CqlClientConnection, query string) *message.PreparedResult {
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.PreparedResult{}, response.Body.Message)
+	return response.Body.Message.(*message.PreparedResult)
+}
+
+func executePrepared(t *testing.T, clientConn *client.CqlClientConnection, id []byte, pk []byte) message.Message {
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Execute{
+		QueryId: id,
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(pk)}},
+	}))
+	require.Nil(t, err)
+	return response.Body.Message
+}
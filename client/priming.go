@@ -0,0 +1,344 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// A PrimeAction tells a PrimingEngine what to do with a request matched by a PrimeRule.
+type PrimeAction int
+
+const (
+	// Reply with the rule's response.
+	PrimeActionRespond = PrimeAction(iota)
+	// Never reply: the request is swallowed until the connection is closed.
+	PrimeActionNoResponse = PrimeAction(iota)
+	// Close the connection without replying.
+	PrimeActionCloseConnection = PrimeAction(iota)
+)
+
+// A PrimeRule tells a PrimingEngine how to respond to matching requests. All the non-zero matching criteria must match
+// for the rule to apply; a rule with no criteria matches all QUERY and EXECUTE requests.
+type PrimeRule struct {
+	// The request opcodes to match. If empty, QUERY and EXECUTE requests are matched. Only QUERY, PREPARE, EXECUTE and
+	// BATCH requests can be matched.
+	OpCodes []primitive.OpCode
+	// The exact query string to match. For EXECUTE requests and prepared BATCH children, the query string is resolved
+	// with the engine's PreparedStatementRegistry; a BATCH request matches if any of its children matches.
+	Query string
+	// A regular expression the query string must match; see Query.
+	QueryPattern *regexp.Regexp
+	// The keyspace to match: the keyspace of the request (protocol version 5 and DSE protocol version 2 only) if set,
+	// or the keyspace the statement was prepared in, for EXECUTE requests, or the keyspace set by the last USE statement
+	// on the connection otherwise.
+	Keyspace string
+	// The consistency level to match.
+	Consistency *primitive.ConsistencyLevel
+	// The positional bound values to match. If non-nil, the request must have exactly the same positional values.
+	PositionalValues []*primitive.Value
+	// The named bound values to match. If non-nil, the request must have at least the given named values.
+	NamedValues map[string]*primitive.Value
+
+	// What to do with matching requests; the default is to reply with the response described below.
+	Action PrimeAction
+	// The delay to wait before applying the action.
+	Delay time.Duration
+	// The error to reply with. If nil, a RESULT response is returned.
+	Error message.Error
+	// The result set metadata to reply with. If nil and Rows is nil, a Void RESULT response is returned.
+	Columns *message.RowsMetadata
+	// The rows to reply with.
+	Rows message.RowSet
+}
+
+// PrimingEngine is a RequestHandler factory that responds to requests according to rules declared at runtime, in the
+// style of Simulacron. Rules can be primed for all the connections of a server with Prime, or for a single connection
+// with PrimeConnection. Rules primed for a connection are tried first, then rules primed for all connections, each in
+// the order they were primed; the first matching rule applies. Requests not matching any rule are left to the next
+// handlers. The engine is safe for concurrent use.
+type PrimingEngine struct {
+	// The registry used to resolve the query strings of prepared statements. If nil, EXECUTE requests and prepared BATCH
+	// children only match rules without query criteria.
+	Registry *PreparedStatementRegistry
+
+	rules           []*PrimeRule
+	connectionRules map[*CqlServerConnection][]*PrimeRule
+	// The connections whose rules are cleared when they are closed.
+	watched map[*CqlServerConnection]bool
+	lock    *sync.RWMutex
+}
+
+func NewPrimingEngine() *PrimingEngine {
+	return &PrimingEngine{
+		connectionRules: make(map[*CqlServerConnection][]*PrimeRule),
+		watched:         make(map[*CqlServerConnection]bool),
+		lock:            &sync.RWMutex{},
+	}
+}
+
+// Primes the given rule for all connections.
+func (e *PrimingEngine) Prime(rule *PrimeRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.rules = append(e.rules, rule)
+}
+
+// Primes the given rule for the given connection only. The rules primed for a connection are removed when the
+// connection is closed.
+func (e *PrimingEngine) PrimeConnection(conn *CqlServerConnection, rule *PrimeRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.connectionRules[conn] = append(e.connectionRules[conn], rule)
+	if !e.watched[conn] {
+		e.watched[conn] = true
+		go func() {
+			<-conn.ctx.Done()
+			e.lock.Lock()
+			defer e.lock.Unlock()
+			delete(e.connectionRules, conn)
+			delete(e.watched, conn)
+		}()
+	}
+}
+
+// Removes the given rule, whether it was primed for all connections or for a single connection.
+func (e *PrimingEngine) Remove(rule *PrimeRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.rules = removeRule(e.rules, rule)
+	for conn, rules := range e.connectionRules {
+		if rules = removeRule(rules, rule); len(rules) == 0 {
+			delete(e.connectionRules, conn)
+		} else {
+			e.connectionRules[conn] = rules
+		}
+	}
+}
+
+// Removes all the rules primed for the given connection.
+func (e *PrimingEngine) ClearConnection(conn *CqlServerConnection) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.connectionRules, conn)
+}
+
+// Removes all the rules.
+func (e *PrimingEngine) Clear() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.rules = nil
+	e.connectionRules = make(map[*CqlServerConnection][]*PrimeRule)
+}
+
+// Returns the first rule matching the given request received on the given connection, or nil if none matches.
+func (e *PrimingEngine) Match(request *frame.Frame, conn *CqlServerConnection) *PrimeRule {
+	e.lock.RLock()
+	rules := make([]*PrimeRule, 0, len(e.connectionRules[conn])+len(e.rules))
+	rules = append(rules, e.connectionRules[conn]...)
+	rules = append(rules, e.rules...)
+	e.lock.RUnlock()
+	for _, rule := range rules {
+		if e.matches(rule, request, conn) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Returns a RequestHandler responding to requests matching the primed rules.
+func (e *PrimingEngine) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) (response *frame.Frame) {
+		rule := e.Match(request, conn)
+		if rule == nil {
+			return nil
+		}
+		log.Debug().Msgf("%v: [priming engine]: request matched primed rule: %v", conn, request.Body.Message)
+		if !e.await(rule, conn) {
+			return nil
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, rule.response())
+	}
+}
+
+// Waits for the rule delay, then applies the rule action; returns true if the rule response should be sent, false if
+// the connection was closed, or if no response should be sent.
+func (e *PrimingEngine) await(rule *PrimeRule, conn *CqlServerConnection) bool {
+	if rule.Delay > 0 {
+		select {
+		case <-time.After(rule.Delay):
+		case <-conn.ctx.Done():
+			return false
+		}
+	}
+	switch rule.Action {
+	case PrimeActionNoResponse:
+		<-conn.ctx.Done()
+		return false
+	case PrimeActionCloseConnection:
+		// closing waits for request handlers to finish, including this one
+		go conn.abort()
+		<-conn.ctx.Done()
+		return false
+	}
+	return true
+}
+
+// Returns the response described by the rule: its error, its rows, or a Void RESULT.
+func (r *PrimeRule) response() message.Message {
+	if r.Error != nil {
+		return r.Error
+	} else if r.Columns != nil || r.Rows != nil {
+		metadata := r.Columns
+		if metadata == nil {
+			metadata = &message.RowsMetadata{}
+			if len(r.Rows) > 0 {
+				metadata.ColumnCount = int32(len(r.Rows[0]))
+			}
+		}
+		return &message.RowsResult{Metadata: metadata, Data: r.Rows}
+	}
+	return &message.VoidResult{}
+}
+
+func (e *PrimingEngine) matches(rule *PrimeRule, request *frame.Frame, conn *CqlServerConnection) bool {
+	opCodes := rule.OpCodes
+	if len(opCodes) == 0 {
+		opCodes = []primitive.OpCode{primitive.OpCodeQuery, primitive.OpCodeExecute}
+	}
+	if !containsOpCode(opCodes, request.Header.OpCode) {
+		return false
+	}
+	// the keyspace set by USE, used by requests that do not set their own keyspace
+	var connKeyspace string
+	if conn != nil {
+		connKeyspace = conn.Keyspace()
+	}
+	switch msg := request.Body.Message.(type) {
+	case *message.Query:
+		return rule.matchesQuery(msg.Query) && rule.matchesOptions(msg.Options, connKeyspace)
+	case *message.Prepare:
+		keyspace := msg.Keyspace
+		if keyspace == "" {
+			keyspace = connKeyspace
+		}
+		return rule.matchesQuery(msg.Query) && (rule.Keyspace == "" || rule.Keyspace == keyspace)
+	case *message.Execute:
+		keyspace, query := e.lookup(msg.QueryId)
+		return rule.matchesQuery(query) && rule.matchesOptions(msg.Options, keyspace)
+	case *message.Batch:
+		keyspace := msg.Keyspace
+		if keyspace == "" {
+			keyspace = connKeyspace
+		}
+		if rule.Consistency != nil && *rule.Consistency != msg.Consistency {
+			return false
+		} else if rule.Keyspace != "" && rule.Keyspace != keyspace {
+			return false
+		}
+		for _, child := range msg.Children {
+			var query string
+			switch queryOrId := child.QueryOrId.(type) {
+			case string:
+				query = queryOrId
+			case []byte:
+				_, query = e.lookup(queryOrId)
+			}
+			if rule.matchesQuery(query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *PrimingEngine) lookup(id []byte) (keyspace string, query string) {
+	if e.Registry != nil {
+		keyspace, query, _ = e.Registry.Lookup(id)
+	}
+	return
+}
+
+func (r *PrimeRule) matchesQuery(query string) bool {
+	if r.Query != "" && r.Query != query {
+		return false
+	}
+	return r.QueryPattern == nil || r.QueryPattern.MatchString(query)
+}
+
+func (r *PrimeRule) matchesOptions(options *message.QueryOptions, defaultKeyspace string) bool {
+	if options == nil {
+		options = &message.QueryOptions{}
+	}
+	keyspace := options.Keyspace
+	if keyspace == "" {
+		keyspace = defaultKeyspace
+	}
+	if r.Keyspace != "" && r.Keyspace != keyspace {
+		return false
+	}
+	if r.Consistency != nil && *r.Consistency != options.Consistency {
+		return false
+	}
+	if r.PositionalValues != nil {
+		if len(r.PositionalValues) != len(options.PositionalValues) {
+			return false
+		}
+		for i, value := range r.PositionalValues {
+			if !valuesEqual(value, options.PositionalValues[i]) {
+				return false
+			}
+		}
+	}
+	for name, value := range r.NamedValues {
+		if !valuesEqual(value, options.NamedValues[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func valuesEqual(v1 *primitive.Value, v2 *primitive.Value) bool {
+	if v1 == nil || v2 == nil {
+		return v1 == v2
+	}
+	return v1.Type == v2.Type && bytes.Equal(v1.Contents, v2.Contents)
+}
+
+func containsOpCode(opCodes []primitive.OpCode, opCode primitive.OpCode) bool {
+	for _, candidate := range opCodes {
+		if candidate == opCode {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRule(rules []*PrimeRule, rule *PrimeRule) []*PrimeRule {
+	var result []*PrimeRule
+	for _, candidate := range rules {
+		if candidate != rule {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
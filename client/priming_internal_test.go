@@ -0,0 +1,36 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPrimingEngine_PrimeConnection_Closed(t *testing.T) {
+	engine := NewPrimingEngine()
+	conn := &CqlServerConnection{}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	engine.PrimeConnection(conn, &PrimeRule{Query: "SELECT * FROM ks1.table1"})
+	engine.PrimeConnection(conn, &PrimeRule{Query: "SELECT * FROM ks1.table2"})
+	conn.cancel()
+	assert.Eventually(t, func() bool {
+		engine.lock.RLock()
+		defer engine.lock.RUnlock()
+		return len(engine.connectionRules) == 0 && len(engine.watched) == 0
+	}, time.Second, time.Millisecond*10)
+}
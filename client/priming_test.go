@@ -0,0 +1,239 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// A RequestHandler replying to all QUERY, EXECUTE and BATCH requests with an INVALID error, to detect unprimed requests.
+var unprimedHandler client.RequestHandler = func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+	switch request.Body.Message.(type) {
+	case *message.Query, *message.Execute, *message.Batch:
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.Invalid{ErrorMessage: "unprimed"})
+	}
+	return nil
+}
+
+func sendQuery(t *testing.T, clientConn *client.CqlClientConnection, query *message.Query) message.Message {
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, query))
+	require.Nil(t, err)
+	return response.Body.Message
+}
+
+func isUnprimed(msg message.Message) bool {
+	invalid, ok := msg.(*message.Invalid)
+	return ok && invalid.ErrorMessage == "unprimed"
+}
+
+func TestPrimingEngine(t *testing.T) {
+	engine := client.NewPrimingEngine()
+	registry := client.NewPreparedStatementRegistry()
+	server, clientConn, cancelFn := createServerAndClient(t, engine.Handler(), registry.Handler(), unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	columns := &message.RowsMetadata{
+		ColumnCount: 1,
+		Columns:     []*message.ColumnMetadata{{Keyspace: "ks1", Table: "table1", Name: "col1", Type: datatype.Varchar}},
+	}
+	rows := message.RowSet{{[]byte("v1")}, {[]byte("v2")}}
+	one := primitive.ConsistencyLevelOne
+	engine.Prime(&client.PrimeRule{Query: "SELECT * FROM ks1.table1", Columns: columns, Rows: rows})
+	engine.Prime(&client.PrimeRule{QueryPattern: regexp.MustCompile(`^INSERT INTO ks1\.`), Consistency: &one})
+	engine.Prime(&client.PrimeRule{
+		Query:            "SELECT * FROM ks1.table2 WHERE pk = ?",
+		PositionalValues: []*primitive.Value{primitive.NewValue([]byte("pk1"))},
+		Error:            &message.Overloaded{ErrorMessage: "overloaded"},
+	})
+
+	// exact match
+	response := sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	require.IsType(t, &message.RowsResult{}, response)
+	assert.Equal(t, columns, response.(*message.RowsResult).Metadata)
+	assert.Equal(t, rows, response.(*message.RowsResult).Data)
+
+	// regex and consistency match
+	response = sendQuery(t, clientConn, &message.Query{
+		Query:   "INSERT INTO ks1.table1 (pk) VALUES (1)",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelOne},
+	})
+	assert.IsType(t, &message.VoidResult{}, response)
+	response = sendQuery(t, clientConn, &message.Query{
+		Query:   "INSERT INTO ks1.table1 (pk) VALUES (1)",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelQuorum},
+	})
+	assert.True(t, isUnprimed(response))
+
+	// bound values match
+	response = sendQuery(t, clientConn, &message.Query{
+		Query:   "SELECT * FROM ks1.table2 WHERE pk = ?",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue([]byte("pk1"))}},
+	})
+	assert.IsType(t, &message.Overloaded{}, response)
+	response = sendQuery(t, clientConn, &message.Query{
+		Query:   "SELECT * FROM ks1.table2 WHERE pk = ?",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue([]byte("pk2"))}},
+	})
+	assert.True(t, isUnprimed(response))
+
+	// opcodes: PREPARE requests are not matched by default
+	prime := &client.PrimeRule{OpCodes: []primitive.OpCode{primitive.OpCodePrepare}, Error: &message.Invalid{ErrorMessage: "invalid"}}
+	engine.Prime(prime)
+	prepared, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: "SELECT * FROM ks1.table1"}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.Invalid{}, prepared.Body.Message)
+
+	// removal
+	engine.Remove(prime)
+	prepared, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: "SELECT * FROM ks1.table1"}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.PreparedResult{}, prepared.Body.Message)
+	engine.Clear()
+	response = sendQuery(t, clientConn, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	assert.True(t, isUnprimed(response))
+}
+
+func TestPrimingEngine_Actions(t *testing.T) {
+	engine := client.NewPrimingEngine()
+	server, clientConn, cancelFn := createServerAndClient(t, engine.Handler(), unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	// delay
+	engine.Prime(&client.PrimeRule{Query: "SELECT delay", Delay: 200 * time.Millisecond})
+	start := time.Now()
+	response := sendQuery(t, clientConn, &message.Query{Query: "SELECT delay"})
+	assert.IsType(t, &message.VoidResult{}, response)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+
+	// no response
+	engine.Prime(&client.PrimeRule{Query: "SELECT nothing", Action: client.PrimeActionNoResponse})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := clientConn.SendAndReceiveContext(ctx, frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT nothing"}))
+	var timeoutErr *client.RequestTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+
+	// close connection
+	engine.Prime(&client.PrimeRule{Query: "SELECT close", Action: client.PrimeActionCloseConnection})
+	_, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT close"}))
+	assert.Error(t, err)
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func TestPrimingEngine_PrimeConnection(t *testing.T) {
+	engine := client.NewPrimingEngine()
+	server, clientConn1, cancelFn := createServerAndClient(t, engine.Handler(), unprimedHandler)
+	defer checkClosed(t, clientConn1, server)
+	defer cancelFn()
+	clientConn2, err := client.NewCqlClient("127.0.0.1:9043", nil).Connect(context.Background())
+	require.Nil(t, err)
+	defer clientConn2.Close()
+
+	var serverConns []*client.CqlServerConnection
+	require.Eventually(t, func() bool {
+		serverConns, err = server.AllAcceptedClients()
+		return err == nil && len(serverConns) == 2
+	}, time.Second*10, time.Millisecond*10)
+	var serverConn1 *client.CqlServerConnection
+	for _, serverConn := range serverConns {
+		if serverConn.RemoteAddr().String() == clientConn1.LocalAddr().String() {
+			serverConn1 = serverConn
+		}
+	}
+	require.NotNil(t, serverConn1)
+
+	engine.Prime(&client.PrimeRule{Query: "SELECT * FROM ks1.table1"})
+	engine.PrimeConnection(serverConn1, &client.PrimeRule{Query: "SELECT * FROM ks1.table1", Error: &message.Overloaded{ErrorMessage: "overloaded"}})
+	assert.IsType(t, &message.Overloaded{}, sendQuery(t, clientConn1, &message.Query{Query: "SELECT * FROM ks1.table1"}))
+	assert.IsType(t, &message.VoidResult{}, sendQuery(t, clientConn2, &message.Query{Query: "SELECT * FROM ks1.table1"}))
+
+	engine.ClearConnection(serverConn1)
+	assert.IsType(t, &message.VoidResult{}, sendQuery(t, clientConn1, &message.Query{Query: "SELECT * FROM ks1.table1"}))
+}
+
+func TestPrimingEngine_PreparedStatements(t *testing.T) {
+	registry := client.NewPreparedStatementRegistry()
+	engine := client.NewPrimingEngine()
+	engine.Registry = registry
+	server, clientConn, cancelFn := createServerAndClient(t, engine.Handler(), registry.Handler(), unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	query := "UPDATE ks1.table1 SET v = ? WHERE pk = ?"
+	engine.Prime(&client.PrimeRule{Query: query, Error: &message.WriteTimeout{ErrorMessage: "timeout", WriteType: primitive.WriteTypeSimple}})
+	prepared := prepareQuery(t, clientConn, query)
+
+	response := executePrepared(t, clientConn, prepared.PreparedQueryId, []byte("pk1"))
+	assert.IsType(t, &message.WriteTimeout{}, response)
+
+	batch := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Batch{
+		Children: []*message.BatchChild{{QueryOrId: "INSERT INTO ks1.table2 (pk) VALUES (1)"}, {QueryOrId: prepared.PreparedQueryId}},
+	})
+	engine.Prime(&client.PrimeRule{OpCodes: []primitive.OpCode{primitive.OpCodeBatch}, Query: query, Error: &message.Unavailable{ErrorMessage: "unavailable"}})
+	result, err := clientConn.SendAndReceive(batch)
+	require.Nil(t, err)
+	assert.IsType(t, &message.Unavailable{}, result.Body.Message)
+
+	// unprepared statements do not match, and are handled by the registry
+	registry.ForgetAll()
+	response = executePrepared(t, clientConn, prepared.PreparedQueryId, []byte("pk1"))
+	assert.IsType(t, &message.Unprepared{}, response)
+}
+
+func TestPrimingEngine_ConnectionKeyspace(t *testing.T) {
+	engine := client.NewPrimingEngine()
+	useHandler := func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+		if query, ok := request.Body.Message.(*message.Query); ok && query.Query == "USE ks1" {
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.SetKeyspaceResult{Keyspace: "ks1"})
+		}
+		return nil
+	}
+	server, clientConn, cancelFn := createServerAndClient(t, useHandler, engine.Handler(), unprimedHandler)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	query := "SELECT * FROM table1"
+	engine.Prime(&client.PrimeRule{
+		OpCodes:  []primitive.OpCode{primitive.OpCodeQuery, primitive.OpCodePrepare, primitive.OpCodeBatch},
+		Query:    query,
+		Keyspace: "ks1",
+		Error:    &message.Overloaded{ErrorMessage: "overloaded"},
+	})
+	assert.True(t, isUnprimed(sendQuery(t, clientConn, &message.Query{Query: query})))
+
+	assert.IsType(t, &message.SetKeyspaceResult{}, sendQuery(t, clientConn, &message.Query{Query: "USE ks1"}))
+	assert.IsType(t, &message.Overloaded{}, sendQuery(t, clientConn, &message.Query{Query: query}))
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Prepare{Query: query}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.Overloaded{}, response.Body.Message)
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Batch{
+		Children: []*message.BatchChild{{QueryOrId: query}},
+	}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.Overloaded{}, response.Body.Message)
+}
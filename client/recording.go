@@ -0,0 +1,543 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultRecorderConnectTimeout = time.Second * 5
+
+// A RecordedExchange is a request frame sent by a client during a recorded session, along with the response frame the
+// server sent for it.
+type RecordedExchange struct {
+	// The time elapsed between the start of the recording and the request.
+	Offset time.Duration
+	// The time elapsed between the request and the response.
+	Latency  time.Duration
+	Request  *frame.Frame
+	Response *frame.Frame
+}
+
+func (e *RecordedExchange) String() string {
+	return fmt.Sprintf("%v -> %v", e.Request, e.Response)
+}
+
+// The JSON representation of a RecordedExchange: frames are stored encoded and uncompressed, and durations are stored
+// in nanoseconds.
+type recordedExchangeJson struct {
+	Offset   int64  `json:"offset"`
+	Latency  int64  `json:"latency"`
+	Request  []byte `json:"request"`
+	Response []byte `json:"response"`
+}
+
+// Writes the given exchange to the given writer, as a single line of JSON. The recording file format is a sequence
+// of such lines, see ReadRecording.
+func WriteRecordedExchange(dest io.Writer, exchange *RecordedExchange) error {
+	codec := frame.NewCodec()
+	encoded := &recordedExchangeJson{Offset: int64(exchange.Offset), Latency: int64(exchange.Latency)}
+	var err error
+	if encoded.Request, err = encodeRecordedFrame(codec, exchange.Request); err != nil {
+		return fmt.Errorf("cannot encode request: %w", err)
+	} else if encoded.Response, err = encodeRecordedFrame(codec, exchange.Response); err != nil {
+		return fmt.Errorf("cannot encode response: %w", err)
+	}
+	line, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	_, err = dest.Write(append(line, '\n'))
+	return err
+}
+
+func encodeRecordedFrame(codec frame.Codec, f *frame.Frame) ([]byte, error) {
+	uncompressed := f.Clone()
+	uncompressed.SetCompress(false)
+	buf := &bytes.Buffer{}
+	if err := codec.EncodeFrame(uncompressed, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the given exchanges to the given writer, in the recording file format.
+func WriteRecording(dest io.Writer, exchanges []*RecordedExchange) error {
+	for i, exchange := range exchanges {
+		if err := WriteRecordedExchange(dest, exchange); err != nil {
+			return fmt.Errorf("cannot write exchange %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Reads exchanges written in the recording file format, e.g. by a SessionRecorder, until the end of the given reader.
+func ReadRecording(source io.Reader) ([]*RecordedExchange, error) {
+	codec := frame.NewCodec()
+	reader := bufio.NewReader(source)
+	var exchanges []*RecordedExchange
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			encoded := &recordedExchangeJson{}
+			exchange := &RecordedExchange{}
+			if err := json.Unmarshal(line, encoded); err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			} else if exchange.Request, err = codec.DecodeFrame(bytes.NewReader(encoded.Request)); err != nil {
+				return nil, fmt.Errorf("line %d: cannot decode request: %w", lineNumber, err)
+			} else if exchange.Response, err = codec.DecodeFrame(bytes.NewReader(encoded.Response)); err != nil {
+				return nil, fmt.Errorf("line %d: cannot decode response: %w", lineNumber, err)
+			}
+			exchange.Offset = time.Duration(encoded.Offset)
+			exchange.Latency = time.Duration(encoded.Latency)
+			exchanges = append(exchanges, exchange)
+		}
+		if errors.Is(err, io.EOF) {
+			return exchanges, nil
+		}
+	}
+}
+
+// SessionRecorder is a TCP proxy that records the sessions of clients with a real CQL server. Clients connect to the
+// recorder's listen address, and their connections are forwarded byte for byte to the remote address; each request
+// and the response the server sent for it are recorded as a RecordedExchange. Server-initiated events are forwarded
+// but not recorded. Replay recorded sessions with a SessionReplayer.
+// It is preferable to create SessionRecorder instances using the constructor function NewSessionRecorder. Once the
+// recorder is properly created and configured, use Start to start it, then Exchanges or WriteRecording to retrieve
+// the recorded exchanges.
+type SessionRecorder struct {
+	// The address to listen to.
+	ListenAddress string
+	// The address of the server to forward connections to.
+	RemoteAddress string
+	// The frame.RawCodec to use to decode frames; if none provided, a default codec will be used. The codec must have
+	// a body compressor if clients use compression.
+	Codec frame.RawCodec
+	// The timeout to apply when connecting to the remote server.
+	ConnectTimeout time.Duration
+	// An optional writer to write exchanges to, in the recording file format, as soon as they are recorded.
+	Output io.Writer
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listener  net.Listener
+	waitGroup *sync.WaitGroup
+	state     int32
+	start     time.Time
+	exchanges []*RecordedExchange
+	conns     map[net.Conn]bool
+	lock      *sync.Mutex
+}
+
+// Creates a new SessionRecorder with default options.
+func NewSessionRecorder(listenAddress string, remoteAddress string) *SessionRecorder {
+	return &SessionRecorder{
+		ListenAddress:  listenAddress,
+		RemoteAddress:  remoteAddress,
+		ConnectTimeout: DefaultRecorderConnectTimeout,
+		conns:          make(map[net.Conn]bool),
+		lock:           &sync.Mutex{},
+	}
+}
+
+func (r *SessionRecorder) String() string {
+	return fmt.Sprintf("CQL session recorder [%v -> %v]", r.ListenAddress, r.RemoteAddress)
+}
+
+func (r *SessionRecorder) IsRunning() bool {
+	return atomic.LoadInt32(&r.state) == ServerStateRunning
+}
+
+func (r *SessionRecorder) IsClosed() bool {
+	return atomic.LoadInt32(&r.state) == ServerStateClosed
+}
+
+// Returns the address the recorder is listening to, or nil if the recorder is not running. Useful when ListenAddress
+// has a zero port.
+func (r *SessionRecorder) Addr() net.Addr {
+	if !r.IsRunning() {
+		return nil
+	}
+	return r.listener.Addr()
+}
+
+// Starts the recorder and binds to its listen address. The recorder is closed when the given context is canceled.
+func (r *SessionRecorder) Start(ctx context.Context) (err error) {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+	if atomic.CompareAndSwapInt32(&r.state, ServerStateNotStarted, ServerStateRunning) {
+		log.Debug().Msgf("%v: recorder is starting", r)
+		if r.listener, err = net.Listen("tcp", r.ListenAddress); err != nil {
+			atomic.StoreInt32(&r.state, ServerStateClosed)
+			return fmt.Errorf("%v: start failed: %w", r, err)
+		}
+		if r.Codec == nil {
+			r.Codec = frame.NewRawCodec()
+		}
+		r.start = time.Now()
+		r.ctx, r.cancel = context.WithCancel(ctx)
+		r.waitGroup = &sync.WaitGroup{}
+		r.waitGroup.Add(1)
+		go r.acceptLoop()
+		go func() {
+			<-r.ctx.Done()
+			log.Debug().Err(r.ctx.Err()).Msgf("%v: context was closed", r)
+			if err := r.Close(); err != nil {
+				log.Error().Err(err).Msgf("%v: error closing", r)
+			}
+		}()
+		log.Info().Msgf("%v: successfully started", r)
+	} else {
+		log.Debug().Msgf("%v: already started or closed", r)
+	}
+	return err
+}
+
+// Closes the recorder and all the proxied connections.
+func (r *SessionRecorder) Close() (err error) {
+	if atomic.CompareAndSwapInt32(&r.state, ServerStateRunning, ServerStateClosed) {
+		log.Debug().Msgf("%v: closing", r)
+		r.cancel()
+		err = r.listener.Close()
+		r.lock.Lock()
+		for conn := range r.conns {
+			_ = conn.Close()
+		}
+		r.lock.Unlock()
+		r.waitGroup.Wait()
+		if err != nil {
+			err = fmt.Errorf("%v: could not close recorder: %w", r, err)
+		} else {
+			log.Info().Msgf("%v: successfully closed", r)
+		}
+	} else {
+		log.Debug().Msgf("%v: not started or already closed", r)
+	}
+	return err
+}
+
+// Returns the exchanges recorded so far, in the order responses were received.
+func (r *SessionRecorder) Exchanges() []*RecordedExchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	exchanges := make([]*RecordedExchange, len(r.exchanges))
+	copy(exchanges, r.exchanges)
+	return exchanges
+}
+
+// Writes the exchanges recorded so far to the given writer, in the recording file format.
+func (r *SessionRecorder) WriteRecording(dest io.Writer) error {
+	return WriteRecording(dest, r.Exchanges())
+}
+
+func (r *SessionRecorder) acceptLoop() {
+	defer r.waitGroup.Done()
+	for r.IsRunning() {
+		clientConn, err := r.listener.Accept()
+		if err != nil {
+			if !r.IsClosed() {
+				log.Error().Err(err).Msgf("%v: error accepting client connections", r)
+			}
+			return
+		}
+		dialer := &net.Dialer{Timeout: r.ConnectTimeout}
+		serverConn, err := dialer.DialContext(r.ctx, "tcp", r.RemoteAddress)
+		if err != nil {
+			log.Error().Err(err).Msgf("%v: cannot connect to remote server, closing client connection", r)
+			_ = clientConn.Close()
+			continue
+		}
+		if !r.track(clientConn, serverConn) {
+			return
+		}
+		log.Info().Msgf("%v: proxying new client connection: %v", r, clientConn.RemoteAddr())
+		session := &recordedSession{
+			recorder: r,
+			name:     fmt.Sprintf("%v: [%v]", r, clientConn.RemoteAddr()),
+			pending:  make(map[int16]*pendingRequest),
+			lock:     &sync.Mutex{},
+		}
+		r.waitGroup.Add(2)
+		go session.forward(clientConn, serverConn, false)
+		go session.forward(serverConn, clientConn, true)
+	}
+}
+
+// Registers the given connections, so that they are closed when the recorder is closed. Returns false if the
+// recorder is already closed, in which case the connections are closed.
+func (r *SessionRecorder) track(conns ...net.Conn) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.IsClosed() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		r.conns[conn] = true
+	}
+	return true
+}
+
+func (r *SessionRecorder) untrack(conns ...net.Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+		delete(r.conns, conn)
+	}
+}
+
+func (r *SessionRecorder) record(exchange *RecordedExchange) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.exchanges = append(r.exchanges, exchange)
+	if r.Output != nil {
+		if err := WriteRecordedExchange(r.Output, exchange); err != nil {
+			log.Error().Err(err).Msgf("%v: cannot write exchange: %v", r, exchange)
+		}
+	}
+}
+
+type pendingRequest struct {
+	request  *frame.RawFrame
+	received time.Time
+}
+
+// recordedSession holds the requests of a proxied connection that are waiting for a response.
+type recordedSession struct {
+	recorder *SessionRecorder
+	name     string
+	pending  map[int16]*pendingRequest
+	lock     *sync.Mutex
+}
+
+// Forwards frames read from source to dest until either connection is closed. Requests are kept pending until their
+// response is forwarded, at which point the exchange is recorded.
+func (s *recordedSession) forward(source net.Conn, dest net.Conn, responses bool) {
+	defer s.recorder.waitGroup.Done()
+	defer s.recorder.untrack(source, dest)
+	codec := s.recorder.Codec
+	for {
+		raw, err := codec.DecodeRawFrame(source)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.recorder.IsClosed() {
+				log.Debug().Err(err).Msgf("%v: error reading, closing connection", s.name)
+			}
+			return
+		}
+		received := time.Now()
+		if !responses {
+			s.lock.Lock()
+			s.pending[raw.Header.StreamId] = &pendingRequest{request: raw, received: received}
+			s.lock.Unlock()
+		}
+		if err := codec.EncodeRawFrame(raw, dest); err != nil {
+			if !s.recorder.IsClosed() {
+				log.Debug().Err(err).Msgf("%v: error writing, closing connection", s.name)
+			}
+			return
+		}
+		if responses && raw.Header.StreamId >= 0 {
+			s.lock.Lock()
+			pending := s.pending[raw.Header.StreamId]
+			delete(s.pending, raw.Header.StreamId)
+			s.lock.Unlock()
+			if pending != nil {
+				s.recordExchange(pending, raw, received)
+			}
+		}
+	}
+}
+
+func (s *recordedSession) recordExchange(pending *pendingRequest, response *frame.RawFrame, received time.Time) {
+	codec := s.recorder.Codec
+	exchange := &RecordedExchange{
+		Offset:  pending.received.Sub(s.recorder.start),
+		Latency: received.Sub(pending.received),
+	}
+	var err error
+	if exchange.Request, err = codec.ConvertFromRawFrame(pending.request); err != nil {
+		log.Error().Err(err).Msgf("%v: cannot decode request, exchange not recorded", s.name)
+	} else if exchange.Response, err = codec.ConvertFromRawFrame(response); err != nil {
+		log.Error().Err(err).Msgf("%v: cannot decode response, exchange not recorded", s.name)
+	} else {
+		log.Debug().Msgf("%v: recorded exchange: %v", s.name, exchange)
+		s.recorder.record(exchange)
+	}
+}
+
+// SessionReplayer replays recorded sessions: use its Handler to have a CqlServer answer requests with the responses
+// recorded for them. A request matches a recorded exchange if it has the same opcode, protocol version and body;
+// stream ids, compression and the default timestamps of QUERY, EXECUTE and BATCH requests are ignored. When several
+// exchanges match a request, their responses are returned in the order they were recorded, and the last one is
+// returned once all were returned. Requests matching no exchange are left to the next handlers.
+// It is preferable to create SessionReplayer instances using the constructor function NewSessionReplayer. The
+// replayer is safe for concurrent use.
+type SessionReplayer struct {
+	// Whether to wait for the recorded latency of each exchange before returning its response.
+	ReplayLatency bool
+
+	exchanges map[string][]*RecordedExchange
+	replayed  map[string]int
+	lock      *sync.Mutex
+}
+
+// Creates a new SessionReplayer for the given exchanges, e.g. as returned by ReadRecording or
+// SessionRecorder.Exchanges.
+func NewSessionReplayer(exchanges []*RecordedExchange) (*SessionReplayer, error) {
+	replayer := &SessionReplayer{
+		exchanges: make(map[string][]*RecordedExchange),
+		replayed:  make(map[string]int),
+		lock:      &sync.Mutex{},
+	}
+	for i, exchange := range exchanges {
+		key, err := replayKey(exchange.Request)
+		if err != nil {
+			return nil, fmt.Errorf("cannot replay exchange %d: %w", i, err)
+		}
+		replayer.exchanges[key] = append(replayer.exchanges[key], exchange)
+	}
+	return replayer, nil
+}
+
+// Returns a RequestHandler returning the recorded responses of the requests it receives.
+func (r *SessionReplayer) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) *frame.Frame {
+		key, err := replayKey(request)
+		if err != nil {
+			log.Debug().Err(err).Msgf("%v: [replay handler]: cannot normalize request: %v", conn, request)
+			return nil
+		}
+		exchange := r.next(key)
+		if exchange == nil {
+			log.Debug().Msgf("%v: [replay handler]: no recorded exchange for request: %v", conn, request)
+			return nil
+		}
+		if r.ReplayLatency && exchange.Latency > 0 {
+			time.Sleep(exchange.Latency)
+		}
+		response := exchange.Response.Clone()
+		response.Header.StreamId = request.Header.StreamId
+		log.Debug().Msgf("%v: [replay handler]: returning recorded response: %v", conn, response)
+		return response
+	}
+}
+
+// Returns the number of exchanges whose responses were never returned.
+func (r *SessionReplayer) Remaining() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	remaining := 0
+	for key, exchanges := range r.exchanges {
+		if replayed := r.replayed[key]; replayed < len(exchanges) {
+			remaining += len(exchanges) - replayed
+		}
+	}
+	return remaining
+}
+
+func (r *SessionReplayer) next(key string) *RecordedExchange {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	exchanges := r.exchanges[key]
+	if len(exchanges) == 0 {
+		return nil
+	}
+	i := r.replayed[key]
+	if i >= len(exchanges) {
+		return exchanges[len(exchanges)-1]
+	}
+	r.replayed[key] = i + 1
+	return exchanges[i]
+}
+
+// Returns the key requests are matched with: the opcode, the protocol version and the encoded body, without the
+// default timestamp. Maps are encoded in no particular order: the STARTUP options, the named values and the custom
+// payload are therefore left out of the encoded body, and their entries are appended to the key in sorted order.
+func replayKey(request *frame.Frame) (string, error) {
+	msg := request.Body.Message.Clone()
+	var entries []string
+	switch m := msg.(type) {
+	case *message.Startup:
+		for name, value := range m.Options {
+			entries = append(entries, fmt.Sprintf("option:%v=%v", name, value))
+		}
+		m.Options = nil
+	case *message.Query:
+		entries = normalizeOptions(m.Options, entries)
+	case *message.Execute:
+		entries = normalizeOptions(m.Options, entries)
+	case *message.Batch:
+		m.DefaultTimestamp = nil
+	}
+	for name, value := range request.Body.CustomPayload {
+		entries = append(entries, fmt.Sprintf("payload:%v=%x", name, value))
+	}
+	sort.Strings(entries)
+	normalized := frame.NewFrame(request.Header.Version, 0, msg)
+	buf := &bytes.Buffer{}
+	if err := frame.NewRawCodec().EncodeBody(normalized.Header, normalized.Body, buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v:%v:%x:%v", request.Header.OpCode, request.Header.Version, buf.Bytes(), strings.Join(entries, ",")), nil
+}
+
+// Removes the default timestamp and the named values from the given options, and appends the named values to the
+// given key entries.
+func normalizeOptions(options *message.QueryOptions, entries []string) []string {
+	if options == nil {
+		return entries
+	}
+	options.DefaultTimestamp = nil
+	for name, value := range options.NamedValues {
+		if value == nil {
+			entries = append(entries, fmt.Sprintf("value:%v", name))
+		} else {
+			entries = append(entries, fmt.Sprintf("value:%v=%v:%x", name, value.Type, value.Contents))
+		}
+	}
+	options.NamedValues = nil
+	return entries
+}
+
+// Reads a recording with ReadRecording, and creates a SessionReplayer for it.
+func NewSessionReplayerFromRecording(source io.Reader) (*SessionReplayer, error) {
+	exchanges, err := ReadRecording(source)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionReplayer(exchanges)
+}
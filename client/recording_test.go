@@ -0,0 +1,159 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSessionRecorder(t *testing.T) {
+	store := newTestTableStore(t,
+		"CREATE TABLE ks1.t1 (pk int PRIMARY KEY, v text)",
+	)
+	require.IsType(t, &message.VoidResult{}, store.Execute("ks1", "INSERT INTO t1 (pk, v) VALUES (1, 'a')"))
+
+	// record a session against a real server
+	server := client.NewCqlServer("127.0.0.1:9043", nil)
+	server.RequestHandlers = []client.RequestHandler{client.HandshakeHandler, store.Handler()}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	require.Nil(t, server.Start(ctx))
+	output := &bytes.Buffer{}
+	recorder := client.NewSessionRecorder("127.0.0.1:9044", "127.0.0.1:9043")
+	recorder.Output = output
+	require.Nil(t, recorder.Start(ctx))
+	clientConn, err := client.NewCqlClient("127.0.0.1:9044", nil).Connect(ctx)
+	require.Nil(t, err)
+	require.Nil(t, clientConn.InitiateHandshake(primitive.ProtocolVersion4, client.ManagedStreamId))
+	recorded := runRecordedSession(t, clientConn, 1)
+	require.Nil(t, clientConn.Close())
+	require.Nil(t, recorder.Close())
+	require.Nil(t, server.Close())
+
+	exchanges := recorder.Exchanges()
+	require.Len(t, exchanges, 4)
+	assert.IsType(t, &message.Startup{}, exchanges[0].Request.Body.Message)
+	assert.IsType(t, &message.Ready{}, exchanges[0].Response.Body.Message)
+	for i, exchange := range exchanges[1:] {
+		assert.Equal(t, recorded[i], exchange.Response.Body.Message)
+		assert.True(t, exchange.Offset >= exchanges[i].Offset)
+	}
+	read, err := client.ReadRecording(bytes.NewReader(output.Bytes()))
+	require.Nil(t, err)
+	require.Len(t, read, 4)
+	for i, exchange := range read {
+		assert.Equal(t, exchanges[i].Request, exchange.Request)
+		assert.Equal(t, exchanges[i].Response, exchange.Response)
+		assert.Equal(t, exchanges[i].Latency, exchange.Latency)
+	}
+
+	// replay the session, with other stream ids and timestamps
+	replayer, err := client.NewSessionReplayer(read)
+	require.Nil(t, err)
+	assert.Equal(t, 4, replayer.Remaining())
+	server, clientConn, cancelFn = createServerAndClient(t, replayer.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+	require.Nil(t, clientConn.InitiateHandshake(primitive.ProtocolVersion4, 0))
+	replayed := runRecordedSession(t, clientConn, 2)
+	assert.Equal(t, recorded, replayed)
+	assert.Equal(t, 0, replayer.Remaining())
+
+	unrecorded := frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Query{Query: "SELECT * FROM ks1.t2"})
+	assert.Nil(t, replayer.Handler()(unrecorded, nil, nil))
+}
+
+func runRecordedSession(t *testing.T, clientConn *client.CqlClientConnection, timestamp int64) []message.Message {
+	version := primitive.ProtocolVersion4
+	options := &message.QueryOptions{DefaultTimestamp: &primitive.NillableInt64{Value: timestamp}}
+	var responses []message.Message
+	response := sendAndReceive(t, clientConn, frame.NewFrame(version, client.ManagedStreamId, &message.Query{
+		Query:   "SELECT v FROM ks1.t1 WHERE pk = 1",
+		Options: options,
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	responses = append(responses, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, client.ManagedStreamId, &message.Prepare{
+		Query: "SELECT v FROM ks1.t1 WHERE pk = ?",
+	}))
+	require.IsType(t, &message.PreparedResult{}, response)
+	responses = append(responses, response)
+	options = options.Clone()
+	options.PositionalValues = encodeValues(t, int32(1))
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, client.ManagedStreamId, &message.Execute{
+		QueryId: response.(*message.PreparedResult).PreparedQueryId,
+		Options: options,
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	return append(responses, response)
+}
+
+func TestSessionReplayer_Maps(t *testing.T) {
+	startup := func() *frame.Frame {
+		msg := message.NewStartup()
+		msg.Options["DRIVER_NAME"] = "driver"
+		msg.Options["DRIVER_VERSION"] = "1.0"
+		msg.Options["APPLICATION_NAME"] = "app"
+		msg.Options["CLIENT_ID"] = "id"
+		return frame.NewFrame(primitive.ProtocolVersion4, 1, msg)
+	}
+	query := func() *frame.Frame {
+		options := &message.QueryOptions{NamedValues: map[string]*primitive.Value{}}
+		for i, name := range []string{"a", "b", "c", "d", "e"} {
+			options.NamedValues[name] = primitive.NewValue([]byte{byte(i)})
+		}
+		request := frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Query{
+			Query:   "SELECT * FROM ks1.t1 WHERE a = :a AND b = :b AND c = :c AND d = :d AND e = :e",
+			Options: options,
+		})
+		request.SetCustomPayload(map[string][]byte{"k1": {1}, "k2": {2}, "k3": {3}, "k4": {4}})
+		return request
+	}
+	// maps are encoded in random order: repeat to make sure their order is not part of the matching
+	for i := 0; i < 20; i++ {
+		replayer, err := client.NewSessionReplayer([]*client.RecordedExchange{
+			{Request: startup(), Response: frame.NewFrame(primitive.ProtocolVersion4, 1, &message.Ready{})},
+			{Request: query(), Response: frame.NewFrame(primitive.ProtocolVersion4, 1, &message.VoidResult{})},
+		})
+		require.Nil(t, err)
+		response := replayer.Handler()(startup(), nil, nil)
+		require.NotNil(t, response)
+		assert.IsType(t, &message.Ready{}, response.Body.Message)
+		response = replayer.Handler()(query(), nil, nil)
+		require.NotNil(t, response)
+		assert.IsType(t, &message.VoidResult{}, response.Body.Message)
+		assert.Equal(t, 0, replayer.Remaining())
+	}
+
+	// named values and payloads are still part of the matching
+	replayer, err := client.NewSessionReplayer([]*client.RecordedExchange{
+		{Request: query(), Response: frame.NewFrame(primitive.ProtocolVersion4, 1, &message.VoidResult{})},
+	})
+	require.Nil(t, err)
+	other := query()
+	other.Body.Message.(*message.Query).Options.NamedValues["a"] = primitive.NewValue([]byte{9})
+	assert.Nil(t, replayer.Handler()(other, nil, nil))
+	other = query()
+	other.SetCustomPayload(map[string][]byte{"k1": {1}})
+	assert.Nil(t, replayer.Handler()(other, nil, nil))
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+// A RetryDecision tells ClusterClient what to do when a statement execution fails.
+type RetryDecision int
+
+const (
+	// Return the error to the caller.
+	RetryDecisionRethrow = RetryDecision(iota)
+	// Retry the statement on the same host.
+	RetryDecisionRetrySame = RetryDecision(iota)
+	// Retry the statement on the next host in the query plan.
+	RetryDecisionRetryNext = RetryDecision(iota)
+	// Ignore the error and return an empty VOID result to the caller.
+	RetryDecisionIgnore = RetryDecision(iota)
+)
+
+func (d RetryDecision) String() string {
+	switch d {
+	case RetryDecisionRethrow:
+		return "RETHROW"
+	case RetryDecisionRetrySame:
+		return "RETRY_SAME"
+	case RetryDecisionRetryNext:
+		return "RETRY_NEXT"
+	case RetryDecisionIgnore:
+		return "IGNORE"
+	}
+	return "UNKNOWN"
+}
+
+// RetryPolicy decides what to do when a statement execution fails, either because the coordinator replied with an
+// error, or because the request could not be completed. In all methods, retryCount is the number of retries already
+// performed for the statement.
+type RetryPolicy interface {
+	// Invoked when the coordinator replies with a READ_TIMEOUT error.
+	OnReadTimeout(statement *Statement, err *message.ReadTimeout, retryCount int) RetryDecision
+	// Invoked when the coordinator replies with a WRITE_TIMEOUT error.
+	OnWriteTimeout(statement *Statement, err *message.WriteTimeout, retryCount int) RetryDecision
+	// Invoked when the coordinator replies with an UNAVAILABLE error.
+	OnUnavailable(statement *Statement, err *message.Unavailable, retryCount int) RetryDecision
+	// Invoked when the coordinator replies with an OVERLOADED, IS_BOOTSTRAPPING, SERVER_ERROR, TRUNCATE_ERROR,
+	// READ_FAILURE or WRITE_FAILURE error. Other errors are never retried.
+	OnErrorResponse(statement *Statement, err message.Error, retryCount int) RetryDecision
+	// Invoked when the request could not be completed, e.g. because the connection was closed or the request timed
+	// out.
+	OnConnectionError(statement *Statement, err error, retryCount int) RetryDecision
+}
+
+// DefaultRetryPolicy mirrors the default retry policy of the DataStax Java driver:
+// - read timeouts are retried once on the same host, if enough replicas replied but data was not retrieved;
+// - write timeouts are retried once on the same host, if the statement is idempotent and the failed write was the
+// batch log write;
+// - unavailable errors are retried once on the next host;
+// - IS_BOOTSTRAPPING errors are always retried on the next host, since the request was not executed at all;
+// - READ_FAILURE and WRITE_FAILURE errors are never retried;
+// - other server errors and connection errors are retried on the next host, if the statement is idempotent.
+type DefaultRetryPolicy struct{}
+
+func NewDefaultRetryPolicy() *DefaultRetryPolicy {
+	return &DefaultRetryPolicy{}
+}
+
+func (p *DefaultRetryPolicy) OnReadTimeout(_ *Statement, err *message.ReadTimeout, retryCount int) RetryDecision {
+	if retryCount == 0 && err.Received >= err.BlockFor && !err.DataPresent {
+		return RetryDecisionRetrySame
+	}
+	return RetryDecisionRethrow
+}
+
+func (p *DefaultRetryPolicy) OnWriteTimeout(statement *Statement, err *message.WriteTimeout, retryCount int) RetryDecision {
+	if retryCount == 0 && statement.Idempotent && err.WriteType == primitive.WriteTypeBatchLog {
+		return RetryDecisionRetrySame
+	}
+	return RetryDecisionRethrow
+}
+
+func (p *DefaultRetryPolicy) OnUnavailable(_ *Statement, _ *message.Unavailable, retryCount int) RetryDecision {
+	if retryCount == 0 {
+		return RetryDecisionRetryNext
+	}
+	return RetryDecisionRethrow
+}
+
+func (p *DefaultRetryPolicy) OnErrorResponse(statement *Statement, err message.Error, _ int) RetryDecision {
+	switch err.(type) {
+	case *message.IsBootstrapping:
+		return RetryDecisionRetryNext
+	case *message.ReadFailure, *message.WriteFailure:
+		return RetryDecisionRethrow
+	}
+	if statement.Idempotent {
+		return RetryDecisionRetryNext
+	}
+	return RetryDecisionRethrow
+}
+
+func (p *DefaultRetryPolicy) OnConnectionError(statement *Statement, _ error, _ int) RetryDecision {
+	if statement.Idempotent {
+		return RetryDecisionRetryNext
+	}
+	return RetryDecisionRethrow
+}
+
+// A RetryPolicy that never retries.
+type FallthroughRetryPolicy struct{}
+
+func NewFallthroughRetryPolicy() *FallthroughRetryPolicy {
+	return &FallthroughRetryPolicy{}
+}
+
+func (p *FallthroughRetryPolicy) OnReadTimeout(*Statement, *message.ReadTimeout, int) RetryDecision {
+	return RetryDecisionRethrow
+}
+
+func (p *FallthroughRetryPolicy) OnWriteTimeout(*Statement, *message.WriteTimeout, int) RetryDecision {
+	return RetryDecisionRethrow
+}
+
+func (p *FallthroughRetryPolicy) OnUnavailable(*Statement, *message.Unavailable, int) RetryDecision {
+	return RetryDecisionRethrow
+}
+
+func (p *FallthroughRetryPolicy) OnErrorResponse(*Statement, message.Error, int) RetryDecision {
+	return RetryDecisionRethrow
+}
+
+func (p *FallthroughRetryPolicy) OnConnectionError(*Statement, error, int) RetryDecision {
+	return RetryDecisionRethrow
+}
+
+// Consults the given RetryPolicy for the given error response.
+func retryDecisionForError(policy RetryPolicy, statement *Statement, err message.Error, retryCount int) RetryDecision {
+	switch e := err.(type) {
+	case *message.ReadTimeout:
+		return policy.OnReadTimeout(statement, e, retryCount)
+	case *message.WriteTimeout:
+		return policy.OnWriteTimeout(statement, e, retryCount)
+	case *message.Unavailable:
+		return policy.OnUnavailable(statement, e, retryCount)
+	case *message.Overloaded,
+		*message.IsBootstrapping,
+		*message.ServerError,
+		*message.TruncateError,
+		*message.ReadFailure,
+		*message.WriteFailure:
+		return policy.OnErrorResponse(statement, err, retryCount)
+	}
+	return RetryDecisionRethrow
+}
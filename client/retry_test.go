@@ -0,0 +1,149 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	policy := client.NewDefaultRetryPolicy()
+	idempotent := &client.Statement{Idempotent: true}
+	nonIdempotent := &client.Statement{}
+	tests := []struct {
+		name     string
+		decision client.RetryDecision
+		expected client.RetryDecision
+	}{
+		{"read timeout enough replicas", policy.OnReadTimeout(nonIdempotent, &message.ReadTimeout{Received: 2, BlockFor: 2}, 0), client.RetryDecisionRetrySame},
+		{"read timeout enough replicas retried", policy.OnReadTimeout(nonIdempotent, &message.ReadTimeout{Received: 2, BlockFor: 2}, 1), client.RetryDecisionRethrow},
+		{"read timeout not enough replicas", policy.OnReadTimeout(nonIdempotent, &message.ReadTimeout{Received: 1, BlockFor: 2}, 0), client.RetryDecisionRethrow},
+		{"read timeout data present", policy.OnReadTimeout(nonIdempotent, &message.ReadTimeout{Received: 2, BlockFor: 2, DataPresent: true}, 0), client.RetryDecisionRethrow},
+		{"write timeout batch log idempotent", policy.OnWriteTimeout(idempotent, &message.WriteTimeout{WriteType: primitive.WriteTypeBatchLog}, 0), client.RetryDecisionRetrySame},
+		{"write timeout batch log non idempotent", policy.OnWriteTimeout(nonIdempotent, &message.WriteTimeout{WriteType: primitive.WriteTypeBatchLog}, 0), client.RetryDecisionRethrow},
+		{"write timeout simple idempotent", policy.OnWriteTimeout(idempotent, &message.WriteTimeout{WriteType: primitive.WriteTypeSimple}, 0), client.RetryDecisionRethrow},
+		{"unavailable", policy.OnUnavailable(nonIdempotent, &message.Unavailable{}, 0), client.RetryDecisionRetryNext},
+		{"unavailable retried", policy.OnUnavailable(nonIdempotent, &message.Unavailable{}, 1), client.RetryDecisionRethrow},
+		{"overloaded idempotent", policy.OnErrorResponse(idempotent, &message.Overloaded{}, 0), client.RetryDecisionRetryNext},
+		{"overloaded non idempotent", policy.OnErrorResponse(nonIdempotent, &message.Overloaded{}, 0), client.RetryDecisionRethrow},
+		{"bootstrapping non idempotent", policy.OnErrorResponse(nonIdempotent, &message.IsBootstrapping{}, 0), client.RetryDecisionRetryNext},
+		{"read failure idempotent", policy.OnErrorResponse(idempotent, &message.ReadFailure{}, 0), client.RetryDecisionRethrow},
+		{"write failure idempotent", policy.OnErrorResponse(idempotent, &message.WriteFailure{}, 0), client.RetryDecisionRethrow},
+		{"connection error idempotent", policy.OnConnectionError(idempotent, errors.New("closed"), 0), client.RetryDecisionRetryNext},
+		{"connection error non idempotent", policy.OnConnectionError(nonIdempotent, errors.New("closed"), 0), client.RetryDecisionRethrow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.decision)
+		})
+	}
+}
+
+// A LoadBalancingPolicy that returns the hosts in the order they are given, that is, sorted by address.
+type orderedPolicy struct{}
+
+func (p orderedPolicy) NewQueryPlan(_ *client.Statement, hosts []*client.Host) []*client.Host {
+	return hosts
+}
+
+func TestClusterClient_Execute_Retries(t *testing.T) {
+
+	var lock sync.Mutex
+	coordinators := map[string][]string{}
+	// 127.0.0.1 replies with errors, other nodes reply with VOID results
+	errorHandler := func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		query, ok := request.Body.Message.(*message.Query)
+		if !ok || strings.Contains(query.Query, "system.") {
+			return nil
+		}
+		coordinator := conn.LocalAddr().String()
+		lock.Lock()
+		coordinators[query.Query] = append(coordinators[query.Query], coordinator)
+		attempts := len(coordinators[query.Query])
+		lock.Unlock()
+		var response message.Message = &message.VoidResult{}
+		if coordinator == "127.0.0.1:9043" {
+			switch query.Query {
+			case "unavailable":
+				response = &message.Unavailable{Required: 2, Alive: 1}
+			case "read timeout":
+				if attempts == 1 {
+					response = &message.ReadTimeout{Received: 2, BlockFor: 2}
+				}
+			case "write timeout":
+				response = &message.WriteTimeout{WriteType: primitive.WriteTypeSimple}
+			case "overloaded":
+				response = &message.Overloaded{}
+			}
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, response)
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	servers := startTestCluster(t, ctx, newTestTopology(), errorHandler)
+
+	cluster := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+	cluster.PoolSize = 1
+	cluster.LoadBalancingPolicy = orderedPolicy{}
+	err := cluster.Start(ctx)
+	require.Nil(t, err)
+
+	tests := []struct {
+		query        string
+		idempotent   bool
+		expected     message.Message
+		coordinators []string
+	}{
+		{"unavailable", false, &message.VoidResult{}, []string{"127.0.0.1:9043", "127.0.0.2:9043"}},
+		{"read timeout", false, &message.VoidResult{}, []string{"127.0.0.1:9043", "127.0.0.1:9043"}},
+		{"write timeout", true, &message.WriteTimeout{WriteType: primitive.WriteTypeSimple}, []string{"127.0.0.1:9043"}},
+		{"overloaded", false, &message.Overloaded{}, []string{"127.0.0.1:9043"}},
+		{"overloaded", true, &message.VoidResult{}, []string{"127.0.0.1:9043", "127.0.0.1:9043", "127.0.0.2:9043"}},
+	}
+	for _, tt := range tests {
+		request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: tt.query})
+		response, err := cluster.Execute(ctx, &client.Statement{Frame: request, Idempotent: tt.idempotent})
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, response.Body.Message)
+		lock.Lock()
+		require.Equal(t, tt.coordinators, coordinators[tt.query])
+		lock.Unlock()
+	}
+
+	// no retries
+	cluster.RetryPolicy = client.NewFallthroughRetryPolicy()
+	request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "unavailable"})
+	response, err := cluster.Execute(ctx, &client.Statement{Frame: request})
+	require.Nil(t, err)
+	require.IsType(t, &message.Unavailable{}, response.Body.Message)
+
+	cancelFn()
+
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+	for _, server := range servers {
+		assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The schema version reported by servers whose schema was never changed.
+var DefaultSchemaVersion = primitive.UUID{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB, 0xBC, 0x31, 0x7B, 0xC1, 0x79, 0x6A}
+
+// SchemaColumn describes a table column.
+type SchemaColumn struct {
+	Name string
+	Type datatype.DataType
+	// For clustering columns, true if the clustering order is descending.
+	Descending bool
+	// For regular columns, true if the column is static.
+	Static bool
+}
+
+// SchemaTable describes a table.
+type SchemaTable struct {
+	Name string
+	// The table id; if nil, an id derived from the keyspace and table names is reported.
+	Id *primitive.UUID
+	// The partition key columns, in order.
+	PartitionKey []*SchemaColumn
+	// The clustering columns, in order.
+	ClusteringColumns []*SchemaColumn
+	// The regular and static columns.
+	Columns []*SchemaColumn
+}
+
+// Returns all the table columns: partition key columns first, then clustering columns, then regular and static
+// columns.
+func (t *SchemaTable) AllColumns() []*SchemaColumn {
+	columns := make([]*SchemaColumn, 0, len(t.PartitionKey)+len(t.ClusteringColumns)+len(t.Columns))
+	columns = append(columns, t.PartitionKey...)
+	columns = append(columns, t.ClusteringColumns...)
+	return append(columns, t.Columns...)
+}
+
+// Returns the column with the given name, or nil if no such column exists.
+func (t *SchemaTable) Column(name string) *SchemaColumn {
+	for _, column := range t.AllColumns() {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+// SchemaType describes a user-defined type.
+type SchemaType struct {
+	Name       string
+	FieldNames []string
+	FieldTypes []datatype.DataType
+}
+
+// SchemaKeyspace describes a keyspace and its tables and user-defined types.
+type SchemaKeyspace struct {
+	Name string
+	// The replication options; if nil, SimpleStrategy with a replication factor of 1 is reported.
+	Replication map[string]string
+	Tables      []*SchemaTable
+	Types       []*SchemaType
+}
+
+// Returns the table with the given name, or nil if no such table exists.
+func (k *SchemaKeyspace) Table(name string) *SchemaTable {
+	for _, table := range k.Tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+// Returns the user-defined type with the given name, or nil if no such type exists.
+func (k *SchemaKeyspace) Type(name string) *SchemaType {
+	for _, t := range k.Types {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Schema is a set of keyspaces, along with a schema version that changes each time a keyspace is put or removed. A
+// Schema is safe for concurrent use, but the keyspaces it contains must not be modified once put: put a new keyspace
+// instead.
+type Schema struct {
+	keyspaces []*SchemaKeyspace
+	version   primitive.UUID
+	lock      *sync.Mutex
+}
+
+// Creates a new Schema containing the given keyspaces, with version DefaultSchemaVersion.
+func NewSchema(keyspaces ...*SchemaKeyspace) *Schema {
+	return &Schema{
+		keyspaces: keyspaces,
+		version:   DefaultSchemaVersion,
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Returns the current schema version.
+func (s *Schema) Version() *primitive.UUID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	version := s.version
+	return &version
+}
+
+// Returns the keyspaces, in the order they were put.
+func (s *Schema) Keyspaces() []*SchemaKeyspace {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keyspaces := make([]*SchemaKeyspace, len(s.keyspaces))
+	copy(keyspaces, s.keyspaces)
+	return keyspaces
+}
+
+// Returns the keyspace with the given name, or nil if no such keyspace exists.
+func (s *Schema) Keyspace(name string) *SchemaKeyspace {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, keyspace := range s.keyspaces {
+		if keyspace.Name == name {
+			return keyspace
+		}
+	}
+	return nil
+}
+
+// Puts the given keyspace, replacing any keyspace with the same name, and changes the schema version.
+func (s *Schema) PutKeyspace(keyspace *SchemaKeyspace) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	replaced := false
+	for i, candidate := range s.keyspaces {
+		if candidate.Name == keyspace.Name {
+			s.keyspaces[i] = keyspace
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		s.keyspaces = append(s.keyspaces, keyspace)
+	}
+	s.version = randomUuid()
+}
+
+// Removes the keyspace with the given name, and changes the schema version. Returns false if no such keyspace exists.
+func (s *Schema) RemoveKeyspace(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, keyspace := range s.keyspaces {
+		if keyspace.Name == name {
+			s.keyspaces = append(s.keyspaces[:i:i], s.keyspaces[i+1:]...)
+			s.version = randomUuid()
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a random (version 4) UUID.
+func randomUuid() primitive.UUID {
+	var uuid primitive.UUID
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0F | 0x40
+	uuid[8] = uuid[8]&0x3F | 0x80
+	return uuid
+}
+
+// Returns a name-based (version 3) UUID for the given names.
+func nameBasedUuid(names ...string) primitive.UUID {
+	var uuid primitive.UUID
+	hash := md5.Sum([]byte(strings.Join(names, ".")))
+	copy(uuid[:], hash[:])
+	uuid[6] = uuid[6]&0x0F | 0x30
+	uuid[8] = uuid[8]&0x3F | 0x80
+	return uuid
+}
+
+// The number of 100-nanosecond intervals between the UUID epoch (1582-10-15) and the Unix epoch.
+const uuidEpochOffset = 0x01B21DD213814000
+
+// Returns a time-based (version 1) UUID for the given time, with random clock sequence and node.
+func timeBasedUuid(t time.Time) primitive.UUID {
+	var uuid primitive.UUID
+	timestamp := uint64(t.UnixNano()/100) + uuidEpochOffset
+	binary.BigEndian.PutUint32(uuid[0:], uint32(timestamp))
+	binary.BigEndian.PutUint16(uuid[4:], uint16(timestamp>>32))
+	binary.BigEndian.PutUint16(uuid[6:], uint16(timestamp>>48)&0x0FFF|0x1000)
+	rand.Read(uuid[8:])
+	uuid[8] = uuid[8]&0x3F | 0x80
+	return uuid
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	schema := client.NewSchema(&client.SchemaKeyspace{Name: "ks1"})
+	assert.Equal(t, &client.DefaultSchemaVersion, schema.Version())
+	assert.Equal(t, "ks1", schema.Keyspace("ks1").Name)
+	assert.Nil(t, schema.Keyspace("ks2"))
+
+	ks2 := &client.SchemaKeyspace{
+		Name: "ks2",
+		Tables: []*client.SchemaTable{{
+			Name:              "table1",
+			PartitionKey:      []*client.SchemaColumn{{Name: "pk", Type: datatype.Int}},
+			ClusteringColumns: []*client.SchemaColumn{{Name: "cc", Type: datatype.Int}},
+			Columns:           []*client.SchemaColumn{{Name: "v", Type: datatype.Varchar}},
+		}},
+	}
+	schema.PutKeyspace(ks2)
+	version := schema.Version()
+	assert.NotEqual(t, &client.DefaultSchemaVersion, version)
+	assert.Len(t, schema.Keyspaces(), 2)
+	table := schema.Keyspace("ks2").Table("table1")
+	assert.Equal(t, []string{"pk", "cc", "v"}, columnNames(table.AllColumns()))
+	assert.Equal(t, datatype.Varchar, table.Column("v").Type)
+	assert.Nil(t, table.Column("nonexistent"))
+
+	// putting a keyspace with the same name replaces it
+	schema.PutKeyspace(&client.SchemaKeyspace{Name: "ks2"})
+	assert.NotEqual(t, version, schema.Version())
+	assert.Len(t, schema.Keyspaces(), 2)
+	assert.Nil(t, schema.Keyspace("ks2").Table("table1"))
+
+	assert.True(t, schema.RemoveKeyspace("ks1"))
+	assert.False(t, schema.RemoveKeyspace("ks1"))
+	assert.Len(t, schema.Keyspaces(), 1)
+}
+
+func columnNames(columns []*client.SchemaColumn) []string {
+	var names []string
+	for _, column := range columns {
+		names = append(names, column.Name)
+	}
+	return names
+}
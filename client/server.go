@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
 	"github.com/rs/zerolog/log"
 	"io"
@@ -83,6 +84,10 @@ type CqlServer struct {
 	Credentials *AuthCredentials
 	// The frame.Codec to use; if none provided, a default codec will be used.
 	Codec frame.Codec
+	// The compressors to advertise in SUPPORTED responses; clients may then request one of them in their STARTUP
+	// request to enable compression on their connection. Ignored if a Codec is provided: in that case, the codec body
+	// compressor, if any, is the only supported compressor.
+	Compressors []frame.BodyCompressor
 	// The maximum number of open client connections to accept. Must be strictly positive.
 	MaxConnections int
 	// The maximum number of in-flight requests to apply for each connection created with Accept. Must be strictly
@@ -94,6 +99,9 @@ type CqlServer struct {
 	IdleTimeout time.Duration
 	// An optional list of handlers to handle incoming requests.
 	RequestHandlers []RequestHandler
+	// The log of the requests received by all the server connections. Each connection also has its own log, see
+	// CqlServerConnection.ActivityLog. If nil, requests are only recorded per connection.
+	ActivityLog *ActivityLog
 
 	ctx                context.Context
 	cancel             context.CancelFunc
@@ -101,6 +109,7 @@ type CqlServer struct {
 	connectionsHandler *clientConnectionHandler
 	waitGroup          *sync.WaitGroup
 	state              int32
+	faults             faultState
 }
 
 // Creates a new CqlServer with default options. Leave credentials nil to opt out from authentication.
@@ -112,6 +121,7 @@ func NewCqlServer(listenAddress string, credentials *AuthCredentials) *CqlServer
 		MaxInFlight:    DefaultMaxInFlight,
 		AcceptTimeout:  DefaultAcceptTimeout,
 		IdleTimeout:    DefaultIdleTimeout,
+		ActivityLog:    NewActivityLog(),
 	}
 }
 
@@ -206,9 +216,12 @@ func (server *CqlServer) acceptLoop() {
 					server.ctx,
 					server.Credentials,
 					server.Codec,
+					server.Compressors,
 					server.MaxInFlight,
 					server.IdleTimeout,
 					server.RequestHandlers,
+					server.ActivityLog,
+					&server.faults,
 					server.connectionsHandler.onConnectionClosed,
 				); err != nil {
 					log.Error().Msgf("%v: failed to create incoming client connection: %v", server, connection)
@@ -323,19 +336,33 @@ func (server *CqlServer) BindAndInit(
 // CqlServerConnection encapsulates a TCP server connection to a remote CQL client.
 // CqlServerConnection instances should be created by calling CqlServer.Accept or CqlServer.Bind.
 type CqlServerConnection struct {
-	conn        net.Conn
-	credentials *AuthCredentials
-	codec       frame.Codec
-	idleTimeout time.Duration
-	handlers    []RequestHandler
-	handlerCtx  []RequestHandlerContext
-	incoming    chan *frame.Frame
-	outgoing    chan *frame.Frame
-	waitGroup   *sync.WaitGroup
-	closed      int32
-	onClose     func(*CqlServerConnection)
-	ctx         context.Context
-	cancel      context.CancelFunc
+	conn         net.Conn
+	credentials  *AuthCredentials
+	codec        frame.Codec
+	compressors  []frame.BodyCompressor
+	compression  negotiatedCompressor
+	idleTimeout  time.Duration
+	handlers     []RequestHandler
+	handlerCtx   []RequestHandlerContext
+	activityLog  *ActivityLog
+	serverLog    *ActivityLog
+	incoming     chan *frame.Frame
+	outgoing     chan *frame.Frame
+	waitGroup    *sync.WaitGroup
+	closed       int32
+	onClose      func(*CqlServerConnection)
+	ctx          context.Context
+	cancel       context.CancelFunc
+	resumed      chan struct{}
+	pauseLock    *sync.Mutex
+	faults       faultState
+	serverFaults *faultState
+	halfClosed   int32
+	writeLock    *sync.Mutex
+	registration eventRegistration
+	interceptors responseInterceptors
+	// The keyspace set by the last USE statement, as a string.
+	keyspace atomic.Value
 }
 
 func newCqlServerConnection(
@@ -343,9 +370,12 @@ func newCqlServerConnection(
 	ctx context.Context,
 	credentials *AuthCredentials,
 	codec frame.Codec,
+	compressors []frame.BodyCompressor,
 	maxInFlight int,
 	idleTimeout time.Duration,
 	handlers []RequestHandler,
+	serverLog *ActivityLog,
+	serverFaults *faultState,
 	onClose func(*CqlServerConnection),
 ) (*CqlServerConnection, error) {
 	if conn == nil {
@@ -356,25 +386,35 @@ func newCqlServerConnection(
 	} else if maxInFlight > math.MaxInt16 {
 		return nil, fmt.Errorf("max in-flight: expecting <= %v, got: %v", math.MaxInt16, maxInFlight)
 	}
-	if codec == nil {
-		codec = frame.NewCodec()
-	}
 	connection := &CqlServerConnection{
-		conn:        conn,
-		codec:       codec,
-		credentials: credentials,
-		idleTimeout: idleTimeout,
-		handlers:    handlers,
-		handlerCtx:  make([]RequestHandlerContext, len(handlers)),
-		incoming:    make(chan *frame.Frame, maxInFlight),
-		outgoing:    make(chan *frame.Frame, maxInFlight),
-		waitGroup:   &sync.WaitGroup{},
-		onClose:     onClose,
+		conn:         conn,
+		codec:        codec,
+		compressors:  compressors,
+		credentials:  credentials,
+		idleTimeout:  idleTimeout,
+		handlers:     handlers,
+		handlerCtx:   make([]RequestHandlerContext, len(handlers)),
+		activityLog:  NewActivityLog(),
+		serverLog:    serverLog,
+		incoming:     make(chan *frame.Frame, maxInFlight),
+		outgoing:     make(chan *frame.Frame, maxInFlight),
+		waitGroup:    &sync.WaitGroup{},
+		onClose:      onClose,
+		pauseLock:    &sync.Mutex{},
+		serverFaults: serverFaults,
+		writeLock:    &sync.Mutex{},
+	}
+	if codec == nil {
+		connection.codec = frame.NewCodec()
+		connection.codec.SetBodyCompressor(&connection.compression)
+	} else {
+		connection.compressors = nil
 	}
 	for i := range handlers {
 		connection.handlerCtx[i] = requestHandlerContext{}
 	}
 	connection.ctx, connection.cancel = context.WithCancel(ctx)
+	connection.applyFaults()
 	connection.incomingLoop()
 	connection.outgoingLoop()
 	connection.awaitDone()
@@ -409,6 +449,9 @@ func (c *CqlServerConnection) incomingLoop() {
 	go func() {
 		abort := false
 		for !c.IsClosed() {
+			if c.awaitReadsResumed(); c.IsClosed() {
+				break
+			}
 			if err := c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
 				if !c.IsClosed() {
 					log.Error().Err(err).Msgf("%v: error setting idle timeout, closing connection", c)
@@ -427,6 +470,10 @@ func (c *CqlServerConnection) incomingLoop() {
 				break
 			} else {
 				log.Debug().Msgf("%v: received incoming frame: %v", c, incoming)
+				if c.awaitResumed(); c.IsClosed() {
+					break
+				}
+				record := c.logRequest(incoming)
 				select {
 				case c.incoming <- incoming:
 					log.Debug().Msgf("%v: incoming frame successfully delivered: %v", c, incoming)
@@ -434,7 +481,7 @@ func (c *CqlServerConnection) incomingLoop() {
 					log.Error().Msgf("%v: incoming frames queue is full, discarding frame: %v", c, incoming)
 				}
 				if len(c.handlers) > 0 {
-					c.invokeRequestHandlers(incoming)
+					c.invokeRequestHandlers(incoming, record)
 				}
 			}
 		}
@@ -450,28 +497,49 @@ func (c *CqlServerConnection) outgoingLoop() {
 	c.waitGroup.Add(1)
 	go func() {
 		abort := false
+		// frames held back to be sent out of order, see Faults.ReorderWindow
+		var held []*frame.Frame
+		var flush <-chan time.Time
+	loop:
 		for !c.IsClosed() {
-			if outgoing, ok := <-c.outgoing; !ok {
-				if !c.IsClosed() {
-					log.Error().Msgf("%v: outgoing frame channel was closed unexpectedly, closing connection", c)
-					abort = true
-				}
-				break
-			} else {
-				log.Debug().Msgf("%v: sending outgoing frame: %v", c, outgoing)
-				if err := c.codec.EncodeFrame(outgoing, c.conn); err != nil {
+			var outgoing []*frame.Frame
+			select {
+			case f, ok := <-c.outgoing:
+				if !ok {
 					if !c.IsClosed() {
-						if errors.Is(err, io.EOF) {
-							log.Info().Msgf("%v: connection reset by peer, closing", c)
-						} else {
-							log.Error().Err(err).Msgf("%v: error writing, closing connection", c)
-						}
+						log.Error().Msgf("%v: outgoing frame channel was closed unexpectedly, closing connection", c)
 						abort = true
 					}
-					break
+					break loop
+				}
+				log.Debug().Msgf("%v: sending outgoing frame: %v", c, f)
+				if faults := c.Faults(); faults == nil || faults.ReorderWindow <= 1 {
+					outgoing = append(reverseFrames(held), f)
+					held = nil
+				} else if held = append(held, f); len(held) >= faults.ReorderWindow {
+					outgoing = reverseFrames(held)
+					held = nil
 				} else {
-					log.Debug().Msgf("%v: outgoing frame successfully written: %v", c, outgoing)
+					flush = time.After(ReorderFlushDelay)
 				}
+			case <-flush:
+				outgoing = reverseFrames(held)
+				held = nil
+			}
+			if err := c.writeFrames(outgoing, c.Faults()); err != nil {
+				if !c.IsClosed() {
+					if errors.Is(err, errFrameTruncated) {
+						log.Info().Msgf("%v: outgoing frame truncated, closing connection", c)
+					} else if errors.Is(err, io.EOF) {
+						log.Info().Msgf("%v: connection reset by peer, closing", c)
+					} else {
+						log.Error().Err(err).Msgf("%v: error writing, closing connection", c)
+					}
+					abort = true
+				}
+				break
+			} else if len(outgoing) > 0 {
+				log.Debug().Msgf("%v: outgoing frames successfully written: %v", c, outgoing)
 			}
 		}
 		c.waitGroup.Done()
@@ -491,17 +559,27 @@ func (c *CqlServerConnection) awaitDone() {
 	}()
 }
 
-func (c *CqlServerConnection) invokeRequestHandlers(request *frame.Frame) {
+func (c *CqlServerConnection) invokeRequestHandlers(request *frame.Frame, record *activityRecord) {
 	c.waitGroup.Add(1)
 	go func() {
 		log.Debug().Msgf("%v: invoking request handlers for incoming request: %v", c, request)
 		var response *frame.Frame
 		var err error
 		for i, handler := range c.handlers {
+			if c.IsClosed() {
+				// a handler may have closed the connection, or blocked until it was closed
+				break
+			}
 			if response = handler(request, c, c.handlerCtx[i]); response != nil {
 				log.Debug().Msgf("%v: request handler %v produced response: %v", c, i, response)
+				// log the response before sending it, so that it is visible to clients receiving it
+				c.logResponse(record, response)
+				if result, ok := response.Body.Message.(*message.SetKeyspaceResult); ok {
+					c.keyspace.Store(result.Keyspace)
+				}
 				if err = c.Send(response); err != nil {
 					log.Error().Err(err).Msgf("%v: send failed for frame: %v", c, response)
+					c.logResponse(record, nil)
 				}
 				break
 			}
@@ -513,11 +591,50 @@ func (c *CqlServerConnection) invokeRequestHandlers(request *frame.Frame) {
 	}()
 }
 
-// Sends the given response frame.
+// Returns the keyspace set by the last USE statement executed on this connection, i.e. the keyspace of the last
+// SET_KEYSPACE RESULT sent by the request handlers; empty if no keyspace was set.
+func (c *CqlServerConnection) Keyspace() string {
+	keyspace, _ := c.keyspace.Load().(string)
+	return keyspace
+}
+
+// Returns the log of the requests received by this connection.
+func (c *CqlServerConnection) ActivityLog() *ActivityLog {
+	return c.activityLog
+}
+
+func (c *CqlServerConnection) logRequest(request *frame.Frame) *activityRecord {
+	record := &activityRecord{
+		entry: ActivityLogEntry{Timestamp: time.Now(), Connection: c, Request: request},
+		lock:  &sync.Mutex{},
+	}
+	c.activityLog.add(record)
+	if c.serverLog != nil {
+		c.serverLog.add(record)
+	}
+	return record
+}
+
+func (c *CqlServerConnection) logResponse(record *activityRecord, response *frame.Frame) {
+	record.lock.Lock()
+	record.entry.Response = response
+	record.lock.Unlock()
+	c.activityLog.notify()
+	if c.serverLog != nil {
+		c.serverLog.notify()
+	}
+}
+
+// Sends the given response frame. The frame is first processed by the interceptors registered for its stream id, if
+// any; see InterceptResponses.
 func (c *CqlServerConnection) Send(f *frame.Frame) error {
 	if c.IsClosed() {
 		return fmt.Errorf("%v: connection closed", c)
 	}
+	if f = c.interceptors.apply(f); f == nil {
+		log.Debug().Msgf("%v: outgoing frame dropped by interceptor", c)
+		return nil
+	}
 	log.Debug().Msgf("%v: enqueuing outgoing frame: %v", c, f)
 	select {
 	case c.outgoing <- f:
@@ -547,6 +664,47 @@ func (c *CqlServerConnection) Receive() (*frame.Frame, error) {
 	}
 }
 
+// Pauses the connection: incoming frames are not read nor processed anymore until Resume is called, as if the server
+// was unresponsive. Clients will eventually fill the TCP window and get blocked. A frame being read when the connection
+// is paused is held until the connection is resumed.
+func (c *CqlServerConnection) Pause() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	if c.resumed == nil {
+		log.Debug().Msgf("%v: pausing", c)
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resumes the connection after a call to Pause.
+func (c *CqlServerConnection) Resume() {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	if c.resumed != nil {
+		log.Debug().Msgf("%v: resuming", c)
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+func (c *CqlServerConnection) IsPaused() bool {
+	c.pauseLock.Lock()
+	defer c.pauseLock.Unlock()
+	return c.resumed != nil
+}
+
+func (c *CqlServerConnection) awaitResumed() {
+	c.pauseLock.Lock()
+	resumed := c.resumed
+	c.pauseLock.Unlock()
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-c.ctx.Done():
+		}
+	}
+}
+
 func (c *CqlServerConnection) IsClosed() bool {
 	return atomic.LoadInt32(&c.closed) == 1
 }
@@ -0,0 +1,444 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultSimulatedClusterPort           = 9042
+	DefaultSimulatedClusterReleaseVersion = "3.11.9"
+)
+
+// SimulatedDatacenter describes the topology of a datacenter in a SimulatedCluster.
+type SimulatedDatacenter struct {
+	// The datacenter name.
+	Name string
+	// The number of nodes in each rack; racks are named rack1, rack2, etc.
+	NodesPerRack []int
+}
+
+// SimulatedNode is a node of a SimulatedCluster, served by its own CqlServer. The exported fields can be modified
+// until the node is started.
+type SimulatedNode struct {
+	// The loopback address the node listens on.
+	IP net.IP
+	// The node's datacenter.
+	Datacenter string
+	// The node's rack.
+	Rack string
+	// The node's host id.
+	HostId *primitive.UUID
+	// The node's tokens.
+	Tokens []string
+
+	cluster *SimulatedCluster
+	server  *CqlServer
+}
+
+// Returns the address the node listens on, in host:port format.
+func (n *SimulatedNode) Address() string {
+	return net.JoinHostPort(n.IP.String(), strconv.Itoa(n.cluster.Port))
+}
+
+func (n *SimulatedNode) String() string {
+	return fmt.Sprintf("simulated node [%v]", n.Address())
+}
+
+// Returns the CqlServer currently serving this node, or nil if the node is down. A new CqlServer is created each time
+// the node is started.
+func (n *SimulatedNode) Server() *CqlServer {
+	n.cluster.lock.Lock()
+	defer n.cluster.lock.Unlock()
+	return n.server
+}
+
+func (n *SimulatedNode) IsUp() bool {
+	return n.Server() != nil
+}
+
+func (n *SimulatedNode) inet() *primitive.Inet {
+	return &primitive.Inet{Addr: n.IP, Port: int32(n.cluster.Port)}
+}
+
+// SimulatedCluster is a fake multi-node cluster, where each node is served by a CqlServer listening on its own
+// loopback address: 127.0.0.1, 127.0.0.2, etc. Nodes handle handshakes, heartbeats, USE queries and REGISTER requests,
+// and answer queries to system.local, system.peers and system.peers_v2 from their own perspective, so that drivers can
+// discover the cluster topology, as well as queries to the system_schema tables; see SystemTables. Nodes can be stopped, started, added and removed while the cluster is running; other
+// nodes then push STATUS_CHANGE and TOPOLOGY_CHANGE events to the connections that registered for them.
+// It is preferable to create SimulatedCluster instances using the constructor function NewSimulatedCluster.
+// Note that addresses other than 127.0.0.1 are not available by default on some operating systems, such as macOS.
+type SimulatedCluster struct {
+	// The cluster name.
+	Name string
+	// The port all nodes listen on.
+	Port int
+	// The release version reported by all nodes.
+	ReleaseVersion string
+	// The AuthCredentials nodes require from clients; if nil, no authentication is required.
+	Credentials *AuthCredentials
+	// The schema reported by all nodes in the system_schema tables.
+	Schema *Schema
+	// Additional handlers to handle incoming requests. They are invoked after the built-in handshake and heartbeat
+	// handlers, and before the built-in handlers for USE queries, REGISTER requests and system tables.
+	RequestHandlers []RequestHandler
+
+	nodes     []*SimulatedNode
+	nextIndex int
+	ctx       context.Context
+	cancel    context.CancelFunc
+	waitGroup *sync.WaitGroup
+	state     int32
+	lock      *sync.Mutex
+}
+
+// Creates a new SimulatedCluster with the given datacenters, with default options. Nodes are assigned consecutive
+// loopback addresses, deterministic host ids, and one token each, evenly distributed across the ring.
+func NewSimulatedCluster(name string, datacenters ...*SimulatedDatacenter) *SimulatedCluster {
+	cluster := &SimulatedCluster{
+		Name:           name,
+		Port:           DefaultSimulatedClusterPort,
+		ReleaseVersion: DefaultSimulatedClusterReleaseVersion,
+		Schema:         NewSchema(),
+		lock:           &sync.Mutex{},
+	}
+	for _, dc := range datacenters {
+		for i, count := range dc.NodesPerRack {
+			for j := 0; j < count; j++ {
+				cluster.nodes = append(cluster.nodes, cluster.newNode(dc.Name, fmt.Sprintf("rack%d", i+1)))
+			}
+		}
+	}
+	for i, node := range cluster.nodes {
+		node.Tokens = []string{evenlyDistributedToken(i, len(cluster.nodes))}
+	}
+	return cluster
+}
+
+func (c *SimulatedCluster) newNode(datacenter string, rack string) *SimulatedNode {
+	c.nextIndex++
+	hostId := &primitive.UUID{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB}
+	hostId[12] = byte(c.nextIndex >> 24)
+	hostId[13] = byte(c.nextIndex >> 16)
+	hostId[14] = byte(c.nextIndex >> 8)
+	hostId[15] = byte(c.nextIndex)
+	return &SimulatedNode{
+		IP:         net.IPv4(127, byte(c.nextIndex>>16), byte(c.nextIndex>>8), byte(c.nextIndex)),
+		Datacenter: datacenter,
+		Rack:       rack,
+		HostId:     hostId,
+		cluster:    c,
+	}
+}
+
+// Returns the token of the node at the given index, when count tokens are evenly distributed across the
+// Murmur3Partitioner ring.
+func evenlyDistributedToken(index int, count int) string {
+	// unsigned arithmetic wraps around, 1 << 63 being the two's complement representation of math.MinInt64
+	step := math.MaxUint64 / uint64(count)
+	return strconv.FormatInt(int64(uint64(1)<<63+uint64(index)*step), 10)
+}
+
+func (c *SimulatedCluster) String() string {
+	return fmt.Sprintf("simulated cluster [%v]", c.Name)
+}
+
+func (c *SimulatedCluster) getState() int32 {
+	return atomic.LoadInt32(&c.state)
+}
+
+func (c *SimulatedCluster) IsNotStarted() bool {
+	return c.getState() == ServerStateNotStarted
+}
+
+func (c *SimulatedCluster) IsRunning() bool {
+	return c.getState() == ServerStateRunning
+}
+
+func (c *SimulatedCluster) IsClosed() bool {
+	return c.getState() == ServerStateClosed
+}
+
+func (c *SimulatedCluster) transitionState(old int32, new int32) bool {
+	return atomic.CompareAndSwapInt32(&c.state, old, new)
+}
+
+// Returns the cluster nodes, including the nodes that are down.
+func (c *SimulatedCluster) Nodes() []*SimulatedNode {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	nodes := make([]*SimulatedNode, len(c.nodes))
+	copy(nodes, c.nodes)
+	return nodes
+}
+
+// Returns the node listening on the given address, in host:port format, or nil if no such node exists.
+func (c *SimulatedCluster) Node(address string) *SimulatedNode {
+	for _, node := range c.Nodes() {
+		if node.Address() == address {
+			return node
+		}
+	}
+	return nil
+}
+
+// Returns the addresses of all the nodes, in host:port format, to be used as contact points.
+func (c *SimulatedCluster) Addresses() []string {
+	var addresses []string
+	for _, node := range c.Nodes() {
+		addresses = append(addresses, node.Address())
+	}
+	return addresses
+}
+
+// Starts all the nodes. Set ctx to context.Background if no parent context exists.
+func (c *SimulatedCluster) Start(ctx context.Context) (err error) {
+	if ctx == nil {
+		return fmt.Errorf("context cannot be nil")
+	}
+	if c.transitionState(ServerStateNotStarted, ServerStateRunning) {
+		log.Debug().Msgf("%v: cluster is starting", c)
+		c.ctx, c.cancel = context.WithCancel(ctx)
+		c.waitGroup = &sync.WaitGroup{}
+		for _, node := range c.Nodes() {
+			if err = c.startNode(node); err != nil {
+				_ = c.Close()
+				return fmt.Errorf("%v: start failed: %w", c, err)
+			}
+		}
+		c.awaitDone()
+		log.Info().Msgf("%v: successfully started", c)
+	} else {
+		log.Debug().Msgf("%v: already started or closed", c)
+	}
+	return err
+}
+
+// Stops all the nodes; no events are pushed.
+func (c *SimulatedCluster) Close() (err error) {
+	if c.transitionState(ServerStateRunning, ServerStateClosed) {
+		log.Debug().Msgf("%v: closing", c)
+		for _, node := range c.Nodes() {
+			if stopErr := c.stopNode(node); stopErr != nil && err == nil {
+				err = fmt.Errorf("%v: could not close cluster: %w", c, stopErr)
+			}
+		}
+		c.cancel()
+		c.waitGroup.Wait()
+		log.Info().Msgf("%v: successfully closed", c)
+	} else {
+		log.Debug().Msgf("%v: not started or already closed", c)
+	}
+	return err
+}
+
+func (c *SimulatedCluster) awaitDone() {
+	c.waitGroup.Add(1)
+	go func() {
+		<-c.ctx.Done()
+		log.Debug().Err(c.ctx.Err()).Msgf("%v: context was closed", c)
+		c.waitGroup.Done()
+		if err := c.Close(); err != nil {
+			log.Error().Err(err).Msgf("%v: error closing", c)
+		}
+	}()
+}
+
+// Starts the given node, if it is down, then pushes a STATUS_CHANGE UP event for it from the other nodes.
+func (c *SimulatedCluster) StartNode(node *SimulatedNode) error {
+	if !c.IsRunning() {
+		return fmt.Errorf("%v: cluster is not running", c)
+	} else if node.IsUp() {
+		return nil
+	} else if err := c.startNode(node); err != nil {
+		return err
+	}
+	c.pushEvent(node, &message.StatusChangeEvent{ChangeType: primitive.StatusChangeTypeUp, Address: node.inet()})
+	return nil
+}
+
+// Stops the given node, if it is up, then pushes a STATUS_CHANGE DOWN event for it from the other nodes. The node
+// remains part of the cluster topology.
+func (c *SimulatedCluster) StopNode(node *SimulatedNode) error {
+	if !c.IsRunning() {
+		return fmt.Errorf("%v: cluster is not running", c)
+	} else if !node.IsUp() {
+		return nil
+	} else if err := c.stopNode(node); err != nil {
+		return err
+	}
+	c.pushEvent(node, &message.StatusChangeEvent{ChangeType: primitive.StatusChangeTypeDown, Address: node.inet()})
+	return nil
+}
+
+// Adds a new node to the cluster, in the given datacenter and rack. The new node is assigned the next available
+// loopback address, and a token in the middle of the largest range of the ring. If the cluster is running, the node
+// is started, and a TOPOLOGY_CHANGE NEW_NODE event is pushed for it from the other nodes.
+func (c *SimulatedCluster) AddNode(datacenter string, rack string) (*SimulatedNode, error) {
+	c.lock.Lock()
+	node := c.newNode(datacenter, rack)
+	node.Tokens = []string{c.largestRangeMidpoint()}
+	c.nodes = append(c.nodes, node)
+	c.lock.Unlock()
+	log.Info().Msgf("%v: added %v", c, node)
+	if c.IsRunning() {
+		if err := c.startNode(node); err != nil {
+			return node, err
+		}
+		c.pushEvent(node, &message.TopologyChangeEvent{ChangeType: primitive.TopologyChangeTypeNewNode, Address: node.inet()})
+	}
+	return node, nil
+}
+
+// Removes the given node from the cluster, stopping it first if it is up. If the cluster is running, a
+// TOPOLOGY_CHANGE REMOVED_NODE event is pushed for it from the other nodes.
+func (c *SimulatedCluster) RemoveNode(node *SimulatedNode) error {
+	if err := c.stopNode(node); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	for i, candidate := range c.nodes {
+		if candidate == node {
+			c.nodes = append(c.nodes[:i:i], c.nodes[i+1:]...)
+			break
+		}
+	}
+	c.lock.Unlock()
+	log.Info().Msgf("%v: removed %v", c, node)
+	if c.IsRunning() {
+		c.pushEvent(node, &message.TopologyChangeEvent{ChangeType: primitive.TopologyChangeTypeRemovedNode, Address: node.inet()})
+	}
+	return nil
+}
+
+// Returns the middle of the largest token range of the ring; must be called while holding the cluster lock.
+func (c *SimulatedCluster) largestRangeMidpoint() string {
+	var tokens []int64
+	for _, node := range c.nodes {
+		for _, token := range node.Tokens {
+			if t, err := strconv.ParseInt(token, 10, 64); err == nil {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return strconv.FormatInt(math.MinInt64, 10)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	start, largest := tokens[0], uint64(math.MaxUint64)
+	if len(tokens) > 1 {
+		largest = 0
+		for i, token := range tokens {
+			// int64 arithmetic wraps around, which accounts for the range spanning the end of the ring
+			if size := uint64(tokens[(i+1)%len(tokens)] - token); size > largest {
+				start, largest = token, size
+			}
+		}
+	}
+	return strconv.FormatInt(start+int64(largest/2), 10)
+}
+
+func (c *SimulatedCluster) startNode(node *SimulatedNode) error {
+	server := NewCqlServer(node.Address(), c.Credentials)
+	server.RequestHandlers = append([]RequestHandler{HandshakeHandler, HeartbeatHandler}, c.RequestHandlers...)
+	server.RequestHandlers = append(server.RequestHandlers,
+		NewSetKeyspaceHandler(func(string) {}),
+		RegisterHandler,
+		node.systemTablesHandler,
+	)
+	if err := server.Start(c.ctx); err != nil {
+		return fmt.Errorf("%v: could not start %v: %w", c, node, err)
+	}
+	c.lock.Lock()
+	node.server = server
+	c.lock.Unlock()
+	log.Info().Msgf("%v: %v is up", c, node)
+	return nil
+}
+
+func (c *SimulatedCluster) stopNode(node *SimulatedNode) error {
+	c.lock.Lock()
+	server := node.server
+	node.server = nil
+	c.lock.Unlock()
+	if server == nil {
+		return nil
+	}
+	if err := server.Close(); err != nil {
+		return fmt.Errorf("%v: could not stop %v: %w", c, node, err)
+	}
+	log.Info().Msgf("%v: %v is down", c, node)
+	return nil
+}
+
+// Pushes the given event about the given node to all the connections of the other nodes that are up and registered for
+// the event type.
+func (c *SimulatedCluster) pushEvent(subject *SimulatedNode, event message.Event) {
+	var servers []*CqlServer
+	c.lock.Lock()
+	for _, node := range c.nodes {
+		if node != subject && node.server != nil {
+			servers = append(servers, node.server)
+		}
+	}
+	c.lock.Unlock()
+	for _, server := range servers {
+		if _, err := server.BroadcastEvent(event); err != nil {
+			log.Error().Err(err).Msgf("%v: could not push event from %v", c, server)
+		}
+	}
+}
+
+// Answers queries to system tables from this node's perspective: the node is reported in system.local, and the other
+// nodes of the cluster, including the nodes that are down, in system.peers and system.peers_v2.
+func (n *SimulatedNode) systemTablesHandler(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) *frame.Frame {
+	tables := &SystemTables{
+		ClusterName:    n.cluster.Name,
+		ReleaseVersion: n.cluster.ReleaseVersion,
+		CqlVersion:     DefaultCqlVersion,
+		Partitioner:    DefaultPartitioner,
+		Local:          n.systemNode(),
+		Schema:         n.cluster.Schema,
+	}
+	for _, node := range n.cluster.Nodes() {
+		if node != n {
+			tables.Peers = append(tables.Peers, node.systemNode())
+		}
+	}
+	return tables.Handler()(request, conn, ctx)
+}
+
+func (n *SimulatedNode) systemNode() *SystemNode {
+	return &SystemNode{
+		Address:    n.IP,
+		NativePort: n.cluster.Port,
+		Datacenter: n.Datacenter,
+		Rack:       n.Rack,
+		HostId:     n.HostId,
+		Tokens:     n.Tokens,
+	}
+}
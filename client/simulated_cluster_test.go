@@ -0,0 +1,216 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSimulatedCluster() *client.SimulatedCluster {
+	cluster := client.NewSimulatedCluster("cluster1",
+		&client.SimulatedDatacenter{Name: "dc1", NodesPerRack: []int{1, 1}},
+		&client.SimulatedDatacenter{Name: "dc2", NodesPerRack: []int{1}},
+	)
+	cluster.Port = 9043
+	return cluster
+}
+
+func TestSimulatedCluster_Topology(t *testing.T) {
+	cluster := newTestSimulatedCluster()
+	nodes := cluster.Nodes()
+	require.Len(t, nodes, 3)
+	assert.Equal(t, []string{"127.0.0.1:9043", "127.0.0.2:9043", "127.0.0.3:9043"}, cluster.Addresses())
+	assert.Equal(t, "dc1", nodes[0].Datacenter)
+	assert.Equal(t, "rack1", nodes[0].Rack)
+	assert.Equal(t, "dc1", nodes[1].Datacenter)
+	assert.Equal(t, "rack2", nodes[1].Rack)
+	assert.Equal(t, "dc2", nodes[2].Datacenter)
+	assert.Equal(t, "rack1", nodes[2].Rack)
+	assert.Equal(t, []string{"-9223372036854775808"}, nodes[0].Tokens)
+	assert.Equal(t, []string{"-3074457345618258603"}, nodes[1].Tokens)
+	assert.Equal(t, []string{"3074457345618258602"}, nodes[2].Tokens)
+	assert.NotEqual(t, nodes[0].HostId, nodes[1].HostId)
+	assert.Same(t, nodes[1], cluster.Node("127.0.0.2:9043"))
+
+	// new nodes take the middle of the largest range
+	node, err := cluster.AddNode("dc2", "rack1")
+	require.Nil(t, err)
+	assert.Equal(t, "127.0.0.4:9043", node.Address())
+	assert.Equal(t, []string{"6148914691236517205"}, node.Tokens)
+	assert.False(t, node.IsUp())
+}
+
+func TestSimulatedCluster_SystemTables(t *testing.T) {
+	cluster := newTestSimulatedCluster()
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, cluster.Start(ctx))
+	clientConn, err := client.NewCqlClient("127.0.0.2:9043", nil).ConnectAndInit(ctx, primitive.ProtocolVersion4, client.ManagedStreamId)
+	require.Nil(t, err)
+	nodes := cluster.Nodes()
+
+	query := func(q string) message.Message {
+		response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: q}))
+		require.Nil(t, err)
+		return response.Body.Message
+	}
+
+	local := query("SELECT * FROM system.local WHERE key = 'local'").(*message.RowsResult)
+	require.Len(t, local.Data, 1)
+	assert.Equal(t, "broadcast_address", local.Metadata.Columns[1].Name)
+	assert.Equal(t, []byte{127, 0, 0, 2}, []byte(local.Data[0][1]))
+	assert.Equal(t, []byte("cluster1"), []byte(local.Data[0][2]))
+	assert.Equal(t, nodes[1].HostId.Bytes(), []byte(local.Data[0][5]))
+
+	projection := query("select data_center, rack, tokens from system.local").(*message.RowsResult)
+	require.Len(t, projection.Metadata.Columns, 3)
+	assert.Equal(t, []byte("dc1"), []byte(projection.Data[0][0]))
+	assert.Equal(t, []byte("rack2"), []byte(projection.Data[0][1]))
+	tokens, err := datatype.NewSetCodec(&datatype.VarcharCodec{}).Decode(projection.Data[0][2], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"-3074457345618258603"}, tokens)
+
+	peers := query("SELECT peer, data_center, host_id FROM system.peers").(*message.RowsResult)
+	require.Len(t, peers.Data, 2)
+	assert.Equal(t, []byte{127, 0, 0, 1}, []byte(peers.Data[0][0]))
+	assert.Equal(t, []byte("dc1"), []byte(peers.Data[0][1]))
+	assert.Equal(t, []byte{127, 0, 0, 3}, []byte(peers.Data[1][0]))
+	assert.Equal(t, []byte("dc2"), []byte(peers.Data[1][1]))
+	assert.Equal(t, nodes[2].HostId.Bytes(), []byte(peers.Data[1][2]))
+
+	peersV2 := query("SELECT native_address, native_port FROM system.peers_v2").(*message.RowsResult)
+	require.Len(t, peersV2.Data, 2)
+	port, err := (&datatype.IntCodec{}).Decode(peersV2.Data[0][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, int32(9043), port)
+
+	assert.IsType(t, &message.Invalid{}, query("SELECT nonexistent FROM system.local"))
+
+	cancelFn()
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+	for _, node := range nodes {
+		assert.False(t, node.IsUp())
+	}
+}
+
+func TestSimulatedCluster_Events(t *testing.T) {
+	cluster := newTestSimulatedCluster()
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, cluster.Start(ctx))
+	clientConn, err := client.NewCqlClient("127.0.0.1:9043", nil).ConnectAndInit(ctx, primitive.ProtocolVersion4, client.ManagedStreamId)
+	require.Nil(t, err)
+	register := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Register{
+		EventTypes: []primitive.EventType{primitive.EventTypeStatusChange, primitive.EventTypeTopologyChange},
+	})
+	response, err := clientConn.SendAndReceive(register)
+	require.Nil(t, err)
+	require.IsType(t, &message.Ready{}, response.Body.Message)
+
+	receiveEvent := func() message.Message {
+		event, err := clientConn.ReceiveEvent()
+		require.Nil(t, err)
+		assert.EqualValues(t, -1, event.Header.StreamId)
+		return event.Body.Message
+	}
+	node3 := cluster.Node("127.0.0.3:9043")
+
+	require.Nil(t, cluster.StopNode(node3))
+	assert.False(t, node3.IsUp())
+	assertEvent(t, primitive.StatusChangeTypeDown, "127.0.0.3:9043", receiveEvent())
+	// stopped nodes remain peers
+	peers, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM system.peers"}))
+	require.Nil(t, err)
+	assert.Len(t, peers.Body.Message.(*message.RowsResult).Data, 2)
+
+	require.Nil(t, cluster.StartNode(node3))
+	assert.True(t, node3.IsUp())
+	assertEvent(t, primitive.StatusChangeTypeUp, "127.0.0.3:9043", receiveEvent())
+
+	node4, err := cluster.AddNode("dc2", "rack1")
+	require.Nil(t, err)
+	assert.True(t, node4.IsUp())
+	assertEvent(t, primitive.TopologyChangeTypeNewNode, "127.0.0.4:9043", receiveEvent())
+
+	require.Nil(t, cluster.RemoveNode(node3))
+	assert.Len(t, cluster.Nodes(), 3)
+	assertEvent(t, primitive.TopologyChangeTypeRemovedNode, "127.0.0.3:9043", receiveEvent())
+
+	cancelFn()
+	assert.Eventually(t, clientConn.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+}
+
+func assertEvent(t *testing.T, changeType interface{}, address string, event message.Message) {
+	var actualChangeType interface{}
+	var actualAddress *primitive.Inet
+	switch e := event.(type) {
+	case *message.StatusChangeEvent:
+		actualChangeType, actualAddress = e.ChangeType, e.Address
+	case *message.TopologyChangeEvent:
+		actualChangeType, actualAddress = e.ChangeType, e.Address
+	default:
+		require.Fail(t, "unexpected event", "%v", event)
+	}
+	assert.Equal(t, changeType, actualChangeType)
+	assert.Equal(t, address, net.JoinHostPort(actualAddress.Addr.String(), strconv.Itoa(int(actualAddress.Port))))
+}
+
+func TestSimulatedCluster_ClusterClient(t *testing.T) {
+	cluster := newTestSimulatedCluster()
+	ctx, cancelFn := context.WithCancel(context.Background())
+	require.Nil(t, cluster.Start(ctx))
+
+	clusterClient := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+	clusterClient.PoolSize = 1
+	require.Nil(t, clusterClient.Start(ctx))
+	hosts := clusterClient.Hosts()
+	require.Len(t, hosts, 3)
+	for i, node := range cluster.Nodes() {
+		assert.Equal(t, node.Address(), hosts[i].Address)
+		assert.Equal(t, node.Datacenter, hosts[i].Datacenter)
+		assert.Equal(t, node.Rack, hosts[i].Rack)
+		assert.Equal(t, node.HostId, hosts[i].HostId)
+		assert.Equal(t, node.Tokens, hosts[i].Tokens)
+		assert.True(t, hosts[i].IsUp())
+	}
+
+	node3 := cluster.Node("127.0.0.3:9043")
+	host3 := clusterClient.Host("127.0.0.3:9043")
+	require.Nil(t, cluster.StopNode(node3))
+	assert.Eventually(t, func() bool { return !host3.IsUp() }, time.Second*10, time.Millisecond*10)
+	require.Nil(t, cluster.StartNode(node3))
+	assert.Eventually(t, host3.IsUp, time.Second*10, time.Millisecond*10)
+
+	_, err := cluster.AddNode("dc1", "rack1")
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return len(clusterClient.Hosts()) == 4 }, time.Second*10, time.Millisecond*10)
+	require.Nil(t, cluster.RemoveNode(node3))
+	assert.Eventually(t, func() bool { return clusterClient.Host("127.0.0.3:9043") == nil }, time.Second*10, time.Millisecond*10)
+
+	cancelFn()
+	assert.Eventually(t, clusterClient.IsClosed, time.Second*10, time.Millisecond*10)
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSpeculativeMinSamples = 100
+	DefaultSpeculativeWindowSize = 1000
+)
+
+// SpeculativeExecutionPolicy decides when ClusterClient should start speculative executions of idempotent statements,
+// that is, send the same request to another host while the previous executions are still running. The first
+// execution to complete wins; all the other executions are then canceled.
+type SpeculativeExecutionPolicy interface {
+	// Returns the delay after which the next speculative execution should be started, or a negative value if no more
+	// executions should be started. started is the number of executions started so far, including the initial one.
+	NextExecution(statement *Statement, started int) time.Duration
+}
+
+// LatencyTracker is an optional interface for SpeculativeExecutionPolicy implementations that need to know the
+// latency of each request sent by ClusterClient.
+type LatencyTracker interface {
+	// Invoked when a response is received from the given host, with the time elapsed since the request was sent.
+	Update(host *Host, latency time.Duration)
+}
+
+// A SpeculativeExecutionPolicy that never starts speculative executions.
+type NoSpeculativeExecutionPolicy struct{}
+
+func NewNoSpeculativeExecutionPolicy() *NoSpeculativeExecutionPolicy {
+	return &NoSpeculativeExecutionPolicy{}
+}
+
+func (p *NoSpeculativeExecutionPolicy) NextExecution(*Statement, int) time.Duration {
+	return -1
+}
+
+// A SpeculativeExecutionPolicy that starts speculative executions after a constant delay, until MaxExecutions
+// executions were started.
+type ConstantSpeculativeExecutionPolicy struct {
+	// The delay to wait before each speculative execution.
+	Delay time.Duration
+	// The maximum number of executions, including the initial one.
+	MaxExecutions int
+}
+
+func NewConstantSpeculativeExecutionPolicy(delay time.Duration, maxExecutions int) *ConstantSpeculativeExecutionPolicy {
+	return &ConstantSpeculativeExecutionPolicy{Delay: delay, MaxExecutions: maxExecutions}
+}
+
+func (p *ConstantSpeculativeExecutionPolicy) NextExecution(_ *Statement, started int) time.Duration {
+	if started >= p.MaxExecutions {
+		return -1
+	}
+	return p.Delay
+}
+
+// A SpeculativeExecutionPolicy that starts speculative executions when a request takes longer than the given
+// percentile of the latencies observed so far, until MaxExecutions executions were started. Latencies are tracked
+// over a sliding window of the last WindowSize requests, across all hosts; no speculative execution is started until
+// MinSamples latencies were observed.
+type PercentileSpeculativeExecutionPolicy struct {
+	// The percentile of observed latencies to use as delay, e.g. 99 for the 99th percentile.
+	Percentile float64
+	// The maximum number of executions, including the initial one.
+	MaxExecutions int
+	// The minimum number of latencies to observe before starting speculative executions.
+	MinSamples int
+	// The number of latencies to keep track of.
+	WindowSize int
+
+	samples []time.Duration
+	next    int
+	lock    sync.Mutex
+}
+
+func NewPercentileSpeculativeExecutionPolicy(percentile float64, maxExecutions int) *PercentileSpeculativeExecutionPolicy {
+	return &PercentileSpeculativeExecutionPolicy{
+		Percentile:    percentile,
+		MaxExecutions: maxExecutions,
+		MinSamples:    DefaultSpeculativeMinSamples,
+		WindowSize:    DefaultSpeculativeWindowSize,
+	}
+}
+
+func (p *PercentileSpeculativeExecutionPolicy) Update(_ *Host, latency time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.samples) < p.WindowSize {
+		p.samples = append(p.samples, latency)
+	} else {
+		p.samples[p.next] = latency
+		p.next = (p.next + 1) % p.WindowSize
+	}
+}
+
+func (p *PercentileSpeculativeExecutionPolicy) NextExecution(_ *Statement, started int) time.Duration {
+	if started >= p.MaxExecutions {
+		return -1
+	}
+	p.lock.Lock()
+	if len(p.samples) < p.MinSamples || len(p.samples) == 0 {
+		p.lock.Unlock()
+		return -1
+	}
+	samples := make([]time.Duration, len(p.samples))
+	copy(samples, p.samples)
+	p.lock.Unlock()
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	index := int(math.Ceil(p.Percentile/100*float64(len(samples)))) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(samples) {
+		index = len(samples) - 1
+	}
+	return samples[index]
+}
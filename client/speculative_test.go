@@ -0,0 +1,106 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestConstantSpeculativeExecutionPolicy(t *testing.T) {
+	policy := client.NewConstantSpeculativeExecutionPolicy(100*time.Millisecond, 3)
+	assert.Equal(t, 100*time.Millisecond, policy.NextExecution(nil, 1))
+	assert.Equal(t, 100*time.Millisecond, policy.NextExecution(nil, 2))
+	assert.True(t, policy.NextExecution(nil, 3) < 0)
+}
+
+func TestPercentileSpeculativeExecutionPolicy(t *testing.T) {
+	policy := client.NewPercentileSpeculativeExecutionPolicy(90, 2)
+	policy.MinSamples = 10
+	policy.WindowSize = 20
+	for i := 1; i <= 9; i++ {
+		policy.Update(nil, time.Duration(i)*time.Millisecond)
+	}
+	// not enough samples
+	assert.True(t, policy.NextExecution(nil, 1) < 0)
+	policy.Update(nil, 10*time.Millisecond)
+	assert.Equal(t, 9*time.Millisecond, policy.NextExecution(nil, 1))
+	assert.True(t, policy.NextExecution(nil, 2) < 0)
+	// older samples are evicted
+	for i := 0; i < 20; i++ {
+		policy.Update(nil, time.Second)
+	}
+	assert.Equal(t, time.Second, policy.NextExecution(nil, 1))
+}
+
+func TestClusterClient_ExecuteWithInfo_SpeculativeExecution(t *testing.T) {
+
+	// 127.0.0.1 is slow to reply
+	slowHandler := func(request *frame.Frame, conn *client.CqlServerConnection, ctx client.RequestHandlerContext) *frame.Frame {
+		if query, ok := request.Body.Message.(*message.Query); ok && query.Query == "SELECT * FROM ks1.table1" {
+			if conn.LocalAddr().String() == "127.0.0.1:9043" {
+				time.Sleep(500 * time.Millisecond)
+			}
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.VoidResult{})
+		}
+		return nil
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	servers := startTestCluster(t, ctx, newTestTopology(), slowHandler)
+
+	cluster := client.NewClusterClient([]string{"127.0.0.1:9043"}, nil, primitive.ProtocolVersion4)
+	cluster.PoolSize = 1
+	cluster.LoadBalancingPolicy = orderedPolicy{}
+	cluster.SpeculativeExecutionPolicy = client.NewConstantSpeculativeExecutionPolicy(50*time.Millisecond, 3)
+	err := cluster.Start(ctx)
+	require.Nil(t, err)
+	slowConn := cluster.Pool(cluster.Host("127.0.0.1:9043")).Connections()[0]
+
+	// idempotent: the speculative execution on 127.0.0.2 wins
+	request := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT * FROM ks1.table1"})
+	response, info, err := cluster.ExecuteWithInfo(ctx, &client.Statement{Frame: request, Idempotent: true})
+	require.Nil(t, err)
+	require.IsType(t, &message.VoidResult{}, response.Body.Message)
+	require.Equal(t, "127.0.0.2:9043", info.Coordinator.Address)
+	require.Equal(t, 1, info.ExecutionIndex)
+	require.Equal(t, 1, info.SpeculativeExecutions)
+
+	// the losing execution was canceled, its stream id is released when the late response arrives
+	assert.Eventually(t, func() bool { return slowConn.OrphanedCount() == 1 }, time.Second*5, time.Millisecond*10)
+	assert.Eventually(t, func() bool { return slowConn.InFlightCount() == 0 }, time.Second*5, time.Millisecond*10)
+
+	// non idempotent: no speculative execution
+	response, info, err = cluster.ExecuteWithInfo(ctx, &client.Statement{Frame: request})
+	require.Nil(t, err)
+	require.IsType(t, &message.VoidResult{}, response.Body.Message)
+	require.Equal(t, "127.0.0.1:9043", info.Coordinator.Address)
+	require.Equal(t, 0, info.ExecutionIndex)
+	require.Equal(t, 0, info.SpeculativeExecutions)
+
+	cancelFn()
+
+	assert.Eventually(t, cluster.IsClosed, time.Second*10, time.Millisecond*10)
+	for _, server := range servers {
+		assert.Eventually(t, server.IsClosed, time.Second*10, time.Millisecond*10)
+	}
+}
@@ -0,0 +1,1392 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TableStore is a small in-memory storage engine, that executes a subset of CQL against typed tables. Use its Handler
+// to have a CqlServer handle QUERY, PREPARE, EXECUTE and BATCH requests with the store. The following statements are
+// supported:
+//
+// - USE <keyspace>;
+// - CREATE KEYSPACE [IF NOT EXISTS] <keyspace> WITH replication = {...};
+// - CREATE TABLE [IF NOT EXISTS] [<keyspace>.]<table> (<column> <type> [STATIC|PRIMARY KEY], ...
+// [, PRIMARY KEY (...)]) [WITH CLUSTERING ORDER BY (...)];
+// - INSERT INTO [<keyspace>.]<table> (<columns>) VALUES (<values>) [IF NOT EXISTS];
+// - UPDATE [<keyspace>.]<table> SET <column> = <value>, ... WHERE <primary key> [IF EXISTS|IF <conditions>]; counter
+// columns can be incremented and decremented with SET <column> = <column> + <value>;
+// - DELETE [<columns>] FROM [<keyspace>.]<table> WHERE <partition key> [AND <clustering conditions>] [IF EXISTS|IF
+// <conditions>];
+// - SELECT [DISTINCT] <*|columns|COUNT(*)> FROM [<keyspace>.]<table> [WHERE <conditions>] [ORDER BY <clustering
+// column> [ASC|DESC]] [LIMIT <limit>] [ALLOW FILTERING].
+//
+// WHERE clauses may contain =, <, <=, >, >= and IN conditions on any column; SELECT statements are executed by
+// filtering the rows of the partition designated by the partition key, if fully restricted by equality conditions, or
+// of all partitions otherwise, in token order. Values can be literals or bind markers, positional or named; USING
+// clauses are accepted, but TTLs and timestamps are ignored. Conditional statements respond with ROWS including the
+// [applied] column, and the current values of the row when their conditions do not apply. BATCH requests are applied
+// atomically, after their type was validated like Cassandra does; batches with conditions must target a single
+// partition. Values are stored decoded, with the datatype codecs;
+// values of types without codecs can only be bound, and are stored as raw bytes.
+// Statements targeting system keyspaces, and statements the store does not understand, are left to the next
+// handlers; the store should therefore be registered after any handler answering queries to system tables.
+// Statements executed by the store create keyspaces and tables in its Schema, which can be shared with SystemTables
+// so that they are reported in the system_schema tables; tables declared in the Schema directly can be used as well.
+// It is preferable to create TableStore instances using the constructor function NewTableStore. The store is safe for
+// concurrent use, and can be shared by many servers.
+type TableStore struct {
+	// The schema keyspaces and tables are read from and created in.
+	Schema *Schema
+
+	tables   map[string]*storedTable
+	prepared map[string]*registeredStatement
+	lock     *sync.Mutex
+}
+
+type storedTable struct {
+	definition *SchemaTable
+	partitions map[string]*storedPartition
+}
+
+type storedPartition struct {
+	key    []interface{}
+	token  int64
+	static map[string]interface{}
+	// The partition rows, sorted by clustering.
+	rows []*storedRow
+}
+
+type storedRow struct {
+	clustering []interface{}
+	values     map[string]interface{}
+}
+
+// Creates a new empty TableStore, with an empty schema.
+func NewTableStore() *TableStore {
+	return &TableStore{
+		Schema:   NewSchema(),
+		tables:   make(map[string]*storedTable),
+		prepared: make(map[string]*registeredStatement),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// Returns a RequestHandler handling QUERY, PREPARE, EXECUTE and BATCH requests with this store.
+func (s *TableStore) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) *frame.Frame {
+		version := request.Header.Version
+		var msg message.Message
+		switch m := request.Body.Message.(type) {
+		case *message.Query:
+			msg = s.handleQuery(m, version, conn)
+		case *message.Prepare:
+			msg = s.handlePrepare(m, version, conn)
+		case *message.Execute:
+			msg = s.handleExecute(m, version)
+		case *message.Batch:
+			msg = s.handleBatch(m, version, conn)
+		}
+		if msg == nil {
+			return nil
+		}
+		log.Debug().Msgf("%v: [table store]: returning %v", conn, msg)
+		return frame.NewFrame(version, request.Header.StreamId, msg)
+	}
+}
+
+// Executes the given statement in the given keyspace, if the statement does not specify one, and returns the result:
+// either a RESULT message or an ERROR message. The statement may not contain bind markers. This is useful to create
+// tables and insert data before a test, without a client.
+func (s *TableStore) Execute(keyspace string, query string) message.Message {
+	parsed, err := parseCql(query)
+	if err != nil {
+		return &message.SyntaxError{ErrorMessage: err.Error()}
+	}
+	values := &cqlValues{version: primitive.ProtocolVersion4}
+	return s.executeStatement(parsed, keyspace, values, &message.QueryOptions{})
+}
+
+func (s *TableStore) handleQuery(query *message.Query, version primitive.ProtocolVersion, conn *CqlServerConnection) message.Message {
+	parsed, err := parseCql(query.Query)
+	if err == errCqlNotSupported {
+		return nil
+	} else if err != nil {
+		return &message.SyntaxError{ErrorMessage: err.Error()}
+	}
+	options := query.Options
+	if options == nil {
+		options = &message.QueryOptions{}
+	}
+	keyspace := options.Keyspace
+	if keyspace == "" {
+		keyspace = s.currentKeyspace(conn)
+	}
+	if isSystemKeyspace(statementKeyspace(parsed, keyspace)) {
+		return nil
+	}
+	values := &cqlValues{positional: options.PositionalValues, named: options.NamedValues, version: version}
+	return s.executeStatement(parsed, keyspace, values, options)
+}
+
+func (s *TableStore) handlePrepare(prepare *message.Prepare, version primitive.ProtocolVersion, conn *CqlServerConnection) message.Message {
+	parsed, err := parseCql(prepare.Query)
+	if err == errCqlNotSupported {
+		return nil
+	} else if err != nil {
+		return &message.SyntaxError{ErrorMessage: err.Error()}
+	}
+	keyspace := prepare.Keyspace
+	if keyspace == "" {
+		keyspace = s.currentKeyspace(conn)
+	}
+	if isSystemKeyspace(statementKeyspace(parsed, keyspace)) {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	variables, columns, errMsg := s.describe(parsed, keyspace)
+	if errMsg != nil {
+		return errMsg
+	}
+	id := PreparedStatementId(keyspace, prepare.Query)
+	s.prepared[string(id)] = &registeredStatement{keyspace: keyspace, query: prepare.Query}
+	result := &message.PreparedResult{PreparedQueryId: id, VariablesMetadata: variables, ResultMetadata: columns}
+	if hasResultMetadataId(version) {
+		result.ResultMetadataId = resultMetadataId(columns)
+	}
+	return result
+}
+
+func (s *TableStore) handleExecute(execute *message.Execute, version primitive.ProtocolVersion) message.Message {
+	s.lock.Lock()
+	statement := s.prepared[string(execute.QueryId)]
+	s.lock.Unlock()
+	if statement == nil {
+		return newUnprepared(execute.QueryId)
+	}
+	parsed, err := parseCql(statement.query)
+	if err != nil {
+		return &message.SyntaxError{ErrorMessage: err.Error()}
+	}
+	options := execute.Options
+	if options == nil {
+		options = &message.QueryOptions{}
+	}
+	keyspace := options.Keyspace
+	if keyspace == "" {
+		keyspace = statement.keyspace
+	}
+	values := &cqlValues{positional: options.PositionalValues, named: options.NamedValues, version: version}
+	result := s.executeStatement(parsed, keyspace, values, options)
+	if rows, ok := result.(*message.RowsResult); ok {
+		if hasResultMetadataId(version) {
+			if id := resultMetadataId(rows.Metadata); !bytes.Equal(id, execute.ResultMetadataId) {
+				rows.Metadata.NewResultMetadataId = id
+			}
+		}
+		if options.SkipMetadata && rows.Metadata.NewResultMetadataId == nil {
+			rows.Metadata.Columns = nil
+		}
+	}
+	return result
+}
+
+func (s *TableStore) handleBatch(batch *message.Batch, version primitive.ProtocolVersion, conn *CqlServerConnection) message.Message {
+	keyspace := batch.Keyspace
+	if keyspace == "" {
+		keyspace = s.currentKeyspace(conn)
+	}
+	var children []*storeBatchChild
+	for _, child := range batch.Children {
+		query, childKeyspace := "", keyspace
+		switch queryOrId := child.QueryOrId.(type) {
+		case string:
+			query = queryOrId
+		case []byte:
+			s.lock.Lock()
+			statement := s.prepared[string(queryOrId)]
+			s.lock.Unlock()
+			if statement == nil {
+				return newUnprepared(queryOrId)
+			}
+			query = statement.query
+			if batch.Keyspace == "" {
+				childKeyspace = statement.keyspace
+			}
+		}
+		parsed, err := parseCql(query)
+		if err == errCqlNotSupported {
+			return nil
+		} else if err != nil {
+			return &message.SyntaxError{ErrorMessage: err.Error()}
+		} else if isSystemKeyspace(statementKeyspace(parsed, childKeyspace)) {
+			return nil
+		}
+		switch parsed.statement.(type) {
+		case *insertStatement, *updateStatement, *deleteStatement:
+		default:
+			return &message.Invalid{ErrorMessage: "Invalid statement in batch: only UPDATE, INSERT and DELETE statements are allowed"}
+		}
+		values := &cqlValues{positional: child.Values, version: version}
+		children = append(children, &storeBatchChild{parsed, childKeyspace, values})
+	}
+	return s.executeBatch(batch.Type, children, version)
+}
+
+// Returns the keyspace set by the last USE statement executed on the given connection, whether by the store or not.
+func (s *TableStore) currentKeyspace(conn *CqlServerConnection) string {
+	if conn == nil {
+		return ""
+	}
+	return conn.Keyspace()
+}
+
+func isSystemKeyspace(keyspace string) bool {
+	switch keyspace {
+	case "system", "system_schema", "system_traces", "system_auth", "system_distributed", "system_views",
+		"system_virtual_schema":
+		return true
+	}
+	return false
+}
+
+// Returns the keyspace targeted by the given statement, or the given default keyspace if the statement does not
+// specify one.
+func statementKeyspace(parsed *cqlStatement, defaultKeyspace string) string {
+	var keyspace string
+	switch statement := parsed.statement.(type) {
+	case *useStatement:
+		keyspace = statement.keyspace
+	case *createKeyspaceStatement:
+		keyspace = statement.keyspace
+	case *createTableStatement:
+		keyspace = statement.keyspace
+	case *insertStatement:
+		keyspace = statement.keyspace
+	case *updateStatement:
+		keyspace = statement.keyspace
+	case *deleteStatement:
+		keyspace = statement.keyspace
+	case *selectStatement:
+		keyspace = statement.keyspace
+	}
+	if keyspace == "" {
+		return defaultKeyspace
+	}
+	return keyspace
+}
+
+func invalidf(format string, args ...interface{}) message.Error {
+	return &message.Invalid{ErrorMessage: fmt.Sprintf(format, args...)}
+}
+
+func (s *TableStore) executeStatement(
+	parsed *cqlStatement,
+	keyspace string,
+	values *cqlValues,
+	options *message.QueryOptions,
+) message.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch statement := parsed.statement.(type) {
+	case *useStatement:
+		if s.Schema.Keyspace(statement.keyspace) == nil {
+			return invalidf("Keyspace '%v' does not exist", statement.keyspace)
+		}
+		// the connection records the keyspace when the response is sent
+		return &message.SetKeyspaceResult{Keyspace: statement.keyspace}
+	case *createKeyspaceStatement:
+		return s.createKeyspace(statement)
+	case *createTableStatement:
+		return s.createTable(statement, keyspace)
+	case *selectStatement:
+		return s.selectRows(statement, keyspace, values, options)
+	}
+	if isConditional(parsed) {
+		return s.executeConditional(parsed, keyspace, values)
+	}
+	mutation, errMsg := s.prepareWrite(parsed, keyspace, values)
+	if errMsg != nil {
+		return errMsg
+	}
+	mutation()
+	return &message.VoidResult{}
+}
+
+// Returns the stored table for the given keyspace and table names; must be called while holding the store lock.
+func (s *TableStore) lookupTable(keyspace string, table string) (*storedTable, message.Error) {
+	if keyspace == "" {
+		return nil, invalidf("No keyspace has been specified. USE a keyspace, or explicitly specify keyspace.tablename")
+	}
+	ks := s.Schema.Keyspace(keyspace)
+	if ks == nil {
+		return nil, invalidf("Keyspace %v does not exist", keyspace)
+	}
+	definition := ks.Table(table)
+	if definition == nil {
+		return nil, invalidf("unconfigured table %v", table)
+	}
+	name := keyspace + "." + table
+	stored := s.tables[name]
+	if stored == nil || stored.definition != definition {
+		// the table is new, or was replaced in the schema
+		stored = &storedTable{definition: definition, partitions: make(map[string]*storedPartition)}
+		s.tables[name] = stored
+	}
+	return stored, nil
+}
+
+func (s *TableStore) createKeyspace(statement *createKeyspaceStatement) message.Message {
+	if s.Schema.Keyspace(statement.keyspace) != nil {
+		if statement.ifNotExists {
+			return &message.VoidResult{}
+		}
+		return &message.AlreadyExists{
+			ErrorMessage: fmt.Sprintf("Cannot add existing keyspace \"%v\"", statement.keyspace),
+			Keyspace:     statement.keyspace,
+		}
+	}
+	s.Schema.PutKeyspace(&SchemaKeyspace{Name: statement.keyspace, Replication: statement.replication})
+	return &message.SchemaChangeResult{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetKeyspace,
+		Keyspace:   statement.keyspace,
+	}
+}
+
+func (s *TableStore) createTable(statement *createTableStatement, keyspace string) message.Message {
+	if statement.keyspace != "" {
+		keyspace = statement.keyspace
+	}
+	if keyspace == "" {
+		return invalidf("No keyspace has been specified. USE a keyspace, or explicitly specify keyspace.tablename")
+	}
+	ks := s.Schema.Keyspace(keyspace)
+	if ks == nil {
+		return invalidf("Keyspace %v does not exist", keyspace)
+	} else if ks.Table(statement.table) != nil {
+		if statement.ifNotExists {
+			return &message.VoidResult{}
+		}
+		return &message.AlreadyExists{
+			ErrorMessage: fmt.Sprintf("Cannot add already existing table \"%v\" to keyspace \"%v\"", statement.table, keyspace),
+			Keyspace:     keyspace,
+			Table:        statement.table,
+		}
+	}
+	table, errMsg := newSchemaTable(statement)
+	if errMsg != nil {
+		return errMsg
+	}
+	updated := *ks
+	updated.Tables = append(append([]*SchemaTable{}, ks.Tables...), table)
+	s.Schema.PutKeyspace(&updated)
+	return &message.SchemaChangeResult{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetTable,
+		Keyspace:   keyspace,
+		Object:     statement.table,
+	}
+}
+
+func newSchemaTable(statement *createTableStatement) (*SchemaTable, message.Error) {
+	columns := make(map[string]*SchemaColumn)
+	for _, column := range statement.columns {
+		if columns[column.Name] != nil {
+			return nil, invalidf("Multiple definition of identifier %v", column.Name)
+		}
+		columns[column.Name] = column
+	}
+	table := &SchemaTable{Name: statement.table}
+	keys := make(map[string]bool)
+	for _, name := range append(append([]string{}, statement.partitionKey...), statement.clusteringColumns...) {
+		column := columns[name]
+		if column == nil {
+			return nil, invalidf("Unknown definition %v referenced in PRIMARY KEY", name)
+		} else if keys[name] {
+			return nil, invalidf("Multiple definition of identifier %v", name)
+		} else if column.Static {
+			return nil, invalidf("Static column %v cannot be part of the PRIMARY KEY", name)
+		}
+		keys[name] = true
+	}
+	for _, name := range statement.partitionKey {
+		table.PartitionKey = append(table.PartitionKey, columns[name])
+	}
+	for _, name := range statement.clusteringColumns {
+		column := columns[name]
+		column.Descending = statement.descending[name]
+		table.ClusteringColumns = append(table.ClusteringColumns, column)
+	}
+	for name := range statement.descending {
+		if table.Column(name) == nil || !containsColumn(table.ClusteringColumns, name) {
+			return nil, invalidf("Missing CLUSTERING ORDER for column %v", name)
+		}
+	}
+	for _, column := range statement.columns {
+		if !keys[column.Name] {
+			if column.Static && len(table.ClusteringColumns) == 0 {
+				return nil, invalidf("Static columns are only useful (and thus allowed) if the table has at least one clustering column")
+			}
+			table.Columns = append(table.Columns, column)
+		}
+	}
+	return table, nil
+}
+
+func containsColumn(columns []*SchemaColumn, name string) bool {
+	for _, column := range columns {
+		if column.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isCounterTable(table *SchemaTable) bool {
+	for _, column := range table.Columns {
+		if column.Type.GetDataTypeCode() == primitive.DataTypeCodeCounter {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the given INSERT, UPDATE or DELETE statement and returns the function applying it; the function must be
+// invoked while holding the store lock.
+func (s *TableStore) prepareWrite(parsed *cqlStatement, keyspace string, values *cqlValues) (func(), message.Error) {
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		return s.prepareInsert(statement, keyspace, values)
+	case *updateStatement:
+		return s.prepareUpdate(statement, keyspace, values)
+	case *deleteStatement:
+		return s.prepareDelete(statement, keyspace, values)
+	}
+	return nil, invalidf("unsupported statement")
+}
+
+func (s *TableStore) prepareInsert(statement *insertStatement, keyspace string, values *cqlValues) (func(), message.Error) {
+	if statement.keyspace != "" {
+		keyspace = statement.keyspace
+	}
+	table, errMsg := s.lookupTable(keyspace, statement.table)
+	if errMsg != nil {
+		return nil, errMsg
+	} else if isCounterTable(table.definition) {
+		return nil, invalidf("INSERT statements are not allowed on counter tables, use UPDATE instead")
+	}
+	assigned := make(map[string]interface{})
+	for i, name := range statement.columns {
+		column := table.definition.Column(name)
+		if column == nil {
+			return nil, invalidf("Undefined column name %v", name)
+		} else if _, found := assigned[name]; found {
+			return nil, invalidf("Multiple definitions found for column %v", name)
+		}
+		value, unset, err := resolveTerm(statement.values[i], column.Type, values)
+		if err != nil {
+			return nil, invalidf("%v", err)
+		} else if !unset {
+			assigned[name] = value
+		}
+	}
+	return table.prepareWrite(assigned, nil, func(row map[string]interface{}) {
+		for name, value := range assigned {
+			setValue(row, name, value)
+		}
+	})
+}
+
+func (s *TableStore) prepareUpdate(statement *updateStatement, keyspace string, values *cqlValues) (func(), message.Error) {
+	if statement.keyspace != "" {
+		keyspace = statement.keyspace
+	}
+	table, errMsg := s.lookupTable(keyspace, statement.table)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	key, errMsg := table.resolveKey(statement.where, values)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	type update struct {
+		column *SchemaColumn
+		value  interface{}
+		delta  int64
+	}
+	var updates []*update
+	for _, assignment := range statement.assignments {
+		column := table.definition.Column(assignment.column)
+		if column == nil {
+			return nil, invalidf("Undefined column name %v", assignment.column)
+		} else if table.isKeyColumn(column.Name) {
+			return nil, invalidf("PRIMARY KEY part %v found in SET part", column.Name)
+		}
+		value, unset, err := resolveTerm(assignment.value, column.Type, values)
+		if err != nil {
+			return nil, invalidf("%v", err)
+		} else if unset {
+			continue
+		}
+		isCounter := column.Type.GetDataTypeCode() == primitive.DataTypeCodeCounter
+		if assignment.operator == "" && isCounter {
+			return nil, invalidf("Cannot set the value of counter column %v (counters can only be incremented/decremented, not set)", column.Name)
+		} else if assignment.operator != "" && !isCounter {
+			return nil, invalidf("Invalid operation (%v = %v %v ?) for non counter column %v", column.Name, column.Name, assignment.operator, column.Name)
+		} else if isCounter {
+			delta, _ := value.(int64)
+			if assignment.operator == "-" {
+				delta = -delta
+			}
+			updates = append(updates, &update{column: column, delta: delta})
+		} else {
+			updates = append(updates, &update{column: column, value: value})
+		}
+	}
+	var columns []*SchemaColumn
+	for _, u := range updates {
+		columns = append(columns, u.column)
+	}
+	return table.prepareWrite(key, columns, func(row map[string]interface{}) {
+		for _, u := range updates {
+			if u.column.Type.GetDataTypeCode() == primitive.DataTypeCodeCounter {
+				current, _ := row[u.column.Name].(int64)
+				row[u.column.Name] = current + u.delta
+			} else {
+				setValue(row, u.column.Name, u.value)
+			}
+		}
+	})
+}
+
+func setValue(row map[string]interface{}, name string, value interface{}) {
+	if value == nil {
+		delete(row, name)
+	} else {
+		row[name] = value
+	}
+}
+
+func (s *TableStore) prepareDelete(statement *deleteStatement, keyspace string, values *cqlValues) (func(), message.Error) {
+	if statement.keyspace != "" {
+		keyspace = statement.keyspace
+	}
+	table, errMsg := s.lookupTable(keyspace, statement.table)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	definition := table.definition
+	var columns []*SchemaColumn
+	for _, name := range statement.columns {
+		column := definition.Column(name)
+		if column == nil {
+			return nil, invalidf("Undefined column name %v", name)
+		} else if table.isKeyColumn(name) {
+			return nil, invalidf("Invalid identifier %v for deletion (should not be a PRIMARY KEY part)", name)
+		}
+		columns = append(columns, column)
+	}
+	relations, errMsg := table.resolveRelations(statement.where, values)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	partitionKey := make(map[string]interface{})
+	hasClusteringRelations := false
+	for _, relation := range relations {
+		if !table.isKeyColumn(relation.column.Name) {
+			return nil, invalidf("Non PRIMARY KEY columns found in where clause: %v", relation.column.Name)
+		} else if containsColumn(definition.PartitionKey, relation.column.Name) {
+			if relation.operator != "=" {
+				return nil, invalidf("Only EQ relations are supported on the partition key in DELETE statements")
+			}
+			partitionKey[relation.column.Name] = relation.values[0]
+		} else {
+			hasClusteringRelations = true
+		}
+	}
+	routingKey, _, errMsg := table.routingKey(partitionKey)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	return func() {
+		partition := table.partitions[string(routingKey)]
+		if partition == nil {
+			return
+		}
+		if len(columns) == 0 && !hasClusteringRelations {
+			delete(table.partitions, string(routingKey))
+			return
+		}
+		var rows []*storedRow
+		for _, row := range partition.rows {
+			if !matchesRelations(relations, table.rowValues(partition, row)) {
+				rows = append(rows, row)
+			} else if len(columns) > 0 {
+				rows = append(rows, row)
+				for _, column := range columns {
+					if column.Static {
+						delete(partition.static, column.Name)
+					} else {
+						delete(row.values, column.Name)
+					}
+				}
+			}
+		}
+		partition.rows = rows
+		if len(partition.rows) == 0 && len(partition.static) == 0 {
+			delete(table.partitions, string(routingKey))
+		}
+	}, nil
+}
+
+func (t *storedTable) isKeyColumn(name string) bool {
+	return containsColumn(t.definition.PartitionKey, name) || containsColumn(t.definition.ClusteringColumns, name)
+}
+
+// Resolves the given WHERE clause of an UPDATE statement, that may only contain equality conditions on primary key
+// columns; missing key columns are checked when the write is prepared.
+func (t *storedTable) resolveKey(where []*cqlRelation, values *cqlValues) (map[string]interface{}, message.Error) {
+	relations, errMsg := t.resolveRelations(where, values)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	key := make(map[string]interface{})
+	for _, relation := range relations {
+		if !t.isKeyColumn(relation.column.Name) {
+			return nil, invalidf("Non PRIMARY KEY columns found in where clause: %v", relation.column.Name)
+		} else if relation.operator != "=" {
+			return nil, invalidf("Only EQ relations are supported on PRIMARY KEY columns in UPDATE statements")
+		}
+		key[relation.column.Name] = relation.values[0]
+	}
+	return key, nil
+}
+
+// Validates a write of the given columns in the row designated by the given primary key values, and returns the
+// function applying it. If columns is nil, all the non-key columns of the given values are written. The update
+// function is invoked with the values of the row, or with the static values of the partition if only static columns
+// are written, in which case the clustering columns are optional.
+func (t *storedTable) prepareWrite(key map[string]interface{}, columns []*SchemaColumn, update func(map[string]interface{})) (func(), message.Error) {
+	definition := t.definition
+	routingKey, partitionKey, errMsg := t.routingKey(key)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	if columns == nil {
+		for name := range key {
+			if !t.isKeyColumn(name) {
+				columns = append(columns, definition.Column(name))
+			}
+		}
+	}
+	staticOnly := len(columns) > 0
+	for _, column := range columns {
+		staticOnly = staticOnly && column.Static
+	}
+	var clustering []interface{}
+	var missing []string
+	for _, column := range definition.ClusteringColumns {
+		if value := key[column.Name]; value != nil {
+			clustering = append(clustering, value)
+		} else {
+			missing = append(missing, column.Name)
+		}
+	}
+	if len(missing) > 0 && !staticOnly {
+		return nil, invalidf("Some clustering keys are missing: %v", strings.Join(missing, ", "))
+	}
+	return func() {
+		partition := t.partitions[string(routingKey)]
+		if partition == nil {
+			partition = &storedPartition{key: partitionKey, token: Murmur3Token(routingKey), static: make(map[string]interface{})}
+			t.partitions[string(routingKey)] = partition
+		}
+		if staticOnly {
+			update(partition.static)
+			return
+		}
+		row := partition.row(clustering, definition.ClusteringColumns)
+		values := make(map[string]interface{})
+		for name, value := range row.values {
+			values[name] = value
+		}
+		update(values)
+		// static values are written to the partition
+		for _, column := range columns {
+			if column.Static {
+				setValue(partition.static, column.Name, values[column.Name])
+				delete(values, column.Name)
+			}
+		}
+		row.values = values
+	}, nil
+}
+
+// Returns the routing key of the partition designated by the given partition key values, along with the values in
+// partition key order.
+func (t *storedTable) routingKey(key map[string]interface{}) ([]byte, []interface{}, message.Error) {
+	var missing []string
+	var values []interface{}
+	var components [][]byte
+	for _, column := range t.definition.PartitionKey {
+		value := key[column.Name]
+		if value == nil {
+			missing = append(missing, column.Name)
+			continue
+		}
+		encoded, err := valueCodecFor(column.Type).Encode(value, primitive.ProtocolVersion4)
+		if err != nil {
+			return nil, nil, invalidf("Invalid value for column %v: %v", column.Name, err)
+		}
+		values = append(values, value)
+		components = append(components, encoded)
+	}
+	if len(missing) > 0 {
+		return nil, nil, invalidf("Some partition key parts are missing: %v", strings.Join(missing, ", "))
+	} else if len(components) == 1 {
+		return components[0], values, nil
+	}
+	// composite partition keys are encoded like Cassandra does: each component is prefixed with its length, and
+	// followed by a zero byte
+	buf := &bytes.Buffer{}
+	for _, component := range components {
+		_ = binary.Write(buf, binary.BigEndian, uint16(len(component)))
+		buf.Write(component)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), values, nil
+}
+
+// Returns the row with the given clustering, creating it if it does not exist.
+func (p *storedPartition) row(clustering []interface{}, columns []*SchemaColumn) *storedRow {
+	i := sort.Search(len(p.rows), func(i int) bool {
+		return compareClustering(p.rows[i].clustering, clustering, columns) >= 0
+	})
+	if i < len(p.rows) && compareClustering(p.rows[i].clustering, clustering, columns) == 0 {
+		return p.rows[i]
+	}
+	row := &storedRow{clustering: clustering, values: make(map[string]interface{})}
+	p.rows = append(p.rows, nil)
+	copy(p.rows[i+1:], p.rows[i:])
+	p.rows[i] = row
+	return row
+}
+
+// Returns the row with the given clustering, or nil if it does not exist.
+func (p *storedPartition) find(clustering []interface{}, columns []*SchemaColumn) *storedRow {
+	i := sort.Search(len(p.rows), func(i int) bool {
+		return compareClustering(p.rows[i].clustering, clustering, columns) >= 0
+	})
+	if i < len(p.rows) && compareClustering(p.rows[i].clustering, clustering, columns) == 0 {
+		return p.rows[i]
+	}
+	return nil
+}
+
+func compareClustering(c1 []interface{}, c2 []interface{}, columns []*SchemaColumn) int {
+	for i, column := range columns {
+		if i >= len(c1) || i >= len(c2) {
+			break
+		} else if result := compareValues(c1[i], c2[i]); result != 0 {
+			if column.Descending {
+				return -result
+			}
+			return result
+		}
+	}
+	return 0
+}
+
+// Returns the values of all the columns of the given row, including the key and static columns.
+func (t *storedTable) rowValues(partition *storedPartition, row *storedRow) map[string]interface{} {
+	values := make(map[string]interface{})
+	for i, column := range t.definition.PartitionKey {
+		values[column.Name] = partition.key[i]
+	}
+	for name, value := range partition.static {
+		values[name] = value
+	}
+	if row != nil {
+		for i, column := range t.definition.ClusteringColumns {
+			values[column.Name] = row.clustering[i]
+		}
+		for name, value := range row.values {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+type storeRelation struct {
+	column   *SchemaColumn
+	operator string
+	values   []interface{}
+}
+
+func (t *storedTable) resolveRelations(where []*cqlRelation, values *cqlValues) ([]*storeRelation, message.Error) {
+	var relations []*storeRelation
+	for _, relation := range where {
+		column := t.definition.Column(relation.column)
+		if column == nil {
+			return nil, invalidf("Undefined column name %v", relation.column)
+		}
+		terms, ok := relation.value.([]cqlTerm)
+		if !ok {
+			terms = []cqlTerm{relation.value}
+		}
+		resolved := &storeRelation{column: column, operator: relation.operator}
+		for _, term := range terms {
+			value, unset, err := resolveTerm(term, column.Type, values)
+			if err != nil {
+				return nil, invalidf("%v", err)
+			} else if unset {
+				return nil, invalidf("Invalid unset value for column %v", column.Name)
+			} else if value == nil {
+				return nil, invalidf("Invalid null value in condition for column %v", column.Name)
+			}
+			resolved.values = append(resolved.values, value)
+		}
+		relations = append(relations, resolved)
+	}
+	return relations, nil
+}
+
+func matchesRelations(relations []*storeRelation, row map[string]interface{}) bool {
+	for _, relation := range relations {
+		value := row[relation.column.Name]
+		if value == nil {
+			return false
+		}
+		matches := false
+		for _, candidate := range relation.values {
+			result := compareValues(value, candidate)
+			switch relation.operator {
+			case "=", "IN":
+				matches = result == 0
+			case "<":
+				matches = result < 0
+			case "<=":
+				matches = result <= 0
+			case ">":
+				matches = result > 0
+			case ">=":
+				matches = result >= 0
+			}
+			if matches {
+				break
+			}
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *TableStore) selectRows(
+	statement *selectStatement,
+	keyspace string,
+	values *cqlValues,
+	options *message.QueryOptions,
+) message.Message {
+	if statement.keyspace != "" {
+		keyspace = statement.keyspace
+	}
+	table, errMsg := s.lookupTable(keyspace, statement.table)
+	if errMsg != nil {
+		return errMsg
+	}
+	definition := table.definition
+	columns, errMsg := selectedColumns(keyspace, definition, statement)
+	if errMsg != nil {
+		return errMsg
+	}
+	relations, errMsg := table.resolveRelations(statement.where, values)
+	if errMsg != nil {
+		return errMsg
+	}
+	reversed := false
+	for i, ordering := range statement.orderBy {
+		if i >= len(definition.ClusteringColumns) || definition.ClusteringColumns[i].Name != ordering.column {
+			return invalidf("Order by currently only supports the ordering of columns following their declared order in the PRIMARY KEY")
+		} else if i == 0 {
+			reversed = ordering.descending != definition.ClusteringColumns[i].Descending
+		} else if reversed != (ordering.descending != definition.ClusteringColumns[i].Descending) {
+			return invalidf("Unsupported order by relation")
+		}
+	}
+	limit := -1
+	if statement.limit != nil {
+		value, unset, err := resolveTerm(statement.limit, datatype.Int, values)
+		if err != nil {
+			return invalidf("%v", err)
+		} else if l, ok := value.(int32); !unset && (!ok || l <= 0) {
+			return invalidf("LIMIT must be strictly positive")
+		} else if !unset {
+			limit = int(l)
+		}
+	}
+	var rows []map[string]interface{}
+	for _, partition := range table.selectPartitions(relations) {
+		partitionRows := partition.rows
+		if len(partitionRows) == 0 {
+			// partitions with static values only have a single row, without clustering
+			partitionRows = []*storedRow{nil}
+		}
+		for i := range partitionRows {
+			row := partitionRows[i]
+			if reversed {
+				row = partitionRows[len(partitionRows)-1-i]
+			}
+			if values := table.rowValues(partition, row); matchesRelations(relations, values) && (limit < 0 || len(rows) < limit) {
+				rows = append(rows, values)
+				if statement.distinct {
+					break
+				}
+			}
+		}
+	}
+	if statement.count {
+		rows = []map[string]interface{}{{"count": int64(len(rows))}}
+	}
+	pageRows, pagingState := pageOf(rows, options)
+	result, err := encodeSystemRows(columns, pageRows, values.version)
+	if err != nil {
+		return &message.ServerError{ErrorMessage: err.Error()}
+	}
+	result.Metadata.PagingState = pagingState
+	return result
+}
+
+// Returns the partitions designated by the given relations: a single partition if the partition key is fully
+// restricted by equality conditions, or all partitions otherwise, in token order.
+func (t *storedTable) selectPartitions(relations []*storeRelation) []*storedPartition {
+	key := make(map[string]interface{})
+	for _, relation := range relations {
+		if relation.operator == "=" && containsColumn(t.definition.PartitionKey, relation.column.Name) {
+			key[relation.column.Name] = relation.values[0]
+		}
+	}
+	if len(key) == len(t.definition.PartitionKey) {
+		if routingKey, _, errMsg := t.routingKey(key); errMsg == nil {
+			if partition := t.partitions[string(routingKey)]; partition != nil {
+				return []*storedPartition{partition}
+			}
+		}
+		return nil
+	}
+	partitions := make([]*storedPartition, 0, len(t.partitions))
+	for _, partition := range t.partitions {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].token < partitions[j].token })
+	return partitions
+}
+
+func selectedColumns(keyspace string, definition *SchemaTable, statement *selectStatement) ([]*message.ColumnMetadata, message.Error) {
+	newColumn := func(name string, dataType datatype.DataType) *message.ColumnMetadata {
+		return &message.ColumnMetadata{Keyspace: keyspace, Table: definition.Name, Name: name, Type: dataType}
+	}
+	if statement.count {
+		return []*message.ColumnMetadata{newColumn("count", datatype.Bigint)}, nil
+	}
+	var selected []*SchemaColumn
+	if statement.columns == nil {
+		selected = allColumns(definition)
+	} else {
+		for _, name := range statement.columns {
+			column := definition.Column(name)
+			if column == nil {
+				return nil, invalidf("Undefined column name %v", name)
+			}
+			selected = append(selected, column)
+		}
+	}
+	var columns []*message.ColumnMetadata
+	for _, column := range selected {
+		columns = append(columns, newColumn(column.Name, column.Type))
+	}
+	return columns, nil
+}
+
+// Returns all the columns of the given table, in the order of SELECT * statements: like Cassandra, the primary key
+// columns first, then the other columns in alphabetical order.
+func allColumns(definition *SchemaTable) []*SchemaColumn {
+	others := append([]*SchemaColumn{}, definition.Columns...)
+	sort.SliceStable(others, func(i, j int) bool { return others[i].Name < others[j].Name })
+	columns := append(append([]*SchemaColumn{}, definition.PartitionKey...), definition.ClusteringColumns...)
+	return append(columns, others...)
+}
+
+// Returns the page of the given rows designated by the page size and paging state of the given options, along with
+// the paging state of the next page, if any. Paging states are row offsets.
+func pageOf(rows []map[string]interface{}, options *message.QueryOptions) ([]map[string]interface{}, []byte) {
+	if options.PageSize <= 0 {
+		return rows, nil
+	}
+	offset := 0
+	if len(options.PagingState) == 4 {
+		offset = int(binary.BigEndian.Uint32(options.PagingState))
+	}
+	if offset > len(rows) {
+		offset = len(rows)
+	}
+	end := offset + int(options.PageSize)
+	if end >= len(rows) {
+		return rows[offset:], nil
+	}
+	pagingState := make([]byte, 4)
+	binary.BigEndian.PutUint32(pagingState, uint32(end))
+	return rows[offset:end], pagingState
+}
+
+// Returns the variables and result set metadata of the given statement; must be called while holding the store lock.
+func (s *TableStore) describe(parsed *cqlStatement, keyspace string) (*message.VariablesMetadata, *message.RowsMetadata, message.Error) {
+	variables := &message.VariablesMetadata{}
+	columns := &message.RowsMetadata{}
+	var table string
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		keyspace, table = statementKeyspace(parsed, keyspace), statement.table
+	case *updateStatement:
+		keyspace, table = statementKeyspace(parsed, keyspace), statement.table
+	case *deleteStatement:
+		keyspace, table = statementKeyspace(parsed, keyspace), statement.table
+	case *selectStatement:
+		keyspace, table = statementKeyspace(parsed, keyspace), statement.table
+		stored, errMsg := s.lookupTable(keyspace, table)
+		if errMsg != nil {
+			return nil, nil, errMsg
+		}
+		selected, errMsg := selectedColumns(keyspace, stored.definition, statement)
+		if errMsg != nil {
+			return nil, nil, errMsg
+		}
+		columns = &message.RowsMetadata{ColumnCount: int32(len(selected)), Columns: selected}
+	default:
+		if len(parsed.markers) > 0 {
+			return nil, nil, invalidf("Bind variables are not supported in schema statements")
+		}
+		return variables, columns, nil
+	}
+	stored, errMsg := s.lookupTable(keyspace, table)
+	if errMsg != nil {
+		return nil, nil, errMsg
+	}
+	pkIndices := make(map[string]uint16)
+	for _, marker := range parsed.markers {
+		var dataType datatype.DataType
+		switch marker.receiver {
+		case cqlReceiverLimit, cqlReceiverTtl:
+			dataType = datatype.Int
+		case cqlReceiverTimestamp:
+			dataType = datatype.Bigint
+		default:
+			column := stored.definition.Column(marker.receiver)
+			if column == nil {
+				return nil, nil, invalidf("Undefined column name %v", marker.receiver)
+			}
+			dataType = column.Type
+			if _, found := pkIndices[column.Name]; !found && containsColumn(stored.definition.PartitionKey, column.Name) {
+				pkIndices[column.Name] = uint16(marker.index)
+			}
+		}
+		name := marker.name
+		if name == "" {
+			name = marker.receiver
+		}
+		variables.Columns = append(variables.Columns, &message.ColumnMetadata{
+			Keyspace: keyspace,
+			Table:    table,
+			Name:     name,
+			Type:     dataType,
+		})
+	}
+	if len(pkIndices) == len(stored.definition.PartitionKey) {
+		for _, column := range stored.definition.PartitionKey {
+			variables.PkIndices = append(variables.PkIndices, pkIndices[column.Name])
+		}
+	}
+	return variables, columns, nil
+}
+
+// cqlValues holds the values bound to the markers of a statement.
+type cqlValues struct {
+	positional []*primitive.Value
+	named      map[string]*primitive.Value
+	version    primitive.ProtocolVersion
+}
+
+func (v *cqlValues) get(marker *cqlMarker) (*primitive.Value, error) {
+	if v.named != nil {
+		name := marker.name
+		if name == "" {
+			name = marker.receiver
+		}
+		if value, found := v.named[name]; found {
+			return value, nil
+		}
+		return nil, fmt.Errorf("no value bound for variable %v", name)
+	} else if marker.index < len(v.positional) {
+		return v.positional[marker.index], nil
+	}
+	return nil, fmt.Errorf("there were %d markers(?) in CQL but %d bound variables", marker.index+1, len(v.positional))
+}
+
+// Resolves the given term into a value of the given type, as returned by the type codec. Returns unset = true if the
+// term is a bind marker with an unset value.
+func resolveTerm(term cqlTerm, dataType datatype.DataType, values *cqlValues) (value interface{}, unset bool, err error) {
+	codec := valueCodecFor(dataType)
+	switch t := term.(type) {
+	case *cqlMarker:
+		var bound *primitive.Value
+		if bound, err = values.get(t); err != nil {
+			return nil, false, err
+		} else if bound == nil || bound.Type == primitive.ValueTypeNull {
+			return nil, false, nil
+		} else if bound.Type == primitive.ValueTypeUnset {
+			return nil, true, nil
+		} else if value, err = codec.Decode(bound.Contents, values.version); err != nil {
+			return nil, false, fmt.Errorf("invalid value for %v: %w", t.receiver, err)
+		}
+	case *cqlLiteral:
+		value, err = literalValue(t.value, dataType, codec)
+	case *cqlCollection:
+		value, err = collectionValue(t, dataType)
+	}
+	if err == nil && value != nil && dataType.GetDataTypeCode() == primitive.DataTypeCodeSet {
+		value = sortedSet(value.([]interface{}))
+	}
+	return value, false, err
+}
+
+func literalValue(literal interface{}, dataType datatype.DataType, codec datatype.Codec) (interface{}, error) {
+	if literal == nil {
+		return nil, nil
+	}
+	if s, ok := literal.(string); ok && dataType.GetDataTypeCode() == primitive.DataTypeCodeInet {
+		if literal = net.ParseIP(s); literal.(net.IP) == nil {
+			return nil, fmt.Errorf("invalid inet literal: %v", s)
+		}
+	}
+	// values are normalized by encoding and decoding them
+	encoded, err := codec.Encode(literal, primitive.ProtocolVersion4)
+	if err != nil {
+		return nil, fmt.Errorf("invalid literal %v for type %v: %w", literal, datatype.FormatDataType(dataType), err)
+	}
+	return codec.Decode(encoded, primitive.ProtocolVersion4)
+}
+
+func collectionValue(collection *cqlCollection, dataType datatype.DataType) (interface{}, error) {
+	var elementType, valueType datatype.DataType
+	switch dataType.GetDataTypeCode() {
+	case primitive.DataTypeCodeList:
+		if collection.kind == '[' {
+			elementType = dataType.(datatype.ListType).GetElementType()
+		}
+	case primitive.DataTypeCodeSet:
+		if collection.kind == '{' && collection.values == nil {
+			elementType = dataType.(datatype.SetType).GetElementType()
+		}
+	case primitive.DataTypeCodeMap:
+		if collection.kind == '{' && len(collection.values) == len(collection.elements) {
+			elementType = dataType.(datatype.MapType).GetKeyType()
+			valueType = dataType.(datatype.MapType).GetValueType()
+		}
+	}
+	if elementType == nil {
+		return nil, fmt.Errorf("invalid collection literal for type %v", datatype.FormatDataType(dataType))
+	}
+	elements := make([]interface{}, 0, len(collection.elements))
+	for _, element := range collection.elements {
+		value, _, err := resolveTerm(element, elementType, nil)
+		if err != nil {
+			return nil, err
+		} else if value == nil {
+			return nil, fmt.Errorf("null is not supported inside collections")
+		}
+		elements = append(elements, value)
+	}
+	if valueType == nil {
+		return elements, nil
+	}
+	result := make(map[interface{}]interface{})
+	for i, key := range elements {
+		if _, ok := key.([]byte); ok {
+			return nil, fmt.Errorf("blob map keys are not supported")
+		}
+		value, _, err := resolveTerm(collection.values[i], valueType, nil)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// Sorts the given set elements and removes duplicates.
+func sortedSet(elements []interface{}) []interface{} {
+	sort.SliceStable(elements, func(i, j int) bool { return compareValues(elements[i], elements[j]) < 0 })
+	var result []interface{}
+	for i, element := range elements {
+		if i == 0 || compareValues(elements[i-1], element) != 0 {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// Returns the codec used to store values of the given type: the datatype codec for the type, or a raw codec for types
+// without codecs. Timestamps and times are stored as int64 values.
+func valueCodecFor(dataType datatype.DataType) datatype.Codec {
+	switch dataType.GetDataTypeCode() {
+	case primitive.DataTypeCodeTimestamp, primitive.DataTypeCodeTime:
+		return &datatype.BigintCodec{}
+	}
+	if codec, err := datatype.CodecFor(dataType); err == nil {
+		return codec
+	}
+	return rawCodec{}
+}
+
+// rawCodec stores values as their encoded bytes.
+type rawCodec struct{}
+
+func (rawCodec) Encode(value interface{}, _ primitive.ProtocolVersion) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	}
+	return nil, fmt.Errorf("literals of this type are not supported")
+}
+
+func (rawCodec) Decode(encoded []byte, _ primitive.ProtocolVersion) (interface{}, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+	return append([]byte{}, encoded...), nil
+}
+
+// Compares the given values, as decoded by the datatype codecs. Nulls sort first.
+func compareValues(v1 interface{}, v2 interface{}) int {
+	if v1 == nil || v2 == nil {
+		switch {
+		case v1 == v2:
+			return 0
+		case v1 == nil:
+			return -1
+		}
+		return 1
+	}
+	if i1, ok := asInt64(v1); ok {
+		if i2, ok := asInt64(v2); ok {
+			switch {
+			case i1 < i2:
+				return -1
+			case i1 > i2:
+				return 1
+			}
+			return 0
+		}
+	}
+	switch x := v1.(type) {
+	case string:
+		if y, ok := v2.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case []byte:
+		if y, ok := v2.([]byte); ok {
+			return bytes.Compare(x, y)
+		}
+	case bool:
+		if y, ok := v2.(bool); ok && x != y {
+			if x {
+				return 1
+			}
+			return -1
+		}
+	case float32:
+		if y, ok := v2.(float32); ok {
+			return compareFloats(float64(x), float64(y))
+		}
+	case float64:
+		if y, ok := v2.(float64); ok {
+			return compareFloats(x, y)
+		}
+	case *big.Int:
+		if y, ok := v2.(*big.Int); ok {
+			return x.Cmp(y)
+		}
+	case primitive.UUID:
+		if y, ok := v2.(primitive.UUID); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case net.IP:
+		if y, ok := v2.(net.IP); ok {
+			return bytes.Compare(x.To16(), y.To16())
+		}
+	case []interface{}:
+		if y, ok := v2.([]interface{}); ok {
+			for i := 0; i < len(x) && i < len(y); i++ {
+				if result := compareValues(x[i], y[i]); result != 0 {
+					return result
+				}
+			}
+			return len(x) - len(y)
+		}
+	}
+	return strings.Compare(fmt.Sprint(v1), fmt.Sprint(v2))
+}
+
+func asInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func compareFloats(f1 float64, f2 float64) int {
+	switch {
+	case f1 < f2:
+		return -1
+	case f1 > f2:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,942 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"regexp"
+	"strings"
+)
+
+// This file contains a parser for the subset of CQL understood by TableStore.
+
+type cqlTokenKind int
+
+const (
+	cqlTokenIdentifier = cqlTokenKind(iota)
+	cqlTokenQuotedIdentifier
+	cqlTokenString
+	cqlTokenNumber
+	cqlTokenHex
+	cqlTokenUuid
+	cqlTokenSymbol
+	cqlTokenEOF
+)
+
+type cqlToken struct {
+	kind cqlTokenKind
+	text string
+}
+
+func (t cqlToken) String() string {
+	if t.kind == cqlTokenEOF {
+		return "EOF"
+	}
+	return t.text
+}
+
+var (
+	cqlUuidPattern       = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	cqlHexPattern        = regexp.MustCompile(`^0[xX][0-9a-fA-F]*`)
+	cqlNumberPattern     = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?`)
+	cqlIdentifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+)
+
+func lexCql(query string) ([]cqlToken, error) {
+	var tokens []cqlToken
+	for i := 0; i < len(query); {
+		c := query[i]
+		rest := query[i:]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(rest, "--") || strings.HasPrefix(rest, "//"):
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			text, n, err := lexQuoted(rest)
+			if err != nil {
+				return nil, err
+			}
+			kind := cqlTokenString
+			if c == '"' {
+				kind = cqlTokenQuotedIdentifier
+			}
+			tokens = append(tokens, cqlToken{kind, text})
+			i += n
+		case cqlUuidPattern.MatchString(rest):
+			tokens = append(tokens, cqlToken{cqlTokenUuid, rest[:36]})
+			i += 36
+		case cqlHexPattern.MatchString(rest):
+			text := cqlHexPattern.FindString(rest)
+			tokens = append(tokens, cqlToken{cqlTokenHex, text})
+			i += len(text)
+		case cqlNumberPattern.MatchString(rest):
+			text := cqlNumberPattern.FindString(rest)
+			tokens = append(tokens, cqlToken{cqlTokenNumber, text})
+			i += len(text)
+		case cqlIdentifierPattern.MatchString(rest):
+			text := cqlIdentifierPattern.FindString(rest)
+			tokens = append(tokens, cqlToken{cqlTokenIdentifier, text})
+			i += len(text)
+		case strings.HasPrefix(rest, "<=") || strings.HasPrefix(rest, ">=") || strings.HasPrefix(rest, "!="):
+			tokens = append(tokens, cqlToken{cqlTokenSymbol, rest[:2]})
+			i += 2
+		case strings.IndexByte("(),;=<>*?:[]{}.+-", c) != -1:
+			tokens = append(tokens, cqlToken{cqlTokenSymbol, rest[:1]})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(tokens, cqlToken{kind: cqlTokenEOF}), nil
+}
+
+// Lexes a string literal or a quoted identifier, where quotes are escaped by doubling them. Returns the unquoted text
+// and the number of bytes consumed.
+func lexQuoted(s string) (string, int, error) {
+	quote := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			sb.WriteByte(s[i])
+		} else if i+1 < len(s) && s[i+1] == quote {
+			sb.WriteByte(quote)
+			i++
+		} else {
+			return sb.String(), i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quoted text: %v", s)
+}
+
+// A cqlTerm is either a cqlLiteral, a cqlCollection or a cqlMarker.
+type cqlTerm interface{}
+
+// cqlLiteral is a constant value: a string for string, numeric, boolean and uuid literals, a []byte for blob literals,
+// or nil for null.
+type cqlLiteral struct {
+	value interface{}
+}
+
+// cqlCollection is a collection literal.
+type cqlCollection struct {
+	// Either '[' for lists, or '{' for sets and maps.
+	kind byte
+	// The elements of lists and sets, or the keys of maps.
+	elements []cqlTerm
+	// The values of maps; nil for lists and sets.
+	values []cqlTerm
+}
+
+// cqlMarker is a bind marker, either positional (?) or named (:name).
+type cqlMarker struct {
+	// The index of the marker among all the markers of the statement.
+	index int
+	// The marker name, for named markers.
+	name string
+	// The column the marker is bound to, or one of the cqlReceiver* pseudo-columns.
+	receiver string
+}
+
+const (
+	cqlReceiverLimit     = "[limit]"
+	cqlReceiverTtl       = "[ttl]"
+	cqlReceiverTimestamp = "[timestamp]"
+)
+
+// cqlRelation is a WHERE clause condition.
+type cqlRelation struct {
+	column string
+	// One of =, <, <=, >, >= or IN.
+	operator string
+	// The value; for IN relations, the value is a []cqlTerm.
+	value interface{}
+}
+
+type cqlAssignment struct {
+	column string
+	value  cqlTerm
+	// For counter updates of the form c = c + value or c = c - value, the operator; empty otherwise.
+	operator string
+}
+
+type cqlOrdering struct {
+	column     string
+	descending bool
+}
+
+type useStatement struct {
+	keyspace string
+}
+
+type createKeyspaceStatement struct {
+	keyspace    string
+	ifNotExists bool
+	replication map[string]string
+}
+
+type createTableStatement struct {
+	keyspace          string
+	table             string
+	ifNotExists       bool
+	columns           []*SchemaColumn
+	partitionKey      []string
+	clusteringColumns []string
+	descending        map[string]bool
+}
+
+type insertStatement struct {
+	keyspace    string
+	table       string
+	columns     []string
+	values      []cqlTerm
+	ifNotExists bool
+}
+
+type updateStatement struct {
+	keyspace    string
+	table       string
+	assignments []*cqlAssignment
+	where       []*cqlRelation
+	ifExists    bool
+	// The IF conditions, if any.
+	conditions []*cqlRelation
+}
+
+type deleteStatement struct {
+	keyspace   string
+	table      string
+	columns    []string
+	where      []*cqlRelation
+	ifExists   bool
+	conditions []*cqlRelation
+}
+
+type selectStatement struct {
+	keyspace string
+	table    string
+	// The selected columns; nil for SELECT *.
+	columns  []string
+	count    bool
+	distinct bool
+	where    []*cqlRelation
+	orderBy  []*cqlOrdering
+	limit    cqlTerm
+}
+
+// A parsed statement, along with its bind markers.
+type cqlStatement struct {
+	statement interface{}
+	markers   []*cqlMarker
+}
+
+// errCqlNotSupported is returned when the statement is not one of the kinds understood by the parser.
+var errCqlNotSupported = errors.New("statement not supported")
+
+var cqlStatementKeywords = map[string]bool{
+	"select": true,
+	"insert": true,
+	"update": true,
+	"delete": true,
+	"use":    true,
+	"create": true,
+}
+
+type cqlParser struct {
+	tokens  []cqlToken
+	pos     int
+	markers []*cqlMarker
+}
+
+// Parses the given query string. Returns errCqlNotSupported if the statement is not a SELECT, INSERT, UPDATE, DELETE,
+// USE, CREATE KEYSPACE or CREATE TABLE statement, or a syntax error if the statement is malformed or uses unsupported
+// features.
+func parseCql(query string) (*cqlStatement, error) {
+	tokens, err := lexCql(query)
+	if err != nil {
+		if fields := strings.Fields(query); len(fields) == 0 || !cqlStatementKeywords[strings.ToLower(fields[0])] {
+			return nil, errCqlNotSupported
+		}
+		return nil, err
+	}
+	p := &cqlParser{tokens: tokens}
+	var statement interface{}
+	switch {
+	case p.acceptKeyword("select"):
+		statement, err = p.parseSelect()
+	case p.acceptKeyword("insert"):
+		statement, err = p.parseInsert()
+	case p.acceptKeyword("update"):
+		statement, err = p.parseUpdate()
+	case p.acceptKeyword("delete"):
+		statement, err = p.parseDelete()
+	case p.acceptKeyword("use"):
+		var keyspace string
+		if keyspace, err = p.parseIdentifier(); err == nil {
+			statement = &useStatement{keyspace}
+		}
+	case p.acceptKeyword("create"):
+		if p.acceptKeyword("keyspace") || p.acceptKeyword("schema") {
+			statement, err = p.parseCreateKeyspace()
+		} else if p.acceptKeyword("table") || p.acceptKeyword("columnfamily") {
+			statement, err = p.parseCreateTable()
+		} else {
+			return nil, errCqlNotSupported
+		}
+	default:
+		return nil, errCqlNotSupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != cqlTokenEOF {
+		return nil, fmt.Errorf("unexpected input: %v", p.peek())
+	}
+	return &cqlStatement{statement: statement, markers: p.markers}, nil
+}
+
+func (p *cqlParser) peek() cqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *cqlParser) next() cqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != cqlTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *cqlParser) isKeyword(keyword string) bool {
+	token := p.peek()
+	return token.kind == cqlTokenIdentifier && strings.EqualFold(token.text, keyword)
+}
+
+func (p *cqlParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cqlParser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		return fmt.Errorf("expected %v, got %v", strings.ToUpper(keyword), p.peek())
+	}
+	return nil
+}
+
+func (p *cqlParser) isSymbol(symbol string) bool {
+	token := p.peek()
+	return token.kind == cqlTokenSymbol && token.text == symbol
+}
+
+func (p *cqlParser) acceptSymbol(symbol string) bool {
+	if p.isSymbol(symbol) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cqlParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return fmt.Errorf("expected '%v', got %v", symbol, p.peek())
+	}
+	return nil
+}
+
+// Parses an identifier; unquoted identifiers are case-insensitive and converted to lower case.
+func (p *cqlParser) parseIdentifier() (string, error) {
+	token := p.next()
+	switch token.kind {
+	case cqlTokenIdentifier:
+		return strings.ToLower(token.text), nil
+	case cqlTokenQuotedIdentifier:
+		return token.text, nil
+	}
+	return "", fmt.Errorf("expected identifier, got %v", token)
+}
+
+func (p *cqlParser) parseIdentifiers() ([]string, error) {
+	var identifiers []string
+	for {
+		identifier, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		identifiers = append(identifiers, identifier)
+		if !p.acceptSymbol(",") {
+			return identifiers, nil
+		}
+	}
+}
+
+// Parses a table name, optionally qualified with a keyspace name.
+func (p *cqlParser) parseTableName() (keyspace string, table string, err error) {
+	if table, err = p.parseIdentifier(); err != nil {
+		return "", "", err
+	} else if p.acceptSymbol(".") {
+		keyspace = table
+		table, err = p.parseIdentifier()
+	}
+	return
+}
+
+func (p *cqlParser) parseIfNotExists() (bool, error) {
+	if !p.acceptKeyword("if") {
+		return false, nil
+	} else if err := p.expectKeyword("not"); err != nil {
+		return false, err
+	}
+	return true, p.expectKeyword("exists")
+}
+
+// Parses a term; bind markers are bound to the given receiver.
+func (p *cqlParser) parseTerm(receiver string) (cqlTerm, error) {
+	token := p.next()
+	switch token.kind {
+	case cqlTokenString, cqlTokenNumber, cqlTokenUuid:
+		return &cqlLiteral{token.text}, nil
+	case cqlTokenHex:
+		value, err := hex.DecodeString(token.text[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob literal %v: %w", token.text, err)
+		}
+		return &cqlLiteral{value}, nil
+	case cqlTokenIdentifier:
+		switch strings.ToLower(token.text) {
+		case "true", "false":
+			return &cqlLiteral{strings.ToLower(token.text)}, nil
+		case "null":
+			return &cqlLiteral{nil}, nil
+		}
+	case cqlTokenSymbol:
+		switch token.text {
+		case "-":
+			if number := p.next(); number.kind == cqlTokenNumber {
+				return &cqlLiteral{"-" + number.text}, nil
+			}
+		case "?":
+			return p.newMarker("", receiver), nil
+		case ":":
+			name, err := p.parseIdentifier()
+			if err != nil {
+				return nil, err
+			}
+			return p.newMarker(name, receiver), nil
+		case "[":
+			return p.parseCollection('[', "]")
+		case "{":
+			return p.parseCollection('{', "}")
+		}
+	}
+	return nil, fmt.Errorf("expected term, got %v", token)
+}
+
+func (p *cqlParser) newMarker(name string, receiver string) *cqlMarker {
+	marker := &cqlMarker{index: len(p.markers), name: name, receiver: receiver}
+	p.markers = append(p.markers, marker)
+	return marker
+}
+
+// Parses the elements of a collection literal, after its opening bracket.
+func (p *cqlParser) parseCollection(kind byte, closing string) (cqlTerm, error) {
+	collection := &cqlCollection{kind: kind}
+	if p.acceptSymbol(closing) {
+		return collection, nil
+	}
+	for {
+		element, err := p.parseCollectionElement()
+		if err != nil {
+			return nil, err
+		}
+		collection.elements = append(collection.elements, element)
+		if kind == '{' && (p.isSymbol(":") || collection.values != nil) {
+			if err := p.expectSymbol(":"); err != nil {
+				return nil, err
+			} else if value, err := p.parseCollectionElement(); err != nil {
+				return nil, err
+			} else {
+				collection.values = append(collection.values, value)
+			}
+		}
+		if p.acceptSymbol(closing) {
+			return collection, nil
+		} else if err := p.expectSymbol(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *cqlParser) parseCollectionElement() (cqlTerm, error) {
+	if p.isSymbol("?") || p.isSymbol(":") {
+		return nil, fmt.Errorf("bind markers are not supported in collection literals")
+	}
+	return p.parseTerm("")
+}
+
+// Parses a WHERE clause, after the WHERE keyword.
+func (p *cqlParser) parseWhere() ([]*cqlRelation, error) {
+	var relations []*cqlRelation
+	for {
+		column, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		}
+		relation := &cqlRelation{column: column}
+		if p.acceptKeyword("in") {
+			relation.operator = "IN"
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			var values []cqlTerm
+			for !p.acceptSymbol(")") {
+				if len(values) > 0 {
+					if err := p.expectSymbol(","); err != nil {
+						return nil, err
+					}
+				}
+				value, err := p.parseTerm(column)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			}
+			relation.value = values
+		} else {
+			token := p.next()
+			switch token.text {
+			case "=", "<", "<=", ">", ">=":
+				relation.operator = token.text
+			default:
+				return nil, fmt.Errorf("unsupported operator: %v", token)
+			}
+			if relation.value, err = p.parseTerm(column); err != nil {
+				return nil, err
+			}
+		}
+		relations = append(relations, relation)
+		if !p.acceptKeyword("and") {
+			return relations, nil
+		}
+	}
+}
+
+// Parses an optional USING clause; TTLs and timestamps are parsed but ignored.
+func (p *cqlParser) parseUsing() error {
+	if !p.acceptKeyword("using") {
+		return nil
+	}
+	for {
+		var receiver string
+		if p.acceptKeyword("ttl") {
+			receiver = cqlReceiverTtl
+		} else if p.acceptKeyword("timestamp") {
+			receiver = cqlReceiverTimestamp
+		} else {
+			return fmt.Errorf("expected TTL or TIMESTAMP, got %v", p.peek())
+		}
+		if _, err := p.parseTerm(receiver); err != nil {
+			return err
+		} else if !p.acceptKeyword("and") {
+			return nil
+		}
+	}
+}
+
+func (p *cqlParser) parseSelect() (*selectStatement, error) {
+	statement := &selectStatement{}
+	statement.distinct = p.acceptKeyword("distinct")
+	if p.acceptSymbol("*") {
+		// all columns
+	} else if p.isKeyword("count") && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		if !p.acceptSymbol("*") {
+			if token := p.next(); token.kind != cqlTokenNumber || token.text != "1" {
+				return nil, fmt.Errorf("expected COUNT(*) or COUNT(1)")
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		statement.count = true
+	} else {
+		columns, err := p.parseIdentifiers()
+		if err != nil {
+			return nil, err
+		} else if p.isSymbol("(") {
+			return nil, fmt.Errorf("functions are not supported in selections")
+		}
+		statement.columns = columns
+	}
+	var err error
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	} else if statement.keyspace, statement.table, err = p.parseTableName(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("where") {
+		if statement.where, err = p.parseWhere(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order") {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		for {
+			ordering := &cqlOrdering{}
+			if ordering.column, err = p.parseIdentifier(); err != nil {
+				return nil, err
+			} else if p.acceptKeyword("desc") {
+				ordering.descending = true
+			} else {
+				p.acceptKeyword("asc")
+			}
+			statement.orderBy = append(statement.orderBy, ordering)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("limit") {
+		if statement.limit, err = p.parseTerm(cqlReceiverLimit); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("allow") {
+		if err = p.expectKeyword("filtering"); err != nil {
+			return nil, err
+		}
+	}
+	return statement, nil
+}
+
+func (p *cqlParser) parseInsert() (*insertStatement, error) {
+	statement := &insertStatement{}
+	var err error
+	if err = p.expectKeyword("into"); err != nil {
+		return nil, err
+	} else if statement.keyspace, statement.table, err = p.parseTableName(); err != nil {
+		return nil, err
+	} else if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	} else if statement.columns, err = p.parseIdentifiers(); err != nil {
+		return nil, err
+	} else if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	} else if err = p.expectKeyword("values"); err != nil {
+		return nil, err
+	} else if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for i := 0; i == 0 || p.acceptSymbol(","); i++ {
+		if i >= len(statement.columns) {
+			return nil, fmt.Errorf("unmatched column names/values")
+		}
+		value, err := p.parseTerm(statement.columns[i])
+		if err != nil {
+			return nil, err
+		}
+		statement.values = append(statement.values, value)
+	}
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	} else if len(statement.values) != len(statement.columns) {
+		return nil, fmt.Errorf("unmatched column names/values")
+	} else if statement.ifNotExists, err = p.parseIfNotExists(); err != nil {
+		return nil, err
+	}
+	return statement, p.parseUsing()
+}
+
+func (p *cqlParser) parseUpdate() (*updateStatement, error) {
+	statement := &updateStatement{}
+	var err error
+	if statement.keyspace, statement.table, err = p.parseTableName(); err != nil {
+		return nil, err
+	} else if err = p.parseUsing(); err != nil {
+		return nil, err
+	} else if err = p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	for i := 0; i == 0 || p.acceptSymbol(","); i++ {
+		assignment := &cqlAssignment{}
+		if assignment.column, err = p.parseIdentifier(); err != nil {
+			return nil, err
+		} else if err = p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		if token := p.peek(); token.kind == cqlTokenIdentifier && strings.ToLower(token.text) == assignment.column ||
+			token.kind == cqlTokenQuotedIdentifier && token.text == assignment.column {
+			p.pos++
+			if operator := p.next(); operator.text == "+" || operator.text == "-" {
+				assignment.operator = operator.text
+			} else {
+				return nil, fmt.Errorf("expected '+' or '-', got %v", operator)
+			}
+		}
+		if assignment.value, err = p.parseTerm(assignment.column); err != nil {
+			return nil, err
+		}
+		statement.assignments = append(statement.assignments, assignment)
+	}
+	if err = p.expectKeyword("where"); err != nil {
+		return nil, err
+	} else if statement.where, err = p.parseWhere(); err != nil {
+		return nil, err
+	} else if statement.ifExists, statement.conditions, err = p.parseConditions(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+func (p *cqlParser) parseDelete() (*deleteStatement, error) {
+	statement := &deleteStatement{}
+	var err error
+	if !p.isKeyword("from") {
+		if statement.columns, err = p.parseIdentifiers(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	} else if statement.keyspace, statement.table, err = p.parseTableName(); err != nil {
+		return nil, err
+	} else if err = p.parseUsing(); err != nil {
+		return nil, err
+	} else if err = p.expectKeyword("where"); err != nil {
+		return nil, err
+	} else if statement.where, err = p.parseWhere(); err != nil {
+		return nil, err
+	} else if statement.ifExists, statement.conditions, err = p.parseConditions(); err != nil {
+		return nil, err
+	}
+	return statement, nil
+}
+
+// Parses an optional IF clause of an UPDATE or DELETE statement: either IF EXISTS, or IF followed by conditions with
+// the same syntax as WHERE clauses.
+func (p *cqlParser) parseConditions() (ifExists bool, conditions []*cqlRelation, err error) {
+	if !p.acceptKeyword("if") {
+		return false, nil, nil
+	} else if p.acceptKeyword("exists") {
+		return true, nil, nil
+	}
+	conditions, err = p.parseWhere()
+	return false, conditions, err
+}
+
+func (p *cqlParser) parseCreateKeyspace() (*createKeyspaceStatement, error) {
+	statement := &createKeyspaceStatement{}
+	var err error
+	if statement.ifNotExists, err = p.parseIfNotExists(); err != nil {
+		return nil, err
+	} else if statement.keyspace, err = p.parseIdentifier(); err != nil {
+		return nil, err
+	} else if err = p.expectKeyword("with"); err != nil {
+		return nil, err
+	}
+	for i := 0; i == 0 || p.acceptKeyword("and"); i++ {
+		option, err := p.parseIdentifier()
+		if err != nil {
+			return nil, err
+		} else if err = p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseTerm("")
+		if err != nil {
+			return nil, err
+		}
+		switch option {
+		case "replication":
+			if statement.replication, err = literalStringMap(value); err != nil {
+				return nil, err
+			}
+		case "durable_writes":
+			// ignored
+		default:
+			return nil, fmt.Errorf("unknown keyspace option: %v", option)
+		}
+	}
+	if statement.replication == nil {
+		return nil, fmt.Errorf("missing mandatory replication strategy class")
+	}
+	return statement, nil
+}
+
+// Converts a map literal with literal keys and values to a map of strings.
+func literalStringMap(term cqlTerm) (map[string]string, error) {
+	collection, ok := term.(*cqlCollection)
+	if !ok || collection.kind != '{' || len(collection.elements) != len(collection.values) {
+		return nil, fmt.Errorf("expected map literal")
+	}
+	result := make(map[string]string)
+	for i, key := range collection.elements {
+		k, keyOk := key.(*cqlLiteral)
+		v, valueOk := collection.values[i].(*cqlLiteral)
+		if !keyOk || !valueOk {
+			return nil, fmt.Errorf("expected map literal with literal keys and values")
+		}
+		result[fmt.Sprint(k.value)] = fmt.Sprint(v.value)
+	}
+	return result, nil
+}
+
+func (p *cqlParser) parseCreateTable() (*createTableStatement, error) {
+	statement := &createTableStatement{descending: make(map[string]bool)}
+	var err error
+	if statement.ifNotExists, err = p.parseIfNotExists(); err != nil {
+		return nil, err
+	} else if statement.keyspace, statement.table, err = p.parseTableName(); err != nil {
+		return nil, err
+	} else if err = p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for i := 0; i == 0 || p.acceptSymbol(","); i++ {
+		if p.acceptKeyword("primary") {
+			if err = p.parsePrimaryKey(statement); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		column := &SchemaColumn{}
+		if column.Name, err = p.parseIdentifier(); err != nil {
+			return nil, err
+		} else if column.Type, err = p.parseDataType(); err != nil {
+			return nil, err
+		}
+		if p.acceptKeyword("static") {
+			column.Static = true
+		} else if p.acceptKeyword("primary") {
+			if err = p.expectKeyword("key"); err != nil {
+				return nil, err
+			}
+			statement.partitionKey = []string{column.Name}
+		}
+		statement.columns = append(statement.columns, column)
+	}
+	if err = p.expectSymbol(")"); err != nil {
+		return nil, err
+	} else if len(statement.partitionKey) == 0 {
+		return nil, fmt.Errorf("no PRIMARY KEY specified")
+	}
+	if p.acceptKeyword("with") {
+		for i := 0; i == 0 || p.acceptKeyword("and"); i++ {
+			if err = p.parseTableOption(statement); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return statement, nil
+}
+
+// Parses a PRIMARY KEY clause, after the PRIMARY keyword.
+func (p *cqlParser) parsePrimaryKey(statement *createTableStatement) error {
+	var err error
+	if err = p.expectKeyword("key"); err != nil {
+		return err
+	} else if err = p.expectSymbol("("); err != nil {
+		return err
+	}
+	if p.acceptSymbol("(") {
+		if statement.partitionKey, err = p.parseIdentifiers(); err != nil {
+			return err
+		} else if err = p.expectSymbol(")"); err != nil {
+			return err
+		}
+	} else {
+		var column string
+		if column, err = p.parseIdentifier(); err != nil {
+			return err
+		}
+		statement.partitionKey = []string{column}
+	}
+	if p.acceptSymbol(",") {
+		if statement.clusteringColumns, err = p.parseIdentifiers(); err != nil {
+			return err
+		}
+	}
+	return p.expectSymbol(")")
+}
+
+// Parses a table option; all options except CLUSTERING ORDER BY are ignored.
+func (p *cqlParser) parseTableOption(statement *createTableStatement) error {
+	if p.acceptKeyword("clustering") {
+		if err := p.expectKeyword("order"); err != nil {
+			return err
+		} else if err := p.expectKeyword("by"); err != nil {
+			return err
+		} else if err := p.expectSymbol("("); err != nil {
+			return err
+		}
+		for i := 0; i == 0 || p.acceptSymbol(","); i++ {
+			column, err := p.parseIdentifier()
+			if err != nil {
+				return err
+			}
+			statement.descending[column] = p.acceptKeyword("desc")
+			if !statement.descending[column] {
+				p.acceptKeyword("asc")
+			}
+		}
+		return p.expectSymbol(")")
+	} else if p.acceptKeyword("compact") {
+		return p.expectKeyword("storage")
+	} else if _, err := p.parseIdentifier(); err != nil {
+		return err
+	} else if err := p.expectSymbol("="); err != nil {
+		return err
+	}
+	_, err := p.parseTerm("")
+	return err
+}
+
+// Parses a data type, e.g. map<text, frozen<list<int>>>.
+func (p *cqlParser) parseDataType() (datatype.DataType, error) {
+	var sb strings.Builder
+	depth := 0
+	for {
+		token := p.peek()
+		if token.kind == cqlTokenEOF || depth == 0 && (token.text == "," || token.text == ")" || sb.Len() > 0 && token.text != "<") {
+			break
+		}
+		switch token.text {
+		case "<":
+			depth++
+		case ">":
+			depth--
+		}
+		if strings.EqualFold(token.text, "text") {
+			// text is an alias for varchar, and the text type code does not exist in recent protocol versions
+			sb.WriteString("varchar")
+		} else {
+			sb.WriteString(token.text)
+		}
+		p.pos++
+		if depth == 0 && token.text == ">" {
+			break
+		}
+	}
+	return datatype.ParseDataType(sb.String())
+}
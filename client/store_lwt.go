@@ -0,0 +1,335 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"strings"
+)
+
+// The name of the column reporting whether the conditions of conditional statements applied.
+const appliedColumn = "[applied]"
+
+// storeCondition is the resolved IF clause of an INSERT, UPDATE or DELETE statement, along with the row the statement
+// writes to.
+type storeCondition struct {
+	keyspace   string
+	table      *storedTable
+	routingKey []byte
+	// The clustering of the row; nil if some clustering columns are not restricted.
+	clustering  []interface{}
+	ifExists    bool
+	ifNotExists bool
+	relations   []*storeRelation
+}
+
+// storeBatchChild is a resolved child statement of a BATCH request.
+type storeBatchChild struct {
+	statement *cqlStatement
+	keyspace  string
+	values    *cqlValues
+}
+
+func isConditional(parsed *cqlStatement) bool {
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		return statement.ifNotExists
+	case *updateStatement:
+		return statement.ifExists || len(statement.conditions) > 0
+	case *deleteStatement:
+		return statement.ifExists || len(statement.conditions) > 0
+	}
+	return false
+}
+
+func (c *storeCondition) isConditional() bool {
+	return c.ifExists || c.ifNotExists || len(c.relations) > 0
+}
+
+// Resolves the row the given INSERT, UPDATE or DELETE statement writes to, along with its IF clause, if any; the
+// statement must have been validated with prepareWrite. Must be called while holding the store lock.
+func (s *TableStore) prepareCondition(parsed *cqlStatement, keyspace string, values *cqlValues) (*storeCondition, message.Error) {
+	condition := &storeCondition{}
+	var tableKeyspace, tableName string
+	var conditions []*cqlRelation
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		tableKeyspace, tableName = statement.keyspace, statement.table
+		condition.ifNotExists = statement.ifNotExists
+	case *updateStatement:
+		tableKeyspace, tableName = statement.keyspace, statement.table
+		condition.ifExists, conditions = statement.ifExists, statement.conditions
+	case *deleteStatement:
+		tableKeyspace, tableName = statement.keyspace, statement.table
+		condition.ifExists, conditions = statement.ifExists, statement.conditions
+	default:
+		return nil, invalidf("unsupported statement")
+	}
+	if tableKeyspace != "" {
+		keyspace = tableKeyspace
+	}
+	table, errMsg := s.lookupTable(keyspace, tableName)
+	if errMsg != nil {
+		return nil, errMsg
+	}
+	condition.keyspace, condition.table = keyspace, table
+	key := make(map[string]interface{})
+	switch statement := parsed.statement.(type) {
+	case *insertStatement:
+		for i, name := range statement.columns {
+			if column := table.definition.Column(name); column != nil && table.isKeyColumn(name) {
+				value, _, err := resolveTerm(statement.values[i], column.Type, values)
+				if err != nil {
+					return nil, invalidf("%v", err)
+				}
+				key[name] = value
+			}
+		}
+	case *updateStatement:
+		if key, errMsg = table.resolveKey(statement.where, values); errMsg != nil {
+			return nil, errMsg
+		}
+	case *deleteStatement:
+		relations, errMsg := table.resolveRelations(statement.where, values)
+		if errMsg != nil {
+			return nil, errMsg
+		}
+		for _, relation := range relations {
+			if relation.operator == "=" {
+				key[relation.column.Name] = relation.values[0]
+			}
+		}
+	}
+	if condition.routingKey, _, errMsg = table.routingKey(key); errMsg != nil {
+		return nil, errMsg
+	}
+	var missing []string
+	for _, column := range table.definition.ClusteringColumns {
+		if value := key[column.Name]; value != nil {
+			condition.clustering = append(condition.clustering, value)
+		} else {
+			missing = append(missing, column.Name)
+		}
+	}
+	if len(missing) > 0 {
+		condition.clustering = nil
+	}
+	if condition.relations, errMsg = table.resolveRelations(conditions, values); errMsg != nil {
+		return nil, errMsg
+	}
+	for _, relation := range condition.relations {
+		if table.isKeyColumn(relation.column.Name) {
+			return nil, invalidf("PRIMARY KEY column '%v' cannot have IF conditions", relation.column.Name)
+		}
+	}
+	if condition.isConditional() {
+		if isCounterTable(table.definition) {
+			return nil, invalidf("Conditional updates are not supported on counter tables")
+		} else if len(missing) > 0 {
+			return nil, invalidf("Some clustering keys are missing: %v", strings.Join(missing, ", "))
+		}
+	}
+	return condition, nil
+}
+
+// Evaluates the condition against the current state of the row; returns whether the condition applies, along with
+// the current values of the row, or nil if the row does not exist. Must be called while holding the store lock.
+func (c *storeCondition) check() (bool, map[string]interface{}) {
+	var current map[string]interface{}
+	if partition := c.table.partitions[string(c.routingKey)]; partition != nil {
+		if row := partition.find(c.clustering, c.table.definition.ClusteringColumns); row != nil {
+			current = c.table.rowValues(partition, row)
+		}
+	}
+	if c.ifNotExists {
+		return current == nil, current
+	} else if c.ifExists {
+		return current != nil, current
+	}
+	return current != nil && matchesRelations(c.relations, current), current
+}
+
+// Returns the columns reported when the condition does not apply: all the columns for IF EXISTS and IF NOT EXISTS
+// conditions, or the columns of the conditions otherwise.
+func (c *storeCondition) columns() []*SchemaColumn {
+	if c.ifExists || c.ifNotExists {
+		return allColumns(c.table.definition)
+	}
+	var columns []*SchemaColumn
+	for _, relation := range c.relations {
+		if !containsColumn(columns, relation.column.Name) {
+			columns = append(columns, relation.column)
+		}
+	}
+	return columns
+}
+
+// Executes a conditional INSERT, UPDATE or DELETE statement; must be called while holding the store lock.
+func (s *TableStore) executeConditional(parsed *cqlStatement, keyspace string, values *cqlValues) message.Message {
+	mutation, errMsg := s.prepareWrite(parsed, keyspace, values)
+	if errMsg != nil {
+		return errMsg
+	}
+	condition, errMsg := s.prepareCondition(parsed, keyspace, values)
+	if errMsg != nil {
+		return errMsg
+	}
+	applied, current := condition.check()
+	if applied {
+		mutation()
+		return conditionalResult(condition, true, nil, nil, values.version)
+	}
+	var rows []map[string]interface{}
+	if current != nil {
+		rows = append(rows, current)
+	}
+	return conditionalResult(condition, false, condition.columns(), rows, values.version)
+}
+
+// Executes the given BATCH children atomically: all the children are validated, and all their conditions, if any,
+// are evaluated, before any of them is applied.
+func (s *TableStore) executeBatch(batchType primitive.BatchType, children []*storeBatchChild, version primitive.ProtocolVersion) message.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var mutations []func()
+	var conditions []*storeCondition
+	var counters []bool
+	for _, child := range children {
+		mutation, errMsg := s.prepareWrite(child.statement, child.keyspace, child.values)
+		if errMsg != nil {
+			return errMsg
+		}
+		condition, errMsg := s.prepareCondition(child.statement, child.keyspace, child.values)
+		if errMsg != nil {
+			return errMsg
+		}
+		mutations = append(mutations, mutation)
+		conditions = append(conditions, condition)
+		counters = append(counters, isCounterTable(condition.table.definition))
+	}
+	if errMsg := validateBatchType(batchType, counters); errMsg != nil {
+		return errMsg
+	}
+	conditional := false
+	for _, condition := range conditions {
+		conditional = conditional || condition.isConditional()
+	}
+	if !conditional {
+		for _, mutation := range mutations {
+			mutation()
+		}
+		return &message.VoidResult{}
+	}
+	first := conditions[0]
+	for _, condition := range conditions[1:] {
+		if condition.table != first.table {
+			return invalidf("Batch with conditions cannot span multiple tables")
+		} else if !bytes.Equal(condition.routingKey, first.routingKey) {
+			return invalidf("Batch with conditions cannot span multiple partitions")
+		}
+	}
+	applied := true
+	var rows []map[string]interface{}
+	var columns []*SchemaColumn
+	exists := false
+	for _, condition := range conditions {
+		if !condition.isConditional() {
+			continue
+		}
+		ok, current := condition.check()
+		applied = applied && ok
+		if current != nil && !containsRow(rows, current, first.table.definition) {
+			rows = append(rows, current)
+		}
+		if condition.ifExists || condition.ifNotExists {
+			exists = true
+		}
+		for _, column := range condition.columns() {
+			if !containsColumn(columns, column.Name) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	if applied {
+		for _, mutation := range mutations {
+			mutation()
+		}
+		return conditionalResult(first, true, nil, nil, version)
+	}
+	// like Cassandra, batches report the primary key columns, followed by the columns of the conditions
+	definition := first.table.definition
+	reported := append(append([]*SchemaColumn{}, definition.PartitionKey...), definition.ClusteringColumns...)
+	if exists {
+		columns = allColumns(definition)
+	}
+	for _, column := range columns {
+		if !containsColumn(reported, column.Name) {
+			reported = append(reported, column)
+		}
+	}
+	return conditionalResult(first, false, reported, rows, version)
+}
+
+// Returns true if the given rows contain a row with the same primary key as the given row.
+func containsRow(rows []map[string]interface{}, row map[string]interface{}, definition *SchemaTable) bool {
+	for _, candidate := range rows {
+		same := true
+		for _, column := range append(append([]*SchemaColumn{}, definition.PartitionKey...), definition.ClusteringColumns...) {
+			same = same && compareValues(candidate[column.Name], row[column.Name]) == 0
+		}
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the result of conditional statements: a single [applied] column if the conditions applied; otherwise, the
+// [applied] column, followed by the given columns if the given current rows are not empty, with one row for each of
+// them.
+func conditionalResult(
+	condition *storeCondition,
+	applied bool,
+	columns []*SchemaColumn,
+	current []map[string]interface{},
+	version primitive.ProtocolVersion,
+) message.Message {
+	newColumn := func(name string, dataType datatype.DataType) *message.ColumnMetadata {
+		return &message.ColumnMetadata{Keyspace: condition.keyspace, Table: condition.table.definition.Name, Name: name, Type: dataType}
+	}
+	metadata := []*message.ColumnMetadata{newColumn(appliedColumn, datatype.Boolean)}
+	rows := []map[string]interface{}{{appliedColumn: applied}}
+	if !applied && len(current) > 0 {
+		for _, column := range columns {
+			metadata = append(metadata, newColumn(column.Name, column.Type))
+		}
+		rows = nil
+		for _, values := range current {
+			row := map[string]interface{}{appliedColumn: false}
+			for name, value := range values {
+				row[name] = value
+			}
+			rows = append(rows, row)
+		}
+	}
+	result, err := encodeSystemRows(metadata, rows, version)
+	if err != nil {
+		return &message.ServerError{ErrorMessage: err.Error()}
+	}
+	return result
+}
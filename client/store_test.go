@@ -0,0 +1,356 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTableStore_Schema(t *testing.T) {
+	store := client.NewTableStore()
+	result := store.Execute("", "CREATE KEYSPACE ks1 WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}")
+	assert.Equal(t, &message.SchemaChangeResult{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetKeyspace,
+		Keyspace:   "ks1",
+	}, result)
+	assert.IsType(t, &message.AlreadyExists{}, store.Execute("", "CREATE KEYSPACE ks1 WITH replication = {'class': 'SimpleStrategy'}"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("", "CREATE KEYSPACE IF NOT EXISTS ks1 WITH replication = {'class': 'SimpleStrategy'}"))
+
+	result = store.Execute("ks1", "CREATE TABLE t1 (pk int, cc text, v int, s text STATIC, PRIMARY KEY (pk, cc)) WITH CLUSTERING ORDER BY (cc DESC)")
+	assert.Equal(t, &message.SchemaChangeResult{
+		ChangeType: primitive.SchemaChangeTypeCreated,
+		Target:     primitive.SchemaChangeTargetTable,
+		Keyspace:   "ks1",
+		Object:     "t1",
+	}, result)
+	keyspace := store.Schema.Keyspace("ks1")
+	require.NotNil(t, keyspace)
+	assert.Equal(t, map[string]string{"class": "SimpleStrategy", "replication_factor": "1"}, keyspace.Replication)
+	table := keyspace.Table("t1")
+	require.NotNil(t, table)
+	assert.Equal(t, []string{"pk"}, columnNames(table.PartitionKey))
+	assert.Equal(t, []string{"cc"}, columnNames(table.ClusteringColumns))
+	assert.True(t, table.ClusteringColumns[0].Descending)
+	assert.Equal(t, []string{"v", "s"}, columnNames(table.Columns))
+	assert.True(t, table.Column("s").Static)
+	assert.Equal(t, datatype.Varchar, table.Column("s").Type)
+
+	assert.IsType(t, &message.AlreadyExists{}, store.Execute("ks1", "CREATE TABLE t1 (pk int PRIMARY KEY)"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "CREATE TABLE IF NOT EXISTS t1 (pk int PRIMARY KEY)"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("", "CREATE TABLE t2 (pk int PRIMARY KEY)"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("ks2", "CREATE TABLE t2 (pk int PRIMARY KEY)"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("ks1", "CREATE TABLE t2 (pk int, v int, PRIMARY KEY (pk, cc))"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("ks1", "CREATE TABLE t2 (pk int PRIMARY KEY, s int STATIC)"))
+	assert.IsType(t, &message.SyntaxError{}, store.Execute("ks1", "CREATE TABLE t2 (pk int PRIMARY KEY"))
+}
+
+func TestTableStore_Crud(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int, cc int, v text, s text STATIC, PRIMARY KEY (pk, cc))")
+	for _, query := range []string{
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 1, 'a')",
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 3, 'c')",
+		"INSERT INTO t1 (pk, cc, v, s) VALUES (1, 2, 'b', 'static')",
+		"INSERT INTO t1 (pk, cc, v) VALUES (2, 1, 'd')",
+		"UPDATE t1 SET v = 'e' WHERE pk = 2 AND cc = 2",
+	} {
+		assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", query), query)
+	}
+
+	rows := selectRows(t, store, "SELECT * FROM t1 WHERE pk = 1")
+	assert.Equal(t, [][]interface{}{
+		{int32(1), int32(1), "static", "a"},
+		{int32(1), int32(2), "static", "b"},
+		{int32(1), int32(3), "static", "c"},
+	}, rows)
+	assert.Equal(t, [][]interface{}{{"b"}, {"c"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 1 AND cc >= 2"))
+	assert.Equal(t, [][]interface{}{{"b"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 1 AND cc > 1 AND cc < 3"))
+	assert.Equal(t, [][]interface{}{{"c"}, {"b"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 1 ORDER BY cc DESC LIMIT 2"))
+	assert.Equal(t, [][]interface{}{{"a"}, {"c"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 1 AND cc IN (1, 3)"))
+	assert.Equal(t, [][]interface{}{{int64(5)}}, selectRows(t, store, "SELECT COUNT(*) FROM t1"))
+	assert.Len(t, selectRows(t, store, "SELECT pk FROM t1 WHERE pk = 3"), 0)
+	assert.ElementsMatch(t, [][]interface{}{{int32(1)}, {int32(2)}}, selectRows(t, store, "SELECT DISTINCT pk FROM t1"))
+	assert.Equal(t, [][]interface{}{{"d"}, {"e"}}, selectRows(t, store, "SELECT v FROM t1 WHERE pk = 2"))
+
+	// updates and deletes
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "UPDATE t1 SET v = null, s = 'updated' WHERE pk = 1 AND cc = 1"))
+	assert.Equal(t, [][]interface{}{{nil, "updated"}, {"b", "updated"}}, selectRows(t, store, "SELECT v, s FROM t1 WHERE pk = 1 AND cc < 3"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "DELETE FROM t1 WHERE pk = 1 AND cc > 1"))
+	assert.Equal(t, [][]interface{}{{int32(1)}}, selectRows(t, store, "SELECT cc FROM t1 WHERE pk = 1"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "DELETE s FROM t1 WHERE pk = 1"))
+	assert.Equal(t, [][]interface{}{{nil}}, selectRows(t, store, "SELECT s FROM t1 WHERE pk = 1"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "DELETE FROM t1 WHERE pk = 2"))
+	assert.Len(t, selectRows(t, store, "SELECT * FROM t1 WHERE pk = 2"), 0)
+
+	// invalid statements
+	for _, query := range []string{
+		"INSERT INTO t1 (pk, v) VALUES (1, 'a')",
+		"INSERT INTO t1 (pk, cc, x) VALUES (1, 1, 'a')",
+		"INSERT INTO t1 (pk, cc, v) VALUES (1, 'a', 'a')",
+		"INSERT INTO t2 (pk) VALUES (1)",
+		"UPDATE t1 SET cc = 1 WHERE pk = 1",
+		"UPDATE t1 SET v = 'a' WHERE pk = 1 AND cc > 1",
+		"DELETE FROM t1 WHERE v = 'a'",
+		"SELECT x FROM t1",
+		"SELECT * FROM t1 LIMIT 0",
+		"SELECT * FROM t1 WHERE pk = 1 ORDER BY v",
+	} {
+		assert.IsType(t, &message.Invalid{}, store.Execute("ks1", query), query)
+	}
+}
+
+func TestTableStore_Counters(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int PRIMARY KEY, c counter)")
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "UPDATE t1 SET c = c + 3 WHERE pk = 1"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "UPDATE t1 SET c = c - 1 WHERE pk = 1"))
+	assert.Equal(t, [][]interface{}{{int32(1), int64(2)}}, selectRows(t, store, "SELECT * FROM t1"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("ks1", "UPDATE t1 SET c = 1 WHERE pk = 1"))
+	assert.IsType(t, &message.Invalid{}, store.Execute("ks1", "INSERT INTO t1 (pk, c) VALUES (2, 1)"))
+}
+
+func TestTableStore_Conditional(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int, cc int, v text, PRIMARY KEY (pk, cc))")
+	conditional := func(query string) [][]interface{} {
+		result := store.Execute("ks1", query)
+		require.IsType(t, &message.RowsResult{}, result, "%v: %v", query, result)
+		rows := result.(*message.RowsResult)
+		assert.Equal(t, "[applied]", rows.Metadata.Columns[0].Name)
+		return decodeRows(t, rows)
+	}
+	assert.Equal(t, [][]interface{}{{true}}, conditional("INSERT INTO t1 (pk, cc, v) VALUES (1, 1, 'a') IF NOT EXISTS"))
+	assert.Equal(t, [][]interface{}{{false, int32(1), int32(1), "a"}}, conditional("INSERT INTO t1 (pk, cc, v) VALUES (1, 1, 'b') IF NOT EXISTS"))
+	assert.Equal(t, [][]interface{}{{false, "a"}}, conditional("UPDATE t1 SET v = 'c' WHERE pk = 1 AND cc = 1 IF v = 'b'"))
+	assert.Equal(t, [][]interface{}{{true}}, conditional("UPDATE t1 SET v = 'c' WHERE pk = 1 AND cc = 1 IF v = 'a'"))
+	assert.Equal(t, [][]interface{}{{false}}, conditional("UPDATE t1 SET v = 'd' WHERE pk = 1 AND cc = 2 IF EXISTS"))
+	assert.Equal(t, [][]interface{}{{false}}, conditional("DELETE FROM t1 WHERE pk = 2 AND cc = 1 IF v = 'c'"))
+	assert.Equal(t, [][]interface{}{{true}}, conditional("DELETE FROM t1 WHERE pk = 1 AND cc = 1 IF EXISTS"))
+	assert.Len(t, selectRows(t, store, "SELECT * FROM t1"), 0)
+
+	// invalid conditions
+	for _, query := range []string{
+		"UPDATE t1 SET v = 'a' WHERE pk = 1 AND cc = 1 IF cc = 1",
+		"UPDATE t1 SET v = 'a' WHERE pk = 1 AND cc = 1 IF x = 1",
+		"DELETE FROM t1 WHERE pk = 1 IF EXISTS",
+	} {
+		assert.IsType(t, &message.Invalid{}, store.Execute("ks1", query), query)
+	}
+}
+
+func TestTableStore_Types(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk text, cc bigint, "+
+		"b boolean, d double, u uuid, i inet, bl blob, l list<int>, st set<text>, m map<text, int>, "+
+		"PRIMARY KEY ((pk), cc)) WITH CLUSTERING ORDER BY (cc DESC)")
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "INSERT INTO t1 (pk, cc, b, d, u, i, bl, l, st, m) "+
+		"VALUES ('a', -1, true, 1.5, c0d1d21e-bb01-4196-86db-bc317bc1796a, '127.0.0.1', 0xCAFE, [2, 1], {'y', 'x', 'y'}, {'k': 1})"))
+	assert.IsType(t, &message.VoidResult{}, store.Execute("ks1", "INSERT INTO t1 (pk, cc) VALUES ('a', 10)"))
+	rows := selectRows(t, store, "SELECT cc, b, d, bl, l, st, m FROM t1 WHERE pk = 'a'")
+	assert.Equal(t, [][]interface{}{
+		{int64(10), nil, nil, nil, nil, nil, nil},
+		{int64(-1), true, 1.5, "\xCA\xFE", []interface{}{int32(2), int32(1)}, []interface{}{"x", "y"}, map[interface{}]interface{}{"k": int32(1)}},
+	}, rows)
+	rows = selectRows(t, store, "SELECT u, i FROM t1 WHERE pk = 'a' AND cc = -1")
+	require.Len(t, rows, 1)
+	uuid := rows[0][0].(primitive.UUID)
+	assert.Equal(t, "c0d1d21e-bb01-4196-86db-bc317bc1796a", uuid.String())
+	assert.Equal(t, "127.0.0.1", rows[0][1].(fmt.Stringer).String())
+}
+
+func TestTableStore_Handler(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int, cc int, v text, PRIMARY KEY (pk, cc))")
+	server, clientConn, cancelFn := createServerAndClient(t, store.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+	version := primitive.ProtocolVersion4
+
+	// queries with bound values, in the connection keyspace
+	response := sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{Query: "SELECT * FROM t1"}))
+	assert.IsType(t, &message.Invalid{}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{Query: "USE ks1"}))
+	assert.Equal(t, &message.SetKeyspaceResult{Keyspace: "ks1"}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{
+		Query:   "INSERT INTO t1 (pk, cc, v) VALUES (?, ?, ?)",
+		Options: &message.QueryOptions{PositionalValues: encodeValues(t, int32(1), int32(1), "a")},
+	}))
+	assert.IsType(t, &message.VoidResult{}, response)
+
+	// prepared statements
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Prepare{
+		Query: "INSERT INTO t1 (pk, cc, v) VALUES (:pk, :cc, :v)",
+	}))
+	require.IsType(t, &message.PreparedResult{}, response)
+	insert := response.(*message.PreparedResult)
+	assert.Equal(t, []uint16{0}, insert.VariablesMetadata.PkIndices)
+	require.Len(t, insert.VariablesMetadata.Columns, 3)
+	assert.Equal(t, "v", insert.VariablesMetadata.Columns[2].Name)
+	assert.Equal(t, datatype.Varchar, insert.VariablesMetadata.Columns[2].Type)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Prepare{
+		Query: "SELECT cc, v FROM t1 WHERE pk = ? AND cc >= ? LIMIT ?",
+	}))
+	require.IsType(t, &message.PreparedResult{}, response)
+	selectAll := response.(*message.PreparedResult)
+	assert.Len(t, selectAll.VariablesMetadata.Columns, 3)
+	assert.Equal(t, "[limit]", selectAll.VariablesMetadata.Columns[2].Name)
+	assert.Equal(t, []string{"cc", "v"}, metadataNames(selectAll.ResultMetadata.Columns))
+
+	// batches are applied atomically
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Batch{
+		Children: []*message.BatchChild{
+			{QueryOrId: insert.PreparedQueryId, Values: encodeValues(t, int32(1), int32(2), "b")},
+			{QueryOrId: "UPDATE t1 SET v = 'c' WHERE pk = 1 AND cc = 3"},
+			{QueryOrId: "INSERT INTO t1 (pk, cc, v) VALUES (1, 4, 'd')"},
+		},
+	}))
+	assert.IsType(t, &message.VoidResult{}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Batch{
+		Children: []*message.BatchChild{
+			{QueryOrId: "INSERT INTO t1 (pk, cc, v) VALUES (1, 5, 'e')"},
+			{QueryOrId: "INSERT INTO t1 (pk, v) VALUES (1, 'f')"},
+		},
+	}))
+	assert.IsType(t, &message.Invalid{}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Batch{
+		Children: []*message.BatchChild{{QueryOrId: "SELECT * FROM t1"}},
+	}))
+	assert.IsType(t, &message.Invalid{}, response)
+
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Execute{
+		QueryId: selectAll.PreparedQueryId,
+		Options: &message.QueryOptions{PositionalValues: encodeValues(t, int32(1), int32(2), int32(2))},
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	rows := decodeRows(t, response.(*message.RowsResult))
+	assert.Equal(t, [][]interface{}{{int32(2), "b"}, {int32(3), "c"}}, rows)
+
+	// paging
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Execute{
+		QueryId: selectAll.PreparedQueryId,
+		Options: &message.QueryOptions{PositionalValues: encodeValues(t, int32(1), int32(0), int32(10)), PageSize: 3},
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	page := response.(*message.RowsResult)
+	assert.Len(t, page.Data, 3)
+	require.NotNil(t, page.Metadata.PagingState)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Execute{
+		QueryId: selectAll.PreparedQueryId,
+		Options: &message.QueryOptions{
+			PositionalValues: encodeValues(t, int32(1), int32(0), int32(10)),
+			PageSize:         3,
+			PagingState:      page.Metadata.PagingState,
+		},
+	}))
+	require.IsType(t, &message.RowsResult{}, response)
+	page = response.(*message.RowsResult)
+	assert.Equal(t, [][]interface{}{{int32(4), "d"}}, decodeRows(t, page))
+	assert.Nil(t, page.Metadata.PagingState)
+
+	// unknown ids and statements
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Execute{QueryId: []byte{1, 2, 3}}))
+	assert.IsType(t, &message.Unprepared{}, response)
+	handler := store.Handler()
+	assert.Nil(t, handler(frame.NewFrame(version, 1, &message.Query{Query: "SELECT * FROM system.local"}), nil, nil))
+	assert.Nil(t, handler(frame.NewFrame(version, 1, &message.Query{Query: "DROP TABLE ks1.t1"}), nil, nil))
+}
+
+func TestTableStore_Handler_ConnectionKeyspace(t *testing.T) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int, cc int, v text, PRIMARY KEY (pk, cc))")
+	// the store uses the keyspace of the connection, even if the USE statement was handled by another handler
+	useHandler := func(request *frame.Frame, _ *client.CqlServerConnection, _ client.RequestHandlerContext) *frame.Frame {
+		if query, ok := request.Body.Message.(*message.Query); ok && query.Query == "USE ks1" {
+			return frame.NewFrame(request.Header.Version, request.Header.StreamId, &message.SetKeyspaceResult{Keyspace: "ks1"})
+		}
+		return nil
+	}
+	server, clientConn, cancelFn := createServerAndClient(t, useHandler, store.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+	version := primitive.ProtocolVersion4
+
+	response := sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{Query: "SELECT * FROM t1"}))
+	assert.IsType(t, &message.Invalid{}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{Query: "USE ks1"}))
+	assert.Equal(t, &message.SetKeyspaceResult{Keyspace: "ks1"}, response)
+	response = sendAndReceive(t, clientConn, frame.NewFrame(version, 1, &message.Query{Query: "SELECT * FROM t1"}))
+	assert.IsType(t, &message.RowsResult{}, response)
+}
+
+func newTestTableStore(t *testing.T, queries ...string) *client.TableStore {
+	store := client.NewTableStore()
+	result := store.Execute("", "CREATE KEYSPACE ks1 WITH replication = {'class': 'SimpleStrategy', 'replication_factor': 1}")
+	require.IsType(t, &message.SchemaChangeResult{}, result)
+	for _, query := range queries {
+		require.IsType(t, &message.SchemaChangeResult{}, store.Execute("ks1", query), query)
+	}
+	return store
+}
+
+func selectRows(t *testing.T, store *client.TableStore, query string) [][]interface{} {
+	result := store.Execute("ks1", query)
+	require.IsType(t, &message.RowsResult{}, result, "%v: %v", query, result)
+	return decodeRows(t, result.(*message.RowsResult))
+}
+
+func decodeRows(t *testing.T, result *message.RowsResult) [][]interface{} {
+	rows := make([][]interface{}, 0, len(result.Data))
+	for _, row := range result.Data {
+		values := make([]interface{}, len(row))
+		for i, column := range result.Metadata.Columns {
+			codec, err := datatype.CodecFor(column.Type)
+			require.Nil(t, err)
+			values[i], err = codec.Decode(row[i], primitive.ProtocolVersion4)
+			require.Nil(t, err)
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+func encodeValues(t *testing.T, values ...interface{}) []*primitive.Value {
+	var encoded []*primitive.Value
+	for _, value := range values {
+		var contents []byte
+		var err error
+		switch v := value.(type) {
+		case int32:
+			contents, err = (&datatype.IntCodec{}).Encode(v, primitive.ProtocolVersion4)
+		case string:
+			contents, err = (&datatype.VarcharCodec{}).Encode(v, primitive.ProtocolVersion4)
+		}
+		require.Nil(t, err)
+		encoded = append(encoded, primitive.NewValue(contents))
+	}
+	return encoded
+}
+
+func metadataNames(columns []*message.ColumnMetadata) []string {
+	var names []string
+	for _, column := range columns {
+		names = append(names, column.Name)
+	}
+	return names
+}
+
+func sendAndReceive(t *testing.T, clientConn *client.CqlClientConnection, request *frame.Frame) message.Message {
+	response, err := clientConn.SendAndReceive(request)
+	require.Nil(t, err)
+	return response.Body.Message
+}
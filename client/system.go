@@ -16,157 +16,689 @@ package client
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/datastax/go-cassandra-native-protocol/datatype"
 	"github.com/datastax/go-cassandra-native-protocol/frame"
 	"github.com/datastax/go-cassandra-native-protocol/message"
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
 	"github.com/rs/zerolog/log"
 	"net"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-// Creates a new RequestHandler to handle queries to system tables (system.local and system.peers).
-func NewSystemTablesHandler(cluster string, datacenter string) RequestHandler {
-	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) (response *frame.Frame) {
-		if query, ok := request.Body.Message.(*message.Query); ok {
-			q := strings.TrimSpace(strings.ToLower(query.Query))
-			q = strings.Join(strings.Fields(q), " ") // remove extra whitespace
-			if strings.HasPrefix(q, "select * from system.local") {
-				log.Debug().Msgf("%v: [system tables handler]: returning full system.local", conn)
-				response = fullSystemLocal(cluster, datacenter, request, conn)
-			} else if strings.HasPrefix(q, "select schema_version from system.local") {
-				log.Debug().Msgf("%v: [system tables handler]: returning schema_version", conn)
-				response = schemaVersion(request)
-			} else if strings.HasPrefix(q, "select cluster_name from system.local") {
-				log.Debug().Msgf("%v: [system tables handler]: returning cluster_name", conn)
-				response = clusterName(cluster, request)
-			} else if strings.Contains(q, "from system.peers") {
-				log.Debug().Msgf("%v: [system tables handler]: returning empty system.peers", conn)
-				response = emptySystemPeers(request)
+const (
+	DefaultReleaseVersion = "3.11.2"
+	DefaultCqlVersion     = "3.4.4"
+	DefaultPartitioner    = "org.apache.cassandra.dht.Murmur3Partitioner"
+	DefaultRack           = "rack1"
+	// The minimum token of the Murmur3Partitioner ring: a node owning this single token owns the entire ring.
+	DefaultToken = "-9223372036854775808"
+)
+
+// The host id reported by default for the local node.
+var DefaultHostId = primitive.UUID{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB, 0xBC, 0x31, 0x7B, 0xC1, 0x79, 0x6A}
+
+// SystemNode describes a node, as reported in system.local, system.peers or system.peers_v2.
+type SystemNode struct {
+	// The node's address; if nil, the local address of the client connection is reported for the local node.
+	Address net.IP
+	// The node's native port; if zero, the local port of the client connection is reported.
+	NativePort int
+	Datacenter string
+	Rack       string
+	HostId     *primitive.UUID
+	// The node's tokens; if empty, DefaultToken is reported.
+	Tokens []string
+	// The node's release version; if empty, SystemTables.ReleaseVersion is reported.
+	ReleaseVersion string
+}
+
+// SystemTables is a configurable model of the system tables, served by the RequestHandler returned by Handler.
+// The following tables are emulated:
+//
+// - system.local, describing the Local node;
+// - system.peers and system.peers_v2, describing the Peers;
+// - system_schema.keyspaces, tables, columns and types, describing the keyspaces declared in Schema; views, functions,
+// aggregates, indexes, triggers and dropped_columns are always empty.
+//
+// Queries must be of the form SELECT <*|columns> FROM <table> [WHERE <column> = <value> [AND ...]]; WHERE clauses may
+// only contain equality conditions, with literal values or bind markers. Queries to other system tables are not
+// handled.
+// It is preferable to create SystemTables instances using the constructor function NewSystemTables. The exported
+// fields must not be modified once the handler is in use, except for the Schema contents.
+type SystemTables struct {
+	ClusterName    string
+	ReleaseVersion string
+	CqlVersion     string
+	Partitioner    string
+	// The schema version; if nil, the version of Schema is reported.
+	SchemaVersion *primitive.UUID
+	Local         *SystemNode
+	Peers         []*SystemNode
+	// The schema reported in the system_schema tables; if nil, DefaultSchemaVersion is reported and the system_schema
+	// tables are empty.
+	Schema *Schema
+}
+
+// Creates a new SystemTables for a single-node cluster, with default options and an empty schema. The local node
+// owns the entire ring.
+func NewSystemTables(cluster string, datacenter string) *SystemTables {
+	hostId := DefaultHostId
+	return &SystemTables{
+		ClusterName:    cluster,
+		ReleaseVersion: DefaultReleaseVersion,
+		CqlVersion:     DefaultCqlVersion,
+		Partitioner:    DefaultPartitioner,
+		Local: &SystemNode{
+			Datacenter: datacenter,
+			Rack:       DefaultRack,
+			HostId:     &hostId,
+			Tokens:     []string{DefaultToken},
+		},
+		Schema: NewSchema(),
+	}
+}
+
+// Creates the SystemTables of a single-datacenter cluster whose nodes listen to the given addresses, of the form
+// <ip>:<port>: one SystemTables per node, in the order of the addresses. Each node reports itself in system.local, and
+// the other nodes in system.peers and system.peers_v2; nodes are assigned deterministic host ids and one token each,
+// evenly distributed across the ring, and share the same empty schema. Nodes listening to unspecified addresses, such
+// as 0.0.0.0, report the local address of the client connection instead.
+func NewClusterSystemTables(cluster string, datacenter string, addresses ...string) ([]*SystemTables, error) {
+	var nodes []*SystemNode
+	for i, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %v: %w", address, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %v: %v is not an IP address", address, host)
+		} else if ip.IsUnspecified() {
+			ip = nil
+		}
+		nativePort, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %v: %w", address, err)
+		}
+		hostId := DefaultHostId
+		hostId[14] = byte(i >> 8)
+		hostId[15] = byte(i)
+		nodes = append(nodes, &SystemNode{
+			Address:    ip,
+			NativePort: nativePort,
+			Datacenter: datacenter,
+			Rack:       DefaultRack,
+			HostId:     &hostId,
+			Tokens:     []string{evenlyDistributedToken(i, len(addresses))},
+		})
+	}
+	schema := NewSchema()
+	var tables []*SystemTables
+	for _, node := range nodes {
+		nodeTables := NewSystemTables(cluster, datacenter)
+		nodeTables.Local = node
+		nodeTables.Schema = schema
+		for _, peer := range nodes {
+			if peer != node {
+				nodeTables.Peers = append(nodeTables.Peers, peer)
 			}
 		}
-		return
+		tables = append(tables, nodeTables)
+	}
+	return tables, nil
+}
+
+// Creates a new RequestHandler to handle queries to system tables, using a SystemTables with default options; see
+// NewSystemTables.
+func NewSystemTablesHandler(cluster string, datacenter string) RequestHandler {
+	return NewSystemTables(cluster, datacenter).Handler()
+}
+
+// Returns a RequestHandler answering queries to the emulated system tables.
+func (t *SystemTables) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) *frame.Frame {
+		query, ok := request.Body.Message.(*message.Query)
+		if !ok {
+			return nil
+		}
+		matches := systemQueryPattern.FindStringSubmatch(strings.Join(strings.Fields(query.Query), " "))
+		if matches == nil {
+			return nil
+		}
+		name := strings.ToLower(matches[2]) + "." + strings.ToLower(matches[3])
+		table, found := systemTables[name]
+		if !found {
+			return nil
+		}
+		msg := t.selectRows(table, strings.ToLower(matches[1]), matches[4], query.Options, request.Header.Version, conn)
+		if result, ok := msg.(*message.RowsResult); ok {
+			log.Debug().Msgf("%v: [system tables handler]: returning %v rows from %v", conn, len(result.Data), name)
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
 	}
 }
 
 var (
-	keyColumn              = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "key", Type: datatype.Varchar}
-	broadcastAddressColumn = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "broadcast_address", Type: datatype.Inet}
-	clusterNameColumn      = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "cluster_name", Type: datatype.Varchar}
-	cqlVersionColumn       = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "cql_version", Type: datatype.Varchar}
-	datacenterColumn       = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "data_center", Type: datatype.Varchar}
-	hostIdColumn           = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "host_id", Type: datatype.Uuid}
-	listenAddressColumn    = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "listen_address", Type: datatype.Inet}
-	partitionerColumn      = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "partitioner", Type: datatype.Varchar}
-	rackColumn             = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "rack", Type: datatype.Varchar}
-	releaseVersionColumn   = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "release_version", Type: datatype.Varchar}
-	rpcAddressColumn       = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "rpc_address", Type: datatype.Inet}
-	schemaVersionColumn    = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "schema_version", Type: datatype.Uuid}
-	tokensColumn           = &message.ColumnMetadata{Keyspace: "system", Table: "local", Name: "tokens", Type: datatype.NewSetType(datatype.Varchar)}
+	systemQueryPattern     = regexp.MustCompile(`(?i)^select (.+?) from (system|system_schema)\.(\w+)(?: where (.+?))?(?: allow filtering)?\s*;?$`)
+	systemConditionPattern = regexp.MustCompile(`^(\w+)\s*=\s*(?:'((?:[^']|'')*)'|(\S+))$`)
+	systemAndPattern       = regexp.MustCompile(`(?i)\s+and\s+`)
 )
 
-// These columns are a subset of the total columns returned by OSS C* 3.11.2, and contain all the information that
-// drivers need in order to establish the cluster topology and determine its characteristics.
-var systemLocalColumns = []*message.ColumnMetadata{
-	keyColumn,
-	broadcastAddressColumn,
-	clusterNameColumn,
-	cqlVersionColumn,
-	datacenterColumn,
-	hostIdColumn,
-	listenAddressColumn,
-	partitionerColumn,
-	rackColumn,
-	releaseVersionColumn,
-	rpcAddressColumn,
-	schemaVersionColumn,
-	tokensColumn,
+// systemTable describes an emulated system table: its columns, and a function returning its rows, as maps of column
+// names to values accepted by the column codecs.
+type systemTable struct {
+	columns []*message.ColumnMetadata
+	rows    func(t *SystemTables, conn *CqlServerConnection) []map[string]interface{}
+}
+
+func (t *SystemTables) selectRows(
+	table *systemTable,
+	selection string,
+	where string,
+	options *message.QueryOptions,
+	version primitive.ProtocolVersion,
+	conn *CqlServerConnection,
+) message.Message {
+	if table.columns == nil {
+		return &message.RowsResult{Metadata: &message.RowsMetadata{ColumnCount: 0}, Data: message.RowSet{}}
+	}
+	selected, err := selectColumns(table.columns, selection)
+	if err != nil {
+		return &message.Invalid{ErrorMessage: err.Error()}
+	}
+	filter, err := parseSystemConditions(table.columns, where, options, version)
+	if err != nil {
+		return &message.Invalid{ErrorMessage: err.Error()}
+	}
+	var rows []map[string]interface{}
+	for _, row := range table.rows(t, conn) {
+		if filter.matches(row) {
+			rows = append(rows, row)
+		}
+	}
+	result, err := encodeSystemRows(selected, rows, version)
+	if err != nil {
+		log.Error().Err(err).Msgf("%v: [system tables handler]: could not encode rows", conn)
+		return &message.ServerError{ErrorMessage: err.Error()}
+	}
+	return result
+}
+
+// systemCondition is an equality condition on a column; values are compared encoded, so that values of different Go
+// types, such as UUID values and pointers, or 4-byte and 16-byte IPv4 addresses, are equal if they encode the same.
+type systemCondition struct {
+	column *message.ColumnMetadata
+	value  []byte
+}
+
+type systemConditions []*systemCondition
+
+func (c systemConditions) matches(row map[string]interface{}) bool {
+	for _, condition := range c {
+		value := row[condition.column.Name]
+		if value == nil {
+			return false
+		}
+		encoded, err := valueCodecFor(condition.column.Type).Encode(value, primitive.ProtocolVersion4)
+		if err != nil || !bytes.Equal(encoded, condition.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the given WHERE clause; bind markers are replaced with the positional values from the given options.
+func parseSystemConditions(
+	columns []*message.ColumnMetadata,
+	where string,
+	options *message.QueryOptions,
+	version primitive.ProtocolVersion,
+) (systemConditions, error) {
+	var conditions systemConditions
+	if where == "" {
+		return conditions, nil
+	}
+	boundValues := 0
+	for _, condition := range systemAndPattern.Split(where, -1) {
+		matches := systemConditionPattern.FindStringSubmatch(condition)
+		if matches == nil {
+			return nil, fmt.Errorf("unsupported condition: %v", condition)
+		}
+		column := findColumn(columns, strings.ToLower(matches[1]))
+		if column == nil {
+			return nil, fmt.Errorf("undefined column name %v", matches[1])
+		}
+		codec := valueCodecFor(column.Type)
+		var value interface{}
+		var err error
+		if matches[3] == "?" {
+			if options == nil || boundValues >= len(options.PositionalValues) {
+				return nil, fmt.Errorf("missing value for bind marker %d", boundValues)
+			}
+			value, err = codec.Decode(options.PositionalValues[boundValues].Contents, version)
+			boundValues++
+		} else if matches[3] != "" {
+			value, err = literalValue(matches[3], column.Type, codec)
+		} else {
+			value, err = literalValue(strings.ReplaceAll(matches[2], "''", "'"), column.Type, codec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for column %v: %w", column.Name, err)
+		}
+		// values are normalized by encoding them with the protocol version rows are compared with
+		encoded, err := codec.Encode(value, primitive.ProtocolVersion4)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for column %v: %w", column.Name, err)
+		}
+		conditions = append(conditions, &systemCondition{column, encoded})
+	}
+	return conditions, nil
+}
+
+// Returns the columns designated by the given selection, which is either * or a comma-separated list of column names.
+func selectColumns(columns []*message.ColumnMetadata, selection string) ([]*message.ColumnMetadata, error) {
+	if strings.TrimSpace(selection) == "*" {
+		return columns, nil
+	}
+	var selected []*message.ColumnMetadata
+	for _, name := range strings.Split(selection, ",") {
+		column := findColumn(columns, strings.TrimSpace(name))
+		if column == nil {
+			return nil, fmt.Errorf("undefined column name %v", strings.TrimSpace(name))
+		}
+		selected = append(selected, column)
+	}
+	return selected, nil
+}
+
+func findColumn(columns []*message.ColumnMetadata, name string) *message.ColumnMetadata {
+	for _, column := range columns {
+		if column.Name == name {
+			return column
+		}
+	}
+	return nil
+}
+
+func encodeSystemRows(columns []*message.ColumnMetadata, rows []map[string]interface{}, version primitive.ProtocolVersion) (*message.RowsResult, error) {
+	data := message.RowSet{}
+	for _, values := range rows {
+		row := make(message.Row, len(columns))
+		for i, column := range columns {
+			value := values[column.Name]
+			if value == nil {
+				continue
+			}
+			var err error
+			if row[i], err = valueCodecFor(column.Type).Encode(value, version); err != nil {
+				return nil, fmt.Errorf("cannot encode column %v: %w", column.Name, err)
+			}
+		}
+		data = append(data, row)
+	}
+	return &message.RowsResult{
+		Metadata: &message.RowsMetadata{ColumnCount: int32(len(columns)), Columns: columns},
+		Data:     data,
+	}, nil
+}
+
+func newSystemColumns(keyspace string, table string, namesAndTypes ...interface{}) []*message.ColumnMetadata {
+	var columns []*message.ColumnMetadata
+	for i := 0; i < len(namesAndTypes); i += 2 {
+		columns = append(columns, &message.ColumnMetadata{
+			Keyspace: keyspace,
+			Table:    table,
+			Name:     namesAndTypes[i].(string),
+			Type:     namesAndTypes[i+1].(datatype.DataType),
+		})
+	}
+	return columns
 }
 
 var (
-	keyValue            = message.Column("local")
-	cqlVersionValue     = message.Column("3.4.4")
-	hostIdValue         = message.Column{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB, 0xBC, 0x31, 0x7B, 0xC1, 0x79, 0x6A}
-	partitionerValue    = message.Column("org.apache.cassandra.dht.Murmur3Partitioner")
-	rackValue           = message.Column("rack1")
-	releaseVersionValue = message.Column("3.11.2")
-	schemaVersionValue  = message.Column{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB, 0xBC, 0x31, 0x7B, 0xC1, 0x79, 0x6A}
+	textSet     = datatype.NewSetType(datatype.Varchar)
+	textList    = datatype.NewListType(datatype.Varchar)
+	textTextMap = datatype.NewMapType(datatype.Varchar, datatype.Varchar)
 )
 
-func systemLocalRow(cluster string, datacenter string, addr net.Addr, version primitive.ProtocolVersion) message.Row {
-	addrBuf := &bytes.Buffer{}
-	// TODO replace the serialization code below when data type serialization is implemented
-	inetAddr := addr.(*net.TCPAddr).IP
-	if inetAddr.To4() != nil {
-		addrBuf.Write(inetAddr.To4())
-	} else {
-		addrBuf.Write(inetAddr)
-	}
-	// emulate {'-9223372036854775808'} (entire ring)
-	tokensBuf := &bytes.Buffer{}
-	if version >= primitive.ProtocolVersion3 {
-		_ = primitive.WriteInt(1, tokensBuf)
-		_ = primitive.WriteInt(int32(len("-9223372036854775808")), tokensBuf)
-	} else {
-		_ = primitive.WriteShort(1, tokensBuf)
-		_ = primitive.WriteShort(uint16(len("-9223372036854775808")), tokensBuf)
-	}
-	tokensBuf.WriteString("-9223372036854775808")
-	return message.Row{
-		keyValue,
-		addrBuf.Bytes(),
-		message.Column(cluster),
-		cqlVersionValue,
-		message.Column(datacenter),
-		hostIdValue,
-		addrBuf.Bytes(),
-		partitionerValue,
-		rackValue,
-		releaseVersionValue,
-		addrBuf.Bytes(),
-		schemaVersionValue,
-		tokensBuf.Bytes(),
-	}
-}
-
-func fullSystemLocal(cluster string, datacenter string, request *frame.Frame, conn *CqlServerConnection) *frame.Frame {
-	systemLocalRow := systemLocalRow(cluster, datacenter, conn.LocalAddr(), request.Header.Version)
-	msg := &message.RowsResult{
-		Metadata: &message.RowsMetadata{
-			ColumnCount: int32(len(systemLocalColumns)),
-			Columns:     systemLocalColumns,
-		},
-		Data: message.RowSet{systemLocalRow},
+// The columns of the emulated tables are a subset of the columns of OSS C* 3.11 and 4.0, and contain all the
+// information that drivers need in order to establish the cluster topology and schema.
+var systemTables = map[string]*systemTable{
+	"system.local": {
+		columns: newSystemColumns("system", "local",
+			"key", datatype.Varchar,
+			"broadcast_address", datatype.Inet,
+			"cluster_name", datatype.Varchar,
+			"cql_version", datatype.Varchar,
+			"data_center", datatype.Varchar,
+			"host_id", datatype.Uuid,
+			"listen_address", datatype.Inet,
+			"partitioner", datatype.Varchar,
+			"rack", datatype.Varchar,
+			"release_version", datatype.Varchar,
+			"rpc_address", datatype.Inet,
+			"schema_version", datatype.Uuid,
+			"tokens", textSet,
+		),
+		rows: (*SystemTables).localRows,
+	},
+	"system.peers": {
+		columns: newSystemColumns("system", "peers",
+			"peer", datatype.Inet,
+			"data_center", datatype.Varchar,
+			"host_id", datatype.Uuid,
+			"preferred_ip", datatype.Inet,
+			"rack", datatype.Varchar,
+			"release_version", datatype.Varchar,
+			"rpc_address", datatype.Inet,
+			"schema_version", datatype.Uuid,
+			"tokens", textSet,
+		),
+		rows: (*SystemTables).peerRows,
+	},
+	"system.peers_v2": {
+		columns: newSystemColumns("system", "peers_v2",
+			"peer", datatype.Inet,
+			"peer_port", datatype.Int,
+			"data_center", datatype.Varchar,
+			"host_id", datatype.Uuid,
+			"native_address", datatype.Inet,
+			"native_port", datatype.Int,
+			"preferred_ip", datatype.Inet,
+			"preferred_port", datatype.Int,
+			"rack", datatype.Varchar,
+			"release_version", datatype.Varchar,
+			"schema_version", datatype.Uuid,
+			"tokens", textSet,
+		),
+		rows: (*SystemTables).peerRows,
+	},
+	"system_schema.keyspaces": {
+		columns: newSystemColumns("system_schema", "keyspaces",
+			"keyspace_name", datatype.Varchar,
+			"durable_writes", datatype.Boolean,
+			"replication", textTextMap,
+		),
+		rows: (*SystemTables).keyspaceRows,
+	},
+	"system_schema.tables": {
+		columns: newSystemColumns("system_schema", "tables",
+			"keyspace_name", datatype.Varchar,
+			"table_name", datatype.Varchar,
+			"bloom_filter_fp_chance", datatype.Double,
+			"caching", textTextMap,
+			"comment", datatype.Varchar,
+			"compaction", textTextMap,
+			"compression", textTextMap,
+			"crc_check_chance", datatype.Double,
+			"dclocal_read_repair_chance", datatype.Double,
+			"default_time_to_live", datatype.Int,
+			"extensions", datatype.NewMapType(datatype.Varchar, datatype.Blob),
+			"flags", textSet,
+			"gc_grace_seconds", datatype.Int,
+			"id", datatype.Uuid,
+			"max_index_interval", datatype.Int,
+			"memtable_flush_period_in_ms", datatype.Int,
+			"min_index_interval", datatype.Int,
+			"read_repair_chance", datatype.Double,
+			"speculative_retry", datatype.Varchar,
+		),
+		rows: (*SystemTables).tableRows,
+	},
+	"system_schema.columns": {
+		columns: newSystemColumns("system_schema", "columns",
+			"keyspace_name", datatype.Varchar,
+			"table_name", datatype.Varchar,
+			"column_name", datatype.Varchar,
+			"clustering_order", datatype.Varchar,
+			"column_name_bytes", datatype.Blob,
+			"kind", datatype.Varchar,
+			"position", datatype.Int,
+			"type", datatype.Varchar,
+		),
+		rows: (*SystemTables).columnRows,
+	},
+	"system_schema.types": {
+		columns: newSystemColumns("system_schema", "types",
+			"keyspace_name", datatype.Varchar,
+			"type_name", datatype.Varchar,
+			"field_names", textList,
+			"field_types", textList,
+		),
+		rows: (*SystemTables).typeRows,
+	},
+	"system_schema.views":           {},
+	"system_schema.functions":       {},
+	"system_schema.aggregates":      {},
+	"system_schema.indexes":         {},
+	"system_schema.triggers":        {},
+	"system_schema.dropped_columns": {},
+}
+
+func (t *SystemTables) schemaVersion() *primitive.UUID {
+	if t.SchemaVersion != nil {
+		return t.SchemaVersion
+	}
+	if t.Schema != nil {
+		return t.Schema.Version()
 	}
-	return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	version := DefaultSchemaVersion
+	return &version
 }
 
-func schemaVersion(request *frame.Frame) *frame.Frame {
-	msg := &message.RowsResult{
-		Metadata: &message.RowsMetadata{
-			ColumnCount: 1,
-			Columns:     []*message.ColumnMetadata{schemaVersionColumn},
-		},
-		Data: message.RowSet{message.Row{schemaVersionValue}},
+func (t *SystemTables) keyspaces() []*SchemaKeyspace {
+	if t.Schema == nil {
+		return nil
 	}
-	return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	return t.Schema.Keyspaces()
 }
 
-func clusterName(cluster string, request *frame.Frame) *frame.Frame {
-	msg := &message.RowsResult{
-		Metadata: &message.RowsMetadata{
-			ColumnCount: 1,
-			Columns:     []*message.ColumnMetadata{clusterNameColumn},
-		},
-		Data: message.RowSet{message.Row{message.Column(cluster)}},
+func (t *SystemTables) releaseVersion(node *SystemNode) string {
+	if node.ReleaseVersion != "" {
+		return node.ReleaseVersion
+	}
+	return t.ReleaseVersion
+}
+
+func nodeTokens(node *SystemNode) []string {
+	if len(node.Tokens) == 0 {
+		return []string{DefaultToken}
+	}
+	return node.Tokens
+}
+
+func nodeNativePort(node *SystemNode, conn *CqlServerConnection) int32 {
+	if node.NativePort != 0 {
+		return int32(node.NativePort)
+	} else if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return int32(addr.Port)
+	}
+	return 0
+}
+
+// Returns the IP address as an interface value, mapping nil addresses to nil interface values, so that they are
+// reported as nulls.
+func nodeAddress(address net.IP) interface{} {
+	if address == nil {
+		return nil
+	}
+	return address
+}
+
+// Returns the host id as an interface value, mapping nil host ids to nil interface values, so that they are reported
+// as nulls.
+func nodeHostId(hostId *primitive.UUID) interface{} {
+	if hostId == nil {
+		return nil
+	}
+	return hostId
+}
+
+func (t *SystemTables) localRows(conn *CqlServerConnection) []map[string]interface{} {
+	local := t.Local
+	if local == nil {
+		local = &SystemNode{}
+	}
+	address := local.Address
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && address == nil {
+		address = addr.IP
 	}
-	return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	return []map[string]interface{}{{
+		"key":               "local",
+		"broadcast_address": nodeAddress(address),
+		"cluster_name":      t.ClusterName,
+		"cql_version":       t.CqlVersion,
+		"data_center":       local.Datacenter,
+		"host_id":           nodeHostId(local.HostId),
+		"listen_address":    nodeAddress(address),
+		"partitioner":       t.Partitioner,
+		"rack":              local.Rack,
+		"release_version":   t.releaseVersion(local),
+		"rpc_address":       nodeAddress(address),
+		"schema_version":    t.schemaVersion(),
+		"tokens":            nodeTokens(local),
+	}}
 }
 
-func emptySystemPeers(request *frame.Frame) *frame.Frame {
-	msg := &message.RowsResult{
-		Metadata: &message.RowsMetadata{ColumnCount: 0},
-		Data:     message.RowSet{},
+// Returns the rows of system.peers and system.peers_v2; columns that do not exist in a table are ignored.
+func (t *SystemTables) peerRows(conn *CqlServerConnection) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, peer := range t.Peers {
+		rows = append(rows, map[string]interface{}{
+			"peer":            nodeAddress(peer.Address),
+			"peer_port":       int32(7000),
+			"data_center":     peer.Datacenter,
+			"host_id":         nodeHostId(peer.HostId),
+			"native_address":  nodeAddress(peer.Address),
+			"native_port":     nodeNativePort(peer, conn),
+			"rack":            peer.Rack,
+			"release_version": t.releaseVersion(peer),
+			"rpc_address":     nodeAddress(peer.Address),
+			"schema_version":  t.schemaVersion(),
+			"tokens":          nodeTokens(peer),
+		})
+	}
+	return rows
+}
+
+func (t *SystemTables) keyspaceRows(_ *CqlServerConnection) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, keyspace := range t.keyspaces() {
+		replication := keyspace.Replication
+		if replication == nil {
+			replication = map[string]string{
+				"class":              "org.apache.cassandra.locator.SimpleStrategy",
+				"replication_factor": "1",
+			}
+		}
+		rows = append(rows, map[string]interface{}{
+			"keyspace_name":  keyspace.Name,
+			"durable_writes": 1,
+			"replication":    replication,
+		})
+	}
+	return rows
+}
+
+func (t *SystemTables) tableRows(_ *CqlServerConnection) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, keyspace := range t.keyspaces() {
+		for _, table := range keyspace.Tables {
+			id := table.Id
+			if id == nil {
+				nameBased := nameBasedUuid(keyspace.Name, table.Name)
+				id = &nameBased
+			}
+			// options are the defaults of OSS C* 3.11
+			rows = append(rows, map[string]interface{}{
+				"keyspace_name":          keyspace.Name,
+				"table_name":             table.Name,
+				"bloom_filter_fp_chance": 0.01,
+				"caching":                map[string]string{"keys": "ALL", "rows_per_partition": "NONE"},
+				"comment":                "",
+				"compaction": map[string]string{
+					"class":         "org.apache.cassandra.db.compaction.SizeTieredCompactionStrategy",
+					"max_threshold": "32",
+					"min_threshold": "4",
+				},
+				"compression": map[string]string{
+					"chunk_length_in_kb": "64",
+					"class":              "org.apache.cassandra.io.compress.LZ4Compressor",
+				},
+				"crc_check_chance":            1.0,
+				"dclocal_read_repair_chance":  0.1,
+				"default_time_to_live":        int32(0),
+				"extensions":                  map[string][]byte{},
+				"flags":                       []string{"compound"},
+				"gc_grace_seconds":            int32(864000),
+				"id":                          id,
+				"max_index_interval":          int32(2048),
+				"memtable_flush_period_in_ms": int32(0),
+				"min_index_interval":          int32(128),
+				"read_repair_chance":          0.0,
+				"speculative_retry":           "99PERCENTILE",
+			})
+		}
+	}
+	return rows
+}
+
+func (t *SystemTables) columnRows(_ *CqlServerConnection) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, keyspace := range t.keyspaces() {
+		for _, table := range keyspace.Tables {
+			row := func(column *SchemaColumn, kind string, position int32, clusteringOrder string) {
+				rows = append(rows, map[string]interface{}{
+					"keyspace_name":     keyspace.Name,
+					"table_name":        table.Name,
+					"column_name":       column.Name,
+					"clustering_order":  clusteringOrder,
+					"column_name_bytes": []byte(column.Name),
+					"kind":              kind,
+					"position":          position,
+					"type":              datatype.FormatDataType(column.Type),
+				})
+			}
+			for i, column := range table.PartitionKey {
+				row(column, "partition_key", int32(i), "none")
+			}
+			for i, column := range table.ClusteringColumns {
+				if column.Descending {
+					row(column, "clustering", int32(i), "desc")
+				} else {
+					row(column, "clustering", int32(i), "asc")
+				}
+			}
+			for _, column := range table.Columns {
+				if column.Static {
+					row(column, "static", -1, "none")
+				} else {
+					row(column, "regular", -1, "none")
+				}
+			}
+		}
+	}
+	return rows
+}
+
+func (t *SystemTables) typeRows(_ *CqlServerConnection) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, keyspace := range t.keyspaces() {
+		for _, udt := range keyspace.Types {
+			var fieldTypes []string
+			for _, fieldType := range udt.FieldTypes {
+				fieldTypes = append(fieldTypes, datatype.FormatDataType(fieldType))
+			}
+			rows = append(rows, map[string]interface{}{
+				"keyspace_name": keyspace.Name,
+				"type_name":     udt.Name,
+				"field_names":   udt.FieldNames,
+				"field_types":   fieldTypes,
+			})
+		}
 	}
-	return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	return rows
 }
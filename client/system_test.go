@@ -16,11 +16,16 @@ package client_test
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
 	"github.com/datastax/go-cassandra-native-protocol/frame"
 	"github.com/datastax/go-cassandra-native-protocol/message"
 	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
 	"testing"
 )
 
@@ -154,7 +159,199 @@ func testSystemPeers(t *testing.T, clientConn *client.CqlClientConnection) {
 	require.IsType(t, &message.RowsResult{}, response.Body.Message)
 
 	rowsResult := response.Body.Message.(*message.RowsResult)
-	require.EqualValues(t, rowsResult.Metadata.ColumnCount, 0)
-	require.Nil(t, rowsResult.Metadata.Columns)
+	require.EqualValues(t, rowsResult.Metadata.ColumnCount, 9)
+	require.Len(t, rowsResult.Metadata.Columns, 9)
+	require.Equal(t, "peer", rowsResult.Metadata.Columns[0].Name)
 	require.Len(t, rowsResult.Data, 0)
 }
+
+func TestSystemTables_Peers(t *testing.T) {
+	tables := client.NewSystemTables("cluster_test", "dc1")
+	tables.ReleaseVersion = "4.0.0"
+	tables.Local.Tokens = []string{"-100"}
+	tables.Peers = []*client.SystemNode{
+		{Address: net.ParseIP("127.0.0.2"), Datacenter: "dc1", Rack: "rack2", Tokens: []string{"0"}},
+		{Address: net.ParseIP("127.0.0.3"), NativePort: 9044, Datacenter: "dc2", Rack: "rack1", Tokens: []string{"100"}, ReleaseVersion: "3.11.9"},
+	}
+	server, clientConn, cancelFunc := createServerAndClient(t, tables.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFunc()
+
+	local := querySystemTables(t, clientConn, "SELECT release_version, tokens FROM system.local")
+	require.Len(t, local.Data, 1)
+	assert.Equal(t, "4.0.0", string(local.Data[0][0]))
+	tokens, err := datatype.NewSetCodec(&datatype.VarcharCodec{}).Decode(local.Data[0][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"-100"}, tokens)
+
+	peers := querySystemTables(t, clientConn, "SELECT native_address, native_port, data_center, release_version, host_id FROM system.peers_v2")
+	require.Len(t, peers.Data, 2)
+	assert.Equal(t, []byte{127, 0, 0, 2}, []byte(peers.Data[0][0]))
+	port, err := (&datatype.IntCodec{}).Decode(peers.Data[0][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, int32(9043), port)
+	assert.Equal(t, "4.0.0", string(peers.Data[0][3]))
+	assert.Nil(t, peers.Data[0][4])
+	port, err = (&datatype.IntCodec{}).Decode(peers.Data[1][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, int32(9044), port)
+	assert.Equal(t, "dc2", string(peers.Data[1][2]))
+	assert.Equal(t, "3.11.9", string(peers.Data[1][3]))
+
+	filtered := querySystemTables(t, clientConn, "SELECT peer FROM system.peers WHERE peer = '127.0.0.3'")
+	require.Len(t, filtered.Data, 1)
+	assert.Equal(t, []byte{127, 0, 0, 3}, []byte(filtered.Data[0][0]))
+
+	// UUID values are compared by value, whether literal or bound
+	hostId := primitive.UUID{0xC0, 0xD1, 0xD2, 0x1E, 0xBB, 0x01, 0x41, 0x96, 0x86, 0xDB, 0xBC, 0x31, 0x7B, 0xC1, 0x79, 0x01}
+	tables.Peers[1].HostId = &hostId
+	filtered = querySystemTables(t, clientConn, fmt.Sprintf("SELECT peer FROM system.peers WHERE host_id = %v", &hostId))
+	require.Len(t, filtered.Data, 1)
+	assert.Equal(t, []byte{127, 0, 0, 3}, []byte(filtered.Data[0][0]))
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query:   "SELECT peer FROM system.peers WHERE host_id = ?",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(hostId.Bytes())}},
+	}))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	filtered = response.Body.Message.(*message.RowsResult)
+	require.Len(t, filtered.Data, 1)
+	assert.Equal(t, []byte{127, 0, 0, 3}, []byte(filtered.Data[0][0]))
+	bound, err := (&datatype.InetCodec{}).Encode(net.ParseIP("127.0.0.2"), primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query:   "SELECT rack FROM system.peers WHERE peer = ?",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(bound)}},
+	}))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.Equal(t, message.RowSet{{[]byte("rack2")}}, response.Body.Message.(*message.RowsResult).Data)
+
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: "SELECT nonexistent FROM system.peers"}))
+	require.Nil(t, err)
+	assert.IsType(t, &message.Invalid{}, response.Body.Message)
+}
+
+func TestNewClusterSystemTables(t *testing.T) {
+	tables, err := client.NewClusterSystemTables("cluster_test", "dc1", "127.0.0.1:9043", "127.0.0.2:9044", "127.0.0.3:9045")
+	require.Nil(t, err)
+	require.Len(t, tables, 3)
+	hostIds := make(map[primitive.UUID]bool)
+	for i, nodeTables := range tables {
+		assert.Equal(t, net.ParseIP(fmt.Sprintf("127.0.0.%d", i+1)), nodeTables.Local.Address)
+		assert.Equal(t, 9043+i, nodeTables.Local.NativePort)
+		assert.Same(t, tables[0].Schema, nodeTables.Schema)
+		hostIds[*nodeTables.Local.HostId] = true
+		require.Len(t, nodeTables.Peers, 2)
+		for _, peer := range nodeTables.Peers {
+			assert.NotSame(t, nodeTables.Local, peer)
+		}
+	}
+	assert.Len(t, hostIds, 3)
+	assert.Equal(t, []string{client.DefaultToken}, tables[0].Local.Tokens)
+
+	// the first node reports the others as peers
+	server, clientConn, cancelFunc := createServerAndClient(t, tables[0].Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFunc()
+	peers := querySystemTables(t, clientConn, "SELECT native_address, native_port FROM system.peers_v2")
+	require.Len(t, peers.Data, 2)
+	assert.Equal(t, []byte{127, 0, 0, 2}, []byte(peers.Data[0][0]))
+	port, err := (&datatype.IntCodec{}).Decode(peers.Data[1][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, int32(9045), port)
+
+	_, err = client.NewClusterSystemTables("cluster_test", "dc1", "localhost:9042")
+	assert.NotNil(t, err)
+	tables, err = client.NewClusterSystemTables("cluster_test", "dc1", "0.0.0.0:9042")
+	require.Nil(t, err)
+	assert.Nil(t, tables[0].Local.Address)
+}
+
+func TestSystemTables_Schema(t *testing.T) {
+	tables := client.NewSystemTables("cluster_test", "dc1")
+	tables.Schema.PutKeyspace(&client.SchemaKeyspace{
+		Name:        "ks1",
+		Replication: map[string]string{"class": "org.apache.cassandra.locator.NetworkTopologyStrategy", "dc1": "3"},
+		Tables: []*client.SchemaTable{{
+			Name:              "table1",
+			PartitionKey:      []*client.SchemaColumn{{Name: "pk", Type: datatype.Int}},
+			ClusteringColumns: []*client.SchemaColumn{{Name: "cc", Type: datatype.Timestamp, Descending: true}},
+			Columns: []*client.SchemaColumn{
+				{Name: "s", Type: datatype.Varchar, Static: true},
+				{Name: "v", Type: datatype.NewMapType(datatype.Varchar, datatype.NewListType(datatype.Int))},
+			},
+		}},
+		Types: []*client.SchemaType{{
+			Name:       "address",
+			FieldNames: []string{"street", "zip"},
+			FieldTypes: []datatype.DataType{datatype.Varchar, datatype.Int},
+		}},
+	})
+	tables.Schema.PutKeyspace(&client.SchemaKeyspace{Name: "ks2"})
+	server, clientConn, cancelFunc := createServerAndClient(t, tables.Handler())
+	defer checkClosed(t, clientConn, server)
+	defer cancelFunc()
+
+	version := querySystemTables(t, clientConn, "SELECT schema_version FROM system.local")
+	assert.Equal(t, tables.Schema.Version().Bytes(), []byte(version.Data[0][0]))
+	assert.NotEqual(t, client.DefaultSchemaVersion.Bytes(), []byte(version.Data[0][0]))
+
+	keyspaces := querySystemTables(t, clientConn, "SELECT * FROM system_schema.keyspaces")
+	require.Len(t, keyspaces.Data, 2)
+	assert.Equal(t, "ks1", string(keyspaces.Data[0][0]))
+	replication, err := datatype.NewMapCodec(&datatype.VarcharCodec{}, &datatype.VarcharCodec{}).Decode(keyspaces.Data[1][2], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "1"}, replication)
+
+	schemaTables := querySystemTables(t, clientConn, "SELECT keyspace_name, table_name, id FROM system_schema.tables WHERE keyspace_name = 'ks1'")
+	require.Len(t, schemaTables.Data, 1)
+	assert.Equal(t, "table1", string(schemaTables.Data[0][1]))
+	assert.Len(t, schemaTables.Data[0][2], 16)
+
+	// bind markers are replaced with positional values
+	ks1, err := (&datatype.VarcharCodec{}).Encode("ks1", primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query:   "SELECT column_name, kind, position, type, clustering_order FROM system_schema.columns WHERE keyspace_name = ? AND table_name = 'table1'",
+		Options: &message.QueryOptions{PositionalValues: []*primitive.Value{primitive.NewValue(ks1)}},
+	}))
+	require.Nil(t, err)
+	columns := response.Body.Message.(*message.RowsResult)
+	require.Len(t, columns.Data, 4)
+	var actual [][]string
+	for _, row := range columns.Data {
+		position, err := (&datatype.IntCodec{}).Decode(row[2], primitive.ProtocolVersion4)
+		require.Nil(t, err)
+		actual = append(actual, []string{string(row[0]), string(row[1]), strconv.Itoa(int(position.(int32))), string(row[3]), string(row[4])})
+	}
+	assert.Equal(t, [][]string{
+		{"pk", "partition_key", "0", "int", "none"},
+		{"cc", "clustering", "0", "timestamp", "desc"},
+		{"s", "static", "-1", "text", "none"},
+		{"v", "regular", "-1", "map<text, frozen<list<int>>>", "none"},
+	}, actual)
+
+	types := querySystemTables(t, clientConn, "SELECT type_name, field_types FROM system_schema.types WHERE keyspace_name = 'ks1'")
+	require.Len(t, types.Data, 1)
+	assert.Equal(t, "address", string(types.Data[0][0]))
+	fieldTypes, err := datatype.NewListCodec(&datatype.VarcharCodec{}).Decode(types.Data[0][1], primitive.ProtocolVersion4)
+	require.Nil(t, err)
+	assert.Equal(t, []interface{}{"text", "int"}, fieldTypes)
+
+	assert.Empty(t, querySystemTables(t, clientConn, "SELECT * FROM system_schema.tables WHERE keyspace_name = 'ks2'").Data)
+	assert.Empty(t, querySystemTables(t, clientConn, "SELECT * FROM system_schema.functions").Data)
+
+	// schema changes are reflected immediately
+	require.True(t, tables.Schema.RemoveKeyspace("ks2"))
+	assert.Len(t, querySystemTables(t, clientConn, "SELECT keyspace_name FROM system_schema.keyspaces").Data, 1)
+	version = querySystemTables(t, clientConn, "SELECT schema_version FROM system.local")
+	assert.Equal(t, tables.Schema.Version().Bytes(), []byte(version.Data[0][0]))
+}
+
+func querySystemTables(t *testing.T, clientConn *client.CqlClientConnection, query string) *message.RowsResult {
+	response, err := clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{Query: query}))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	return response.Body.Message.(*message.RowsResult)
+}
@@ -0,0 +1,513 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/datatype"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/rs/zerolog/log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The default maximum number of trace sessions kept by a QueryTracer.
+	DefaultMaxTraceSessions = 1000
+	// The interval between two attempts to retrieve a trace session that is not complete yet; see
+	// CqlClientConnection.RetrieveQueryTrace.
+	DefaultTraceRetrievalInterval = 3 * time.Millisecond
+)
+
+// QueryTrace is the trace of a request executed with tracing enabled, as stored in the system_traces.sessions and
+// system_traces.events tables.
+type QueryTrace struct {
+	// The trace session id, which is also the tracing id of the response.
+	SessionId primitive.UUID
+	// The client address.
+	Client net.IP
+	// The command, always QUERY for CQL requests.
+	Command string
+	// The address of the node that coordinated the request.
+	Coordinator net.IP
+	// The time it took the coordinator to execute the request.
+	Duration time.Duration
+	// The request parameters, such as the query string and the consistency level.
+	Parameters map[string]string
+	// A description of the request, e.g. "Execute CQL3 query".
+	Request string
+	// The time at which the coordinator started executing the request.
+	StartedAt time.Time
+	// The events that occurred while executing the request.
+	Events []*TraceEvent
+}
+
+// TraceEvent is an event of a QueryTrace, as stored in the system_traces.events table.
+type TraceEvent struct {
+	// The event id, a time-based UUID.
+	EventId primitive.UUID
+	// A description of the event.
+	Activity string
+	// The address of the node where the event occurred.
+	Source net.IP
+	// The time elapsed on the source node since it started processing the request, when the event occurred.
+	SourceElapsed time.Duration
+	// The name of the thread that recorded the event.
+	Thread string
+}
+
+// QueryTracer emulates query tracing. The Middleware returned by Middleware assigns a tracing id to the responses of
+// QUERY, PREPARE, EXECUTE and BATCH requests that have the tracing flag set, see frame.Frame.RequestTracingId, and
+// records a trace session for them; the RequestHandler returned by Handler answers queries to the
+// system_traces.sessions and system_traces.events tables with the recorded sessions. Sessions are reported as
+// complete (that is, with a non-null duration) only after CompletionDelay, which allows to test how clients poll
+// for incomplete traces. Queries must be of the form SELECT <*|columns> FROM system_traces.<sessions|events>
+// [WHERE <column> = <value> [AND ...]], as for SystemTables.
+// It is preferable to create QueryTracer instances using the constructor function NewQueryTracer.
+type QueryTracer struct {
+	// The address reported as coordinator and as source of the events. If nil, the server connection local address
+	// is reported.
+	Coordinator net.IP
+	// The delay after which trace sessions are reported as complete, once the traced request was handled.
+	CompletionDelay time.Duration
+	// The maximum number of trace sessions to keep; when exceeded, the oldest sessions are discarded.
+	MaxSessions int
+
+	sessions map[primitive.UUID]*traceSession
+	order    []primitive.UUID
+	lock     *sync.Mutex
+}
+
+// traceSession is a QueryTrace recorded by a QueryTracer, along with the time at which it should be reported as
+// complete.
+type traceSession struct {
+	trace       *QueryTrace
+	completedAt time.Time
+}
+
+// Creates a new QueryTracer with default options.
+func NewQueryTracer() *QueryTracer {
+	return &QueryTracer{
+		MaxSessions: DefaultMaxTraceSessions,
+		sessions:    make(map[primitive.UUID]*traceSession),
+		lock:        &sync.Mutex{},
+	}
+}
+
+// Returns the trace recorded for the given session id, or nil if no such trace exists. The returned trace must not
+// be modified.
+func (t *QueryTracer) Trace(sessionId primitive.UUID) *QueryTrace {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if session, found := t.sessions[sessionId]; found {
+		return session.trace
+	}
+	return nil
+}
+
+// Returns a Middleware tracing the requests that have the tracing flag set, when the next handler handles them. The
+// tracing id is set on all the response frames, including those sent beforehand by handlers replying with multiple
+// frames.
+func (t *QueryTracer) Middleware() Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(request *frame.Frame, conn *CqlServerConnection, ctx RequestHandlerContext) *frame.Frame {
+			if !request.Header.Flags.Contains(primitive.HeaderFlagTracing) || traceRequest(request.Body.Message) == "" {
+				return next(request, conn, ctx)
+			}
+			start := time.Now()
+			sessionId := timeBasedUuid(start)
+			var response *frame.Frame
+			conn.InterceptResponses(request, func(sent *frame.Frame) *frame.Frame {
+				return withTracingId(sent, &sessionId)
+			}, func() {
+				response = next(request, conn, ctx)
+			})
+			if response == nil {
+				return nil
+			}
+			t.record(sessionId, request, conn, start, time.Since(start))
+			log.Debug().Msgf("%v: [query tracer]: traced request %v with session id %v", conn, request, &sessionId)
+			return withTracingId(response, &sessionId)
+		}
+	}
+}
+
+// Returns a RequestHandler answering queries to the system_traces.sessions and system_traces.events tables.
+func (t *QueryTracer) Handler() RequestHandler {
+	return func(request *frame.Frame, conn *CqlServerConnection, _ RequestHandlerContext) *frame.Frame {
+		query, ok := request.Body.Message.(*message.Query)
+		if !ok {
+			return nil
+		}
+		matches := traceQueryPattern.FindStringSubmatch(strings.Join(strings.Fields(query.Query), " "))
+		if matches == nil {
+			return nil
+		}
+		var columns []*message.ColumnMetadata
+		var rows []map[string]interface{}
+		switch strings.ToLower(matches[2]) {
+		case "sessions":
+			columns, rows = traceSessionColumns, t.sessionRows(time.Now())
+		case "events":
+			columns, rows = traceEventColumns, t.eventRows()
+		default:
+			return nil
+		}
+		msg := selectTraceRows(columns, rows, matches[1], matches[3], query.Options, request.Header.Version, conn)
+		if result, ok := msg.(*message.RowsResult); ok {
+			log.Debug().Msgf("%v: [query tracer]: returning %v rows from system_traces.%v", conn, len(result.Data), strings.ToLower(matches[2]))
+		}
+		return frame.NewFrame(request.Header.Version, request.Header.StreamId, msg)
+	}
+}
+
+var traceQueryPattern = regexp.MustCompile(`(?i)^select (.+?) from system_traces\.(\w+)(?: where (.+?))?(?: allow filtering)?\s*;?$`)
+
+var (
+	traceSessionColumns = newSystemColumns("system_traces", "sessions",
+		"session_id", datatype.Uuid,
+		"client", datatype.Inet,
+		"command", datatype.Varchar,
+		"coordinator", datatype.Inet,
+		"duration", datatype.Int,
+		"parameters", textTextMap,
+		"request", datatype.Varchar,
+		"started_at", datatype.Timestamp,
+	)
+	traceEventColumns = newSystemColumns("system_traces", "events",
+		"session_id", datatype.Uuid,
+		"event_id", datatype.Timeuuid,
+		"activity", datatype.Varchar,
+		"source", datatype.Inet,
+		"source_elapsed", datatype.Int,
+		"thread", datatype.Varchar,
+	)
+)
+
+func selectTraceRows(
+	columns []*message.ColumnMetadata,
+	rows []map[string]interface{},
+	selection string,
+	where string,
+	options *message.QueryOptions,
+	version primitive.ProtocolVersion,
+	conn *CqlServerConnection,
+) message.Message {
+	selected, err := selectColumns(columns, selection)
+	if err != nil {
+		return &message.Invalid{ErrorMessage: err.Error()}
+	}
+	filter, err := parseSystemConditions(columns, where, options, version)
+	if err != nil {
+		return &message.Invalid{ErrorMessage: err.Error()}
+	}
+	var matching []map[string]interface{}
+	for _, row := range rows {
+		if filter.matches(row) {
+			matching = append(matching, row)
+		}
+	}
+	result, err := encodeSystemRows(selected, matching, version)
+	if err != nil {
+		log.Error().Err(err).Msgf("%v: [query tracer]: could not encode rows", conn)
+		return &message.ServerError{ErrorMessage: err.Error()}
+	}
+	return result
+}
+
+func (t *QueryTracer) record(
+	sessionId primitive.UUID,
+	request *frame.Frame,
+	conn *CqlServerConnection,
+	start time.Time,
+	duration time.Duration,
+) {
+	coordinator := t.Coordinator
+	if coordinator == nil {
+		coordinator = addressIP(conn.LocalAddr())
+	}
+	trace := &QueryTrace{
+		SessionId:   sessionId,
+		Client:      addressIP(conn.RemoteAddr()),
+		Command:     "QUERY",
+		Coordinator: coordinator,
+		Duration:    duration,
+		Parameters:  traceParameters(request.Body.Message),
+		Request:     traceRequest(request.Body.Message),
+		StartedAt:   start,
+	}
+	activities := traceActivities(request.Body.Message)
+	for i, activity := range activities {
+		elapsed := duration * time.Duration(i+1) / time.Duration(len(activities))
+		trace.Events = append(trace.Events, &TraceEvent{
+			EventId:       timeBasedUuid(start.Add(elapsed)),
+			Activity:      activity,
+			Source:        coordinator,
+			SourceElapsed: elapsed,
+			Thread:        "Native-Transport-Requests-1",
+		})
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sessions[sessionId] = &traceSession{trace: trace, completedAt: start.Add(duration + t.CompletionDelay)}
+	t.order = append(t.order, sessionId)
+	for t.MaxSessions > 0 && len(t.order) > t.MaxSessions {
+		delete(t.sessions, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (t *QueryTracer) sessionRows(now time.Time) []map[string]interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var rows []map[string]interface{}
+	for _, sessionId := range t.order {
+		session := t.sessions[sessionId]
+		trace := session.trace
+		var duration interface{}
+		if !now.Before(session.completedAt) {
+			duration = int32(trace.Duration / time.Microsecond)
+		}
+		rows = append(rows, map[string]interface{}{
+			"session_id":  &trace.SessionId,
+			"client":      trace.Client,
+			"command":     trace.Command,
+			"coordinator": trace.Coordinator,
+			"duration":    duration,
+			"parameters":  trace.Parameters,
+			"request":     trace.Request,
+			"started_at":  trace.StartedAt.UnixNano() / int64(time.Millisecond),
+		})
+	}
+	return rows
+}
+
+func (t *QueryTracer) eventRows() []map[string]interface{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var rows []map[string]interface{}
+	for _, sessionId := range t.order {
+		trace := t.sessions[sessionId].trace
+		for _, event := range trace.Events {
+			rows = append(rows, map[string]interface{}{
+				"session_id":     &trace.SessionId,
+				"event_id":       &event.EventId,
+				"activity":       event.Activity,
+				"source":         event.Source,
+				"source_elapsed": int32(event.SourceElapsed / time.Microsecond),
+				"thread":         event.Thread,
+			})
+		}
+	}
+	return rows
+}
+
+// Returns the description of the given request in trace sessions, or an empty string if the request cannot be traced.
+func traceRequest(msg message.Message) string {
+	switch msg.(type) {
+	case *message.Query:
+		return "Execute CQL3 query"
+	case *message.Prepare:
+		return "Preparing CQL3 query"
+	case *message.Execute:
+		return "Execute CQL3 prepared query"
+	case *message.Batch:
+		return "Execute batch of CQL3 queries"
+	}
+	return ""
+}
+
+func traceParameters(msg message.Message) map[string]string {
+	parameters := make(map[string]string)
+	var options *message.QueryOptions
+	switch msg := msg.(type) {
+	case *message.Query:
+		parameters["query"] = msg.Query
+		options = msg.Options
+	case *message.Prepare:
+		parameters["query"] = msg.Query
+	case *message.Execute:
+		options = msg.Options
+	case *message.Batch:
+		parameters["consistency_level"] = consistencyName(msg.Consistency)
+	}
+	if options != nil {
+		parameters["consistency_level"] = consistencyName(options.Consistency)
+		if options.PageSize > 0 {
+			parameters["page_size"] = fmt.Sprint(options.PageSize)
+		}
+	}
+	return parameters
+}
+
+func traceActivities(msg message.Message) []string {
+	switch msg := msg.(type) {
+	case *message.Query:
+		return []string{"Parsing " + msg.Query, "Preparing statement", "Executing query"}
+	case *message.Prepare:
+		return []string{"Parsing " + msg.Query, "Preparing statement"}
+	case *message.Execute:
+		return []string{"Executing prepared statement"}
+	case *message.Batch:
+		return []string{fmt.Sprintf("Executing batch of %d statements", len(msg.Children))}
+	}
+	return nil
+}
+
+func addressIP(address net.Addr) net.IP {
+	if tcpAddress, ok := address.(*net.TCPAddr); ok {
+		return tcpAddress.IP
+	}
+	return nil
+}
+
+// Returns a copy of the given frame with the given tracing id.
+func withTracingId(f *frame.Frame, tracingId *primitive.UUID) *frame.Frame {
+	body := *f.Body
+	traced := &frame.Frame{Header: f.Header.Clone(), Body: &body}
+	traced.SetTracingId(tracingId)
+	return traced
+}
+
+// Retrieves the trace of the request whose response had the given tracing id, see frame.Body.TracingId, by querying
+// the system_traces.sessions and system_traces.events tables. Traces are written asynchronously by the server: while
+// the trace session is not found or not complete yet, the tables are polled again every
+// DefaultTraceRetrievalInterval, until the given context is done. Use a context with a deadline to bound the
+// retrieval time.
+func (c *CqlClientConnection) RetrieveQueryTrace(
+	ctx context.Context,
+	version primitive.ProtocolVersion,
+	tracingId *primitive.UUID,
+) (*QueryTrace, error) {
+	if tracingId == nil {
+		return nil, fmt.Errorf("%v: tracing id cannot be nil", c)
+	}
+	for {
+		if trace, err := c.retrieveTraceSession(ctx, version, tracingId); err != nil {
+			return nil, err
+		} else if trace != nil {
+			if trace.Events, err = c.retrieveTraceEvents(ctx, version, tracingId); err != nil {
+				return nil, err
+			}
+			log.Debug().Msgf("%v: retrieved trace %v with %v events", c, tracingId, len(trace.Events))
+			return trace, nil
+		}
+		log.Debug().Msgf("%v: trace %v not complete, retrying in %v", c, tracingId, DefaultTraceRetrievalInterval)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%v: trace %v not complete: %w", c, tracingId, ctx.Err())
+		case <-time.After(DefaultTraceRetrievalInterval):
+		}
+	}
+}
+
+// Returns the trace session with the given id, without events, or nil if the session does not exist or is not
+// complete.
+func (c *CqlClientConnection) retrieveTraceSession(
+	ctx context.Context,
+	version primitive.ProtocolVersion,
+	sessionId *primitive.UUID,
+) (*QueryTrace, error) {
+	rows, err := c.queryTraceRows(ctx, version, "SELECT * FROM system_traces.sessions WHERE session_id = ?", sessionId)
+	if err != nil {
+		return nil, err
+	} else if len(rows) == 0 || rows[0]["duration"] == nil {
+		return nil, nil
+	}
+	row := rows[0]
+	trace := &QueryTrace{SessionId: *sessionId, Parameters: make(map[string]string)}
+	trace.Client, _ = row["client"].(net.IP)
+	trace.Command, _ = row["command"].(string)
+	trace.Coordinator, _ = row["coordinator"].(net.IP)
+	duration, _ := row["duration"].(int32)
+	trace.Duration = time.Duration(duration) * time.Microsecond
+	parameters, _ := row["parameters"].(map[interface{}]interface{})
+	for key, value := range parameters {
+		trace.Parameters[fmt.Sprint(key)] = fmt.Sprint(value)
+	}
+	trace.Request, _ = row["request"].(string)
+	if startedAt, ok := row["started_at"].(int64); ok {
+		trace.StartedAt = time.Unix(0, startedAt*int64(time.Millisecond))
+	}
+	return trace, nil
+}
+
+func (c *CqlClientConnection) retrieveTraceEvents(
+	ctx context.Context,
+	version primitive.ProtocolVersion,
+	sessionId *primitive.UUID,
+) ([]*TraceEvent, error) {
+	rows, err := c.queryTraceRows(ctx, version, "SELECT * FROM system_traces.events WHERE session_id = ?", sessionId)
+	if err != nil {
+		return nil, err
+	}
+	var events []*TraceEvent
+	for _, row := range rows {
+		event := &TraceEvent{}
+		event.EventId, _ = row["event_id"].(primitive.UUID)
+		event.Activity, _ = row["activity"].(string)
+		event.Source, _ = row["source"].(net.IP)
+		elapsed, _ := row["source_elapsed"].(int32)
+		event.SourceElapsed = time.Duration(elapsed) * time.Microsecond
+		event.Thread, _ = row["thread"].(string)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Executes the given query, with the given session id as its only bound value, and returns the decoded rows as maps
+// of column names to values.
+func (c *CqlClientConnection) queryTraceRows(
+	ctx context.Context,
+	version primitive.ProtocolVersion,
+	query string,
+	sessionId *primitive.UUID,
+) ([]map[string]interface{}, error) {
+	request := frame.NewFrame(version, ManagedStreamId, &message.Query{
+		Query: query,
+		Options: &message.QueryOptions{
+			Consistency:      primitive.ConsistencyLevelOne,
+			PositionalValues: []*primitive.Value{primitive.NewValue(sessionId.Bytes())},
+		},
+	})
+	response, err := c.SendAndReceiveContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("%v: cannot retrieve trace %v: %w", c, sessionId, err)
+	}
+	result, ok := response.Body.Message.(*message.RowsResult)
+	if !ok {
+		return nil, fmt.Errorf("%v: cannot retrieve trace %v: expected ROWS, got %v", c, sessionId, response.Body.Message)
+	}
+	var rows []map[string]interface{}
+	for _, data := range result.Data {
+		row := make(map[string]interface{}, len(data))
+		for i, column := range result.Metadata.Columns {
+			if i >= len(data) {
+				break
+			}
+			if row[column.Name], err = valueCodecFor(column.Type).Decode(data[i], version); err != nil {
+				return nil, fmt.Errorf("%v: cannot decode trace %v column %v: %w", c, sessionId, column.Name, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/datastax/go-cassandra-native-protocol/message"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQueryTracer(t *testing.T) {
+	tracer := client.NewQueryTracer()
+	server, clientConn, cancelFn := createTracingServerAndClient(t, tracer)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	// untraced requests
+	response, err := clientConn.SendAndReceive(newTracingTestQuery(false))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	assert.Nil(t, response.Body.TracingId)
+
+	// traced requests
+	response, err = clientConn.SendAndReceive(newTracingTestQuery(true))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	require.NotNil(t, response.Body.TracingId)
+	assert.True(t, response.Header.Flags.Contains(primitive.HeaderFlagTracing))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	trace, err := clientConn.RetrieveQueryTrace(ctx, primitive.ProtocolVersion4, response.Body.TracingId)
+	require.Nil(t, err)
+	assert.Equal(t, *response.Body.TracingId, trace.SessionId)
+	assert.Equal(t, "QUERY", trace.Command)
+	assert.Equal(t, "Execute CQL3 query", trace.Request)
+	assert.Equal(t, map[string]string{"query": "SELECT v FROM ks1.t1 WHERE pk = 1", "consistency_level": "ONE"}, trace.Parameters)
+	assert.True(t, net.ParseIP("127.0.0.1").Equal(trace.Client))
+	assert.True(t, net.ParseIP("127.0.0.1").Equal(trace.Coordinator))
+	require.Len(t, trace.Events, 3)
+	assert.Equal(t, "Parsing SELECT v FROM ks1.t1 WHERE pk = 1", trace.Events[0].Activity)
+	assert.Equal(t, "Preparing statement", trace.Events[1].Activity)
+	assert.Equal(t, "Executing query", trace.Events[2].Activity)
+
+	recorded := tracer.Trace(trace.SessionId)
+	require.NotNil(t, recorded)
+	assert.Equal(t, recorded.Duration.Truncate(time.Microsecond), trace.Duration)
+	assert.Equal(t, recorded.StartedAt.Truncate(time.Millisecond).UnixNano(), trace.StartedAt.UnixNano())
+	for i, event := range trace.Events {
+		assert.Equal(t, recorded.Events[i].EventId, event.EventId)
+		assert.Equal(t, recorded.Events[i].SourceElapsed.Truncate(time.Microsecond), event.SourceElapsed)
+		assert.Equal(t, "Native-Transport-Requests-1", event.Thread)
+	}
+
+	// queries with literals and selected columns
+	response, err = clientConn.SendAndReceive(frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query: fmt.Sprintf("SELECT session_id, request FROM system_traces.sessions WHERE session_id = %v", &trace.SessionId),
+	}))
+	require.Nil(t, err)
+	require.IsType(t, &message.RowsResult{}, response.Body.Message)
+	rows := response.Body.Message.(*message.RowsResult)
+	assert.Equal(t, []string{"session_id", "request"}, metadataNames(rows.Metadata.Columns))
+	assert.Equal(t, message.RowSet{{trace.SessionId.Bytes(), []byte("Execute CQL3 query")}}, rows.Data)
+}
+
+func TestQueryTracer_CompletionDelay(t *testing.T) {
+	tracer := client.NewQueryTracer()
+	tracer.CompletionDelay = 200 * time.Millisecond
+	server, clientConn, cancelFn := createTracingServerAndClient(t, tracer)
+	defer checkClosed(t, clientConn, server)
+	defer cancelFn()
+
+	response, err := clientConn.SendAndReceive(newTracingTestQuery(true))
+	require.Nil(t, err)
+	require.NotNil(t, response.Body.TracingId)
+
+	// the session is not complete yet
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = clientConn.RetrieveQueryTrace(ctx, primitive.ProtocolVersion4, response.Body.TracingId)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	trace, err := clientConn.RetrieveQueryTrace(ctx, primitive.ProtocolVersion4, response.Body.TracingId)
+	require.Nil(t, err)
+	assert.Equal(t, *response.Body.TracingId, trace.SessionId)
+	assert.Len(t, trace.Events, 3)
+}
+
+func createTracingServerAndClient(t *testing.T, tracer *client.QueryTracer) (*client.CqlServer, *client.CqlClientConnection, context.CancelFunc) {
+	store := newTestTableStore(t, "CREATE TABLE ks1.t1 (pk int PRIMARY KEY, v text)")
+	require.IsType(t, &message.VoidResult{}, store.Execute("ks1", "INSERT INTO t1 (pk, v) VALUES (1, 'a')"))
+	handler := client.NewMiddlewareChain(client.NewCompositeRequestHandler(tracer.Handler(), store.Handler()), tracer.Middleware())
+	return createServerAndClient(t, handler)
+}
+
+func newTracingTestQuery(tracing bool) *frame.Frame {
+	query := frame.NewFrame(primitive.ProtocolVersion4, client.ManagedStreamId, &message.Query{
+		Query:   "SELECT v FROM ks1.t1 WHERE pk = 1",
+		Options: &message.QueryOptions{Consistency: primitive.ConsistencyLevelOne},
+	})
+	query.RequestTracingId(tracing)
+	return query
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command cqlfake starts one or more fake CQL servers, that can be used as standalone fakes by tests written in any
+// language. The servers form a single-datacenter cluster, one node per listen address: each of them reports the others
+// in system.peers and system.peers_v2, so that drivers connecting to one server discover the others. Each server
+// accepts driver connections, with or without LZ4 or Snappy compression, answers queries to
+// system tables, and handles PREPARE, EXECUTE and BATCH requests for any query, with query tracing emulation, see
+// client.QueryTracer; other requests can be primed at runtime through the HTTP/JSON admin API, see client.AdminServer.
+//
+// Usage:
+//
+//	cqlfake -listen 127.0.0.1:9042,127.0.0.2:9042 -admin 127.0.0.1:8187
+//	cqlfake -config cqlfake.json
+//	cqlfake -replay session.jsonl
+//
+// The configuration file is a JSON object with the same keys as the command line flags, plus an optional "primes"
+// array of client.AdminPrime objects to prime at startup. Flags given on the command line override the configuration
+// file. With -replay, requests matching an exchange of the given recording, see client.SessionRecorder, are answered
+// with the recorded responses before any other handler is tried. BATCH requests not matching a rule as a whole are
+// answered child by child, see client.BatchHandler.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/client"
+	"github.com/datastax/go-cassandra-native-protocol/compression/lz4"
+	"github.com/datastax/go-cassandra-native-protocol/compression/snappy"
+	"github.com/datastax/go-cassandra-native-protocol/frame"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+type config struct {
+	Listen     []string             `json:"listen"`
+	Admin      string               `json:"admin"`
+	Cluster    string               `json:"cluster"`
+	Datacenter string               `json:"datacenter"`
+	Username   string               `json:"username"`
+	Password   string               `json:"password"`
+	LogLevel   string               `json:"log-level"`
+	Replay     string               `json:"replay"`
+	Primes     []*client.AdminPrime `json:"primes"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "cqlfake: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	cfg, err := parseConfig()
+	if err != nil {
+		return err
+	}
+	level, err := zerolog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(level)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var credentials *client.AuthCredentials
+	if cfg.Username != "" {
+		credentials = &client.AuthCredentials{Username: cfg.Username, Password: cfg.Password}
+	}
+	registry := client.NewPreparedStatementRegistry()
+	engine := client.NewPrimingEngine()
+	engine.Registry = registry
+	tracer := client.NewQueryTracer()
+	batches := client.NewBatchHandler(engine, nil)
+	// the servers form a cluster: each of them reports the others in its system.peers tables
+	systemTables, err := client.NewClusterSystemTables(cfg.Cluster, cfg.Datacenter, cfg.Listen...)
+	if err != nil {
+		return err
+	}
+	var servers []*client.CqlServer
+	for _, address := range cfg.Listen {
+		server := client.NewCqlServer(address, credentials)
+		server.Compressors = []frame.BodyCompressor{lz4.BodyCompressor{}, snappy.BodyCompressor{}}
+		servers = append(servers, server)
+	}
+	admin := client.NewAdminServer(cfg.Admin, engine, servers...)
+	var replayer *client.SessionReplayer
+	if cfg.Replay != "" {
+		if replayer, err = loadRecording(cfg.Replay); err != nil {
+			return err
+		}
+	}
+	for i, server := range servers {
+		handlers := []client.RequestHandler{
+			client.HeartbeatHandler,
+			client.HandshakeHandler,
+			client.NewSetKeyspaceHandler(func(string) {}),
+			client.RegisterHandler,
+			systemTables[i].Handler(),
+			tracer.Handler(),
+			engine.Handler(),
+			batches.Handler(),
+			registry.Handler(),
+		}
+		if replayer != nil {
+			handlers = append([]client.RequestHandler{replayer.Handler()}, handlers...)
+		}
+		server.RequestHandlers = []client.RequestHandler{
+			client.NewMiddlewareChain(client.NewCompositeRequestHandler(handlers...), tracer.Middleware()),
+		}
+		if err := server.Start(ctx); err != nil {
+			return err
+		}
+	}
+	for _, prime := range cfg.Primes {
+		if _, err := admin.Prime(prime); err != nil {
+			return fmt.Errorf("cannot prime %v: %w", prime.When.Query, err)
+		}
+	}
+	if cfg.Admin != "" {
+		if err := admin.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info().Msgf("received %v, shutting down", sig)
+	cancel()
+	_ = admin.Close()
+	for _, server := range servers {
+		_ = server.Close()
+	}
+	return nil
+}
+
+func parseConfig() (*config, error) {
+	cfg := &config{
+		Listen:     []string{"127.0.0.1:9042"},
+		Admin:      "127.0.0.1:8187",
+		Cluster:    "cqlfake",
+		Datacenter: "dc1",
+		LogLevel:   "info",
+	}
+	configFile := flag.String("config", "", "the JSON configuration file to load")
+	listen := flag.String("listen", strings.Join(cfg.Listen, ","), "the comma-separated <ip>:<port> addresses to listen to, one cluster node per address")
+	admin := flag.String("admin", cfg.Admin, "the address of the HTTP admin API; empty to disable it")
+	cluster := flag.String("cluster", cfg.Cluster, "the cluster name")
+	datacenter := flag.String("datacenter", cfg.Datacenter, "the datacenter name")
+	username := flag.String("username", "", "the username required to authenticate; empty to disable authentication")
+	password := flag.String("password", "", "the password required to authenticate")
+	logLevel := flag.String("log-level", cfg.LogLevel, "the log level")
+	replay := flag.String("replay", "", "the recording file to replay")
+	flag.Parse()
+	if *configFile != "" {
+		if contents, err := ioutil.ReadFile(*configFile); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(contents, cfg); err != nil {
+			return nil, fmt.Errorf("invalid configuration file %v: %w", *configFile, err)
+		}
+	}
+	// flags given explicitly override the configuration file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = strings.Split(*listen, ",")
+		case "admin":
+			cfg.Admin = *admin
+		case "cluster":
+			cfg.Cluster = *cluster
+		case "datacenter":
+			cfg.Datacenter = *datacenter
+		case "username":
+			cfg.Username = *username
+		case "password":
+			cfg.Password = *password
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "replay":
+			cfg.Replay = *replay
+		}
+	})
+	if len(cfg.Listen) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return cfg, nil
+}
+
+func loadRecording(path string) (*client.SessionReplayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	replayer, err := client.NewSessionReplayerFromRecording(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recording file %v: %w", path, err)
+	}
+	return replayer, nil
+}
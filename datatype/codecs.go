@@ -0,0 +1,84 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datatype
+
+import (
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+)
+
+// Returns a Codec for the given data type, or an error if no codec is available for it. Collection codecs are
+// created recursively for their element types.
+func CodecFor(dataType DataType) (Codec, error) {
+	switch dataType.GetDataTypeCode() {
+	case primitive.DataTypeCodeAscii, primitive.DataTypeCodeText, primitive.DataTypeCodeVarchar:
+		return &VarcharCodec{}, nil
+	case primitive.DataTypeCodeBigint:
+		return &BigintCodec{}, nil
+	case primitive.DataTypeCodeBlob:
+		return &BlobCodec{}, nil
+	case primitive.DataTypeCodeBoolean:
+		return &BooleanCodec{}, nil
+	case primitive.DataTypeCodeCounter:
+		return &CounterCodec{}, nil
+	case primitive.DataTypeCodeDecimal:
+		return &DecimalCodec{}, nil
+	case primitive.DataTypeCodeDouble:
+		return &DoubleCodec{}, nil
+	case primitive.DataTypeCodeFloat:
+		return &FloatCodec{}, nil
+	case primitive.DataTypeCodeInet:
+		return &InetCodec{}, nil
+	case primitive.DataTypeCodeInt:
+		return &IntCodec{}, nil
+	case primitive.DataTypeCodeSmallint:
+		return &SmallintCodec{}, nil
+	case primitive.DataTypeCodeTimeuuid:
+		return &TimeuuidCodec{}, nil
+	case primitive.DataTypeCodeTinyint:
+		return &TinyintCodec{}, nil
+	case primitive.DataTypeCodeUuid:
+		return &UuidCodec{}, nil
+	case primitive.DataTypeCodeVarint:
+		return &VarintCodec{}, nil
+	case primitive.DataTypeCodeList:
+		if listType, ok := dataType.(ListType); !ok {
+			return nil, fmt.Errorf("expected ListType, got %T", dataType)
+		} else if elementCodec, err := CodecFor(listType.GetElementType()); err != nil {
+			return nil, fmt.Errorf("cannot create codec for list element type: %w", err)
+		} else {
+			return NewListCodec(elementCodec), nil
+		}
+	case primitive.DataTypeCodeSet:
+		if setType, ok := dataType.(SetType); !ok {
+			return nil, fmt.Errorf("expected SetType, got %T", dataType)
+		} else if elementCodec, err := CodecFor(setType.GetElementType()); err != nil {
+			return nil, fmt.Errorf("cannot create codec for set element type: %w", err)
+		} else {
+			return NewSetCodec(elementCodec), nil
+		}
+	case primitive.DataTypeCodeMap:
+		if mapType, ok := dataType.(MapType); !ok {
+			return nil, fmt.Errorf("expected MapType, got %T", dataType)
+		} else if keyCodec, err := CodecFor(mapType.GetKeyType()); err != nil {
+			return nil, fmt.Errorf("cannot create codec for map key type: %w", err)
+		} else if valueCodec, err := CodecFor(mapType.GetValueType()); err != nil {
+			return nil, fmt.Errorf("cannot create codec for map value type: %w", err)
+		} else {
+			return NewMapCodec(keyCodec, valueCodec), nil
+		}
+	}
+	return nil, fmt.Errorf("no codec available for data type %v", dataType)
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datatype
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    DataType
+		expected Codec
+		err      bool
+	}{
+		{"varchar", Varchar, &VarcharCodec{}, false},
+		{"text", Text, &VarcharCodec{}, false},
+		{"int", Int, &IntCodec{}, false},
+		{"uuid", Uuid, &UuidCodec{}, false},
+		{"list<int>", NewListType(Int), NewListCodec(&IntCodec{}), false},
+		{"set<varchar>", NewSetType(Varchar), NewSetCodec(&VarcharCodec{}), false},
+		{"map<varchar,bigint>", NewMapType(Varchar, Bigint), NewMapCodec(&VarcharCodec{}, &BigintCodec{}), false},
+		{"duration", Duration, nil, true},
+		{"list<duration>", NewListType(Duration), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := CodecFor(tt.input)
+			assert.Equal(t, tt.expected, actual)
+			assert.Equal(t, tt.err, err != nil)
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datatype
+
+import (
+	"fmt"
+	"github.com/datastax/go-cassandra-native-protocol/primitive"
+	"strings"
+)
+
+var primitiveTypesByName = map[string]DataType{
+	"ascii":     Ascii,
+	"bigint":    Bigint,
+	"blob":      Blob,
+	"boolean":   Boolean,
+	"counter":   Counter,
+	"date":      Date,
+	"decimal":   Decimal,
+	"double":    Double,
+	"duration":  Duration,
+	"float":     Float,
+	"inet":      Inet,
+	"int":       Int,
+	"smallint":  Smallint,
+	"text":      Text,
+	"time":      Time,
+	"timestamp": Timestamp,
+	"timeuuid":  Timeuuid,
+	"tinyint":   Tinyint,
+	"uuid":      Uuid,
+	"varchar":   Varchar,
+	"varint":    Varint,
+}
+
+// Parses the given CQL type name, e.g. "int" or "map<varchar,list<int>>". Primitive types, lists, sets, maps and tuples
+// are supported; type names are case-insensitive and may contain whitespace. The "frozen" modifier is accepted and
+// ignored.
+func ParseDataType(name string) (DataType, error) {
+	dataType, err := parseDataType(strings.TrimSpace(name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse data type %q: %w", name, err)
+	}
+	return dataType, nil
+}
+
+func parseDataType(name string) (DataType, error) {
+	open := strings.IndexByte(name, '<')
+	if open == -1 {
+		if dataType, found := primitiveTypesByName[strings.ToLower(name)]; found {
+			return dataType, nil
+		}
+		return nil, fmt.Errorf("unknown type: %v", name)
+	} else if !strings.HasSuffix(name, ">") {
+		return nil, fmt.Errorf("missing closing bracket: %v", name)
+	}
+	typeName := strings.ToLower(strings.TrimSpace(name[:open]))
+	parameters, err := splitTypeParameters(name[open+1 : len(name)-1])
+	if err != nil {
+		return nil, err
+	}
+	var types []DataType
+	for _, parameter := range parameters {
+		if dataType, err := parseDataType(parameter); err != nil {
+			return nil, err
+		} else {
+			types = append(types, dataType)
+		}
+	}
+	switch {
+	case typeName == "frozen" && len(types) == 1:
+		return types[0], nil
+	case typeName == "list" && len(types) == 1:
+		return NewListType(types[0]), nil
+	case typeName == "set" && len(types) == 1:
+		return NewSetType(types[0]), nil
+	case typeName == "map" && len(types) == 2:
+		return NewMapType(types[0], types[1]), nil
+	case typeName == "tuple" && len(types) > 0:
+		return NewTupleType(types...), nil
+	}
+	return nil, fmt.Errorf("wrong type parameters for %v: %v", typeName, name)
+}
+
+// Splits the given comma-separated type parameters, taking nested parameters into account.
+func splitTypeParameters(parameters string) ([]string, error) {
+	var result []string
+	depth := 0
+	start := 0
+	for i, c := range parameters {
+		switch c {
+		case '<':
+			depth++
+		case '>':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("unbalanced brackets: %v", parameters)
+			}
+		case ',':
+			if depth == 0 {
+				result = append(result, strings.TrimSpace(parameters[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced brackets: %v", parameters)
+	}
+	return append(result, strings.TrimSpace(parameters[start:])), nil
+}
+
+// Returns the CQL name of the given data type, as reported in system_schema tables, e.g. "map<text, int>". Tuples,
+// user-defined types and collections nested in other types are frozen; user-defined types are designated by their
+// name only. This is the inverse of ParseDataType, except for user-defined and custom types, which ParseDataType does
+// not support.
+func FormatDataType(dataType DataType) string {
+	return formatDataType(dataType, false)
+}
+
+func formatDataType(dataType DataType, nested bool) string {
+	// switch on type codes rather than types, since list and set types implement the same interfaces
+	var name string
+	switch dataType.GetDataTypeCode() {
+	case primitive.DataTypeCodeList:
+		name = fmt.Sprintf("list<%v>", formatDataType(dataType.(ListType).GetElementType(), true))
+	case primitive.DataTypeCodeSet:
+		name = fmt.Sprintf("set<%v>", formatDataType(dataType.(SetType).GetElementType(), true))
+	case primitive.DataTypeCodeMap:
+		mapType := dataType.(MapType)
+		name = fmt.Sprintf("map<%v, %v>", formatDataType(mapType.GetKeyType(), true), formatDataType(mapType.GetValueType(), true))
+	case primitive.DataTypeCodeTuple:
+		var fieldTypes []string
+		for _, fieldType := range dataType.(TupleType).GetFieldTypes() {
+			fieldTypes = append(fieldTypes, formatDataType(fieldType, true))
+		}
+		return fmt.Sprintf("frozen<tuple<%v>>", strings.Join(fieldTypes, ", "))
+	case primitive.DataTypeCodeUdt:
+		return fmt.Sprintf("frozen<%v>", dataType.(UserDefinedType).GetName())
+	case primitive.DataTypeCodeCustom:
+		return fmt.Sprintf("'%v'", dataType.(CustomType).GetClassName())
+	case primitive.DataTypeCodeVarchar, primitive.DataTypeCodeText:
+		return "text"
+	default:
+		return fmt.Sprintf("%v", dataType)
+	}
+	if nested {
+		return fmt.Sprintf("frozen<%v>", name)
+	}
+	return name
+}
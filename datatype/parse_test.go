@@ -0,0 +1,79 @@
+// Copyright 2020 DataStax
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datatype
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseDataType(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected DataType
+		err      bool
+	}{
+		{"int", Int, false},
+		{" VARCHAR ", Varchar, false},
+		{"text", Text, false},
+		{"list<int>", NewListType(Int), false},
+		{"set<uuid>", NewSetType(Uuid), false},
+		{"map<varchar, bigint>", NewMapType(Varchar, Bigint), false},
+		{"map<varchar,list<map<int,text>>>", NewMapType(Varchar, NewListType(NewMapType(Int, Text))), false},
+		{"frozen<list<int>>", NewListType(Int), false},
+		{"tuple<int,varchar,boolean>", NewTupleType(Int, Varchar, Boolean), false},
+		{"", nil, true},
+		{"integer", nil, true},
+		{"list<int", nil, true},
+		{"list<int,int>", nil, true},
+		{"map<int>", nil, true},
+		{"map<int,list<int>", nil, true},
+		{"map<int,int>>", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			actual, err := ParseDataType(tt.input)
+			assert.Equal(t, tt.expected, actual)
+			assert.Equal(t, tt.err, err != nil)
+		})
+	}
+}
+
+func TestFormatDataType(t *testing.T) {
+	udt, _ := NewUserDefinedType("ks1", "udt1", []string{"f1"}, []DataType{Int})
+	tests := []struct {
+		input    DataType
+		expected string
+	}{
+		{Int, "int"},
+		{Varchar, "text"},
+		{Text, "text"},
+		{NewListType(Int), "list<int>"},
+		{NewSetType(Timeuuid), "set<timeuuid>"},
+		{NewMapType(Varchar, NewListType(Bigint)), "map<text, frozen<list<bigint>>>"},
+		{NewTupleType(Int, Varchar), "frozen<tuple<int, text>>"},
+		{udt, "frozen<udt1>"},
+		{NewCustomType("com.example.Type"), "'com.example.Type'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FormatDataType(tt.input))
+		})
+	}
+	// round trip
+	dataType, err := ParseDataType(FormatDataType(NewMapType(Varchar, NewTupleType(Int, NewSetType(Uuid)))))
+	assert.Nil(t, err)
+	assert.Equal(t, NewMapType(Text, NewTupleType(Int, NewSetType(Uuid))), dataType)
+}
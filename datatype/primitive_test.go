@@ -54,3 +54,24 @@ func TestPrimitiveType(t *testing.T) {
 		})
 	}
 }
+
+func TestBooleanCodec_Encode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    interface{}
+		expected []byte
+	}{
+		{"nil", nil, nil},
+		{"true", true, []byte{1}},
+		{"false", false, []byte{0}},
+		{"int", 1, []byte{1}},
+		{"string", "false", []byte{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := (&BooleanCodec{}).Encode(test.input, primitive.ProtocolVersion4)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
@@ -654,7 +654,7 @@ func TestErrorCodec_Encode(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						false,
 					},
 					[]byte{
@@ -678,7 +678,7 @@ func TestErrorCodec_Encode(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						primitive.WriteTypeBatchLog,
 					},
 					[]byte{
@@ -908,7 +908,7 @@ func TestErrorCodec_EncodedLength(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						false,
 					},
 					primitive.LengthOfInt +
@@ -930,7 +930,7 @@ func TestErrorCodec_EncodedLength(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						primitive.WriteTypeBatchLog,
 					},
 					primitive.LengthOfInt +
@@ -1218,7 +1218,7 @@ func TestErrorCodec_Decode(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						false,
 					},
 					nil,
@@ -1242,7 +1242,7 @@ func TestErrorCodec_Decode(test *testing.T) {
 						0,
 						2,
 						0,
-						[]*primitive.FailureReason{{net.IPv4(192, 168, 1, 1), primitive.FailureCodeTooManyTombstonesRead}},
+						[]*primitive.FailureReason{{Endpoint: net.IPv4(192, 168, 1, 1), Code: primitive.FailureCodeTooManyTombstonesRead}},
 						primitive.WriteTypeBatchLog,
 					},
 					nil,